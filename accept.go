@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	PreviewRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "preview_requests_total",
+		Subsystem: "github",
+		Help:      "Number of requests with a graduated preview media type in the Accept header by preview and client",
+	}, []string{"preview", "client"})
+)
+
+// DefaultGraduatedPreviews are the names of the API previews that graduated to the REST API, their media types (ex:
+// application/vnd.github.mockingbird-preview+json) are no longer required (and are rejected by some routes).
+var DefaultGraduatedPreviews = []string{
+	"ant-man", "antiope", "ash", "baptiste", "barred-rock", "black-cat", "black-panther", "cloak", "dorian",
+	"eye-scream", "fury", "flash", "gambit", "groot", "hagar", "hawkgirl", "hellcat", "inertia", "jean-grey",
+	"london", "luke-cage", "lydian", "machine-man", "mercy", "mister-fantastic", "mockingbird", "nebula",
+	"nightshade", "phoenix", "polaris", "sailor-v", "scarlet-witch", "shadow-cat", "squirrel-girl", "starfox",
+	"switcheroo", "symmetra", "valkyrie", "vixen", "wyandotte", "zzzax",
+}
+
+// previewMediaType matches a preview media type, with the preview name and optional format (ex: ".raw") and suffix.
+var previewMediaType = regexp.MustCompile(`^application/vnd\.github\.([a-z0-9-]+)-preview(\.[a-z0-9]+)?(\+json)?$`)
+
+// AcceptRule rewrites a media type of the Accept header of the requests to a route (the RouteTemplate of the path,
+// empty for every route) to another (or drops it if empty). From is either a media type or the name of a preview.
+type AcceptRule struct {
+	Route string
+	From  string
+	To    string
+}
+
+// ParseAcceptRule parses a rule in the format '[<route> ]<from>=<to>', ex:
+// '/repos/{owner}/{repo}/issues/{issue_number}/timeline mockingbird=application/vnd.github+json'.
+func ParseAcceptRule(spec string) (AcceptRule, error) {
+	from, to, ok := strings.Cut(spec, "=")
+	if !ok {
+		return AcceptRule{}, fmt.Errorf("invalid Accept rewrite %q, expected '[<route> ]<from>=<to>'", spec)
+	}
+	rule := AcceptRule{To: strings.ToLower(strings.TrimSpace(to))}
+	from = strings.TrimSpace(from)
+	if route, media, ok := strings.Cut(from, " "); ok {
+		rule.Route, from = RouteTemplate(route), strings.TrimSpace(media)
+	}
+	if from == "" {
+		return AcceptRule{}, fmt.Errorf("invalid Accept rewrite %q, the media type to rewrite is empty", spec)
+	}
+	rule.From = strings.ToLower(from)
+	return rule, nil
+}
+
+// matches reports if the rule applies to the media type (of the preview, if any) of a request to the route.
+func (r *AcceptRule) matches(route string, media string, preview string) bool {
+	return (r.Route == "" || r.Route == route) && (r.From == media || (preview != "" && r.From == preview))
+}
+
+// AcceptTransport normalizes the Accept header of the requests before they are cached, so equivalent requests share
+// a cache key: the media types are lower-cased and deduplicated, the redundant "v3" version is dropped and the
+// graduated Previews are upgraded to the stable media types (after the Rules, which take precedence). The clients
+// still sending graduated previews are logged (at most once an hour per client and preview) to be migrated.
+type AcceptTransport struct {
+	Base     http.RoundTripper
+	Rules    []AcceptRule
+	Previews []string
+
+	mu     sync.Mutex
+	warned map[[2]string]time.Time
+}
+
+// normalize returns the normalized Accept header of a request to the route, and the graduated previews it had.
+func (t *AcceptTransport) normalize(route string, accept string) (string, []string) {
+	var types, previews []string
+	for value := range strings.SplitSeq(accept, ",") {
+		media, params, _ := strings.Cut(strings.TrimSpace(value), ";")
+		media = strings.ToLower(strings.TrimSpace(media))
+		if media == "" {
+			continue
+		}
+		var preview, format, suffix string
+		if match := previewMediaType.FindStringSubmatch(media); match != nil {
+			preview, format, suffix = match[1], match[2], match[3]
+		}
+		if idx := slices.IndexFunc(t.Rules, func(rule AcceptRule) bool { return rule.matches(route, media, preview) }); idx >= 0 {
+			media = t.Rules[idx].To
+		} else if preview != "" && slices.Contains(t.Previews, preview) {
+			previews = append(previews, preview)
+			if format == "" {
+				suffix = "+json" // application/vnd.github alone is not a media type
+			}
+			media = "application/vnd.github" + format + suffix
+		}
+		// application/vnd.github.v3+json is application/vnd.github+json (and the same for the formats).
+		media = strings.Replace(media, "application/vnd.github.v3", "application/vnd.github", 1)
+		if media == "" {
+			continue
+		}
+		if params = strings.TrimSpace(params); params != "" {
+			media += ";" + strings.ReplaceAll(params, " ", "")
+		}
+		if !slices.Contains(types, media) {
+			types = append(types, media)
+		}
+	}
+	if len(types) == 0 && len(previews) > 0 {
+		types = append(types, "application/vnd.github+json")
+	}
+	return strings.Join(types, ", "), previews
+}
+
+// warn reports if the client sending the preview should be logged.
+func (t *AcceptTransport) warn(client string, preview string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.warned == nil {
+		t.warned = make(map[[2]string]time.Time)
+	}
+	key := [2]string{client, preview}
+	if now.Sub(t.warned[key]) < time.Hour {
+		return false
+	}
+	t.warned[key] = now
+	return true
+}
+
+func (t *AcceptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return t.Base.RoundTrip(req)
+	}
+	route := RouteTemplate(req.URL.Path)
+	normalized, previews := t.normalize(route, strings.Join(req.Header.Values("Accept"), ","))
+	client := ClientFromContext(req.Context())
+	for _, preview := range previews {
+		PreviewRequests.WithLabelValues(preview, ClientLabels.Value(client)).Inc()
+		if t.warn(client, preview, time.Now()) {
+			log.Warn().Str("client", client).Str("preview", preview).Str("method", req.Method).Str("route", route).Msg("client sends a graduated preview media type")
+		}
+	}
+	if normalized == accept {
+		return t.Base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	if normalized == "" {
+		req.Header.Del("Accept")
+	} else {
+		req.Header.Set("Accept", normalized)
+	}
+	return t.Base.RoundTrip(req)
+}
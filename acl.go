@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	InboundRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "inbound_rejected_total",
+		Subsystem: "github",
+		Help:      "Number of inbound requests/connections rejected by the proxy, by reason",
+	}, []string{"reason"})
+)
+
+// ParseCIDRs parses a list of CIDRs (or bare IP addresses) into prefixes.
+func ParseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, fmt.Errorf("netip.ParsePrefix(%q) failed: %w", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// remoteAddr parses the IP address of the remote connection.
+func remoteAddr(req *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// CIDRHandler restricts which source networks may use the proxy, rejecting everything else with a 403.
+type CIDRHandler struct {
+	Handler http.Handler
+	// Allowed are the allowed source networks, if empty all sources are allowed.
+	Allowed []netip.Prefix
+	Shadow  PolicyShadow
+}
+
+// allowed reports if the remote address of the request is within an allowed network.
+func (h *CIDRHandler) allowed(req *http.Request) bool {
+	if len(h.Allowed) == 0 {
+		return true
+	}
+	addr, ok := remoteAddr(req)
+	if !ok {
+		return false
+	}
+	for _, prefix := range h.Allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *CIDRHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !h.allowed(req) && h.Shadow.Deny(req, ReasonSourceNotAllowed) {
+		InboundRejected.WithLabelValues("cidr").Inc()
+		WriteProxyError(w, http.StatusForbidden, ReasonSourceNotAllowed, "Source address is not allowed to use this proxy")
+		return
+	}
+	h.Handler.ServeHTTP(w, req)
+}
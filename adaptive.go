@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+)
+
+// adaptiveBucket is the token-bucket state for a single resource.
+type adaptiveBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// AdaptiveTransport paces requests so the remaining rate-limit quota is spread evenly until the reset.
+// The refill rate of each per-resource token-bucket is derived from the most recent X-RateLimit headers.
+type AdaptiveTransport struct {
+	Base http.RoundTripper
+	// Limits is the (continuously updated) rate-limit state of the credential.
+	Limits *ghratelimit.Limits
+	// Burst is the capacity of the token-bucket.
+	Burst int
+	// MaxWait is the maximum time a single request will be delayed.
+	MaxWait time.Duration
+	// Now returns the current time, if nil UpstreamNow is used.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[ghratelimit.Resource]*adaptiveBucket
+}
+
+func (t *AdaptiveTransport) now() time.Time {
+	if t.Now != nil {
+		return t.Now()
+	}
+	return UpstreamNow()
+}
+
+// delay takes a token for the resource, returning how long the caller must wait before making the request.
+func (t *AdaptiveTransport) delay(resource ghratelimit.Resource) time.Duration {
+	rate := t.Limits.Load(resource)
+	if rate == nil {
+		return 0 // No rate-limit information yet, nothing to pace against
+	}
+	now := t.now()
+	window := time.Unix(int64(rate.Reset), 0).Sub(now)
+	if window <= 0 {
+		return 0 // The window has already reset
+	}
+	// The refill rate (per second) that spreads the remaining quota until the reset.
+	refill := float64(rate.Remaining) / window.Seconds()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.buckets == nil {
+		t.buckets = make(map[ghratelimit.Resource]*adaptiveBucket)
+	}
+	bucket, ok := t.buckets[resource]
+	if !ok {
+		bucket = &adaptiveBucket{tokens: float64(t.Burst), last: now}
+		t.buckets[resource] = bucket
+	}
+	bucket.tokens = min(float64(t.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*refill)
+	bucket.last = now
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	if refill <= 0 {
+		bucket.tokens = 0 // Don't accumulate debt while exhausted
+		return t.MaxWait
+	}
+	wait := time.Duration(-bucket.tokens / refill * float64(time.Second))
+	if t.MaxWait > 0 && wait > t.MaxWait {
+		// Only carry the debt that is actually being waited for
+		bucket.tokens = -t.MaxWait.Seconds() * refill
+		wait = t.MaxWait
+	}
+	return wait
+}
+
+func (t *AdaptiveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := t.delay(ghratelimit.InferResource(req)); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	return t.Base.RoundTrip(req)
+}
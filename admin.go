@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AdminHandler serves the admin API (/admin/*) on its own listener (see --admin-listen), authenticating its requests
+// by the Token (if set) as a bearer token of the Authorization header.
+type AdminHandler struct {
+	Handler http.Handler
+	Token   string
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.Token != "" {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			WriteProxyError(w, http.StatusUnauthorized, ReasonAdminAuth, "Missing or invalid admin token")
+			return
+		}
+	}
+	h.Handler.ServeHTTP(w, req)
+}
+
+// adminNotFound answers the admin API paths on the listeners of the proxy, rather than forwarding them upstream.
+func adminNotFound(w http.ResponseWriter, req *http.Request) {
+	WriteProxyError(w, http.StatusNotFound, ReasonAdminOnly, "The admin API is only served on the --admin-listen address")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"hash/maphash"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	AffinityRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "affinity_requests_total",
+		Subsystem: "github",
+		Help:      "Number of requests of a session by result (sticky, assigned, reassigned)",
+	}, []string{"result"})
+)
+
+// affinitySession is the credential a session sticks to until it expires.
+type affinitySession struct {
+	credential string
+	expires    time.Time
+}
+
+// affinityShards is the number of shards of the sessions of an Affinity, the requests of distinct sessions rarely
+// contend on the same lock.
+const affinityShards = 64
+
+// affinityShard is a shard of the sessions of an Affinity, padded to a cache line.
+type affinityShard struct {
+	mu       sync.Mutex
+	sessions map[string]affinitySession
+	swept    time.Time
+	_        [24]byte
+}
+
+// Affinity makes the requests sharing a session key (the Header, or the inbound client identity if unset) stick to
+// one credential of the pool, so a paginated listing is not served by credentials with different views of the data
+// (and cache visibility). A session sticks to its credential until it is idle for the Window, the credential leaves
+// the pool (or the credentials of the tenant) or its quota of the resource of the request is exhausted.
+type Affinity struct {
+	Header string
+	Window time.Duration
+
+	once   sync.Once
+	seed   maphash.Seed
+	shards [affinityShards]affinityShard
+}
+
+// shard returns the shard of the sessions of the key.
+func (a *Affinity) shard(key string) *affinityShard {
+	a.once.Do(func() { a.seed = maphash.MakeSeed() })
+	return &a.shards[maphash.String(a.seed, key)%affinityShards]
+}
+
+// Session returns the session key of the request and the request to send, without the Header if it is consumed by
+// the proxy.
+func (a *Affinity) Session(req *http.Request) (string, *http.Request) {
+	if a.Header == "" {
+		return ClientFromContext(req.Context()), req
+	}
+	key := req.Header.Get(a.Header)
+	if key != "" && strings.HasPrefix(http.CanonicalHeaderKey(a.Header), ProxyHeaderPrefix) {
+		req = req.Clone(req.Context())
+		req.Header.Del(a.Header)
+	}
+	return key, req
+}
+
+// usable reports if the credential has not exhausted the quota of the resource.
+func usable(credential *Credential, resource ghratelimit.Resource) bool {
+	rate := credential.Transport.Limits.Load(resource)
+	return rate == nil || rate.Remaining > 0 || !time.Unix(int64(rate.Reset), 0).After(UpstreamNow())
+}
+
+// best returns the credential with the highest remaining quota of the resource like ghratelimit.BalancingTransport,
+// or a random one if none is known yet.
+func best(credentials []*Credential, resource ghratelimit.Resource) *Credential {
+	var chosen *Credential
+	var remaining uint64
+	for _, credential := range credentials {
+		if rate := credential.Transport.Limits.Load(resource); rate != nil && rate.Remaining > remaining {
+			chosen, remaining = credential, rate.Remaining
+		}
+	}
+	if chosen == nil {
+		chosen = credentials[rand.IntN(len(credentials))]
+	}
+	return chosen
+}
+
+// Pick returns the credential of the session among the credentials, assigning the best one for the resource of the
+// request if the session has none (or its credential is no longer usable). It returns nil without a session.
+func (a *Affinity) Pick(key string, req *http.Request, credentials []*Credential) *Credential {
+	resource := ghratelimit.InferResource(req)
+	if key == "" || resource == "" || len(credentials) == 0 {
+		return nil
+	}
+	now := time.Now()
+	shard := a.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.sessions == nil {
+		shard.sessions = make(map[string]affinitySession)
+	}
+	// Forget the expired sessions of the shard at most once per window.
+	if now.Sub(shard.swept) > a.Window {
+		for key, session := range shard.sessions {
+			if !now.Before(session.expires) {
+				delete(shard.sessions, key)
+			}
+		}
+		shard.swept = now
+	}
+
+	result := "assigned"
+	if session, ok := shard.sessions[key]; ok && now.Before(session.expires) {
+		for _, credential := range credentials {
+			if credential.ID == session.credential && usable(credential, resource) {
+				AffinityRequests.WithLabelValues("sticky").Inc()
+				shard.sessions[key] = affinitySession{credential: credential.ID, expires: now.Add(a.Window)}
+				return credential
+			}
+		}
+		result = "reassigned"
+	}
+	credential := best(credentials, resource)
+	AffinityRequests.WithLabelValues(result).Inc()
+	shard.sessions[key] = affinitySession{credential: credential.ID, expires: now.Add(a.Window)}
+	return credential
+}
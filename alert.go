@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	AlertsFired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "alerts_total",
+		Subsystem: "github",
+		Help:      "Number of alerts by kind (quota_low, credential_failing, credential_recovered, credential_expiring) and result (sent, error, suppressed)",
+	}, []string{"kind", "result"})
+)
+
+const (
+	// alertTimeout bounds the delivery of an alert to its webhook.
+	alertTimeout = 10 * time.Second
+	// alertQuotaInterval is the interval the remaining quota of the pool is checked at.
+	alertQuotaInterval = time.Minute
+)
+
+// alertResources are the resources whose remaining quota is alerted on.
+var alertResources = []ghratelimit.Resource{ghratelimit.ResourceCore, ghratelimit.ResourceSearch, ghratelimit.ResourceGraphQL}
+
+// postWebhook POSTs the payload to the webhook URL as JSON.
+func postWebhook(ctx context.Context, client *http.Client, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("(*http.Client).Do failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Alert is an operational alert, as sent to the webhook.
+type Alert struct {
+	// Kind is "quota_low", "credential_failing", "credential_recovered" or "credential_expiring".
+	Kind       string `json:"kind"`
+	Credential string `json:"credential,omitempty"`
+	Resource   string `json:"resource,omitempty"`
+	Remaining  uint64 `json:"remaining,omitempty"`
+	Limit      uint64 `json:"limit,omitempty"`
+	// Text summarizes the alert for chat webhooks (ex: Slack).
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// Alerter sends the alerts to the Webhook, each alert (by kind and subject) at most once per Cooldown.
+type Alerter struct {
+	Webhook  string
+	Client   *http.Client
+	Cooldown time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// Fire sends the alert in the background, unless the same alert was sent within the Cooldown.
+func (a *Alerter) Fire(alert Alert) {
+	key := alert.Kind + "\x00" + alert.Credential + "\x00" + alert.Resource
+	a.mu.Lock()
+	if last, ok := a.last[key]; ok && time.Since(last) < a.Cooldown {
+		a.mu.Unlock()
+		AlertsFired.WithLabelValues(alert.Kind, "suppressed").Inc()
+		return
+	}
+	if a.last == nil {
+		a.last = make(map[string]time.Time)
+	}
+	a.last[key] = time.Now()
+	a.mu.Unlock()
+	alert.Time = time.Now()
+	log.Warn().Str("kind", alert.Kind).Str("credential", alert.Credential).Str("resource", alert.Resource).Msg(alert.Text)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+		defer cancel()
+		if err := postWebhook(ctx, a.Client, a.Webhook, alert); err != nil {
+			AlertsFired.WithLabelValues(alert.Kind, "error").Inc()
+			log.Error().Err(DefaultScrubber.ScrubError(err)).Msg("postWebhook failed")
+			return
+		}
+		AlertsFired.WithLabelValues(alert.Kind, "sent").Inc()
+	}()
+}
+
+// quota returns the remaining and total quota of the credentials of the pool for the resource, a window that has
+// already reset counts its full limit.
+func quota(pool *CredentialPool, resource ghratelimit.Resource, now time.Time) (remaining uint64, limit uint64) {
+	for _, credential := range pool.Credentials() {
+		rate := credential.Transport.Limits.Load(resource)
+		if rate == nil {
+			continue
+		}
+		limit += rate.Limit
+		if rate.Reset > 0 && int64(rate.Reset) <= now.Unix() {
+			remaining += rate.Limit
+		} else {
+			remaining += rate.Remaining
+		}
+	}
+	return remaining, limit
+}
+
+// WatchQuota alerts whenever the remaining quota of the pool for a resource drops below the threshold (a fraction of
+// the limit), until the context is cancelled.
+func (a *Alerter) WatchQuota(ctx context.Context, pool *CredentialPool, threshold float64) {
+	ticker := time.NewTicker(alertQuotaInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, resource := range alertResources {
+			remaining, limit := quota(pool, resource, UpstreamNow())
+			if limit == 0 || float64(remaining) >= threshold*float64(limit) {
+				continue
+			}
+			a.Fire(Alert{
+				Kind:      "quota_low",
+				Resource:  resource.String(),
+				Remaining: remaining,
+				Limit:     limit,
+				Text:      fmt.Sprintf("The %s quota of the credential pool is low: %d of %d requests remaining", resource, remaining, limit),
+			})
+		}
+	}
+}
+
+// CredentialAlertTransport alerts when the requests authenticated by a credential fail (errors or 401 Unauthorized
+// responses, ex: a revoked token) Threshold times in a row, and again once it recovers.
+type CredentialAlertTransport struct {
+	Base       http.RoundTripper
+	Credential string
+	Alerter    *Alerter
+	Threshold  int
+
+	failures atomic.Int64
+}
+
+func (t *CredentialAlertTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Base.RoundTrip(req)
+	if errors.Is(err, context.Canceled) {
+		return resp, err
+	}
+	if err != nil || resp.StatusCode == http.StatusUnauthorized {
+		if failures := t.failures.Add(1); failures == int64(max(t.Threshold, 1)) {
+			reason := "401 Unauthorized"
+			if err != nil {
+				reason = DefaultScrubber.ScrubError(err).Error()
+			}
+			t.Alerter.Fire(Alert{
+				Kind:       "credential_failing",
+				Credential: t.Credential,
+				Text:       fmt.Sprintf("Credential %s failed %d requests in a row: %s", t.Credential, failures, reason),
+			})
+		}
+		return resp, err
+	}
+	if t.failures.Swap(0) >= int64(max(t.Threshold, 1)) {
+		t.Alerter.Fire(Alert{
+			Kind:       "credential_recovered",
+			Credential: t.Credential,
+			Text:       fmt.Sprintf("Credential %s recovered", t.Credential),
+		})
+	}
+	return resp, err
+}
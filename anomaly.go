@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	Anomalies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "anomalies_total",
+		Subsystem: "github",
+		Help:      "Number of anomalous client behaviours detected by kind (rate, endpoint)",
+	}, []string{"kind"})
+	AnomalyRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name:      "anomaly_rejected_total",
+		Subsystem: "github",
+		Help:      "Number of requests rejected because their client is blocked after an anomaly",
+	})
+	AnomalyAlerts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "anomaly_alerts_total",
+		Subsystem: "github",
+		Help:      "Number of anomaly alerts sent to the webhook by result (sent, error)",
+	}, []string{"result"})
+)
+
+// DefaultAnomalyEndpoints are the destructive (or otherwise sensitive) endpoints which are unusual for any client.
+var DefaultAnomalyEndpoints = []string{
+	"DELETE /repos/{owner}/{repo}",
+	"DELETE /orgs/{org}",
+	"POST /repos/{owner}/{repo}/transfer",
+	"DELETE /repos/{owner}/{repo}/branches/{branch}/protection",
+}
+
+// AnomalyRule is an unusual endpoint, matched by the method and the RouteTemplate of the path.
+type AnomalyRule struct {
+	Method string
+	Route  string
+}
+
+// ParseAnomalyRule parses a rule in the format '<method> <route>', ex: 'DELETE /repos/{owner}/{repo}'.
+func ParseAnomalyRule(spec string) (AnomalyRule, error) {
+	method, route, ok := strings.Cut(strings.TrimSpace(spec), " ")
+	if !ok || method == "" || !strings.HasPrefix(strings.TrimSpace(route), "/") {
+		return AnomalyRule{}, fmt.Errorf("invalid anomaly endpoint %q, expected '<method> <route>'", spec)
+	}
+	return AnomalyRule{Method: strings.ToUpper(method), Route: RouteTemplate(strings.TrimSpace(route))}, nil
+}
+
+// Anomaly is an anomalous client behaviour, as logged and sent to the webhook.
+type Anomaly struct {
+	// Kind is "rate" for a sudden increase of the request rate, "endpoint" for a request to an unusual endpoint.
+	Kind   string `json:"kind"`
+	Client string `json:"client"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Rate is the number of requests of the client in the current minute, Baseline its usual rate per minute.
+	Rate     int       `json:"rate,omitempty"`
+	Baseline float64   `json:"baseline,omitempty"`
+	Blocked  time.Time `json:"blocked_until,omitzero"`
+	Time     time.Time `json:"time"`
+	// Text summarizes the anomaly for chat webhooks (ex: Slack).
+	Text string `json:"text"`
+}
+
+// clientRate is the request rate of a single client.
+type clientRate struct {
+	minute   int64 // Current window (Unix minutes)
+	count    int
+	baseline float64
+	warm     bool // The baseline has at least one full window
+	flagged  bool // An anomaly was detected in the current window
+}
+
+// rateWeight is the weight of each completed minute in the exponentially weighted baseline of a client.
+const rateWeight = 0.1
+
+// roll advances the rate to the minute, folding the completed windows (and the idle ones) into the baseline.
+func (r *clientRate) roll(minute int64) {
+	if r.minute == minute {
+		return
+	}
+	if r.minute != 0 {
+		if r.warm {
+			r.baseline += rateWeight * (float64(r.count) - r.baseline)
+		} else {
+			r.baseline = float64(r.count)
+		}
+		for range min(minute-r.minute-1, 60) {
+			r.baseline -= rateWeight * r.baseline
+		}
+		r.warm = true
+	}
+	r.minute, r.count, r.flagged = minute, 0, false
+}
+
+// AnomalyTransport detects anomalous behaviour of the clients sharing the credentials of the proxy (ex: a compromised
+// caller): a sudden increase of the request rate of a client (RateFactor times its usual rate, and at least MinRate
+// requests per minute) or a request to an unusual Endpoint (ex: a repository deletion). Every anomaly is logged, sent
+// to the Webhook (optional) and, if Block is set, the client is blocked for its duration (including the request).
+type AnomalyTransport struct {
+	Base http.RoundTripper
+	// RateFactor is the increase of the request rate of a client which is anomalous, zero to disable.
+	RateFactor float64
+	// MinRate is the minimum number of requests per minute of a client which are anomalous.
+	MinRate   int
+	Endpoints []AnomalyRule
+	// Webhook (optional) is the URL each Anomaly is POSTed to as JSON.
+	Webhook string
+	Client  *http.Client
+	// Block (optional) is the duration a client is blocked for after an anomaly.
+	Block  time.Duration
+	Shadow PolicyShadow
+
+	mu      sync.Mutex
+	rates   map[string]*clientRate
+	blocked map[string]time.Time
+	swept   int64
+}
+
+// detect records the request of the client, returning the anomaly (if any) it is.
+func (t *AnomalyTransport) detect(client string, req *http.Request, now time.Time) *Anomaly {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rates == nil {
+		t.rates = make(map[string]*clientRate)
+	}
+	minute := now.Unix() / 60
+	if t.swept != minute {
+		// Forget the clients idle for an hour, their baseline has decayed anyway.
+		for name, rate := range t.rates {
+			if minute-rate.minute > 60 {
+				delete(t.rates, name)
+			}
+		}
+		t.swept = minute
+	}
+	rate, ok := t.rates[client]
+	if !ok {
+		rate = &clientRate{}
+		t.rates[client] = rate
+	}
+	rate.roll(minute)
+	rate.count++
+
+	anomaly := &Anomaly{Client: client, Method: req.Method, Path: req.URL.Path, Time: now}
+	route := RouteTemplate(req.URL.Path)
+	for _, rule := range t.Endpoints {
+		if rule.Method == req.Method && rule.Route == route {
+			anomaly.Kind = "endpoint"
+			anomaly.Text = fmt.Sprintf("Client %s requested the unusual endpoint %s %s", client, req.Method, req.URL.Path)
+			return anomaly
+		}
+	}
+	if t.RateFactor > 0 && rate.warm && !rate.flagged && rate.count >= t.MinRate && float64(rate.count) > t.RateFactor*rate.baseline {
+		rate.flagged = true
+		anomaly.Kind = "rate"
+		anomaly.Rate = rate.count
+		anomaly.Baseline = rate.baseline
+		anomaly.Text = fmt.Sprintf("Client %s made %d requests this minute, usually %.1f per minute", client, rate.count, rate.baseline)
+		return anomaly
+	}
+	return nil
+}
+
+// alert sends the anomaly to the Webhook.
+func (t *AnomalyTransport) alert(anomaly *Anomaly) {
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	if err := postWebhook(ctx, t.Client, t.Webhook, anomaly); err != nil {
+		AnomalyAlerts.WithLabelValues("error").Inc()
+		log.Error().Err(DefaultScrubber.ScrubError(err)).Msg("postWebhook failed")
+		return
+	}
+	AnomalyAlerts.WithLabelValues("sent").Inc()
+}
+
+// rejected returns the response rejecting the request of a blocked client, if it is blocked.
+func (t *AnomalyTransport) rejected(client string, req *http.Request, now time.Time) *http.Response {
+	t.mu.Lock()
+	until, ok := t.blocked[client]
+	if ok && !now.Before(until) {
+		delete(t.blocked, client)
+		ok = false
+	}
+	t.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	resp := ProxyResponse(req, http.StatusForbidden, ReasonClientBlocked, "The client is temporarily blocked after anomalous behaviour")
+	resp.Header.Set("Retry-After", strconv.Itoa(int(until.Sub(now).Round(time.Second)/time.Second)))
+	return resp
+}
+
+func (t *AnomalyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	client := ClientFromContext(req.Context())
+	now := time.Now()
+	if resp := t.rejected(client, req, now); resp != nil {
+		if t.Shadow.Deny(req, ReasonClientBlocked) {
+			AnomalyRejected.Inc()
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+	if anomaly := t.detect(client, req, now); anomaly != nil {
+		Anomalies.WithLabelValues(anomaly.Kind).Inc()
+		if t.Block > 0 {
+			anomaly.Blocked = now.Add(t.Block)
+			t.mu.Lock()
+			if t.blocked == nil {
+				t.blocked = make(map[string]time.Time)
+			}
+			t.blocked[client] = anomaly.Blocked
+			t.mu.Unlock()
+		}
+		event := log.Warn().Str("kind", anomaly.Kind).Str("client", client).Str("method", req.Method).Str("path", req.URL.Path)
+		if anomaly.Kind == "rate" {
+			event = event.Int("rate", anomaly.Rate).Float64("baseline", anomaly.Baseline)
+		}
+		if !anomaly.Blocked.IsZero() {
+			event = event.Time("blocked_until", anomaly.Blocked)
+		}
+		event.Msg("anomaly detected")
+		if t.Webhook != "" {
+			go t.alert(anomaly)
+		}
+		if resp := t.rejected(client, req, now); resp != nil {
+			return resp, nil
+		}
+	}
+	return t.Base.RoundTrip(req)
+}
+
+// ServeHTTP implements the /admin/anomalies API: GET returns the blocked clients (and until when), DELETE unblocks the
+// client of the query parameter.
+func (t *AnomalyTransport) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		client := req.URL.Query().Get("client")
+		t.mu.Lock()
+		delete(t.blocked, client)
+		t.mu.Unlock()
+		log.Warn().Str("client", client).Msg("client unblocked")
+	default:
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	now := time.Now()
+	blocked := make(map[string]time.Time)
+	t.mu.Lock()
+	for client, until := range t.blocked {
+		if now.Before(until) {
+			blocked[client] = until
+		}
+	}
+	t.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"blocked": blocked}); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+)
+
+// APIVersionHeader is the header used by GitHub to select the REST API version.
+// https://docs.github.com/en/rest/about-the-rest-api/api-versions
+const APIVersionHeader = "X-GitHub-Api-Version"
+
+// APIVersionTransport injects a default X-GitHub-Api-Version header into requests that do not specify one.
+// Client-specified versions are always passed through unmodified.
+type APIVersionTransport struct {
+	Base    http.RoundTripper
+	Version string
+}
+
+func (t *APIVersionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Version != "" && req.Header.Get(APIVersionHeader) == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(APIVersionHeader, t.Version)
+	}
+	return t.Base.RoundTrip(req)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	oauth2githubapp "github.com/int128/oauth2-github-app"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/oauth2"
+)
+
+var (
+	ScopedTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "scoped_tokens_total",
+		Subsystem: "github",
+		Help:      "Number of scoped installation tokens by credential and result (minted, reused, error)",
+	}, []string{"client_id", "result"})
+)
+
+// ScopeRule scopes the installation tokens of the requests to a route (matched by the method, "*" for any, and the
+// RouteTemplate of the path) to the repository of the path and the Permissions.
+type ScopeRule struct {
+	Method      string
+	Route       string
+	Permissions map[string]string
+}
+
+// ParseScopeRule parses a rule in the format '<method> <route>=<permission>:<level>[,...]', ex:
+// 'POST /repos/{owner}/{repo}/issues=issues:write'. The route must be within a repository.
+func ParseScopeRule(spec string) (ScopeRule, error) {
+	endpoint, permissions, ok := strings.Cut(spec, "=")
+	if !ok {
+		return ScopeRule{}, fmt.Errorf("invalid scope %q, expected '<method> <route>=<permission>:<level>[,...]'", spec)
+	}
+	method, route, ok := strings.Cut(strings.TrimSpace(endpoint), " ")
+	route = RouteTemplate(strings.TrimSpace(route))
+	if !ok || method == "" || !strings.HasPrefix(route+"/", "/repos/{owner}/{repo}/") {
+		return ScopeRule{}, fmt.Errorf("invalid scope %q, expected a route within /repos/{owner}/{repo}", spec)
+	}
+	rule := ScopeRule{Method: strings.ToUpper(method), Route: route, Permissions: make(map[string]string)}
+	for permission := range strings.SplitSeq(permissions, ",") {
+		name, level, ok := strings.Cut(strings.TrimSpace(permission), ":")
+		if !ok || name == "" || (level != "read" && level != "write" && level != "admin") {
+			return ScopeRule{}, fmt.Errorf("invalid scope %q, expected permissions in the format '<permission>:<read|write|admin>'", spec)
+		}
+		rule.Permissions[name] = level
+	}
+	return rule, nil
+}
+
+// appJWT returns the JWT authenticating as the GitHub App, valid for the maximum of 10 minutes (allowing for clock
+// drift).
+func appJWT(appID string, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal failed: %w", err)
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("rsa.SignPKCS1v15 failed: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// parseAppKey parses the private key of a GitHub App, either the PEM itself or the path to it (like ghauth.App).
+func parseAppKey(privateKey string) (*rsa.PrivateKey, error) {
+	if strings.Contains(privateKey, "-BEGIN RSA PRIVATE KEY-") {
+		key, err := oauth2githubapp.ParsePrivateKey([]byte(privateKey))
+		if err != nil {
+			return nil, fmt.Errorf("oauth2githubapp.ParsePrivateKey failed: %w", err)
+		}
+		return key, nil
+	}
+	key, err := oauth2githubapp.LoadPrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("oauth2githubapp.LoadPrivateKey failed: %w", err)
+	}
+	return key, nil
+}
+
+// ScopedTokenTransport authenticates the requests of a GitHub App installation, the requests matching a Rule with an
+// installation token restricted to the repository of the path and the permissions of the rule (reducing the blast
+// radius of any leak of the token), the other requests with the installation token of the Source. The scoped tokens
+// are minted from the URL of the upstream and reused until they expire. A request whose scoped token cannot be minted
+// fails rather than falling back to the unrestricted token.
+type ScopedTokenTransport struct {
+	Base           http.RoundTripper
+	Source         oauth2.TokenSource
+	URL            *url.URL
+	Credential     string
+	AppID          string
+	InstallationID string
+	Key            *rsa.PrivateKey
+	Rules          []ScopeRule
+
+	mu      sync.Mutex
+	tokens  map[string]*oauth2.Token
+	minting map[string]*scopedMint
+}
+
+// scopedMint is the in-flight minting of a scoped token, shared by the concurrent requests needing the same token.
+type scopedMint struct {
+	done  chan struct{}
+	token *oauth2.Token
+	err   error
+}
+
+// scope returns the rule and repository of the request, if it matches a rule.
+func (t *ScopedTokenTransport) scope(req *http.Request) (*ScopeRule, string) {
+	route := RouteTemplate(req.URL.Path)
+	for idx, rule := range t.Rules {
+		if (rule.Method == "*" || rule.Method == req.Method) && rule.Route == route {
+			segments := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v3"), "/"), "/")
+			return &t.Rules[idx], segments[2]
+		}
+	}
+	return nil, ""
+}
+
+// mint creates an installation token restricted to the repository and the permissions of the rule.
+func (t *ScopedTokenTransport) mint(ctx context.Context, rule *ScopeRule, repo string) (*oauth2.Token, error) {
+	jwt, err := appJWT(t.AppID, t.Key, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("appJWT failed: %w", err)
+	}
+	body, err := json.Marshal(map[string]any{
+		"repositories": []string{repo},
+		"permissions":  rule.Permissions,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed: %w", err)
+	}
+	mintURL := t.URL.JoinPath("app", "installations", t.InstallationID, "access_tokens")
+	mintReq, err := http.NewRequestWithContext(ctx, http.MethodPost, mintURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+	}
+	mintReq.Header.Set("Authorization", "Bearer "+jwt)
+	mintReq.Header.Set("Accept", "application/vnd.github+json")
+	mintReq.Header.Set("Content-Type", "application/json")
+	resp, err := t.Base.RoundTrip(mintReq)
+	if err != nil {
+		return nil, fmt.Errorf("(http.RoundTripper).RoundTrip failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("(*json.Decoder).Decode failed: %w", err)
+	}
+	return &oauth2.Token{AccessToken: token.Token, TokenType: "token", Expiry: token.ExpiresAt}, nil
+}
+
+// token returns the (cached) scoped token of the rule for the repository. The token is minted without holding the
+// lock, once for the concurrent requests needing it (the other tokens are served meanwhile).
+func (t *ScopedTokenTransport) token(req *http.Request, rule *ScopeRule, repo string) (*oauth2.Token, error) {
+	var builder strings.Builder
+	builder.WriteString(strings.ToLower(repo))
+	for _, name := range slices.Sorted(maps.Keys(rule.Permissions)) {
+		builder.WriteString("\x00" + name + ":" + rule.Permissions[name])
+	}
+	key := builder.String()
+
+	t.mu.Lock()
+	if token, ok := t.tokens[key]; ok && token.Valid() {
+		t.mu.Unlock()
+		ScopedTokens.WithLabelValues(t.Credential, "reused").Inc()
+		return token, nil
+	}
+	if mint, ok := t.minting[key]; ok {
+		t.mu.Unlock()
+		select {
+		case <-mint.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if mint.err != nil {
+			return nil, mint.err
+		}
+		ScopedTokens.WithLabelValues(t.Credential, "reused").Inc()
+		return mint.token, nil
+	}
+	mint := &scopedMint{done: make(chan struct{})}
+	if t.minting == nil {
+		t.minting = make(map[string]*scopedMint)
+	}
+	t.minting[key] = mint
+	t.mu.Unlock()
+
+	// The token is shared with the requests waiting for it, their minting is not cancelled with this request.
+	mint.token, mint.err = t.mint(context.WithoutCancel(req.Context()), rule, repo)
+	t.mu.Lock()
+	delete(t.minting, key)
+	if mint.err == nil {
+		if t.tokens == nil {
+			t.tokens = make(map[string]*oauth2.Token)
+		}
+		// Forget the expired tokens, the repositories written to are usually a small set.
+		maps.DeleteFunc(t.tokens, func(_ string, token *oauth2.Token) bool { return !token.Valid() })
+		t.tokens[key] = mint.token
+	}
+	t.mu.Unlock()
+	close(mint.done)
+
+	if mint.err != nil {
+		ScopedTokens.WithLabelValues(t.Credential, "error").Inc()
+		return nil, mint.err
+	}
+	ScopedTokens.WithLabelValues(t.Credential, "minted").Inc()
+	return mint.token, nil
+}
+
+func (t *ScopedTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var token *oauth2.Token
+	var err error
+	if rule, repo := t.scope(req); rule != nil {
+		token, err = t.token(req, rule, repo)
+		if err != nil {
+			return nil, fmt.Errorf("(*ScopedTokenTransport).token failed: %w", err)
+		}
+	} else if token, err = t.Source.Token(); err != nil {
+		return nil, fmt.Errorf("(oauth2.TokenSource).Token failed: %w", err)
+	}
+	req = req.Clone(req.Context())
+	token.SetAuthHeader(req)
+	return t.Base.RoundTrip(req)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxBatchRequests is the maximum number of sub-requests of a single /batch request.
+	maxBatchRequests = 100
+	// maxBatchBody is the maximum size of the body of a /batch request.
+	maxBatchBody = 8 << 20
+)
+
+// BatchRequest is a REST sub-request of a /batch request, the Body (if any) is sent as JSON.
+type BatchRequest struct {
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// BatchResponse is the response of a sub-request, the Body is embedded as-is if it is JSON and as a string otherwise.
+type BatchResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+// BatchHandler implements the /batch API: POST executes a JSON array of BatchRequest through the Handler (ex: the
+// proxy, so each is cached and scheduled on the credential pool like any other request) concurrently, returning the
+// array of BatchResponse in the same order.
+type BatchHandler struct {
+	Handler http.Handler
+	// Concurrency is the maximum number of sub-requests of a single request at a time, DefaultBulkConcurrency if zero.
+	Concurrency int
+}
+
+func (h *BatchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBatchBody))
+	if err != nil {
+		WriteProxyError(w, http.StatusRequestEntityTooLarge, ReasonInvalidRequest, "The batch must not exceed "+strconv.Itoa(maxBatchBody)+" bytes")
+		return
+	}
+	var batch []BatchRequest
+	if err := json.Unmarshal(body, &batch); err != nil {
+		WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The batch must be a JSON array of requests: "+err.Error())
+		return
+	}
+	if len(batch) == 0 || len(batch) > maxBatchRequests {
+		WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The batch must contain between 1 and "+strconv.Itoa(maxBatchRequests)+" requests")
+		return
+	}
+	for idx, sub := range batch {
+		if !strings.HasPrefix(sub.Path, "/") {
+			WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The path of request "+strconv.Itoa(idx)+" must begin with /")
+			return
+		}
+	}
+
+	// The sub-requests are serialized as JSON (if they have a body), never as the batch itself.
+	parent := req.Clone(req.Context())
+	parent.Header.Del("Content-Type")
+	responses := make([]BatchResponse, len(batch))
+	sem := make(chan struct{}, DefaultBulkConcurrency)
+	if h.Concurrency > 0 {
+		sem = make(chan struct{}, h.Concurrency)
+	}
+	var wg sync.WaitGroup
+	for idx, sub := range batch {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			header := make(http.Header, len(sub.Headers)+1)
+			if len(sub.Body) > 0 {
+				header.Set("Content-Type", "application/json")
+			}
+			for name, val := range sub.Headers {
+				header.Set(name, val)
+			}
+			resp := subrequest(h.Handler, parent, batchMethod(sub.Method), strings.TrimPrefix(sub.Path, "/api/v3"), header, sub.Body)
+			BulkSubrequests.WithLabelValues("batch", strconv.Itoa(resp.status)).Inc()
+			responses[idx] = batchResponse(resp)
+		})
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(responses); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
+
+// batchResponse converts the buffered response of a sub-request to its BatchResponse.
+func batchResponse(resp *bufferedResponse) BatchResponse {
+	response := BatchResponse{Status: resp.status, Headers: make(map[string]string, len(resp.header))}
+	for name := range resp.header {
+		response.Headers[name] = strings.Join(resp.header.Values(name), ", ")
+	}
+	if json.Valid(resp.body.Bytes()) {
+		response.Body = resp.body.Bytes()
+	} else if resp.body.Len() > 0 {
+		response.Body, _ = json.Marshal(resp.body.String())
+	}
+	return response
+}
+
+// batchMethod returns the (upper-cased) method of a sub-request, GET if it is omitted.
+func batchMethod(method string) string {
+	if method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(method)
+}
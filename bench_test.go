@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+)
+
+var (
+	benchMax        = flag.String("bench-max", "", "Maximum ns/op of each benchmark, ex: 'CacheHit=20000,CacheMiss=50000' (above it fails the run)")
+	benchEfficiency = flag.Float64("bench-efficiency", 0, "Minimum throughput of BenchmarkCredentialPool at each -cpu relative to a linear scaling of the first (0 to only report it)")
+)
+
+var (
+	// benchResults are the ns/op of the last (final) run of each benchmark by GOMAXPROCS, checked by TestMain.
+	benchResults = make(map[string]map[int]float64)
+	benchMu      sync.Mutex
+)
+
+// record stores the ns/op of the (final) run of the benchmark at the current GOMAXPROCS.
+func record(b *testing.B) {
+	if b.N == 0 {
+		return
+	}
+	benchMu.Lock()
+	defer benchMu.Unlock()
+	name := strings.TrimPrefix(b.Name(), "Benchmark")
+	if benchResults[name] == nil {
+		benchResults[name] = make(map[int]float64)
+	}
+	benchResults[name][runtime.GOMAXPROCS(0)] = float64(b.Elapsed().Nanoseconds()) / float64(b.N)
+}
+
+// checkBenchmarks reports the benchmarks above their --bench-max or below the --bench-efficiency.
+func checkBenchmarks() (failures []string) {
+	benchMu.Lock()
+	defer benchMu.Unlock()
+	if *benchMax != "" {
+		for _, pair := range strings.Split(*benchMax, ",") {
+			name, raw, _ := strings.Cut(pair, "=")
+			limit, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("--bench-max %q: %v", pair, err))
+				continue
+			}
+			for procs, nsop := range benchResults[name] {
+				if nsop > limit {
+					failures = append(failures, fmt.Sprintf("Benchmark%s-%d: %.0f ns/op above the %.0f ns/op threshold", name, procs, nsop, limit))
+				}
+			}
+		}
+	}
+	if byProcs := benchResults["CredentialPool"]; len(byProcs) > 1 {
+		procs := slices.Sorted(maps.Keys(byProcs))
+		for _, p := range procs[1:] {
+			// Beyond the cores of the machine the parallel requests only share them, the scaling is meaningless.
+			if p > runtime.NumCPU() {
+				fmt.Fprintf(os.Stderr, "BenchmarkCredentialPool-%d: skipped the efficiency check beyond the %d cores\n", p, runtime.NumCPU())
+				continue
+			}
+			// The ns/op of a parallel benchmark is the wall time per operation, its throughput is the inverse.
+			efficiency := byProcs[procs[0]] * float64(procs[0]) / (byProcs[p] * float64(p))
+			fmt.Fprintf(os.Stderr, "BenchmarkCredentialPool-%d: %.2f efficiency relative to -cpu %d\n", p, efficiency, procs[0])
+			if efficiency < *benchEfficiency {
+				failures = append(failures, fmt.Sprintf("BenchmarkCredentialPool-%d: %.2f efficiency below the %.2f threshold", p, efficiency, *benchEfficiency))
+			}
+		}
+	}
+	slices.Sort(failures)
+	return failures
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	for _, failure := range checkBenchmarks() {
+		fmt.Fprintln(os.Stderr, "FAIL:", failure)
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// benchUpstream answers every request like the API does for an issue, fresh for 60 seconds.
+var benchUpstream = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+	resp := jsonResponse(req, `{"id":1,"number":1,"title":"Found a bug","state":"open","body":"`+strings.Repeat("x", 2048)+`"}`)
+	resp.Header.Set("Cache-Control", "private, max-age=60, s-maxage=60")
+	resp.Header.Set("Etag", `"`+strconv.Itoa(len(req.URL.Path))+`"`)
+	resp.Header.Set("X-Ratelimit-Limit", "5000")
+	resp.Header.Set("X-Ratelimit-Remaining", "4999")
+	resp.Header.Set("X-Ratelimit-Used", "1")
+	resp.Header.Set("X-Ratelimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	resp.Header.Set("X-Ratelimit-Resource", "core")
+	return resp, nil
+})
+
+// benchCache returns the cache transport of the proxy (as built by main with --cache-freshness) over the upstream.
+func benchCache(upstream http.RoundTripper) http.RoundTripper {
+	storage := NewKeyStorage(NewMemoryStorage(64 << 20))
+	return &FreshnessTransport{
+		Base:    ghtransport.NewTransport(&TeeStorage{Storage: storage}, upstream),
+		Storage: storage,
+	}
+}
+
+func benchRoundTrip(b *testing.B, transport http.RoundTripper, url string) {
+	resp, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, url, nil))
+	if err != nil {
+		b.Fatalf("RoundTrip failed: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func BenchmarkCacheHit(b *testing.B) {
+	var misses atomic.Int64
+	transport := benchCache(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		misses.Add(1)
+		return benchUpstream(req)
+	}))
+	const url = "https://api.github.com/repos/octocat/hello-world/issues/1"
+	// The body is stored in the background while it is streamed, warm the cache until the response is a hit.
+	for deadline := time.Now().Add(time.Second); ; {
+		misses.Store(0)
+		benchRoundTrip(b, transport, url)
+		if misses.Load() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			b.Fatal("the warmed response was never served from the cache")
+		}
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		benchRoundTrip(b, transport, url)
+	}
+	if n := misses.Load(); n > 0 {
+		b.Fatalf("%d requests reached the upstream, expected every request to be a hit", n)
+	}
+	record(b)
+}
+
+func BenchmarkCacheMiss(b *testing.B) {
+	transport := benchCache(benchUpstream)
+	b.ReportAllocs()
+	var idx int
+	for b.Loop() {
+		idx++
+		benchRoundTrip(b, transport, "https://api.github.com/repos/octocat/hello-world/issues/"+strconv.Itoa(idx))
+	}
+	record(b)
+}
+
+// BenchmarkCredentialPool selects the credential of parallel requests across many affinity sessions, run it with
+// -cpu 1,2,4,8 to measure the scaling of the credential selection (see --bench-efficiency).
+func BenchmarkCredentialPool(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := NewCredentialPool(ctx, nil)
+	pool.Affinity = &Affinity{Header: "X-Session", Window: time.Minute}
+	for idx := range 16 {
+		if err := pool.Add(NewCredential("token", "bench-"+strconv.Itoa(idx), benchUpstream)); err != nil {
+			b.Fatalf("(*CredentialPool).Add failed: %v", err)
+		}
+	}
+	var sessions atomic.Int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodGet, "https://api.github.com/repos/octocat/hello-world/issues/1", nil)
+			req.Header.Set("X-Session", strconv.FormatInt(sessions.Add(1)%1024, 10))
+			resp, err := pool.RoundTrip(req)
+			if err != nil {
+				b.Errorf("(*CredentialPool).RoundTrip failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+		}
+	})
+	record(b)
+}
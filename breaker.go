@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	StorageDegraded = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "storage_degraded",
+		Subsystem: "github",
+		Help:      "Whether the circuit breaker of the storage backend is open, the cache is skipped and the requests are served from upstream",
+	}, []string{"backend"})
+	StorageOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "storage_operations_total",
+		Subsystem: "github",
+		Help:      "Number of operations (get, put) of the storage backend by result (ok, failed, timeout, busy, skipped)",
+	}, []string{"backend", "operation", "result"})
+)
+
+// The defaults of the BreakerStorage.
+const (
+	DefaultStorageWorkers  = 64
+	DefaultStorageFailures = 5
+	DefaultStorageCooldown = 30 * time.Second
+)
+
+var (
+	errStorageDegraded = errors.New("the storage backend is degraded")
+	errStorageBusy     = errors.New("the queue of the storage workers is full")
+)
+
+// BreakerStorage decouples the requests from a slow (remote) storage backend: its operations are performed by a fixed
+// pool of workers (queueing up to as many operations), each bounded by the Timeout including its wait in the queue.
+// Once Failures consecutive operations failed (an error, a timeout or the queue full) the breaker opens and the
+// Storage is skipped entirely for the Cooldown, after which a single operation probes it again. While degraded (or on
+// any failure) a Get is a miss and a Put is dropped, the requests are served from upstream rather than failing or
+// stalling.
+type BreakerStorage struct {
+	Storage ghtransport.Storage
+	// Backend is the name of the backend in the metrics, ex: s3.
+	Backend  string
+	Timeout  time.Duration
+	Failures int
+	Cooldown time.Duration
+
+	jobs     chan func()
+	mu       sync.Mutex
+	failures int
+	opened   time.Time
+	probing  bool
+}
+
+// NewBreakerStorage returns a BreakerStorage with the workers, which run until the context is cancelled.
+func NewBreakerStorage(ctx context.Context, storage ghtransport.Storage, backend string, workers int, timeout time.Duration, failures int, cooldown time.Duration) *BreakerStorage {
+	s := &BreakerStorage{
+		Storage:  storage,
+		Backend:  backend,
+		Timeout:  timeout,
+		Failures: failures,
+		Cooldown: cooldown,
+		jobs:     make(chan func(), workers),
+	}
+	StorageDegraded.WithLabelValues(backend).Set(0)
+	for range workers {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-s.jobs:
+					job()
+				}
+			}
+		}()
+	}
+	return s
+}
+
+// allow reports if an operation may be performed and if it probes the backend, at most one is allowed while the
+// breaker is open and once its cooldown elapsed.
+func (s *BreakerStorage) allow() (allowed bool, probe bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.opened.IsZero() {
+		return true, false
+	}
+	if s.probing || time.Since(s.opened) < s.Cooldown {
+		return false, false
+	}
+	s.probing = true
+	return true, true
+}
+
+// record records the outcome of an allowed operation, opening (or closing) the breaker.
+func (s *BreakerStorage) record(probe bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if probe {
+		s.probing = false
+	}
+	if err == nil {
+		s.failures = 0
+		if !s.opened.IsZero() {
+			s.opened = time.Time{}
+			StorageDegraded.WithLabelValues(s.Backend).Set(0)
+			log.Info().Str("backend", s.Backend).Msg("storage backend recovered, the cache is used again")
+		}
+		return
+	}
+	s.failures++
+	if probe || (s.opened.IsZero() && s.failures >= s.Failures) {
+		if s.opened.IsZero() {
+			StorageDegraded.WithLabelValues(s.Backend).Set(1)
+			log.Warn().Err(err).Str("backend", s.Backend).Int("failures", s.failures).Msg("storage backend degraded, the cache is skipped")
+		}
+		s.opened = time.Now()
+	}
+}
+
+// breakerDo performs the operation of the storage on a worker within the timeout, skipping it while degraded.
+func breakerDo[T any](ctx context.Context, s *BreakerStorage, operation string, op func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	allowed, probe := s.allow()
+	if !allowed {
+		StorageOperations.WithLabelValues(s.Backend, operation, "skipped").Inc()
+		return zero, errStorageDegraded
+	}
+	type result struct {
+		value T
+		err   error
+	}
+	// The operation is abandoned (but the breaker still informed) if the client goes away.
+	opCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.Timeout)
+	done := make(chan result, 1)
+	select {
+	case s.jobs <- func() {
+		defer cancel()
+		value, err := op(opCtx)
+		done <- result{value, err}
+	}:
+	default:
+		cancel()
+		StorageOperations.WithLabelValues(s.Backend, operation, "busy").Inc()
+		s.record(probe, errStorageBusy)
+		return zero, errStorageBusy
+	}
+	select {
+	case r := <-done:
+		switch {
+		case r.err == nil:
+			StorageOperations.WithLabelValues(s.Backend, operation, "ok").Inc()
+		case errors.Is(r.err, context.DeadlineExceeded):
+			StorageOperations.WithLabelValues(s.Backend, operation, "timeout").Inc()
+		default:
+			StorageOperations.WithLabelValues(s.Backend, operation, "failed").Inc()
+		}
+		s.record(probe, r.err)
+		return r.value, r.err
+	case <-opCtx.Done():
+		// The backend did not honor the deadline, the worker is released once it returns.
+		StorageOperations.WithLabelValues(s.Backend, operation, "timeout").Inc()
+		s.record(probe, opCtx.Err())
+		return zero, opCtx.Err()
+	}
+}
+
+func (s *BreakerStorage) Get(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := breakerDo(ctx, s, "get", func(ctx context.Context) (*http.Response, error) {
+		resp, err := s.Storage.Get(ctx, req)
+		if err != nil || resp == nil {
+			return nil, err
+		}
+		// Read the body within the timeout too, the response outlives the operation.
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("io.ReadAll failed: %w", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		return resp, nil
+	})
+	if err != nil {
+		if !errors.Is(err, errStorageDegraded) {
+			log.Warn().Err(err).Str("backend", s.Backend).Str("url", req.URL.String()).Msg("(ghtransport.Storage).Get failed")
+		}
+		return nil, nil
+	}
+	return resp, nil
+}
+
+func (s *BreakerStorage) Put(ctx context.Context, resp *http.Response) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("io.ReadAll failed: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	// The worker may outlive the request (and the response is modified once returned).
+	stored := *resp
+	stored.Header = resp.Header.Clone()
+	stored.Body = io.NopCloser(bytes.NewReader(body))
+	if _, err := breakerDo(ctx, s, "put", func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.Storage.Put(ctx, &stored)
+	}); err != nil && !errors.Is(err, errStorageDegraded) {
+		log.Warn().Err(err).Str("backend", s.Backend).Str("url", resp.Request.URL.String()).Msg("(ghtransport.Storage).Put failed")
+	}
+	return nil
+}
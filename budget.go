@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+)
+
+// BudgetHeader is the response header set on paginated responses with the number of pages the caller can afford.
+const BudgetHeader = "X-Proxy-Budget-Remaining-Pages"
+
+// budget returns the number of requests the credentials of the pool (or the subset of the tenant) can make for the
+// resource in their current rate-limit windows, a window that has already reset counts its full limit.
+func budget(pool *CredentialPool, tenant *Tenant, resource ghratelimit.Resource, now time.Time) (uint64, bool) {
+	var total uint64
+	var known bool
+	for _, credential := range pool.Credentials() {
+		if tenant != nil && len(tenant.Credentials) > 0 && !slices.Contains(tenant.Credentials, credential.ID) {
+			continue
+		}
+		rate := credential.Transport.Limits.Load(resource)
+		if rate == nil {
+			continue
+		}
+		known = true
+		if rate.Reset > 0 && int64(rate.Reset) <= now.Unix() {
+			total += rate.Limit
+		} else {
+			total += rate.Remaining
+		}
+	}
+	return total, known
+}
+
+// paginated reports if the response has a next page (the Link header has a rel="next" link).
+func paginated(resp *http.Response) bool {
+	for _, val := range resp.Header.Values("Link") {
+		for link := range strings.SplitSeq(val, ",") {
+			for param := range strings.SplitSeq(link, ";") {
+				if strings.EqualFold(strings.ReplaceAll(strings.TrimSpace(param), " ", ""), `rel="next"`) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// BudgetTransport sets the BudgetHeader on paginated responses with the number of requests the pool can still afford
+// for the resource of the request, so clients can decide to truncate long listings before exhausting the quota.
+// Without a Pool the rate-limit of the response itself is used. Cached pages cost nothing, so the budget is the lower
+// bound of the pages the caller can fetch.
+type BudgetTransport struct {
+	Base http.RoundTripper
+	Pool *CredentialPool
+}
+
+func (t *BudgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || !paginated(resp) {
+		return resp, err
+	}
+	if t.Pool != nil {
+		if remaining, ok := budget(t.Pool, TenantFromContext(req.Context()), ghratelimit.InferResource(req), time.Now()); ok {
+			resp.Header.Set(BudgetHeader, strconv.FormatUint(remaining, 10))
+		}
+	} else if remaining := resp.Header.Get("X-Ratelimit-Remaining"); remaining != "" {
+		resp.Header.Set(BudgetHeader, remaining)
+	}
+	return resp, nil
+}
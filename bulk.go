@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	BulkSubrequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "bulk_subrequests_total",
+		Subsystem: "github",
+		Help:      "Number of sub-requests of the bulk endpoints by endpoint and status code",
+	}, []string{"endpoint", "code"})
+)
+
+// DefaultBulkConcurrency is the number of sub-requests of a bulk request executed at a time.
+const DefaultBulkConcurrency = 8
+
+// maxBulkRepos is the maximum number of repositories of a single /bulk/dependency-graph request.
+const maxBulkRepos = 1000
+
+// bufferedResponse is an http.ResponseWriter buffering the response of a sub-request.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *bufferedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *bufferedResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *bufferedResponse) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+// subrequest serves the request for the path through the handler (ex: the proxy, so the sub-request is cached,
+// authenticated and counted against the tenant like any other) with the headers of the parent request, overridden by
+// the header. The Accept-Encoding and conditional headers of the parent are dropped so the body can be combined.
+func subrequest(handler http.Handler, parent *http.Request, method string, path string, header http.Header, body []byte) *bufferedResponse {
+	target, err := url.Parse(path)
+	if err != nil {
+		resp := &bufferedResponse{header: make(http.Header)}
+		WriteProxyError(resp, http.StatusBadRequest, ReasonInvalidRequest, "The path of the sub-request is invalid")
+		return resp
+	}
+	req, err := http.NewRequestWithContext(parent.Context(), method, target.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		resp := &bufferedResponse{header: make(http.Header)}
+		WriteProxyError(resp, http.StatusBadRequest, ReasonInvalidRequest, "The method of the sub-request is invalid")
+		return resp
+	}
+	req.Header = parent.Header.Clone()
+	for _, name := range []string{"Content-Length", "Accept-Encoding", "If-None-Match", "If-Modified-Since"} {
+		req.Header.Del(name)
+	}
+	for name, vals := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = vals
+	}
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	req.Host = parent.Host
+	req.RemoteAddr = parent.RemoteAddr
+	req.TLS = parent.TLS
+	resp := &bufferedResponse{header: make(http.Header)}
+	handler.ServeHTTP(resp, req)
+	resp.WriteHeader(http.StatusOK) // The handler may not have written anything at all
+	return resp
+}
+
+// DependencyGraphResult is the SBOM of a repository (or the error fetching it) in a /bulk/dependency-graph response.
+type DependencyGraphResult struct {
+	Repository string          `json:"repository"`
+	Status     int             `json:"status"`
+	SBOM       json.RawMessage `json:"sbom,omitempty"`
+	// Error is the (GitHub-shaped) error response if the status is not 200 OK.
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+// DependencyGraphHandler implements the /bulk/dependency-graph API: GET fetches the SBOM of each of the repos (comma
+// separated, either owner/name or just the name with the owner parameter) concurrently through the Handler, returning
+// the results in the order of the repos.
+type DependencyGraphHandler struct {
+	Handler http.Handler
+	// Concurrency is the maximum number of SBOM requests of a single request at a time, DefaultBulkConcurrency if zero.
+	Concurrency int
+}
+
+func (h *DependencyGraphHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	query := req.URL.Query()
+	var repos []string
+	for repo := range strings.SplitSeq(query.Get("repos"), ",") {
+		if repo = strings.TrimSpace(repo); repo == "" {
+			continue
+		}
+		if !strings.Contains(repo, "/") && query.Get("owner") != "" {
+			repo = query.Get("owner") + "/" + repo
+		}
+		owner, name, ok := strings.Cut(repo, "/")
+		if !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+			WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "Invalid repository "+strconv.Quote(repo)+", must be owner/name (or the owner parameter must be set)")
+			return
+		}
+		repos = append(repos, repo)
+	}
+	if len(repos) == 0 || len(repos) > maxBulkRepos {
+		WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The repos parameter must list between 1 and "+strconv.Itoa(maxBulkRepos)+" repositories")
+		return
+	}
+
+	results := make([]DependencyGraphResult, len(repos))
+	sem := make(chan struct{}, DefaultBulkConcurrency)
+	if h.Concurrency > 0 {
+		sem = make(chan struct{}, h.Concurrency)
+	}
+	var wg sync.WaitGroup
+	for idx, repo := range repos {
+		owner, name, _ := strings.Cut(repo, "/")
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			path := "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(name) + "/dependency-graph/sbom"
+			resp := subrequest(h.Handler, req, http.MethodGet, path, nil, nil)
+			BulkSubrequests.WithLabelValues("dependency-graph", strconv.Itoa(resp.status)).Inc()
+			result := DependencyGraphResult{Repository: repo, Status: resp.status}
+			var sbom struct {
+				SBOM json.RawMessage `json:"sbom"`
+			}
+			if resp.status == http.StatusOK && json.Unmarshal(resp.body.Bytes(), &sbom) == nil {
+				if result.SBOM = sbom.SBOM; len(result.SBOM) == 0 {
+					result.SBOM = resp.body.Bytes() // Not wrapped in an sbom object
+				}
+			} else if json.Valid(resp.body.Bytes()) {
+				result.Error = resp.body.Bytes()
+			} else {
+				result.Error, _ = json.Marshal(map[string]string{"message": resp.body.String()})
+			}
+			results[idx] = result
+		})
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"results": results}); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+)
+
+// DefaultKeyHeaders are the request headers which always vary the cache key.
+var DefaultKeyHeaders = []string{
+	"Accept",
+	"X-GitHub-Api-Version",
+}
+
+// KeyStorage wraps a ghtransport.Storage, incorporating the values of request headers into the cache key.
+// All of the backends key by (*http.Request).URL, so the header values are appended as the URL fragment,
+// which is never sent upstream. Requests without any of the headers keep the original (un-fragmented) key.
+type KeyStorage struct {
+	Storage ghtransport.Storage
+	// Headers is the set of request headers that vary the cache key.
+	Headers []string
+	// Namespace (optional) prefixes every cache key, except those of the proxy's own state (see proxyHost).
+	Namespace *CacheNamespace
+	// Mesh (optional) is the underlying storage shared with the other replicas, see MeshStorage.
+	Mesh *MeshStorage
+}
+
+// key returns a copy of the request with the namespace, header values (and tenant) encoded into the URL fragment.
+func (s *KeyStorage) key(req *http.Request) *http.Request {
+	var parts []string
+	if namespace := s.Namespace.String(); namespace != "" && !proxyHost(req.URL.Host) {
+		parts = append(parts, "ns="+url.QueryEscape(namespace))
+	}
+	// Each tenant has its own cache partition.
+	if tenant := TenantFromContext(req.Context()); tenant != nil {
+		parts = append(parts, "tenant="+url.QueryEscape(tenant.Name))
+	}
+	for _, header := range s.Headers {
+		vals := req.Header.Values(header)
+		if len(vals) == 0 {
+			continue
+		}
+		value := strings.Join(vals, ",")
+		if http.CanonicalHeaderKey(header) == "Authorization" {
+			value = ghtransport.HashToken(value) // Never persist the raw authentication token
+		}
+		parts = append(parts, strings.ToLower(header)+"="+url.QueryEscape(value))
+	}
+	if len(parts) == 0 {
+		return req
+	}
+	keyed := *req
+	keyedURL := *req.URL
+	keyedURL.Fragment = strings.Join(parts, "&")
+	keyedURL.RawFragment = ""
+	keyed.URL = &keyedURL
+	return &keyed
+}
+
+func (s *KeyStorage) Get(ctx context.Context, req *http.Request) (*http.Response, error) {
+	return s.Storage.Get(ctx, s.key(req))
+}
+
+func (s *KeyStorage) Put(ctx context.Context, resp *http.Response) error {
+	keyed := *resp
+	keyed.Request = s.key(resp.Request)
+	if err := s.Storage.Put(ctx, &keyed); err != nil {
+		return err
+	}
+	// Per the storage contract, restore the (possibly replaced) body.
+	resp.Body = keyed.Body
+	resp.ContentLength = keyed.ContentLength
+	return nil
+}
+
+// NewKeyStorage wraps the storage, varying the cache key by DefaultKeyHeaders and any additional headers.
+func NewKeyStorage(storage ghtransport.Storage, headers ...string) *KeyStorage {
+	keyHeaders := slices.Clone(DefaultKeyHeaders)
+	for _, header := range headers {
+		if !slices.ContainsFunc(keyHeaders, func(existing string) bool {
+			return strings.EqualFold(existing, header)
+		}) {
+			keyHeaders = append(keyHeaders, header)
+		}
+	}
+	// Sort the headers so the key is stable regardless of flag ordering.
+	slices.SortFunc(keyHeaders, func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	})
+	return &KeyStorage{
+		Storage: storage,
+		Headers: keyHeaders,
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	CacheChunks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "cache_chunks_total",
+		Subsystem: "github",
+		Help:      "Number of chunks of the --cache-chunk-path responses by result (hit, fetched, failed), a failed chunk was fetched upstream but not stored",
+	}, []string{"result"})
+)
+
+// DefaultCacheChunkSize is the default size of the chunks of the ChunkedTransport.
+const DefaultCacheChunkSize = 8 << 20
+
+const (
+	// chunkQuery is the query parameter of the cache key of each chunk, the manifest is keyed by the request itself.
+	chunkQuery = "proxy-chunk"
+	// The headers of the stored manifest of a chunked response.
+	chunkSizeHeader   = "X-Proxy-Chunk-Size"
+	chunkLengthHeader = "X-Proxy-Chunk-Length"
+)
+
+var errChunkChanged = errors.New("the upstream response changed while serving its chunks")
+
+// byteRange is a single range of the Range header, Start is negative for a suffix range (of the last -Start bytes) and
+// End is negative for an open-ended range.
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+// parseRange parses the Range header, false for a missing, invalid or multiple range (served as the full response).
+func parseRange(header string) (byteRange, bool) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, false
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return byteRange{}, false
+		}
+		return byteRange{Start: -n, End: -1}, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false
+	}
+	if last == "" {
+		return byteRange{Start: start, End: -1}, true
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return byteRange{}, false
+	}
+	return byteRange{Start: start, End: end}, true
+}
+
+// resolve returns the (inclusive) offsets of the range within a body of the length, false if it is unsatisfiable.
+func (r byteRange) resolve(length int64) (int64, int64, bool) {
+	if r.Start < 0 {
+		return max(length+r.Start, 0), length - 1, length > 0
+	}
+	if r.Start >= length {
+		return 0, 0, false
+	}
+	if r.End < 0 || r.End >= length {
+		return r.Start, length - 1, true
+	}
+	return r.Start, r.End, true
+}
+
+// parseContentRange parses the "bytes <start>-<end>/<length>" Content-Range header of a 206 response.
+func parseContentRange(header string) (start int64, end int64, length int64, ok bool) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	span, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	var errs [3]error
+	start, errs[0] = strconv.ParseInt(first, 10, 64)
+	end, errs[1] = strconv.ParseInt(last, 10, 64)
+	length, errs[2] = strconv.ParseInt(total, 10, 64)
+	if errors.Join(errs[:]...) != nil || start < 0 || end < start || end >= length {
+		return 0, 0, 0, false
+	}
+	return start, end, length, true
+}
+
+// chunkedObject is a chunked response: the headers of the upstream response, its length and the size of its chunks.
+type chunkedObject struct {
+	Header http.Header
+	ETag   string
+	Length int64
+	Size   int64
+	// version identifies the chunks, those of another version (or size) of the response are never mixed in.
+	version string
+}
+
+func newChunkedObject(header http.Header, etag string, length int64, size int64) *chunkedObject {
+	hash := sha256.Sum256([]byte(etag + "\n" + strconv.FormatInt(length, 10) + "\n" + strconv.FormatInt(size, 10)))
+	return &chunkedObject{
+		Header:  header,
+		ETag:    etag,
+		Length:  length,
+		Size:    size,
+		version: hex.EncodeToString(hash[:8]),
+	}
+}
+
+// chunkable returns the object of the upstream (200 or 206) response and the offset of its body, false if it cannot
+// be chunked: without a strong ETag (identifying the chunks), a known length or a 206 aligned to the chunks.
+func chunkable(resp *http.Response, size int64) (*chunkedObject, int64, bool) {
+	etag := resp.Header.Get("Etag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return nil, 0, false
+	}
+	var offset, length int64
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if resp.ContentLength < 0 {
+			return nil, 0, false
+		}
+		length = resp.ContentLength
+	case http.StatusPartialContent:
+		start, end, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start%size != 0 || resp.ContentLength != end-start+1 {
+			return nil, 0, false
+		}
+		offset, length = start, total
+	default:
+		return nil, 0, false
+	}
+	header := resp.Header.Clone()
+	for _, name := range []string{"Content-Length", "Content-Range", "Accept-Ranges"} {
+		header.Del(name)
+	}
+	return newChunkedObject(header, etag, length, size), offset, true
+}
+
+// parseManifest returns the object of the stored manifest, nil if it is invalid.
+func parseManifest(resp *http.Response) *chunkedObject {
+	resp.Body.Close()
+	size, err := strconv.ParseInt(resp.Header.Get(chunkSizeHeader), 10, 64)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	length, err := strconv.ParseInt(resp.Header.Get(chunkLengthHeader), 10, 64)
+	if err != nil || length < 0 {
+		return nil
+	}
+	etag := resp.Header.Get("Etag")
+	if etag == "" {
+		return nil
+	}
+	header := resp.Header.Clone()
+	for _, name := range []string{chunkSizeHeader, chunkLengthHeader, "Content-Length"} {
+		header.Del(name)
+	}
+	return newChunkedObject(header, etag, length, size)
+}
+
+// manifest returns the response stored as the manifest of the object.
+func (o *chunkedObject) manifest(req *http.Request) *http.Response {
+	header := o.Header.Clone()
+	header.Set(chunkSizeHeader, strconv.FormatInt(o.Size, 10))
+	header.Set(chunkLengthHeader, strconv.FormatInt(o.Length, 10))
+	return &http.Response{
+		Status:     http.StatusText(http.StatusOK),
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// span returns the (inclusive) offsets of the chunk at the index.
+func (o *chunkedObject) span(idx int64) (int64, int64) {
+	start := idx * o.Size
+	return start, min(start+o.Size, o.Length) - 1
+}
+
+// key returns the request of the cache key of the chunk at the index, the key of the manifest with the chunkQuery.
+func (o *chunkedObject) key(req *http.Request, idx int64) *http.Request {
+	keyed := *req
+	keyedURL := *req.URL
+	chunk := chunkQuery + "=" + o.version + "." + strconv.FormatInt(idx, 10)
+	if keyedURL.RawQuery == "" {
+		keyedURL.RawQuery = chunk
+	} else {
+		keyedURL.RawQuery += "&" + chunk
+	}
+	keyed.URL = &keyedURL
+	return &keyed
+}
+
+// ChunkedTransport caches the (very large, ex: archives) responses of the Patterns as a manifest and fixed size chunks
+// rather than as a single response, serving the Range requests of the clients (ex: resuming a download) from the
+// chunks. The manifest is revalidated upstream as usual (a 304 does not transfer the body), then only the missing
+// chunks of the range are fetched upstream with a ranged request and stored as they are read, so a partial download
+// is resumed without refetching the full response. Only the chunk being read is buffered. The responses without a
+// strong ETag or a known length are passed through uncached.
+type ChunkedTransport struct {
+	Base http.RoundTripper
+	// Upstream is the transport below the caching transport the chunked requests are sent with.
+	Upstream http.RoundTripper
+	Storage  ghtransport.Storage
+	// Patterns are path.Match patterns (ex: /repos/*/*/tarball/*), matched like those of the StreamTransport.
+	Patterns  []string
+	ChunkSize int64
+}
+
+// Chunked reports if the request is served from the chunks.
+func (t *ChunkedTransport) Chunked(req *http.Request) bool {
+	if req.Method != http.MethodGet || StreamingFromContext(req.Context()) {
+		return false
+	}
+	p := "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/api/v3"), "/")
+	return slices.ContainsFunc(t.Patterns, func(pattern string) bool {
+		ok, _ := path.Match(pattern, p)
+		return ok
+	})
+}
+
+func (t *ChunkedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.Chunked(req) {
+		return t.Base.RoundTrip(req)
+	}
+	ctx := req.Context()
+	rng, ranged := parseRange(req.Header.Get("Range"))
+
+	// The request of the full (identity encoded, the ranges are of its bytes) response, the key of the manifest.
+	plain := req.Clone(ctx)
+	for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		plain.Header.Del(name)
+	}
+	plain.Header.Set("Accept-Encoding", "identity")
+
+	var object *chunkedObject
+	cached, err := t.Storage.Get(ctx, plain)
+	if err != nil {
+		log.Warn().Err(err).Str("url", req.URL.String()).Msg("(ghtransport.Storage).Get failed")
+	} else if cached != nil {
+		object = parseManifest(cached)
+	}
+
+	// Revalidate the manifest, fetching only the chunks of the range if it changed (or is missing).
+	fetch := plain.Clone(ctx)
+	if ranged && rng.Start >= 0 {
+		first := rng.Start / t.ChunkSize * t.ChunkSize
+		switch {
+		case rng.End >= 0:
+			fetch.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, (rng.End/t.ChunkSize+1)*t.ChunkSize-1))
+		case first > 0:
+			fetch.Header.Set("Range", fmt.Sprintf("bytes=%d-", first))
+		}
+	}
+	if object != nil {
+		fetch.Header.Set("If-None-Match", object.ETag)
+	}
+	resp, err := t.Upstream.RoundTrip(fetch)
+	if err != nil {
+		return nil, err
+	}
+	var source io.ReadCloser
+	var offset int64
+	header := resp.Header
+	if object != nil && resp.StatusCode == http.StatusNotModified {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		// Like the caching transport, the headers of the 304 (ex: the rate-limit) take precedence.
+		for key, vals := range object.Header {
+			if key == "X-Github-Request-Id" {
+				header[ghtransport.CachedRequestIDHeader] = vals
+			}
+			if _, ok := header[key]; !ok {
+				header[key] = vals
+			}
+		}
+	} else {
+		var ok bool
+		if object, offset, ok = chunkable(resp, t.ChunkSize); !ok {
+			if fetch.Header.Get("Range") == req.Header.Get("Range") {
+				return resp, nil
+			}
+			// The response to the aligned range is not that of the client's range.
+			resp.Body.Close()
+			return t.Base.RoundTrip(req)
+		}
+		if err := t.Storage.Put(ctx, object.manifest(plain)); err != nil {
+			log.Warn().Err(err).Str("url", req.URL.String()).Msg("(ghtransport.Storage).Put failed")
+		}
+		source = resp.Body
+		header = object.Header.Clone()
+	}
+
+	header.Set("Accept-Ranges", "bytes")
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" && notModified(ifNoneMatch, object.ETag) {
+		if source != nil {
+			source.Close()
+		}
+		return chunkedResponse(req, http.StatusNotModified, header, http.NoBody, 0), nil
+	}
+	if ifRange := req.Header.Get("If-Range"); ranged && ifRange != "" && ifRange != object.ETag {
+		ranged = false
+	}
+	start, end := int64(0), object.Length-1
+	status := http.StatusOK
+	if ranged {
+		var ok bool
+		if start, end, ok = rng.resolve(object.Length); !ok {
+			if source != nil {
+				source.Close()
+			}
+			header.Set("Content-Range", "bytes */"+strconv.FormatInt(object.Length, 10))
+			return chunkedResponse(req, http.StatusRequestedRangeNotSatisfiable, header, http.NoBody, 0), nil
+		}
+		status = http.StatusPartialContent
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, object.Length))
+	}
+	header.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	body := &chunkReader{
+		t:      t,
+		req:    plain,
+		object: object,
+		start:  start,
+		end:    end,
+		source: source,
+		at:     offset / object.Size,
+	}
+	return chunkedResponse(req, status, header, body, end-start+1), nil
+}
+
+// chunkedResponse returns the response to the chunked request.
+func chunkedResponse(req *http.Request, status int, header http.Header, body io.ReadCloser, length int64) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: length,
+		Request:       req,
+	}
+}
+
+// chunkReader reads the range of the object from its chunks, once a chunk is missing the remaining chunks of the
+// range are read (and stored) from upstream instead.
+type chunkReader struct {
+	t      *ChunkedTransport
+	req    *http.Request
+	object *chunkedObject
+	// start and end are the (inclusive) offsets of the remainder of the range.
+	start int64
+	end   int64
+	buf   []byte
+	err   error
+	// source (optional) is the upstream body, positioned at the chunk at the index at.
+	source io.ReadCloser
+	at     int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.start > r.end {
+			return 0, io.EOF
+		}
+		idx := r.start / r.object.Size
+		chunk, err := r.chunk(idx)
+		if err != nil {
+			r.err = err
+			continue
+		}
+		first, _ := r.object.span(idx)
+		r.buf = chunk[r.start-first : min(r.end-first+1, int64(len(chunk)))]
+		r.start = first + int64(len(chunk))
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.source == nil {
+		return nil
+	}
+	return r.source.Close()
+}
+
+// chunk returns the chunk at the index, from the cache until the first missing chunk.
+func (r *chunkReader) chunk(idx int64) ([]byte, error) {
+	ctx := r.req.Context()
+	first, last := r.object.span(idx)
+	if r.source == nil {
+		cached, err := r.t.Storage.Get(ctx, r.object.key(r.req, idx))
+		if err != nil {
+			log.Warn().Err(err).Str("url", r.req.URL.String()).Int64("chunk", idx).Msg("(ghtransport.Storage).Get failed")
+		} else if cached != nil {
+			chunk, err := io.ReadAll(cached.Body)
+			cached.Body.Close()
+			if err == nil && int64(len(chunk)) == last-first+1 {
+				CacheChunks.WithLabelValues("hit").Inc()
+				return chunk, nil
+			}
+		}
+		if err := r.open(idx); err != nil {
+			return nil, err
+		}
+	}
+	// The chunks before the index (if the upstream ignored the range) are stored as they are read through.
+	for {
+		first, last := r.object.span(r.at)
+		chunk := make([]byte, last-first+1)
+		if _, err := io.ReadFull(r.source, chunk); err != nil {
+			return nil, fmt.Errorf("io.ReadFull failed: %w", err)
+		}
+		r.store(r.at, chunk)
+		r.at++
+		if r.at > idx {
+			return chunk, nil
+		}
+	}
+}
+
+// open fetches the chunks from the index to the end of the range upstream, failing if the response changed.
+func (r *chunkReader) open(idx int64) error {
+	first, _ := r.object.span(idx)
+	_, last := r.object.span(r.end / r.object.Size)
+	fetch := r.req.Clone(r.req.Context())
+	fetch.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+	fetch.Header.Set("If-Range", r.object.ETag)
+	resp, err := r.t.Upstream.RoundTrip(fetch)
+	if err != nil {
+		return fmt.Errorf("(http.RoundTripper).RoundTrip failed: %w", err)
+	}
+	object, offset, ok := chunkable(resp, r.object.Size)
+	if !ok || object.version != r.object.version {
+		resp.Body.Close()
+		return errChunkChanged
+	}
+	r.source = resp.Body
+	r.at = offset / r.object.Size
+	return nil
+}
+
+// store stores the chunk at the index read from upstream.
+func (r *chunkReader) store(idx int64, chunk []byte) {
+	if err := r.t.Storage.Put(r.req.Context(), &http.Response{
+		Status:     http.StatusText(http.StatusOK),
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": []string{"application/octet-stream"},
+		},
+		Body:          io.NopCloser(bytes.NewReader(chunk)),
+		ContentLength: int64(len(chunk)),
+		Request:       r.object.key(r.req, idx),
+	}); err != nil {
+		CacheChunks.WithLabelValues("failed").Inc()
+		log.Warn().Err(err).Str("url", r.req.URL.String()).Int64("chunk", idx).Msg("(ghtransport.Storage).Put failed")
+		return
+	}
+	CacheChunks.WithLabelValues("fetched").Inc()
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bored-engineer/github-api-proxy/middleware"
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/spf13/pflag"
+)
+
+const usage = `Usage: github-api-proxy [command] [flags]
+
+Commands:
+  serve         Run the proxy (default)
+  validate      Validate the configuration, credentials and storage backend, then exit
+  cache purge   Purge cached responses from a running proxy, optionally by path prefix
+  cache warm    Warm the cache of a running proxy by requesting paths (arguments or stdin)
+  cache bump    Invalidate the entire cache of a running proxy by bumping the cache namespace
+  stats         Print the rate-limits, cache hit rate and top routes of a running proxy
+  login         Authorize a token with the OAuth device flow, adding it to the credential store
+  credentials   Add, remove or list the credentials of the credential store
+
+Run 'github-api-proxy <command> --help' for the flags of a command.
+`
+
+// Run dispatches the (optional) subcommand, defaulting to serve for backwards compatibility.
+func Run(ctx context.Context, args []string) error {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "serve":
+		cfg, err := parseConfig(ctx, "serve", args)
+		if err != nil {
+			return err
+		}
+		Serve(ctx, cfg)
+		return nil
+	case "validate":
+		cfg, err := parseConfig(ctx, "validate", args)
+		if err != nil {
+			return err
+		}
+		return Validate(ctx, cfg, os.Stdout)
+	case "cache":
+		if len(args) == 0 {
+			return errors.New("cache requires a subcommand: purge, warm or bump")
+		}
+		switch args[0] {
+		case "purge":
+			return cachePurge(ctx, args[1:])
+		case "warm":
+			return cacheWarm(ctx, args[1:])
+		case "bump":
+			return cacheBump(ctx, args[1:])
+		default:
+			return fmt.Errorf("unknown cache subcommand %q", args[0])
+		}
+	case "stats":
+		return stats(ctx, args)
+	case "login":
+		return login(ctx, args)
+	case "credentials":
+		if len(args) == 0 {
+			return errors.New("credentials requires a subcommand: add, remove or list")
+		}
+		switch args[0] {
+		case "add":
+			return credentialsAdd(ctx, args[1:])
+		case "remove":
+			return credentialsRemove(ctx, args[1:])
+		case "list":
+			return credentialsList(ctx, args[1:])
+		default:
+			return fmt.Errorf("unknown credentials subcommand %q", args[0])
+		}
+	case "help":
+		fmt.Fprint(os.Stdout, usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+// parseConfig parses the proxy configuration flags for the command.
+func parseConfig(ctx context.Context, name string, args []string) (*Config, error) {
+	fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	var cfg Config
+	cfg.RegisterFlags(fs)
+	configFile := fs.String("config", "", "Path to a YAML (or JSON) file of flag values, flags on the command-line (and environment variables) take precedence")
+	printConfig := fs.String("print-config", "", "Print the resolved configuration (secrets redacted) as json or yaml, then exit")
+	fs.Lookup("print-config").NoOptDefVal = "yaml"
+	configSchema := fs.Bool("config-schema", false, "Print the JSON Schema of the configuration file, then exit")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			os.Exit(0)
+		}
+		return nil, err
+	}
+	if err := LoadConfigEnv(fs, os.LookupEnv); err != nil {
+		return nil, fmt.Errorf("LoadConfigEnv failed: %w", err)
+	}
+	if *configFile != "" {
+		if err := LoadConfigFile(fs, *configFile); err != nil {
+			return nil, fmt.Errorf("LoadConfigFile failed: %w", err)
+		}
+	}
+	if cfg.CredentialStore != "" {
+		cipher, err := NewCredentialStoreCipher(ctx, cfg.CredentialKey, cfg.CredentialPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("NewCredentialStoreCipher failed: %w", err)
+		}
+		store, err := LoadCredentialStore(cfg.CredentialStore, cipher)
+		if err != nil {
+			return nil, fmt.Errorf("LoadCredentialStore failed: %w", err)
+		}
+		if err := store.Apply(&cfg); err != nil {
+			return nil, fmt.Errorf("(*CredentialStore).Apply failed: %w", err)
+		}
+	}
+	if err := cfg.ProxyOutbound(); err != nil {
+		return nil, fmt.Errorf("(*Config).ProxyOutbound failed: %w", err)
+	}
+	if *configSchema {
+		if err := PrintConfig(os.Stdout, "json", ConfigSchema(fs)); err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	}
+	if *printConfig != "" {
+		// A dedicated scrubber, only the configured secrets (and well-known secret formats) are redacted.
+		scrubber := &Scrubber{}
+		cfg.RegisterSecrets(scrubber)
+		if err := PrintConfig(os.Stdout, *printConfig, ConfigValues(fs, scrubber)); err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	}
+	return &cfg, nil
+}
+
+// Validate checks the static configuration, every credential (against /rate_limit) and that the storage backend is
+// writable, printing the results. An error is returned if anything failed.
+func Validate(ctx context.Context, cfg *Config, w io.Writer) error {
+	cfg.RegisterSecrets(DefaultScrubber)
+	var failed bool
+	check := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(w, "FAIL %s: %s\n", name, DefaultScrubber.ScrubError(err))
+		} else {
+			fmt.Fprintf(w, "ok   %s\n", name)
+		}
+	}
+
+	proxyURL, err := url.Parse(cfg.APIURL)
+	check("url", err)
+	if cfg.DialPrefer != "" && cfg.DialPrefer != DialPreferIPv4 && cfg.DialPrefer != DialPreferIPv6 {
+		check("dial-prefer", fmt.Errorf("must be %s or %s, got %q", DialPreferIPv4, DialPreferIPv6, cfg.DialPrefer))
+	}
+	for _, raw := range cfg.FailoverURL {
+		_, err := url.Parse(raw)
+		check("failover-url "+raw, err)
+	}
+	_, err = ParseCIDRs(cfg.AllowCIDR)
+	check("allow-cidr", err)
+	_, err = cfg.Listeners()
+	check("listener", err)
+	_, err = ParseCIDRs(cfg.ProxyProtocolTrusted)
+	check("proxy-protocol-trusted-cidr", err)
+	for _, spec := range cfg.FreezeSchedule {
+		_, err := ParseCronWindow(spec)
+		check("freeze-schedule "+spec, err)
+	}
+	for _, spec := range cfg.RouteTimeout {
+		_, err := ParseRouteTimeout(spec)
+		check("route-timeout "+spec, err)
+	}
+	if cfg.UserAgentMode != UserAgentAppend && cfg.UserAgentMode != UserAgentReplace {
+		check("upstream-user-agent-mode", fmt.Errorf("must be %q or %q, got %q", UserAgentAppend, UserAgentReplace, cfg.UserAgentMode))
+	}
+	for _, spec := range cfg.LogRoute {
+		_, err := ParseLogRoute(spec)
+		check("log-route "+spec, err)
+	}
+	if cfg.SLOAvailability < 0 || cfg.SLOAvailability >= 1 {
+		check("slo-availability", fmt.Errorf("must be at least 0 and below 1, got %v", cfg.SLOAvailability))
+	}
+	if cfg.SLOLatencyTarget <= 0 || cfg.SLOLatencyTarget >= 1 {
+		check("slo-latency-target", fmt.Errorf("must be above 0 and below 1, got %v", cfg.SLOLatencyTarget))
+	}
+	if cfg.SLOPeriod < time.Hour {
+		check("slo-period", fmt.Errorf("must be at least 1h, got %v", cfg.SLOPeriod))
+	}
+	for _, spec := range cfg.AcceptRewrite {
+		_, err := ParseAcceptRule(spec)
+		check("accept-rewrite "+spec, err)
+	}
+	for _, spec := range cfg.AuthAppScope {
+		_, err := ParseScopeRule(spec)
+		check("auth-app-scope "+spec, err)
+	}
+	if cfg.HeaderPolicy != "" {
+		check("header-policy", NewHeaderPolicy(false).LoadRoutes(cfg.HeaderPolicy))
+	}
+	if cfg.CredentialOverrides != "" {
+		_, err := LoadOverridePolicy(cfg.CredentialOverrides)
+		check("credential-overrides", err)
+	}
+	if cfg.OpenAPISpec != "" {
+		_, err := LoadOpenAPISpec(ctx, cfg.OpenAPISpec)
+		check("openapi-spec", err)
+	}
+	if cfg.ValidateRequests && cfg.OpenAPISpec == "" {
+		check("validate-requests", errors.New("requires --openapi-spec"))
+	}
+	if cfg.ValidateResponses < 0 || cfg.ValidateResponses > 1 {
+		check("validate-responses", fmt.Errorf("must be between 0 and 1, got %v", cfg.ValidateResponses))
+	} else if cfg.ValidateResponses > 0 && cfg.OpenAPISpec == "" {
+		check("validate-responses", errors.New("requires --openapi-spec"))
+	}
+	if len(cfg.HedgePath) > 0 && cfg.Affinity > 0 {
+		check("hedge-path", errors.New("conflicts with --affinity, a hedge uses another credential than the session"))
+	}
+	if cfg.HedgeBudget < 0 || cfg.HedgeBudget > 1 {
+		check("hedge-budget", fmt.Errorf("must be between 0 and 1, got %v", cfg.HedgeBudget))
+	}
+	if cfg.Sidecar && !loopback(cfg.ListenAddr) {
+		check("sidecar", fmt.Errorf("requires a loopback --listen address, got %q", cfg.ListenAddr))
+	}
+	if cfg.LeaderElection && cfg.CoordinateRedisAddr == "" {
+		check("leader-election", errors.New("requires --coordinate-redis-addr"))
+	}
+	switch cfg.S3KeyHash {
+	case S3KeyHashNever, S3KeyHashLong, S3KeyHashAlways:
+	default:
+		check("s3-key-hash", fmt.Errorf("must be %q, %q or %q, got %q", S3KeyHashNever, S3KeyHashLong, S3KeyHashAlways, cfg.S3KeyHash))
+	}
+	for _, spec := range cfg.S3ReplicateTo {
+		_, err := ParseS3Replica(spec)
+		check("s3-replicate-to "+spec, err)
+	}
+	if cfg.S3ReadThrough != "" {
+		_, err := ParseS3Replica(cfg.S3ReadThrough)
+		check("s3-read-through", err)
+	}
+	if (len(cfg.S3ReplicateTo) > 0 || cfg.S3ReadThrough != "") && cfg.S3Bucket == "" {
+		check("s3-bucket", errors.New("required by --s3-replicate-to and --s3-read-through"))
+	}
+	if cfg.BoltDBPreload && cfg.BoltDBPath == "" {
+		check("bbolt-preload", errors.New("requires --bbolt-db"))
+	}
+	if _, err := NewPolicyShadow(cfg.ShadowPolicy); err != nil {
+		check("shadow-policy", err)
+	}
+	if cfg.MiddlewareDir != "" {
+		check("middleware-dir", LoadMiddlewarePlugins(cfg.MiddlewareDir))
+	}
+	for _, spec := range cfg.Middleware {
+		config, err := ParseMiddleware(spec)
+		if err == nil {
+			if _, ok := middleware.Lookup(config.Name); !ok {
+				err = fmt.Errorf("unknown middleware %q, registered are %v", config.Name, middleware.Names())
+			}
+		}
+		check("middleware "+spec, err)
+	}
+	if len(cfg.Script) > 0 && cfg.ScriptTimeout <= 0 {
+		check("script-timeout", fmt.Errorf("must be positive, got %s", cfg.ScriptTimeout))
+	} else {
+		for _, path := range cfg.Script {
+			_, err := LoadScript(path, cfg.ScriptTimeout)
+			check("script "+path, err)
+		}
+	}
+	if len(cfg.WASMFilter) > 0 && (cfg.WASMTimeout <= 0 || cfg.WASMMemory <= 0) {
+		check("wasm-timeout", fmt.Errorf("requires a positive --wasm-timeout and --wasm-memory, got %s and %d", cfg.WASMTimeout, cfg.WASMMemory))
+	} else {
+		for _, path := range cfg.WASMFilter {
+			filter, err := LoadWASMFilter(ctx, path, cfg.WASMTimeout, cfg.WASMMemory)
+			if err == nil {
+				err = filter.Close(ctx)
+			}
+			check("wasm-filter "+path, err)
+		}
+	}
+	if len(cfg.CacheChunkPath) > 0 && cfg.CacheChunkSize <= 0 {
+		check("cache-chunk-size", fmt.Errorf("must be positive, got %d", cfg.CacheChunkSize))
+	}
+	for _, pattern := range cfg.CacheChunkPath {
+		_, err := path.Match(pattern, "")
+		check("cache-chunk-path "+pattern, err)
+	}
+	if cfg.StorageTimeout > 0 && (cfg.StorageWorkers < 1 || cfg.StorageFailures < 1) {
+		check("storage-timeout", fmt.Errorf("requires a positive --storage-workers and --storage-failures, got %d and %d", cfg.StorageWorkers, cfg.StorageFailures))
+	}
+	for _, interval := range cfg.intervals() {
+		if interval.value <= 0 {
+			check(interval.flag, fmt.Errorf("must be positive, got %s", interval.value))
+		}
+	}
+	if cfg.MetricLabelValues < 0 {
+		check("metric-label-values", fmt.Errorf("must not be negative, got %d", cfg.MetricLabelValues))
+	}
+	for _, raw := range cfg.MeshPeer {
+		_, err := url.Parse(raw)
+		check("mesh-peer "+raw, err)
+	}
+	if len(cfg.MeshPeer) > 0 && cfg.MeshURL == "" {
+		check("mesh-url", errors.New("required by --mesh-peer"))
+	}
+	if len(cfg.MeshPeer) > 0 && cfg.MeshSecret == "" {
+		check("mesh-secret", errors.New("required by --mesh-peer"))
+	}
+	if cfg.AdminListenAddr != "" {
+		_, _, err := net.SplitHostPort(cfg.AdminListenAddr)
+		check("admin-listen", err)
+	}
+	if failed || proxyURL == nil {
+		return errors.New("invalid configuration")
+	}
+
+	storage, closeStorage, err := OpenStorage(ctx, cfg)
+	check("storage", err)
+	if err == nil {
+		defer closeStorage()
+		readiness := &Readiness{Storage: storage}
+		check("storage writable", readiness.probeStorage(ctx))
+	}
+
+	credentials, err := NewCredentials(ctx, cfg, http.DefaultTransport)
+	check("credentials", err)
+	rateLimitURL := proxyURL.ResolveReference(&url.URL{Path: "/rate_limit"})
+	for _, credential := range credentials {
+		check("credential "+credential.Kind+" "+credential.ID, credential.Transport.Limits.Fetch(ctx, credential.Transport, rateLimitURL))
+	}
+
+	if failed {
+		return errors.New("validation failed")
+	}
+	return nil
+}
+
+// adminFlags registers the flags shared by the commands that talk to the admin API of a running proxy.
+func adminFlags(name string) (*pflag.FlagSet, *string, *string) {
+	fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	addr := fs.String("addr", "http://127.0.0.1:44880", "URL of the admin API (--admin-listen) of the running proxy")
+	token := fs.String("token", os.Getenv("GH_PROXY_ADMIN_TOKEN"), "Admin token (--admin-token) of the running proxy")
+	return fs, addr, token
+}
+
+// parseAdminFlags parses the flags, exiting on --help.
+func parseAdminFlags(fs *pflag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			os.Exit(0)
+		}
+		return err
+	}
+	return nil
+}
+
+// adminRequest performs a request against the admin API of the running proxy, decoding the JSON response into v.
+func adminRequest(ctx context.Context, token string, method string, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("(*http.Client).Do failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %d: %s", method, u, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %w", err)
+	}
+	return nil
+}
+
+// cachePurge implements 'cache purge [--addr URL] [prefix...]'.
+func cachePurge(ctx context.Context, args []string) error {
+	fs, addr, token := adminFlags("cache purge")
+	all := fs.Bool("all", false, "Purge every cached response (required if no prefix is given)")
+	if err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+	prefixes := fs.Args()
+	if len(prefixes) == 0 {
+		if !*all {
+			return errors.New("cache purge requires a path prefix or --all")
+		}
+		prefixes = []string{""}
+	}
+	for _, prefix := range prefixes {
+		var result struct {
+			Prefix string `json:"prefix"`
+			Purged int    `json:"purged"`
+		}
+		u := strings.TrimSuffix(*addr, "/") + "/admin/cache?" + url.Values{"prefix": {prefix}}.Encode()
+		if err := adminRequest(ctx, *token, http.MethodDelete, u, &result); err != nil {
+			return err
+		}
+		fmt.Printf("purged %d cached responses under %s\n", result.Purged, result.Prefix)
+	}
+	return nil
+}
+
+// cacheBump implements 'cache bump [--addr URL]'.
+func cacheBump(ctx context.Context, args []string) error {
+	fs, addr, token := adminFlags("cache bump")
+	if err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+	var result struct {
+		Namespace  string `json:"namespace"`
+		Generation int64  `json:"generation"`
+	}
+	if err := adminRequest(ctx, *token, http.MethodPost, strings.TrimSuffix(*addr, "/")+"/admin/cache/namespace", &result); err != nil {
+		return err
+	}
+	fmt.Printf("bumped the cache namespace to generation %d (%s)\n", result.Generation, result.Namespace)
+	return nil
+}
+
+// cacheWarm implements 'cache warm [--addr URL] [path...]', reading the paths from stdin if none are given.
+func cacheWarm(ctx context.Context, args []string) error {
+	fs := pflag.NewFlagSet("cache warm", pflag.ContinueOnError)
+	addr := fs.String("addr", "http://127.0.0.1:44879", "URL of the running proxy")
+	client := fs.String("client", "cache-warm", "Value of the X-Proxy-Client header")
+	if err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+	paths := fs.Args()
+	if len(paths) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				paths = append(paths, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("(*bufio.Scanner).Scan failed: %w", err)
+		}
+	}
+	var failed int
+	for _, p := range paths {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(*addr, "/")+"/"+strings.TrimPrefix(p, "/"), nil)
+		if err != nil {
+			return fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+		}
+		req.Header.Set(ClientHeader, *client)
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %s\n", p, err)
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		state := "miss"
+		if resp.Header.Get(ghtransport.CachedRequestIDHeader) != "" {
+			state = "hit"
+		}
+		if resp.StatusCode != http.StatusOK {
+			failed++
+		}
+		fmt.Printf("%d %-4s %6dms %s\n", resp.StatusCode, state, time.Since(start).Milliseconds(), p)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d paths failed", failed, len(paths))
+	}
+	return nil
+}
+
+// stats implements 'stats [--addr URL] [--json]'.
+func stats(ctx context.Context, args []string) error {
+	fs, addr, token := adminFlags("stats")
+	raw := fs.Bool("json", false, "Print the raw JSON")
+	if err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+	var data DashboardData
+	if err := adminRequest(ctx, *token, http.MethodGet, strings.TrimSuffix(*addr, "/")+"/admin/ui/data", &data); err != nil {
+		return err
+	}
+	if *raw {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(data)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	hitRate := "-"
+	if data.Requests > 0 {
+		hitRate = fmt.Sprintf("%.1f%%", 100*float64(data.Cached)/float64(data.Requests))
+	}
+	fmt.Fprintf(w, "requests\t%d\ncache hit rate\t%s\n\n", data.Requests, hitRate)
+	fmt.Fprintln(w, "CREDENTIAL\tKIND\tRESOURCE\tREMAINING\tRESETS IN")
+	for _, rate := range data.Rates {
+		reset := time.Until(time.Unix(int64(rate.Reset), 0)).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d\t%s\n", rate.Credential, rate.Kind, rate.Resource, rate.Remaining, rate.Limit, max(reset, 0))
+	}
+	fmt.Fprintln(w, "\nMETHOD\tROUTE\tREQUESTS\tCACHED\tERRORS")
+	for _, route := range data.Routes {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", route.Method, route.Route, route.Requests, route.Cached, route.Errors)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// ClientHeader is the (optional) request header used by inbound clients to identify themselves.
+// It is stripped before the request is sent upstream.
+const ClientHeader = "X-Proxy-Client"
+
+type clientKey struct{}
+
+// WithClient returns a copy of the context carrying the inbound client identity.
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFromContext returns the inbound client identity from the context, if any.
+func ClientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// ClientIdentity determines the identity of the inbound client from the ClientHeader,
+// falling back to the IP address of the remote connection.
+func ClientIdentity(req *http.Request) string {
+	if client := req.Header.Get(ClientHeader); client != "" {
+		return client
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// ClientHandler stores the inbound client identity in the request context for use by the transports.
+type ClientHandler struct {
+	Handler http.Handler
+}
+
+func (h *ClientHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req = req.WithContext(WithClient(req.Context(), ClientIdentity(req)))
+	req.Header.Del(ClientHeader)
+	h.Handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ClockSkew = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "clock_skew_seconds",
+		Subsystem: "github",
+		Help:      "Measured offset of the upstream clock (via the Date header) relative to the local clock",
+	})
+)
+
+// skewWeight is the weight of each new sample in the exponentially weighted moving average.
+const skewWeight = 0.1
+
+var (
+	// skewMu serializes the samples, the skew itself is read without locking (on every credential selection).
+	skewMu      sync.Mutex
+	skew        atomic.Int64
+	skewSampled bool
+)
+
+// UpstreamNow returns the current time according to the upstream's clock.
+// All rate-limit reset math should use this instead of time.Now so clock skew does not cause premature unblocking.
+func UpstreamNow() time.Time {
+	return time.Now().Add(time.Duration(skew.Load()))
+}
+
+// observeSkew records a sample of the upstream clock, the upstream time was observed at the local time.
+func observeSkew(upstream time.Time, local time.Time) {
+	sample := upstream.Sub(local)
+	skewMu.Lock()
+	defer skewMu.Unlock()
+	current := time.Duration(skew.Load())
+	if skewSampled {
+		current += time.Duration(skewWeight * float64(sample-current))
+	} else {
+		current = sample
+		skewSampled = true
+	}
+	skew.Store(int64(current))
+	ClockSkew.Set(current.Seconds())
+}
+
+// SkewTransport measures the clock skew relative to the upstream using the Date header of each response.
+// It must wrap the transport performing the actual upstream requests so cached responses are not sampled.
+type SkewTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *SkewTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		end := time.Now()
+		// The Date header is truncated to the second, so assume it was generated halfway through that second,
+		// and compare it to the midpoint of the local request (assuming symmetric latency).
+		observeSkew(date.Add(500*time.Millisecond), start.Add(end.Sub(start)/2))
+	}
+	return resp, nil
+}
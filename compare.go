@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	CompareRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "compare_requests_total",
+		Subsystem: "github",
+		Help:      "Number of responses compared against the secondary upstream by result (match, differ, error, dropped)",
+	}, []string{"result"})
+)
+
+const (
+	// maxCompareBody is the maximum size of a response body that is compared, larger responses are skipped.
+	maxCompareBody = 8 << 20
+	// maxCompareDiffs is the maximum number of differences recorded per response.
+	maxCompareDiffs = 100
+	// compareTimeout bounds the request to the secondary upstream.
+	compareTimeout = 30 * time.Second
+)
+
+// CompareDiff is a structural difference between the JSON responses, at the JSON pointer Path.
+type CompareDiff struct {
+	Path      string `json:"path"`
+	Primary   any    `json:"primary"`
+	Secondary any    `json:"secondary"`
+}
+
+// CompareRecord is the result of comparing a response of the primary upstream to that of the secondary upstream.
+type CompareRecord struct {
+	Time            time.Time     `json:"time"`
+	Method          string        `json:"method"`
+	Path            string        `json:"path"`
+	PrimaryStatus   int           `json:"primary_status"`
+	SecondaryStatus int           `json:"secondary_status,omitempty"`
+	Diffs           []CompareDiff `json:"diffs,omitempty"`
+	Truncated       bool          `json:"truncated,omitempty"`
+	Error           string        `json:"error,omitempty"`
+}
+
+// jsonMediaType reports if the response is JSON, only JSON responses are compared structurally.
+func jsonMediaType(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// CompareTransport sends the safe (GET) requests to a secondary upstream as well (ex: the GitHub Enterprise Server
+// being migrated to), always returning the response of the primary upstream. The JSON responses are compared in the
+// background and the structural differences recorded, so the migration can be validated against real traffic.
+type CompareTransport struct {
+	Base http.RoundTripper
+	// Primary and Secondary are the base URLs of the upstreams, the requests are rebased from one to the other and the
+	// Secondary URL in the string values of its responses is replaced with the Primary URL before comparing.
+	Primary   *url.URL
+	Secondary *url.URL
+	// Transport sends the requests to the secondary upstream.
+	Transport http.RoundTripper
+	// Token (optional) authenticates the requests to the secondary upstream, otherwise they are sent as the client's.
+	Token string
+	// Ignore are the object keys never compared (ex: "node_id" which differs across instances).
+	Ignore []string
+	// Sample is the fraction of the requests compared.
+	Sample float64
+	// Log (optional) receives every differing CompareRecord as a line of JSON.
+	Log io.Writer
+
+	mu  sync.Mutex
+	sem chan struct{}
+}
+
+// NewCompareTransport returns a CompareTransport comparing at most concurrency responses at a time, additional
+// responses are not compared rather than queueing the requests to the secondary upstream.
+func NewCompareTransport(base http.RoundTripper, primary, secondary *url.URL, concurrency int) *CompareTransport {
+	return &CompareTransport{
+		Base:      base,
+		Primary:   primary,
+		Secondary: secondary,
+		Transport: http.DefaultTransport,
+		Sample:    1,
+		sem:       make(chan struct{}, max(concurrency, 1)),
+	}
+}
+
+// secondaryRequest rebases the request onto the secondary upstream, it is never conditional so the full response can
+// be compared.
+func (t *CompareTransport) secondaryRequest(req *http.Request) *http.Request {
+	secondary := req.Clone(context.WithoutCancel(req.Context()))
+	path := strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(t.Primary.Path, "/"))
+	secondary.URL = t.Secondary.JoinPath(path)
+	secondary.URL.RawQuery = req.URL.RawQuery
+	secondary.Host = ""
+	secondary.Header.Del("If-None-Match")
+	secondary.Header.Del("If-Modified-Since")
+	if t.Token != "" {
+		secondary.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+	return secondary
+}
+
+// diff appends the structural differences between the JSON values at the path, up to maxCompareDiffs.
+func (t *CompareTransport) diff(path string, primary, secondary any, diffs *[]CompareDiff) bool {
+	if len(*diffs) >= maxCompareDiffs {
+		return false
+	}
+	switch p := primary.(type) {
+	case map[string]any:
+		if s, ok := secondary.(map[string]any); ok {
+			keys := slices.Sorted(maps.Keys(p))
+			for key := range s {
+				if _, ok := p[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			for _, key := range keys {
+				if slices.Contains(t.Ignore, key) {
+					continue
+				}
+				escaped := strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+				if !t.diff(path+"/"+escaped, p[key], s[key], diffs) {
+					return false
+				}
+			}
+			return true
+		}
+	case []any:
+		if s, ok := secondary.([]any); ok {
+			for idx := range max(len(p), len(s)) {
+				var pv, sv any
+				if idx < len(p) {
+					pv = p[idx]
+				}
+				if idx < len(s) {
+					sv = s[idx]
+				}
+				if !t.diff(path+"/"+strconv.Itoa(idx), pv, sv, diffs) {
+					return false
+				}
+			}
+			return true
+		}
+	case string:
+		if s, ok := secondary.(string); ok {
+			base := strings.TrimSuffix(t.Secondary.String(), "/")
+			if p == strings.ReplaceAll(s, base, strings.TrimSuffix(t.Primary.String(), "/")) {
+				return true
+			}
+		}
+	default:
+		if primary == secondary {
+			return true
+		}
+	}
+	*diffs = append(*diffs, CompareDiff{Path: path, Primary: primary, Secondary: secondary})
+	return true
+}
+
+// compare sends the request to the secondary upstream and compares its response to the body of the primary response.
+func (t *CompareTransport) compare(req *http.Request, path string, status int, body []byte) {
+	ctx, cancel := context.WithTimeout(req.Context(), compareTimeout)
+	defer cancel()
+	record := CompareRecord{Time: time.Now(), Method: req.Method, Path: path, PrimaryStatus: status}
+	result := t.record(req.WithContext(ctx), &record, body)
+	CompareRequests.WithLabelValues(result).Inc()
+	if result == "match" {
+		return
+	}
+	log.Warn().Str("path", record.Path).Int("primary_status", record.PrimaryStatus).Int("secondary_status", record.SecondaryStatus).Int("diffs", len(record.Diffs)).Str("error", record.Error).Msg("secondary upstream response differs")
+	if t.Log == nil {
+		return
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		log.Error().Err(err).Msg("json.Marshal failed")
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.Log.Write(append(b, '\n')); err != nil {
+		log.Error().Err(err).Msg("(io.Writer).Write failed")
+	}
+}
+
+// record fills the record with the comparison of the responses, returning the result.
+func (t *CompareTransport) record(req *http.Request, record *CompareRecord, body []byte) string {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil {
+		record.Error = DefaultScrubber.ScrubError(err).Error()
+		return "error"
+	}
+	defer resp.Body.Close()
+	record.SecondaryStatus = resp.StatusCode
+	secondaryBody, err := io.ReadAll(io.LimitReader(resp.Body, maxCompareBody+1))
+	if err != nil {
+		record.Error = DefaultScrubber.ScrubError(err).Error()
+		return "error"
+	}
+	if resp.StatusCode != record.PrimaryStatus {
+		return "differ"
+	}
+	var primary, secondary any
+	if err := json.Unmarshal(body, &primary); err != nil {
+		record.Error = fmt.Sprintf("invalid primary JSON: %s", err)
+		return "error"
+	}
+	if err := json.Unmarshal(secondaryBody, &secondary); err != nil {
+		record.Error = fmt.Sprintf("invalid secondary JSON: %s", err)
+		return "differ"
+	}
+	record.Truncated = !t.diff("", primary, secondary, &record.Diffs)
+	if len(record.Diffs) == 0 {
+		return "match"
+	}
+	return "differ"
+}
+
+// compareBody captures the body of the primary response as it is read by the client, once it is closed done is called
+// with the body and if it was complete (read to EOF without exceeding the limit, maxCompareBody if zero).
+type compareBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	read     int64
+	limit    int
+	eof      bool
+	tooLarge bool
+	done     func(body []byte, complete bool)
+	once     sync.Once
+}
+
+func (b *compareBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if !b.tooLarge {
+		if limit := cmp.Or(b.limit, maxCompareBody); b.buf.Len()+n > limit {
+			b.tooLarge = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *compareBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.done(b.buf.Bytes(), b.eof && !b.tooLarge)
+	})
+	return err
+}
+
+func (t *CompareTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || (t.Sample < 1 && rand.Float64() >= t.Sample) {
+		return t.Base.RoundTrip(req)
+	}
+	secondary := t.secondaryRequest(req)
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || !jsonMediaType(resp.Header) || resp.ContentLength > maxCompareBody {
+		return resp, err
+	}
+	select {
+	case t.sem <- struct{}{}:
+	default:
+		CompareRequests.WithLabelValues("dropped").Inc()
+		return resp, nil
+	}
+	status := resp.StatusCode
+	body := &compareBody{ReadCloser: resp.Body}
+	body.done = func(b []byte, complete bool) {
+		if !complete {
+			<-t.sem // The client did not read the entire body (or it was too large), it cannot be compared
+			return
+		}
+		go func() {
+			defer func() { <-t.sem }()
+			t.compare(secondary, req.URL.RequestURI(), status, b)
+		}()
+	}
+	resp.Body = body
+	return resp, nil
+}
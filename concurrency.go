@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	UpstreamInflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "upstream_inflight",
+		Subsystem: "github",
+		Help:      "Number of requests currently in-flight to the upstream",
+	})
+	UpstreamQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "upstream_queue_depth",
+		Subsystem: "github",
+		Help:      "Number of requests waiting for an in-flight slot to the upstream",
+	})
+	UpstreamQueueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:      "upstream_queue_wait_seconds",
+		Subsystem: "github",
+		Help:      "Time spent waiting for an in-flight slot to the upstream",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	UpstreamRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name:      "upstream_rejected_total",
+		Subsystem: "github",
+		Help:      "Number of requests rejected because the upstream wait queue was full",
+	})
+)
+
+// ConcurrencyTransport limits the number of in-flight requests to the Base transport.
+// Requests beyond the limit wait in a bounded queue, once the queue is full they are rejected with a 503.
+type ConcurrencyTransport struct {
+	Base http.RoundTripper
+	// Queue is the maximum number of requests waiting for an in-flight slot.
+	Queue int64
+	// RetryAfter is the value of the Retry-After header for rejected requests.
+	RetryAfter time.Duration
+
+	slots  chan struct{}
+	queued atomic.Int64
+}
+
+// NewConcurrencyTransport creates a ConcurrencyTransport allowing limit in-flight requests.
+func NewConcurrencyTransport(base http.RoundTripper, limit int, queue int, retryAfter time.Duration) *ConcurrencyTransport {
+	return &ConcurrencyTransport{
+		Base:       base,
+		Queue:      int64(queue),
+		RetryAfter: retryAfter,
+		slots:      make(chan struct{}, limit),
+	}
+}
+
+func (t *ConcurrencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		// No slot is immediately available, join the queue (if there is room).
+		if t.queued.Add(1) > t.Queue {
+			t.queued.Add(-1)
+			UpstreamRejected.Inc()
+			return t.reject(req), nil
+		}
+		UpstreamQueueDepth.Inc()
+		start := time.Now()
+		select {
+		case t.slots <- struct{}{}:
+		case <-req.Context().Done():
+			t.queued.Add(-1)
+			UpstreamQueueDepth.Dec()
+			return nil, req.Context().Err()
+		}
+		t.queued.Add(-1)
+		UpstreamQueueDepth.Dec()
+		UpstreamQueueWait.Observe(time.Since(start).Seconds())
+	}
+	UpstreamInflight.Inc()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			UpstreamInflight.Dec()
+			<-t.slots
+		})
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || resp.Body == nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		// Upgraded connections (ex: WebSocket) are long-lived and must retain their writable body.
+		release()
+		return resp, err
+	}
+	// The slot is held until the response body has been fully consumed/closed.
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// reject builds the 503 response for a request that could not be queued.
+func (t *ConcurrencyTransport) reject(req *http.Request) *http.Response {
+	resp := ProxyResponse(req, http.StatusServiceUnavailable, ReasonQueueFull, "Too many concurrent requests to the upstream, retry later")
+	if t.RetryAfter > 0 {
+		resp.Header.Set("Retry-After", strconv.Itoa(int(t.RetryAfter.Round(time.Second)/time.Second)))
+	}
+	return resp
+}
+
+// releaseBody calls release once the body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
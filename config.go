@@ -0,0 +1,441 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Config is the configuration of the proxy, populated from the command-line flags.
+type Config struct {
+	APIURL                string
+	FailoverURL           []string
+	UpstreamSOCKS5        string
+	UpstreamUserAgent     string
+	UserAgentMode         string
+	HealthInterval        time.Duration
+	ListenAddr            string
+	AdminListenAddr       string
+	AdminToken            string
+	Sidecar               bool
+	TLSCert               string
+	TLSKey                string
+	Listener              []string
+	ReadTimeout           time.Duration
+	ReadHeaderTimeout     time.Duration
+	WriteTimeout          time.Duration
+	IdleTimeout           time.Duration
+	MaxConnsPerIP         int
+	ResponseHeaderTimeout time.Duration
+	DNSRefresh            time.Duration
+	DialPrefer            string
+	DialFallbackDelay     time.Duration
+	Timeout               time.Duration
+	RouteTimeout          []string
+	SLOAvailability       float64
+	SLOLatency            time.Duration
+	SLOLatencyTarget      float64
+	SLOPeriod             time.Duration
+	LogRoute              []string
+	AllowCIDR             []string
+	ProxyProtocol         bool
+	ProxyProtocolTrusted  []string
+	PebbleDBPath          string
+	BoltDBPath            string
+	BoltDBBucket          string
+	BoltDBPreload         bool
+	S3Bucket              string
+	S3Region              string
+	S3Endpoint            string
+	S3Prefix              string
+	S3SSEKMSKeyID         string
+	S3ObjectTags          []string
+	S3KeyHash             string
+	S3ReplicateTo         []string
+	S3ReadThrough         string
+	S3ReplicationQueue    int
+	RedisAddr             string
+	RedisUsername         string
+	RedisPassword         string
+	RedisDB               int
+	StorageTimeout        time.Duration
+	StorageWorkers        int
+	StorageFailures       int
+	StorageCooldown       time.Duration
+	CoordinateRedisAddr   string
+	CoordinatePrefix      string
+	CoordinateInterval    time.Duration
+	LeaderElection        bool
+	MeshPeer              []string
+	MeshURL               string
+	MeshSecret            string
+	MeshInterval          time.Duration
+	MeshKeys              int
+	CacheVary             []string
+	CacheMaxBody          int64
+	CacheChunkPath        []string
+	CacheChunkSize        int64
+	CacheEncryptionKey    []string
+	CacheRejectPlaintext  bool
+	CacheMemoryBudget     int64
+	CacheNamespace        string
+	CacheNamespaceRefresh time.Duration
+	CacheFreshness        bool
+	NegativeCacheTTL      time.Duration
+	GraphQLPersisted      bool
+	GraphQLCacheTTL       time.Duration
+	GraphQLMaxCost        int
+	GraphQLRESTFallback   bool
+	NegativeCacheStatus   []int
+	HeaderAllow           []string
+	HeaderDeny            []string
+	HeaderPolicy          string
+	AuthPassthrough       bool
+	AuthOAuth             []string
+	AuthApp               []string
+	AuthAppScope          []string
+	CredentialStore       string
+	CredentialKey         string
+	CredentialPassphrase  string
+	TokenExpiryWarning    time.Duration
+	AuthToken             []string
+	MaxInflight           int
+	MaxQueue              int
+	QueueRetryAfter       time.Duration
+	RPH                   int
+	Adaptive              bool
+	BudgetHeader          bool
+	AdaptiveBurst         int
+	AdaptiveMaxWait       time.Duration
+	WriteRPM              int
+	WriteConcurrency      int
+	WriteRevalidate       bool
+	WriteInvalidate       bool
+	WriteInvalidateSkip   []string
+	Freeze                bool
+	FreezeSchedule        []string
+	FreezeQueue           bool
+	ScrubResponses        bool
+	RateInterval          time.Duration
+	RateJitter            float64
+	DeprecationInterval   time.Duration
+	UsageWindow           time.Duration
+	UsageRetention        int
+	UsageUserAgents       int
+	MetricLabelValues     int
+	OpenAPISpec           string
+	CoverageInterval      time.Duration
+	ValidateRequests      bool
+	ValidateResponses     float64
+	TeamReport            string
+	Tenants               string
+	CredentialOverrides   string
+	Affinity              time.Duration
+	AffinityHeader        string
+	PaginationSnapshot    time.Duration
+	SnapshotPages         int
+	SignKey               string
+	TeamReportInterval    time.Duration
+	StreamPath            []string
+	HedgePath             []string
+	HedgeBudget           float64
+	HedgeMinDelay         time.Duration
+	ReadyCredentials      int
+	StartupTimeout        time.Duration
+	APIVersion            string
+	NormalizeAccept       bool
+	AcceptRewrite         []string
+	CompareURL            string
+	CompareAuthToken      string
+	CompareSample         float64
+	CompareIgnore         []string
+	CompareLog            string
+	CompareConcurrency    int
+	BulkConcurrency       int
+	Delta                 bool
+	IdempotencyTTL        time.Duration
+	AnomalyDetection      bool
+	AnomalyRateFactor     float64
+	AnomalyMinRate        int
+	AnomalyEndpoint       []string
+	AnomalyWebhook        string
+	AnomalyBlock          time.Duration
+	AlertWebhook          string
+	AlertQuota            float64
+	AlertFailures         int
+	AlertCooldown         time.Duration
+	EventsInterval        time.Duration
+	WebhookSecret         string
+	Jobs                  bool
+	JobsMax               int
+	JobsWorkers           int
+	JobsRetries           int
+	JobsReserve           int
+	Reservations          bool
+	RateLimitOverride     bool
+	ShadowPolicy          []string
+	Middleware            []string
+	MiddlewareDir         string
+	Script                []string
+	ScriptTimeout         time.Duration
+	WASMFilter            []string
+	WASMTimeout           time.Duration
+	WASMMemory            int
+	GRPCListenAddr        string
+	GRPCTLSCert           string
+	GRPCTLSKey            string
+	GRPCClientCA          string
+}
+
+// RegisterFlags registers the configuration flags (and their defaults) on the flag set.
+func (c *Config) RegisterFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.APIURL, "url", "https://api.github.com/", "GitHub API URL")
+	fs.StringSliceVar(&c.FailoverURL, "failover-url", nil, "GitHub API URLs (ex: of the replicas of a GitHub Enterprise Server) to fail over to in order if --url is unhealthy")
+	fs.StringVar(&c.UpstreamSOCKS5, "upstream-socks5", "", "SOCKS5 proxy (socks5://[user:password@]host:port) of every outbound connection: the API, webhooks, S3, KMS and Redis")
+	fs.StringVar(&c.UpstreamUserAgent, "upstream-user-agent", "", "User-Agent identifying the proxy to the upstream, ex: 'our-proxy/1.2 (+https://wiki.company.com/github-proxy)'")
+	fs.StringVar(&c.UserAgentMode, "upstream-user-agent-mode", UserAgentAppend, "Whether the --upstream-user-agent is appended to the User-Agent of the client ('append') or replaces it ('replace')")
+	fs.DurationVar(&c.HealthInterval, "health-interval", 30*time.Second, "Interval for the health checks of --url and the --failover-url upstreams")
+	fs.StringVar(&c.ListenAddr, "listen", "127.0.0.1:44879", "Address to listen on")
+	fs.StringVar(&c.AdminListenAddr, "admin-listen", "127.0.0.1:44880", "Address to serve the admin API (/admin/*) on, never served on the --listen addresses (empty to disable it)")
+	fs.StringVar(&c.AdminToken, "admin-token", "", "Bearer token required by the admin API (Authorization header)")
+	fs.BoolVar(&c.Sidecar, "sidecar", false, "Run as a per-pod sidecar: localhost-only listener, in-memory cache (with --redis-addr as a shared tier) and the /env endpoint")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "TLS certificate file to use")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "TLS key file to use")
+	fs.StringArrayVar(&c.Listener, "listener", nil, "Additional address to serve on in the format '<addr>[,cert=<path>,key=<path>][,proxy-protocol]', ex: '0.0.0.0:8443,cert=tls.crt,key=tls.key'")
+	fs.StringVar(&c.GRPCListenAddr, "grpc-listen", "", "Address to serve the gRPC control-plane API on (requires the --grpc-tls-* flags)")
+	fs.StringVar(&c.GRPCTLSCert, "grpc-tls-cert", "", "TLS certificate file of the gRPC control-plane API")
+	fs.StringVar(&c.GRPCTLSKey, "grpc-tls-key", "", "TLS key file of the gRPC control-plane API")
+	fs.StringVar(&c.GRPCClientCA, "grpc-client-ca", "", "CA certificate file used to verify the client certificates of the gRPC control-plane API")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 0, "Maximum duration for reading an entire inbound request, including the body (0 for none)")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "Maximum duration for reading the inbound request headers (0 for --read-timeout)")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 0, "Maximum duration before timing out writes of the response, also bounds streams (0 for none)")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 2*time.Minute, "Maximum duration to wait for the next request on a keep-alive connection (0 for --read-timeout)")
+	fs.IntVar(&c.MaxConnsPerIP, "max-conns-per-ip", 0, "Maximum concurrent inbound connections from a single source IP (0 for unlimited)")
+	fs.BoolVar(&c.GraphQLRESTFallback, "graphql-rest-fallback", false, "Answer simple GraphQL repository queries (metadata, default branch, latest release) from the cached REST responses")
+	fs.DurationVar(&c.ResponseHeaderTimeout, "response-header-timeout", 0, "Maximum duration to wait for the upstream response headers (0 for none)")
+	fs.DurationVar(&c.DNSRefresh, "dns-refresh", 0, "Interval for re-resolving the upstream hosts, closing the idle connections once their addresses change (0 to resolve on each dial)")
+	fs.StringVar(&c.DialPrefer, "dial-prefer", "", "Address family dialed first for the upstream hosts: ipv4 or ipv6 (defaults to the resolver order)")
+	fs.DurationVar(&c.DialFallbackDelay, "dial-fallback-delay", 300*time.Millisecond, "Delay before dialing the next resolved address of an upstream host if the previous has not connected (negative to dial them one after the other)")
+	fs.DurationVar(&c.Timeout, "timeout", 0, "Overall deadline for each proxied request (0 for none)")
+	fs.StringArrayVar(&c.RouteTimeout, "route-timeout", nil, "Overall deadline for a path prefix in the format '<prefix>=<duration>', ex: '/search/=10s'")
+	fs.StringArrayVar(&c.LogRoute, "log-route", nil, "Logging of the requests to a path prefix in the format '<prefix>=<level>[,sample=<n>][,body-on-error]', ex: '/repos/=info,sample=100,body-on-error' (adjustable via the /admin/log-routes API)")
+	fs.Float64Var(&c.SLOAvailability, "slo-availability", 0, "Availability objective, the target fraction of the requests answered without a server error (ex: 0.999, 0 to disable)")
+	fs.DurationVar(&c.SLOLatency, "slo-latency", 0, "Latency objective, the threshold of the time to the response headers of a good request (ex: 500ms, 0 to disable)")
+	fs.Float64Var(&c.SLOLatencyTarget, "slo-latency-target", 0.99, "Target fraction of the requests faster than --slo-latency")
+	fs.DurationVar(&c.SLOPeriod, "slo-period", 30*24*time.Hour, "Period of the --slo-availability and --slo-latency objectives the error budgets are computed over")
+	fs.StringSliceVar(&c.AllowCIDR, "allow-cidr", nil, "Source networks (CIDRs) allowed to use the proxy (default all)")
+	fs.BoolVar(&c.ProxyProtocol, "proxy-protocol", false, "Read the PROXY protocol (v1 or v2) header of the connections to --listen for the real client address")
+	fs.StringSliceVar(&c.ProxyProtocolTrusted, "proxy-protocol-trusted-cidr", nil, "Source networks (CIDRs) of the load balancers sending the PROXY protocol header (default all)")
+	fs.StringVar(&c.PebbleDBPath, "pebble-db", "", "Path to PebbleDB to use for caching")
+	fs.StringVar(&c.BoltDBPath, "bbolt-db", "", "Path to BoltDB to use for caching")
+	fs.StringVar(&c.BoltDBBucket, "bbolt-bucket", "github-api-proxy", "BoltDB bucket to use for caching")
+	fs.BoolVar(&c.BoltDBPreload, "bbolt-preload", false, "Read the --bbolt-db file into the page cache in the background at startup, so the first cache hits are not penalized")
+	fs.StringVar(&c.S3Bucket, "s3-bucket", "", "S3 bucket to use")
+	fs.StringVar(&c.S3Region, "s3-region", "", "S3 region to use")
+	fs.StringVar(&c.S3Endpoint, "s3-endpoint", "", "S3 endpoint to use")
+	fs.StringVar(&c.S3Prefix, "s3-prefix", "", "S3 prefix to use")
+	fs.StringVar(&c.S3SSEKMSKeyID, "s3-sse-kms-key-id", "", "KMS key (ID, alias or ARN) used to encrypt cached S3 objects with SSE-KMS")
+	fs.StringSliceVar(&c.S3ObjectTags, "s3-object-tags", nil, "Tags (key=value) applied to every cached S3 object")
+	fs.StringVar(&c.S3KeyHash, "s3-key-hash", S3KeyHashNever, "Whether the S3 keys are the SHA-256 of their URL: never, long (only those exceeding the S3 key limit) or always (spreading them across the bucket)")
+	fs.StringSliceVar(&c.S3ReplicateTo, "s3-replicate-to", nil, "S3 buckets (<region>=<bucket>) of the peer regions the cached responses are asynchronously replicated to")
+	fs.StringVar(&c.S3ReadThrough, "s3-read-through", "", "S3 bucket (<region>=<bucket>) of the primary region the misses of --s3-bucket are read through from")
+	fs.IntVar(&c.S3ReplicationQueue, "s3-replication-queue", DefaultReplicationQueue, "Maximum number of cached responses pending replication to each of the --s3-replicate-to regions")
+	fs.StringVar(&c.RedisAddr, "redis-addr", "", "Redis address to use")
+	fs.StringVar(&c.RedisUsername, "redis-username", "", "Redis username to use")
+	fs.StringVar(&c.RedisPassword, "redis-password", "", "Redis password to use")
+	fs.IntVar(&c.RedisDB, "redis-db", 0, "Redis database to use")
+	fs.DurationVar(&c.StorageTimeout, "storage-timeout", 0, "Timeout of each operation of the S3 or Redis storage, enables its worker pool and circuit breaker (0 to disable)")
+	fs.IntVar(&c.StorageWorkers, "storage-workers", DefaultStorageWorkers, "Number of workers performing the operations of the --storage-timeout storage")
+	fs.IntVar(&c.StorageFailures, "storage-failures", DefaultStorageFailures, "Consecutive failed operations of the --storage-timeout storage before the cache is skipped")
+	fs.DurationVar(&c.StorageCooldown, "storage-cooldown", DefaultStorageCooldown, "Duration the cache is skipped for once the --storage-timeout storage is degraded, before it is probed again")
+	fs.StringVar(&c.CoordinateRedisAddr, "coordinate-redis-addr", "", "Redis address used to share rate-limits between replicas (uses the --redis-* credentials)")
+	fs.StringVar(&c.CoordinatePrefix, "coordinate-prefix", "github-api-proxy:", "Redis key prefix used to share rate-limits between replicas")
+	fs.DurationVar(&c.CoordinateInterval, "coordinate-interval", 5*time.Second, "Interval for sharing rate-limits between replicas")
+	fs.BoolVar(&c.LeaderElection, "leader-election", false, "Only poll the rate-limits from the elected leader replica (requires --coordinate-redis-addr)")
+	fs.StringSliceVar(&c.MeshPeer, "mesh-peer", nil, "URLs of the other replicas to share the cached responses with (requires --mesh-url)")
+	fs.StringVar(&c.MeshURL, "mesh-url", "", "URL this replica is reachable at by the --mesh-peer replicas, ex: http://10.0.0.1:44879")
+	fs.StringVar(&c.MeshSecret, "mesh-secret", "", "Secret authenticating the --mesh-peer replicas to each other (X-Proxy-Mesh-Secret header, required by --mesh-peer)")
+	fs.DurationVar(&c.MeshInterval, "mesh-interval", DefaultMeshInterval, "Interval to advertise the recently cached keys to the --mesh-peer replicas")
+	fs.IntVar(&c.MeshKeys, "mesh-keys", DefaultMeshKeys, "Maximum number of keys advertised by the --mesh-peer replicas to remember")
+	fs.StringSliceVar(&c.CacheVary, "cache-vary", nil, "Additional request headers to incorporate into the cache key")
+	fs.StringVar(&c.CacheNamespace, "cache-namespace", "", "Namespace incorporated into every cache key, changing it invalidates the entire cache")
+	fs.DurationVar(&c.CacheNamespaceRefresh, "cache-namespace-refresh", 10*time.Second, "Interval to reload the cache namespace generation, to pick up bumps by other replicas")
+	fs.Int64Var(&c.CacheMemoryBudget, "cache-memory-budget", 0, "Maximum size in bytes of the in-memory cache (0 for unlimited)")
+	fs.BoolVar(&c.CacheFreshness, "cache-freshness", false, "Serve cached responses that are fresh per the upstream Cache-Control (or Expires) without revalidating them")
+	fs.DurationVar(&c.NegativeCacheTTL, "negative-cache-ttl", 0, "Duration to cache negative (ex: 404) responses for, bypassed by the X-Proxy-Cache-Bypass header (0 to disable)")
+	fs.BoolVar(&c.GraphQLPersisted, "graphql-persisted-queries", false, "Support persisted GraphQL queries (the Apollo automatic persisted queries protocol)")
+	fs.DurationVar(&c.GraphQLCacheTTL, "graphql-cache-ttl", 0, "Duration to cache the results of read-only GraphQL queries for (0 to disable)")
+	fs.IntVar(&c.GraphQLMaxCost, "graphql-max-cost", 0, "Maximum estimated cost (in points) of a GraphQL query without the X-Proxy-Priority header (0 for unlimited)")
+	fs.IntSliceVar(&c.NegativeCacheStatus, "negative-cache-status", DefaultNegativeStatuses, "Response statuses cached by --negative-cache-ttl")
+	fs.Int64Var(&c.CacheMaxBody, "cache-max-body", 0, "Maximum size in bytes of a cached response body (0 for unlimited)")
+	fs.StringSliceVar(&c.CacheChunkPath, "cache-chunk-path", nil, "Path patterns (ex: '/repos/*/*/tarball/*') whose (very large) responses are cached as chunks, serving the Range requests of the clients from the cache")
+	fs.Int64Var(&c.CacheChunkSize, "cache-chunk-size", DefaultCacheChunkSize, "Size in bytes of the chunks of the --cache-chunk-path responses")
+	fs.StringSliceVar(&c.CacheEncryptionKey, "cache-encryption-key", nil, "AES-256 key used to encrypt cached responses, as a file path or 'kms:' followed by the path of a KMS-encrypted data key (the first key encrypts, the rest only decrypt)")
+	fs.BoolVar(&c.CacheRejectPlaintext, "cache-encryption-reject-plaintext", false, "Treat cached responses stored as plaintext as cache misses instead of re-encrypting them")
+	fs.StringSliceVar(&c.HeaderAllow, "header-allow", nil, "Additional request headers forwarded upstream (supports a trailing '*' wildcard)")
+	fs.StringSliceVar(&c.HeaderDeny, "header-deny", nil, "Additional response headers stripped before they are returned to the client")
+	fs.StringVar(&c.HeaderPolicy, "header-policy", "", "Path to a JSON file of per-route header policies")
+	fs.BoolVar(&c.AuthPassthrough, "auth-passthrough", false, "Forward the client's Authorization header upstream (always enabled without credentials)")
+	fs.StringSliceVar(&c.AuthOAuth, "auth-oauth", nil, "OAuth clients for GitHub API authentication in the format 'client_id:client_secret'")
+	fs.StringSliceVar(&c.AuthApp, "auth-app", nil, "GitHub App clients for GitHub API authentication in the format 'app_id:installation_id:private_key'")
+	fs.StringArrayVar(&c.AuthAppScope, "auth-app-scope", nil, "Scope the GitHub App installation tokens of a route to the repository of the path, in the format '<method> <route>=<permission>:<level>[,...]'")
+	fs.StringSliceVar(&c.AuthToken, "auth-token", nil, "GitHub personal access tokens for GitHub API authentication")
+	fs.StringVar(&c.CredentialStore, "credential-store", "", "Path of a credential store file (see the login command) loaded in addition to the --auth-* flags and watched for changes")
+	fs.StringVar(&c.CredentialKey, "credential-store-key", "", "AES-256 key encrypting the --credential-store, as a file path or 'kms:' followed by the path of a KMS-encrypted data key")
+	fs.StringVar(&c.CredentialPassphrase, "credential-store-passphrase", "", "Passphrase encrypting the --credential-store (instead of --credential-store-key)")
+	fs.DurationVar(&c.TokenExpiryWarning, "token-expiry-warning", 7*24*time.Hour, "Warn (daily) about the personal access tokens expiring within this duration")
+	fs.IntVar(&c.MaxInflight, "max-inflight", 0, "Maximum number of in-flight requests to the upstream (0 for unlimited)")
+	fs.IntVar(&c.MaxQueue, "max-queue", 100, "Maximum number of requests waiting for an in-flight slot before rejecting with a 503")
+	fs.DurationVar(&c.QueueRetryAfter, "queue-retry-after", 5*time.Second, "Retry-After for requests rejected because the wait queue is full")
+	fs.IntVar(&c.RPH, "rph", 0, "maximum requests per hour (per authentication token)")
+	fs.BoolVar(&c.BudgetHeader, "budget-header", false, "Set the X-Proxy-Budget-Remaining-Pages header on paginated responses with the number of requests the pool can still afford")
+	fs.BoolVar(&c.Adaptive, "adaptive", false, "Pace requests to spread the remaining rate-limit evenly until the reset (per authentication token)")
+	fs.IntVar(&c.AdaptiveBurst, "adaptive-burst", 10, "Burst size for the adaptive rate-limiter")
+	fs.DurationVar(&c.AdaptiveMaxWait, "adaptive-max-wait", 30*time.Second, "Maximum time the adaptive rate-limiter will delay a single request")
+	fs.IntVar(&c.WriteRPM, "write-rpm", 0, "Maximum mutating (POST/PUT/PATCH/DELETE) requests per minute (0 for unlimited)")
+	fs.IntVar(&c.WriteConcurrency, "write-concurrency", 0, "Maximum concurrent mutating requests (0 for unlimited)")
+	fs.BoolVar(&c.WriteInvalidate, "write-invalidate", false, "Purge the cached responses of (and under) the path of every successful PUT, PATCH or DELETE")
+	fs.StringSliceVar(&c.WriteInvalidateSkip, "write-invalidate-exclude", nil, "Path prefixes whose mutations are never invalidated by --write-invalidate, ex: /repos/octocat/hello-world/contents/")
+	fs.BoolVar(&c.WriteRevalidate, "write-revalidate", false, "Revalidate the cached response of the path of every mutation (and 409/422 write conflict) before responding")
+	fs.BoolVar(&c.Freeze, "freeze", false, "Start with mutating requests frozen (toggle via the /admin/freeze API)")
+	fs.StringArrayVar(&c.FreezeSchedule, "freeze-schedule", nil, "Recurring freeze window as a cron expression followed by a duration, ex: '0 17 * * 5 64h'")
+	fs.BoolVar(&c.FreezeQueue, "freeze-queue", false, "Queue mutating requests until the freeze ends instead of rejecting them")
+	fs.BoolVar(&c.ScrubResponses, "scrub-responses", false, "Scrub the configured secrets (and the tokens minted upstream) from response bodies and cached responses, buffering them")
+	fs.DurationVar(&c.RateInterval, "rate-interval", 60*time.Second, "Interval for rate limit checks")
+	fs.Float64Var(&c.RateJitter, "rate-jitter", 0.2, "Fraction of the rate limit check interval to randomly adjust each check by")
+	fs.DurationVar(&c.DeprecationInterval, "deprecation-interval", time.Hour, "Interval for logging deprecated endpoint usage")
+	fs.DurationVar(&c.UsageWindow, "usage-window", time.Hour, "Duration of each usage analytics window")
+	fs.IntVar(&c.UsageRetention, "usage-retention", 24, "Number of completed usage analytics windows to retain")
+	fs.IntVar(&c.MetricLabelValues, "metric-label-values", 100, "Maximum distinct clients (and teams) in the metric labels, the following are reported as (other)")
+	fs.IntVar(&c.UsageUserAgents, "usage-user-agents", 0, "Attribute the usage (and rate-limit consumption metrics) to the normalized User-Agents of the clients, up to this many distinct ones (0 to disable)")
+	fs.StringVar(&c.OpenAPISpec, "openapi-spec", "", "Path (or URL) of the OpenAPI description of GitHub (ex: api.github.com.json) the usage is mapped onto in the /admin/coverage report (and --validate-requests validates against)")
+	fs.DurationVar(&c.CoverageInterval, "coverage-interval", 15*time.Minute, "Interval for regenerating the /admin/coverage report")
+	fs.BoolVar(&c.ValidateRequests, "validate-requests", false, "Reject the requests which do not match the --openapi-spec (unknown path, unsupported method, invalid parameters) without sending them upstream")
+	fs.Float64Var(&c.ValidateResponses, "validate-responses", 0, "Fraction of the JSON responses validated against the schemas of the --openapi-spec, counting their drift (0 to disable)")
+	fs.StringVar(&c.TeamReport, "team-report", "", "Path to periodically write the per-team (X-Proxy-Team) usage report to")
+	fs.DurationVar(&c.TeamReportInterval, "team-report-interval", 5*time.Minute, "Interval for writing the per-team usage report")
+	fs.StringSliceVar(&c.StreamPath, "stream-path", nil, "Path patterns (ex: '/repos/*/*/actions/jobs/*/logs') whose responses are streamed without buffering")
+	fs.StringSliceVar(&c.HedgePath, "hedge-path", nil, "Path patterns (ex: '/repos/*/*/pulls/*') whose read-only requests are hedged with another credential once slower than the P95 latency of their route")
+	fs.Float64Var(&c.HedgeBudget, "hedge-budget", 0.05, "Maximum fraction of the --hedge-path requests which are hedged")
+	fs.DurationVar(&c.HedgeMinDelay, "hedge-min-delay", 50*time.Millisecond, "Minimum delay before a --hedge-path request is hedged")
+	fs.StringVar(&c.Tenants, "tenants", "", "Path to a JSON file mapping inbound clients to tenants (each with a credential subset, cache partition and quota)")
+	fs.StringVar(&c.CredentialOverrides, "credential-overrides", "", "Path to a JSON file of the grants allowing trusted clients to pin the credential of their requests (see X-Proxy-Credential)")
+	fs.DurationVar(&c.Affinity, "affinity", 0, "Idle window the requests of a session stick to one credential for, ex: across a paginated listing (0 to disable)")
+	fs.StringVar(&c.AffinityHeader, "affinity-header", "", "Request header keying the sessions of --affinity (defaults to the client identity)")
+	fs.DurationVar(&c.PaginationSnapshot, "pagination-snapshot", 0, "Duration the prefetched pages of a pagination snapshot (X-Proxy-Snapshot) are served for (0 to disable)")
+	fs.IntVar(&c.SnapshotPages, "snapshot-pages", DefaultSnapshotPages, "Maximum number of pages prefetched by a pagination snapshot")
+	fs.StringVar(&c.SignKey, "sign-key", "", "Path to a PEM-encoded Ed25519 private key used to sign every response body (X-Proxy-Signature header)")
+	fs.IntVar(&c.ReadyCredentials, "ready-credentials", 0, "Minimum number of credentials that must validate before /readyz reports ready")
+	fs.DurationVar(&c.StartupTimeout, "startup-timeout", 5*time.Minute, "Exit if the proxy is not ready within this duration (0 to wait forever)")
+	fs.StringVar(&c.APIVersion, "api-version", "", "Default X-GitHub-Api-Version to send upstream if the client does not specify one")
+	fs.BoolVar(&c.NormalizeAccept, "normalize-accept", false, "Normalize the Accept header of the requests (upgrading the graduated preview media types) so equivalent requests share a cache key")
+	fs.StringArrayVar(&c.AcceptRewrite, "accept-rewrite", nil, "Rewrite a media type of the Accept header, in the format '[<route> ]<from>=<to>' (repeatable, implies --normalize-accept)")
+	fs.StringVar(&c.CompareURL, "compare-url", "", "Secondary GitHub API URL to also send GET requests to, recording the differences of the JSON responses")
+	fs.StringVar(&c.CompareAuthToken, "compare-auth-token", "", "GitHub token for the --compare-url requests (defaults to the client's Authorization header)")
+	fs.Float64Var(&c.CompareSample, "compare-sample", 1, "Fraction of the GET requests also sent to --compare-url")
+	fs.StringSliceVar(&c.CompareIgnore, "compare-ignore", nil, "Object keys ignored when comparing the responses of --compare-url, ex: node_id")
+	fs.StringVar(&c.CompareLog, "compare-log", "", "File the differences found by --compare-url are appended to as JSON lines")
+	fs.IntVar(&c.CompareConcurrency, "compare-concurrency", 16, "Maximum concurrent requests to --compare-url, additional responses are not compared")
+	fs.BoolVar(&c.Delta, "delta", false, "Respond with a JSON Patch of the changes since the last response to requests with the X-Proxy-Delta header")
+	fs.DurationVar(&c.IdempotencyTTL, "idempotency-ttl", 0, "Duration the outcomes of the mutations with an Idempotency-Key are replayed for (0 to disable)")
+	fs.BoolVar(&c.AnomalyDetection, "anomaly-detection", false, "Log the anomalous client behaviour (sudden request rate increases, unusual endpoints)")
+	fs.Float64Var(&c.AnomalyRateFactor, "anomaly-rate-factor", 10, "Increase of the request rate of a client over its usual rate which is anomalous (0 to disable)")
+	fs.IntVar(&c.AnomalyMinRate, "anomaly-min-rate", 100, "Minimum requests per minute of a client which are an anomalous rate")
+	fs.StringArrayVar(&c.AnomalyEndpoint, "anomaly-endpoint", DefaultAnomalyEndpoints, "Unusual endpoint in the format '<method> <route>', ex: 'DELETE /repos/{owner}/{repo}'")
+	fs.StringVar(&c.AnomalyWebhook, "anomaly-webhook", "", "URL each anomaly is POSTed to as JSON (ex: a Slack incoming webhook)")
+	fs.DurationVar(&c.AnomalyBlock, "anomaly-block", 0, "Duration a client is blocked for after an anomaly (0 to never block)")
+	fs.StringVar(&c.AlertWebhook, "alert-webhook", "", "URL the quota and credential alerts are POSTed to as JSON (ex: a Slack incoming webhook)")
+	fs.Float64Var(&c.AlertQuota, "alert-quota", 0.1, "Fraction of the quota of the credential pool (per resource) below which it is alerted on")
+	fs.IntVar(&c.AlertFailures, "alert-failures", 3, "Consecutive failed requests (errors or 401 Unauthorized) of a credential which are alerted on")
+	fs.DurationVar(&c.AlertCooldown, "alert-cooldown", 15*time.Minute, "Minimum interval between the repeats of the same alert")
+	fs.DurationVar(&c.EventsInterval, "events-interval", DefaultEventsInterval, "Minimum interval the /events/stream feeds are polled upstream at (the X-Poll-Interval is always respected)")
+	fs.StringVar(&c.WebhookSecret, "webhook-secret", "", "Secret of the webhooks delivered to /webhooks, which then back the /subscribe streams instead of polling")
+	fs.BoolVar(&c.Jobs, "jobs", false, "Defer the mutations with the X-Proxy-Async header to a background queue, queryable at /jobs/{id}")
+	fs.IntVar(&c.JobsMax, "jobs-max", DefaultMaxJobs, "Maximum deferred mutations queued at a time, additional ones are rejected")
+	fs.IntVar(&c.JobsWorkers, "jobs-workers", DefaultJobWorkers, "Number of deferred mutations executed at a time")
+	fs.IntVar(&c.JobsRetries, "jobs-retries", 5, "Maximum retries of a deferred mutation failing with a server error (rate-limited attempts are always retried)")
+	fs.IntVar(&c.JobsReserve, "jobs-reserve", 500, "Remaining quota of the credential pool reserved for the other requests, the deferred mutations wait while it is lower")
+	fs.StringSliceVar(&c.ShadowPolicy, "shadow-policy", nil, "Policies (by the reason of their denials, ex: source_not_allowed, tenant_quota_exceeded) whose denials are only logged and counted, allowing the requests")
+	fs.StringArrayVar(&c.Middleware, "middleware", nil, "Custom transport registered by a build-time import or a plugin (see --middleware-dir) to enable: '<name>[,stage=upstream|client][,<key>=<value>...]', in order")
+	fs.StringVar(&c.MiddlewareDir, "middleware-dir", "", "Directory of the Go plugins (*.so) registering custom transports for --middleware")
+	fs.StringArrayVar(&c.Script, "script", nil, "Lua script defining on_request and/or on_response hooks run on the requests of the clients and their final responses, in order")
+	fs.DurationVar(&c.ScriptTimeout, "script-timeout", DefaultScriptTimeout, "Deadline of a run of a --script hook, a hook exceeding it fails and the request proceeds unmodified")
+	fs.StringArrayVar(&c.WASMFilter, "wasm-filter", nil, "(Experimental) WebAssembly filter exporting on_request and/or on_response hooks run on the requests of the clients and their final responses, in order")
+	fs.DurationVar(&c.WASMTimeout, "wasm-timeout", DefaultWASMTimeout, "Deadline of a call of a --wasm-filter hook, a hook exceeding it fails and the request proceeds unmodified")
+	fs.IntVar(&c.WASMMemory, "wasm-memory", DefaultWASMMemory, "Memory limit (in MiB) of an instance of a --wasm-filter")
+	fs.BoolVar(&c.RateLimitOverride, "rate-limit-override", false, "Serve the /rate_limit API from the aggregated quota of the credential pool (see /proxy/rate_limit) instead of forwarding it upstream")
+	fs.BoolVar(&c.Reservations, "reservations", false, "Allow batch jobs to reserve core requests of the credential pool via /admin/reservations (and the gRPC API)")
+	fs.IntVar(&c.BulkConcurrency, "bulk-concurrency", DefaultBulkConcurrency, "Maximum concurrent sub-requests of a single /bulk request")
+}
+
+// RegisterSecrets registers all of the configured secrets with the Scrubber.
+func (c *Config) RegisterSecrets(scrubber *Scrubber) {
+	for _, params := range c.AuthOAuth {
+		if _, clientSecret, ok := strings.Cut(params, ":"); ok {
+			scrubber.Add(clientSecret)
+		}
+	}
+	for _, params := range c.AuthApp {
+		if _, privateKey, ok := strings.Cut(params, ":"); ok {
+			if _, privateKey, ok := strings.Cut(privateKey, ":"); ok {
+				scrubber.Add(privateKey)
+			}
+		}
+	}
+	scrubber.Add(c.AuthToken...)
+	scrubber.Add(c.RedisPassword)
+	scrubber.Add(c.CompareAuthToken)
+	scrubber.Add(c.WebhookSecret)
+	scrubber.Add(c.MeshSecret)
+	scrubber.Add(c.AdminToken)
+	scrubber.Add(c.AnomalyWebhook) // ex: Slack webhook URLs embed their secret
+	scrubber.Add(c.AlertWebhook)
+	scrubber.Add(c.CredentialPassphrase)
+	if u, err := url.Parse(c.UpstreamSOCKS5); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		scrubber.Add(password)
+	}
+}
+
+// Snapshot returns the value of every flag by name, the registered secrets are scrubbed from the values.
+func (c *Config) Snapshot(scrubber *Scrubber) map[string]string {
+	// The flag values point at the fields of the copy, so registering (the defaults) then copying exposes the values.
+	fs := pflag.NewFlagSet("snapshot", pflag.ContinueOnError)
+	var snapshot Config
+	snapshot.RegisterFlags(fs)
+	snapshot = *c
+	values := make(map[string]string)
+	fs.VisitAll(func(f *pflag.Flag) {
+		values[f.Name] = scrubber.ScrubString(f.Value.String())
+	})
+	return values
+}
+
+// interval is a flag of the period of a background task.
+type interval struct {
+	flag  string
+	value time.Duration
+}
+
+// intervals returns the flags of the periods of the background tasks, which must be positive (time.NewTicker panics
+// otherwise).
+func (c *Config) intervals() []interval {
+	return []interval{
+		{"cache-namespace-refresh", c.CacheNamespaceRefresh},
+		{"deprecation-interval", c.DeprecationInterval},
+		{"usage-window", c.UsageWindow},
+		{"team-report-interval", c.TeamReportInterval},
+		{"coordinate-interval", c.CoordinateInterval},
+		{"health-interval", c.HealthInterval},
+		{"coverage-interval", c.CoverageInterval},
+		{"mesh-interval", c.MeshInterval},
+	}
+}
+
+// Credentialed reports if any credentials are configured, or may be added at runtime to the credential store (which
+// may be empty at startup).
+func (c *Config) Credentialed() bool {
+	return len(c.AuthOAuth) > 0 || len(c.AuthApp) > 0 || len(c.AuthToken) > 0 || c.CredentialStore != ""
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// configFlags are the flags controlling how the configuration is loaded, they are not part of the configuration.
+var configFlags = []string{"config", "print-config", "config-schema"}
+
+// LoadConfigFile sets the flags from the YAML (or JSON) file mapping flag names to values, lists set the slice flags.
+// Flags already set on the command-line (or by their environment variables) take precedence over the file.
+func LoadConfigFile(fs *pflag.FlagSet, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("os.ReadFile failed: %w", err)
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("yaml.Unmarshal failed: %w", err)
+	}
+	for name, value := range values {
+		f := fs.Lookup(name)
+		if f == nil || slices.Contains(configFlags, name) {
+			return fmt.Errorf("unknown flag %q in %s", name, path)
+		}
+		if f.Changed {
+			continue
+		}
+		if err := setFlag(f, value); err != nil {
+			return fmt.Errorf("invalid value for %q in %s: %w", name, path, err)
+		}
+	}
+	return nil
+}
+
+// EnvPrefix prefixes the environment variable of every flag, ex: --cache-vary is GH_PROXY_CACHE_VARY.
+const EnvPrefix = "GH_PROXY_"
+
+// EnvName returns the name of the environment variable binding the flag.
+func EnvName(flag string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// splitEnv splits the environment variable value of a slice flag on newlines (and commas, unless the values are never
+// split on the command-line either). The lines of a PEM block (ex: the private key of --auth-app) are kept together.
+func splitEnv(value string, commas bool) []string {
+	var vals []string
+	var pem []string
+	for line := range strings.SplitSeq(value, "\n") {
+		if pem != nil || strings.Contains(line, "-----BEGIN ") {
+			if pem = append(pem, line); strings.Contains(line, "-----END ") {
+				vals = append(vals, strings.Join(pem, "\n"))
+				pem = nil
+			}
+			continue
+		}
+		items := []string{line}
+		if commas {
+			items = strings.Split(line, ",")
+		}
+		for _, item := range items {
+			if item = strings.TrimSpace(item); item != "" {
+				vals = append(vals, item)
+			}
+		}
+	}
+	if pem != nil {
+		vals = append(vals, strings.Join(pem, "\n"))
+	}
+	return vals
+}
+
+// LoadConfigEnv sets the flags from their environment variables (see EnvName), the values of slice flags are separated
+// by commas or newlines. Flags already set on the command-line take precedence, and the environment variables in turn
+// take precedence over the configuration file (including GH_PROXY_CONFIG itself).
+func LoadConfigEnv(fs *pflag.FlagSet, lookup func(string) (string, bool)) error {
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || (f.Name != "config" && slices.Contains(configFlags, f.Name)) {
+			return
+		}
+		value, ok := lookup(EnvName(f.Name))
+		if !ok {
+			return
+		}
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			if err = slice.Replace(splitEnv(value, f.Value.Type() != "stringArray")); err != nil {
+				err = fmt.Errorf("invalid value for %s: %w", EnvName(f.Name), err)
+			}
+		} else if err = f.Value.Set(value); err != nil {
+			err = fmt.Errorf("invalid value for %s: %w", EnvName(f.Name), err)
+		}
+		// Mark the flag as set so the configuration file does not override it.
+		f.Changed = true
+	})
+	return err
+}
+
+// setFlag sets the flag to the (decoded) value, a list replaces the values of a slice flag.
+func setFlag(f *pflag.Flag, value any) error {
+	if list, ok := value.([]any); ok {
+		slice, ok := f.Value.(pflag.SliceValue)
+		if !ok {
+			return fmt.Errorf("a list is only valid for a slice flag, not %s", f.Value.Type())
+		}
+		vals := make([]string, 0, len(list))
+		for _, val := range list {
+			vals = append(vals, fmt.Sprint(val))
+		}
+		return slice.Replace(vals)
+	}
+	if value == nil {
+		return nil // An empty value keeps the default
+	}
+	return f.Value.Set(fmt.Sprint(value))
+}
+
+// typedValue converts the string representation of a flag value to the JSON type of the flag.
+func typedValue(kind, val string) any {
+	switch kind {
+	case "bool":
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b
+		}
+	case "int", "int64":
+		if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+			return n
+		}
+	case "float64":
+		if n, err := strconv.ParseFloat(val, 64); err == nil {
+			return n
+		}
+	}
+	return val
+}
+
+// sliceItem returns the type of the items of a slice flag type (ex: "intSlice" is "int"), if it is a slice at all.
+func sliceItem(kind string) (string, bool) {
+	switch kind {
+	case "stringSlice", "stringArray":
+		return "string", true
+	case "intSlice":
+		return "int", true
+	}
+	return "", false
+}
+
+// ConfigValues returns the resolved value of every configuration flag by name, typed as in a configuration file.
+// The secrets registered with the scrubber are redacted.
+func ConfigValues(fs *pflag.FlagSet, scrubber *Scrubber) map[string]any {
+	values := make(map[string]any)
+	fs.VisitAll(func(f *pflag.Flag) {
+		if slices.Contains(configFlags, f.Name) {
+			return
+		}
+		if item, ok := sliceItem(f.Value.Type()); ok {
+			vals := []any{}
+			for _, val := range f.Value.(pflag.SliceValue).GetSlice() {
+				vals = append(vals, typedValue(item, scrubber.ScrubString(val)))
+			}
+			values[f.Name] = vals
+			return
+		}
+		values[f.Name] = typedValue(f.Value.Type(), scrubber.ScrubString(f.Value.String()))
+	})
+	return values
+}
+
+// schemaType returns the JSON Schema of a flag value type.
+func schemaType(kind string) map[string]any {
+	if item, ok := sliceItem(kind); ok {
+		return map[string]any{"type": "array", "items": schemaType(item)}
+	}
+	switch kind {
+	case "bool":
+		return map[string]any{"type": "boolean"}
+	case "int", "int64":
+		return map[string]any{"type": "integer"}
+	case "float64":
+		return map[string]any{"type": "number"}
+	case "duration":
+		return map[string]any{"type": "string", "pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$|^0$`}
+	}
+	return map[string]any{"type": "string"}
+}
+
+// ConfigSchema returns the JSON Schema of the configuration file (see LoadConfigFile).
+func ConfigSchema(fs *pflag.FlagSet) map[string]any {
+	properties := make(map[string]any)
+	fs.VisitAll(func(f *pflag.Flag) {
+		if slices.Contains(configFlags, f.Name) {
+			return
+		}
+		property := schemaType(f.Value.Type())
+		property["description"] = f.Usage
+		if item, ok := sliceItem(f.Value.Type()); ok {
+			defaults := []any{}
+			for _, val := range f.Value.(pflag.SliceValue).GetSlice() {
+				defaults = append(defaults, typedValue(item, val))
+			}
+			property["default"] = defaults
+		} else {
+			property["default"] = typedValue(f.Value.Type(), f.DefValue)
+		}
+		properties[f.Name] = property
+	})
+	return map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "github-api-proxy configuration",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+// PrintConfig writes the value as indented JSON or YAML.
+func PrintConfig(w io.Writer, format string, value any) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(value); err != nil {
+			return fmt.Errorf("(*json.Encoder).Encode failed: %w", err)
+		}
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(value); err != nil {
+			return fmt.Errorf("(*yaml.Encoder).Encode failed: %w", err)
+		}
+		if err := encoder.Close(); err != nil {
+			return fmt.Errorf("(*yaml.Encoder).Close failed: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown format %q, must be json or yaml", format)
+	}
+	return nil
+}
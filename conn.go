@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ConnectionsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "connections_dropped_total",
+		Subsystem: "github",
+		Help:      "Number of inbound connections dropped by the slow-client protections, by guard",
+	}, []string{"guard"})
+	ConnectionsOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "connections_open",
+		Subsystem: "github",
+		Help:      "Number of currently open inbound connections",
+	})
+)
+
+// connState is the last known state of an inbound connection.
+type connState struct {
+	state http.ConnState
+	since time.Time
+}
+
+// ConnGuard protects the server against slow-loris style clients by limiting the concurrent connections per source IP
+// and accounting for the connections reaped by the http.Server header read and idle timeouts.
+type ConnGuard struct {
+	// PerIP is the maximum number of concurrent connections from a single source IP (0 for unlimited).
+	PerIP int
+	// HeaderTimeout and IdleTimeout should match the http.Server configuration, they are only used for the metrics.
+	HeaderTimeout time.Duration
+	IdleTimeout   time.Duration
+
+	mu     sync.Mutex
+	perIP  map[netip.Addr]int
+	states map[net.Conn]connState
+}
+
+// Listener wraps the net.Listener, closing any connections exceeding the per IP limit as soon as they are accepted.
+func (g *ConnGuard) Listener(l net.Listener) net.Listener {
+	return &guardListener{Listener: l, guard: g}
+}
+
+// acquire reserves a connection slot for the address, reporting false if the limit was reached.
+func (g *ConnGuard) acquire(addr netip.Addr) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.perIP == nil {
+		g.perIP = make(map[netip.Addr]int)
+	}
+	if g.PerIP > 0 && g.perIP[addr] >= g.PerIP {
+		return false
+	}
+	g.perIP[addr]++
+	return true
+}
+
+// release frees the connection slot for the address.
+func (g *ConnGuard) release(addr netip.Addr) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.perIP[addr]--; g.perIP[addr] <= 0 {
+		delete(g.perIP, addr)
+	}
+}
+
+// ConnState implements the http.Server ConnState hook, counting connections closed by the server-side timeouts.
+func (g *ConnGuard) ConnState(conn net.Conn, state http.ConnState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.states == nil {
+		g.states = make(map[net.Conn]connState)
+	}
+	switch state {
+	case http.StateClosed:
+		prev, ok := g.states[conn]
+		delete(g.states, conn)
+		if !ok {
+			return
+		}
+		elapsed := time.Since(prev.since)
+		if prev.state == http.StateNew && g.HeaderTimeout > 0 && elapsed >= g.HeaderTimeout {
+			ConnectionsDropped.WithLabelValues("header_timeout").Inc()
+		} else if prev.state == http.StateIdle && g.IdleTimeout > 0 && elapsed >= g.IdleTimeout {
+			ConnectionsDropped.WithLabelValues("idle_timeout").Inc()
+		}
+	case http.StateHijacked:
+		delete(g.states, conn) // Upgraded connections are no longer managed by the http.Server
+	default:
+		g.states[conn] = connState{state: state, since: time.Now()}
+	}
+}
+
+type guardListener struct {
+	net.Listener
+	guard *ConnGuard
+}
+
+func (l *guardListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+		if err != nil {
+			return conn, nil // Not an IP connection (ex: a unix socket), nothing to limit
+		}
+		addr := addrPort.Addr().Unmap()
+		if !l.guard.acquire(addr) {
+			ConnectionsDropped.WithLabelValues("per_ip").Inc()
+			conn.Close()
+			continue
+		}
+		ConnectionsOpen.Inc()
+		return &guardConn{Conn: conn, release: func() {
+			ConnectionsOpen.Dec()
+			l.guard.release(addr)
+		}}, nil
+	}
+}
+
+// guardConn releases its connection slot once closed.
+type guardConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *guardConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
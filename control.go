@@ -0,0 +1,251 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/bored-engineer/github-api-proxy/controlpb"
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// ControlService implements the gRPC control-plane API (see controlpb/control.proto).
+type ControlService struct {
+	controlpb.UnimplementedControlServer
+	Config *Config
+	// Pool is nil if the proxy has no credentials (ex: --auth-passthrough only).
+	Pool    *CredentialPool
+	Storage ghtransport.Storage
+	// URL is the upstream URL, cache prefixes are resolved relative to it.
+	URL *url.URL
+	// Transport is the base transport of the credentials added at runtime.
+	Transport http.RoundTripper
+	// Reservations is nil unless --reservations is set.
+	Reservations *ReservationTransport
+}
+
+// caller identifies the (mTLS) client of the request for logging.
+func caller(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+		return info.State.PeerCertificates[0].Subject.CommonName
+	}
+	return p.Addr.String()
+}
+
+func credentialMessage(credential *Credential) *controlpb.Credential {
+	return &controlpb.Credential{Id: credential.ID, Kind: credential.Kind}
+}
+
+func (s *ControlService) ListCredentials(ctx context.Context, req *controlpb.ListCredentialsRequest) (*controlpb.ListCredentialsResponse, error) {
+	resp := &controlpb.ListCredentialsResponse{}
+	for _, credential := range s.Pool.Credentials() {
+		resp.Credentials = append(resp.Credentials, credentialMessage(credential))
+	}
+	return resp, nil
+}
+
+func (s *ControlService) AddCredential(ctx context.Context, req *controlpb.AddCredentialRequest) (*controlpb.AddCredentialResponse, error) {
+	if s.Pool == nil {
+		return nil, status.Error(codes.FailedPrecondition, "the proxy was started without credentials")
+	}
+	// Parse the credential exactly as the equivalent flag would be.
+	var cfg Config
+	switch req.GetKind() {
+	case "oauth":
+		cfg.AuthOAuth = []string{req.GetParams()}
+	case "app":
+		cfg.AuthApp = []string{req.GetParams()}
+	case "token":
+		cfg.AuthToken = []string{req.GetParams()}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown credential kind %q", req.GetKind())
+	}
+	cfg.RegisterSecrets(DefaultScrubber)
+	// The credential outlives the request (ex: refreshing a GitHub App installation token).
+	credentials, err := NewCredentials(context.WithoutCancel(ctx), &cfg, s.Transport)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, DefaultScrubber.ScrubError(err).Error())
+	}
+	if err := s.Pool.Add(credentials...); errors.Is(err, ErrCredentialExists) {
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Warn().Str("caller", caller(ctx)).Str("credential", credentials[0].ID).Str("kind", credentials[0].Kind).Msg("credential added")
+	return &controlpb.AddCredentialResponse{Credential: credentialMessage(credentials[0])}, nil
+}
+
+func (s *ControlService) RemoveCredential(ctx context.Context, req *controlpb.RemoveCredentialRequest) (*controlpb.RemoveCredentialResponse, error) {
+	if s.Pool == nil {
+		return nil, status.Error(codes.FailedPrecondition, "the proxy was started without credentials")
+	}
+	credential, err := s.Pool.Remove(req.GetId())
+	switch {
+	case errors.Is(err, ErrCredentialNotFound):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrLastCredential):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Warn().Str("caller", caller(ctx)).Str("credential", credential.ID).Str("kind", credential.Kind).Msg("credential removed")
+	return &controlpb.RemoveCredentialResponse{}, nil
+}
+
+func (s *ControlService) PurgeCache(ctx context.Context, req *controlpb.PurgeCacheRequest) (*controlpb.PurgeCacheResponse, error) {
+	if req.GetPrefix() == "" && !req.GetAll() {
+		return nil, status.Error(codes.InvalidArgument, "a prefix is required unless purging the entire cache")
+	}
+	prefix := PurgePrefix(s.URL, req.GetPrefix())
+	purged, err := PurgeStorage(ctx, s.Storage, prefix)
+	if err != nil {
+		log.Error().Err(err).Str("prefix", prefix).Msg("PurgeStorage failed")
+		return nil, status.Error(codes.Internal, "failed to purge the cache")
+	}
+	log.Warn().Str("caller", caller(ctx)).Str("prefix", prefix).Int("purged", purged).Msg("cache purged")
+	return &controlpb.PurgeCacheResponse{Prefix: prefix, Purged: int64(purged)}, nil
+}
+
+func (s *ControlService) GetQuota(ctx context.Context, req *controlpb.GetQuotaRequest) (*controlpb.GetQuotaResponse, error) {
+	credentials := s.Pool.Credentials()
+	if id := req.GetCredentialId(); id != "" {
+		credential := s.Pool.Get(id)
+		if credential == nil {
+			return nil, status.Errorf(codes.NotFound, "%s: %s", ErrCredentialNotFound, id)
+		}
+		credentials = []*Credential{credential}
+	}
+	resp := &controlpb.GetQuotaResponse{}
+	for _, credential := range credentials {
+		for resource, rate := range credential.Transport.Limits.Iter() {
+			resp.Quotas = append(resp.Quotas, &controlpb.Quota{
+				CredentialId: credential.ID,
+				Resource:     resource.String(),
+				Limit:        rate.Limit,
+				Used:         rate.Used,
+				Remaining:    rate.Remaining,
+				ResetAt:      rate.Reset,
+			})
+		}
+	}
+	slices.SortFunc(resp.Quotas, func(a, b *controlpb.Quota) int {
+		return cmp.Or(cmp.Compare(a.CredentialId, b.CredentialId), cmp.Compare(a.Resource, b.Resource))
+	})
+	return resp, nil
+}
+
+func (s *ControlService) GetConfig(ctx context.Context, req *controlpb.GetConfigRequest) (*controlpb.GetConfigResponse, error) {
+	return &controlpb.GetConfigResponse{Flags: s.Config.Snapshot(DefaultScrubber)}, nil
+}
+
+func reservationMessage(reservation Reservation) *controlpb.Reservation {
+	return &controlpb.Reservation{
+		Id:        reservation.ID,
+		Name:      reservation.Name,
+		Requests:  reservation.Requests,
+		Used:      reservation.Used,
+		CreatedAt: reservation.Created.Unix(),
+		ExpiresAt: reservation.Expires.Unix(),
+	}
+}
+
+func (s *ControlService) ReserveBudget(ctx context.Context, req *controlpb.ReserveBudgetRequest) (*controlpb.ReserveBudgetResponse, error) {
+	if s.Reservations == nil {
+		return nil, status.Error(codes.FailedPrecondition, "the proxy was started without --reservations")
+	}
+	if req.GetRequests() == 0 || req.GetDurationSeconds() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "a positive number of requests (and duration) is required")
+	}
+	reservation, err := s.Reservations.Reserve(req.GetName(), req.GetRequests(), time.Duration(req.GetDurationSeconds())*time.Second)
+	if errors.Is(err, ErrInsufficientQuota) {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Warn().Str("caller", caller(ctx)).Str("reservation", reservation.ID).Str("name", reservation.Name).Uint64("requests", reservation.Requests).Msg("budget reserved")
+	return &controlpb.ReserveBudgetResponse{Reservation: reservationMessage(reservation)}, nil
+}
+
+func (s *ControlService) ListReservations(ctx context.Context, req *controlpb.ListReservationsRequest) (*controlpb.ListReservationsResponse, error) {
+	resp := &controlpb.ListReservationsResponse{}
+	if s.Reservations == nil {
+		return resp, nil
+	}
+	for _, reservation := range s.Reservations.List() {
+		resp.Reservations = append(resp.Reservations, reservationMessage(reservation))
+	}
+	return resp, nil
+}
+
+func (s *ControlService) ReleaseReservation(ctx context.Context, req *controlpb.ReleaseReservationRequest) (*controlpb.ReleaseReservationResponse, error) {
+	if s.Reservations == nil {
+		return nil, status.Error(codes.FailedPrecondition, "the proxy was started without --reservations")
+	}
+	reservation, err := s.Reservations.Release(req.GetId())
+	if errors.Is(err, ErrReservationNotFound) {
+		return nil, status.Errorf(codes.NotFound, "%s: %s", err, req.GetId())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Warn().Str("caller", caller(ctx)).Str("reservation", reservation.ID).Str("name", reservation.Name).Uint64("used", reservation.Used).Msg("reservation released")
+	return &controlpb.ReleaseReservationResponse{Reservation: reservationMessage(reservation)}, nil
+}
+
+// ControlTLSConfig returns the mutual TLS configuration of the gRPC control-plane API, every client must present a
+// certificate signed by the client CA.
+func ControlTLSConfig(cfg *Config) (*tls.Config, error) {
+	if cfg.GRPCTLSCert == "" || cfg.GRPCTLSKey == "" || cfg.GRPCClientCA == "" {
+		return nil, errors.New("--grpc-listen requires --grpc-tls-cert, --grpc-tls-key and --grpc-client-ca")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.GRPCTLSCert, cfg.GRPCTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("tls.LoadX509KeyPair failed: %w", err)
+	}
+	pem, err := os.ReadFile(cfg.GRPCClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile failed: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %q", cfg.GRPCClientCA)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ServeControl serves the gRPC control-plane API on the listener until the context is cancelled.
+func ServeControl(ctx context.Context, listener net.Listener, tlsConfig *tls.Config, service *ControlService) error {
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+	controlpb.RegisterControlServer(server, service)
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+	if err := server.Serve(listener); err != nil {
+		return fmt.Errorf("(*grpc.Server).Serve failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/ratelimit"
+)
+
+var (
+	CoordinationReplicas = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "coordination_replicas",
+		Subsystem: "github",
+		Help:      "Number of live proxy replicas sharing the rate-limits",
+	})
+)
+
+// mergeRateScript atomically merges a replica's view of a rate-limit into the shared view.
+// The most pessimistic view wins: a later reset, or the lowest remaining quota for the same reset.
+var mergeRateScript = redis.NewScript(`
+local cur = redis.call('HMGET', KEYS[1], 'reset', 'remaining', 'limit', 'used')
+local reset, remaining = tonumber(ARGV[1]), tonumber(ARGV[2])
+if cur[1] then
+	local creset, cremaining = tonumber(cur[1]), tonumber(cur[2])
+	if creset > reset or (creset == reset and cremaining <= remaining) then
+		return cur
+	end
+end
+redis.call('HSET', KEYS[1], 'reset', ARGV[1], 'remaining', ARGV[2], 'limit', ARGV[3], 'used', ARGV[4])
+redis.call('EXPIREAT', KEYS[1], reset + 60)
+return {ARGV[1], ARGV[2], ARGV[3], ARGV[4]}
+`)
+
+// DividedLimiter is a ratelimit.Limiter whose rate is divided evenly between the live replicas.
+type DividedLimiter struct {
+	rate    int
+	per     time.Duration
+	divisor atomic.Int64
+	limiter atomic.Pointer[ratelimit.Limiter]
+}
+
+// NewDividedLimiter creates a DividedLimiter allowing rate requests per duration (across all replicas).
+func NewDividedLimiter(rate int, per time.Duration) *DividedLimiter {
+	l := &DividedLimiter{rate: rate, per: per}
+	l.Divide(1)
+	return l
+}
+
+// Divide updates the limiter to allow 1/n of the rate.
+func (l *DividedLimiter) Divide(n int) {
+	if n < 1 {
+		n = 1
+	}
+	if l.divisor.Swap(int64(n)) == int64(n) {
+		return
+	}
+	limiter := ratelimit.New(max(l.rate/n, 1), ratelimit.Per(l.per))
+	l.limiter.Store(&limiter)
+}
+
+// Take implements ratelimit.Limiter.
+func (l *DividedLimiter) Take() time.Time {
+	return (*l.limiter.Load()).Take()
+}
+
+// Coordinator shares the rate-limit state of the credentials between proxy replicas via Redis.
+type Coordinator struct {
+	Client *redis.Client
+	// Prefix is prepended to all of the Redis keys.
+	Prefix string
+	// ID uniquely identifies this replica.
+	ID string
+	// Pool contains the credentials whose rate-limits are shared.
+	Pool *CredentialPool
+
+	mu sync.Mutex
+	// limiters are divided between the live replicas.
+	limiters []*DividedLimiter
+	replicas int
+}
+
+// AddLimiter registers a limiter to be divided between the live replicas.
+func (c *Coordinator) AddLimiter(limiter *DividedLimiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replicas > 0 {
+		limiter.Divide(c.replicas)
+	}
+	c.limiters = append(c.limiters, limiter)
+}
+
+// NewCoordinator creates a Coordinator with a unique replica ID.
+func NewCoordinator(client *redis.Client, prefix string) *Coordinator {
+	hostname, _ := os.Hostname()
+	return &Coordinator{
+		Client: client,
+		Prefix: prefix,
+		ID:     hostname + ":" + strconv.Itoa(os.Getpid()) + ":" + strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+}
+
+// heartbeat registers this replica as live and returns the number of live replicas.
+func (c *Coordinator) heartbeat(ctx context.Context, ttl time.Duration) (int, error) {
+	key := c.Prefix + "replicas"
+	now := time.Now()
+	pipe := c.Client.TxPipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.Unix()), Member: c.ID})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(now.Add(-ttl).Unix(), 10))
+	card := pipe.ZCard(ctx, key)
+	pipe.Expire(ctx, key, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("(redis.Pipeliner).Exec failed: %w", err)
+	}
+	return int(card.Val()), nil
+}
+
+// leave removes this replica from the live set.
+func (c *Coordinator) leave(ctx context.Context) error {
+	return c.Client.ZRem(ctx, c.Prefix+"replicas", c.ID).Err()
+}
+
+// merge publishes the local rate and returns the merged (shared) rate.
+func (c *Coordinator) merge(ctx context.Context, credential *Credential, resource ghratelimit.Resource, rate *ghratelimit.Rate) (*ghratelimit.Rate, error) {
+	vals, err := mergeRateScript.Run(ctx, c.Client, []string{
+		c.Prefix + "rate:" + credential.ID + ":" + resource.String(),
+	}, rate.Reset, rate.Remaining, rate.Limit, rate.Used).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("(*redis.Script).Run failed: %w", err)
+	}
+	if len(vals) != 4 {
+		return nil, fmt.Errorf("unexpected merge result: %v", vals)
+	}
+	var merged ghratelimit.Rate
+	for idx, field := range []*uint64{&merged.Reset, &merged.Remaining, &merged.Limit, &merged.Used} {
+		if *field, err = strconv.ParseUint(vals[idx], 10, 64); err != nil {
+			return nil, fmt.Errorf("strconv.ParseUint failed: %w", err)
+		}
+	}
+	return &merged, nil
+}
+
+// Sync publishes the local rate-limits, adopts the shared view and divides the limiters between the live replicas.
+func (c *Coordinator) Sync(ctx context.Context, ttl time.Duration) error {
+	replicas, err := c.heartbeat(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	CoordinationReplicas.Set(float64(replicas))
+	c.mu.Lock()
+	c.replicas = replicas
+	for _, limiter := range c.limiters {
+		limiter.Divide(replicas)
+	}
+	c.mu.Unlock()
+	for _, credential := range c.Pool.Credentials() {
+		for resource, rate := range credential.Transport.Limits.Iter() {
+			merged, err := c.merge(ctx, credential, resource, rate)
+			if err != nil {
+				return err
+			}
+			if *merged != *rate {
+				credential.Transport.Limits.Store(nil, resource, merged)
+			}
+		}
+	}
+	return nil
+}
+
+// Poll calls (*Coordinator).Sync every interval until the context is cancelled.
+func (c *Coordinator) Poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Sync(ctx, 3*interval); err != nil {
+			log.Error().Err(err).Msg("(*Coordinator).Sync failed")
+		}
+		select {
+		case <-ctx.Done():
+			if err := c.leave(context.WithoutCancel(ctx)); err != nil {
+				log.Error().Err(err).Msg("(*Coordinator).leave failed")
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// CoverageOperation is the usage of an operation of the OpenAPI description.
+type CoverageOperation struct {
+	OperationID string   `json:"operation_id"`
+	Method      string   `json:"method"`
+	Path        string   `json:"path"`
+	Summary     string   `json:"summary,omitempty"`
+	Deprecated  bool     `json:"deprecated,omitempty"`
+	Requests    uint64   `json:"requests"`
+	Cached      uint64   `json:"cached"`
+	Errors      uint64   `json:"errors"`
+	Clients     []string `json:"clients,omitempty"`
+}
+
+// CoverageReport maps the usage of the retained windows onto the operations of the OpenAPI description.
+type CoverageReport struct {
+	Generated time.Time `json:"generated_at"`
+	Start     time.Time `json:"start,omitzero"`
+	Spec      string    `json:"spec"`
+	// Operations is the number of operations of the description, Used of those with requests.
+	Operations int     `json:"operations"`
+	Used       int     `json:"used"`
+	Coverage   float64 `json:"coverage"`
+	// DeprecatedUsed is the number of deprecated operations with requests, to be migrated.
+	DeprecatedUsed int `json:"deprecated_used"`
+	// Items are the operations, the used ones first by requests.
+	Items []*CoverageOperation `json:"items"`
+	// Unmatched are the routes that do not match any operation (ex: the description is outdated).
+	Unmatched []*UsageCount `json:"unmatched,omitempty"`
+}
+
+// NewCoverageReport maps the usage windows onto the operations of the spec.
+func NewCoverageReport(spec *OpenAPISpec, windows []UsageWindow) *CoverageReport {
+	report := &CoverageReport{
+		Generated:  time.Now(),
+		Spec:       strings.TrimSpace(spec.Title + " " + spec.Version),
+		Operations: len(spec.Operations),
+		Items:      make([]*CoverageOperation, 0, len(spec.Operations)),
+	}
+	items := make(map[*OpenAPIOperation]*CoverageOperation, len(spec.Operations))
+	for _, operation := range spec.Operations {
+		item := &CoverageOperation{
+			OperationID: operation.ID,
+			Method:      operation.Method,
+			Path:        operation.Path,
+			Summary:     operation.Summary,
+			Deprecated:  operation.Deprecated,
+		}
+		items[operation] = item
+		report.Items = append(report.Items, item)
+	}
+	unmatched := make(map[UsageKey]*UsageCount)
+	for _, window := range windows {
+		if report.Start.IsZero() || window.Start.Before(report.Start) {
+			report.Start = window.Start
+		}
+		for _, count := range window.Counts {
+			operation := spec.Match(count.Method, count.Route)
+			if operation == nil {
+				key := UsageKey{Method: count.Method, Route: count.Route}
+				if unmatched[key] == nil {
+					unmatched[key] = &UsageCount{UsageKey: key}
+					report.Unmatched = append(report.Unmatched, unmatched[key])
+				}
+				unmatched[key].Requests += count.Requests
+				unmatched[key].Cached += count.Cached
+				unmatched[key].Errors += count.Errors
+				continue
+			}
+			item := items[operation]
+			item.Requests += count.Requests
+			item.Cached += count.Cached
+			item.Errors += count.Errors
+			if count.Client != "" && !slices.Contains(item.Clients, count.Client) {
+				item.Clients = append(item.Clients, count.Client)
+			}
+		}
+	}
+	for _, item := range report.Items {
+		if item.Requests == 0 {
+			continue
+		}
+		report.Used++
+		if item.Deprecated {
+			report.DeprecatedUsed++
+		}
+		slices.Sort(item.Clients)
+	}
+	report.Coverage = float64(report.Used) / float64(report.Operations)
+	slices.SortStableFunc(report.Items, func(a, b *CoverageOperation) int {
+		return cmp.Compare(b.Requests, a.Requests)
+	})
+	slices.SortFunc(report.Unmatched, func(a, b *UsageCount) int {
+		return cmp.Compare(b.Requests, a.Requests)
+	})
+	return report
+}
+
+// CoverageReporter periodically maps the traffic observed by the Usage analytics onto the OpenAPI Spec, serving the
+// latest report at /admin/coverage as JSON (or CSV with ?format=csv, ex: for a spreadsheet of the migration plan).
+type CoverageReporter struct {
+	Spec  *OpenAPISpec
+	Usage *UsageTransport
+
+	mu     sync.Mutex
+	report *CoverageReport
+}
+
+// Report returns the latest report, generating it if there is none yet.
+func (r *CoverageReporter) Report() *CoverageReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.report == nil {
+		r.report = NewCoverageReport(r.Spec, r.Usage.Windows(0))
+	}
+	return r.report
+}
+
+// Run regenerates the report every interval until the context is cancelled.
+func (r *CoverageReporter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report := NewCoverageReport(r.Spec, r.Usage.Windows(0))
+			r.mu.Lock()
+			r.report = report
+			r.mu.Unlock()
+			log.Info().Int("used", report.Used).Int("operations", report.Operations).Int("deprecated_used", report.DeprecatedUsed).Int("unmatched", len(report.Unmatched)).Msg("API coverage report")
+		}
+	}
+}
+
+// ServeHTTP implements the /admin/coverage report, ?used=true only includes the used operations.
+func (r *CoverageReporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	report := *r.Report()
+	if used, _ := strconv.ParseBool(req.URL.Query().Get("used")); used {
+		report.Items = slices.DeleteFunc(slices.Clone(report.Items), func(item *CoverageOperation) bool { return item.Requests == 0 })
+	}
+	if req.URL.Query().Get("format") != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="coverage.csv"`)
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"operation_id", "method", "path", "deprecated", "requests", "cached", "errors", "clients"})
+	for _, item := range report.Items {
+		_ = writer.Write([]string{
+			item.OperationID,
+			item.Method,
+			item.Path,
+			strconv.FormatBool(item.Deprecated),
+			strconv.FormatUint(item.Requests, 10),
+			strconv.FormatUint(item.Cached, 10),
+			strconv.FormatUint(item.Errors, 10),
+			strings.Join(item.Clients, " "),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Error().Err(err).Msg("(*csv.Writer).Flush failed")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// storeOptions are the flags locating (and decrypting) the credential store, shared by the commands managing it.
+type storeOptions struct {
+	path       *string
+	key        *string
+	passphrase *string
+}
+
+// storeFlags registers the credential store flags, defaulting to the environment variables of the serve flags.
+func storeFlags(fs *pflag.FlagSet) *storeOptions {
+	return &storeOptions{
+		path:       fs.String("credential-store", os.Getenv("GH_PROXY_CREDENTIAL_STORE"), "Path of the credential store file"),
+		key:        fs.String("credential-store-key", os.Getenv("GH_PROXY_CREDENTIAL_STORE_KEY"), "AES-256 key encrypting the credential store, as a file path or 'kms:' followed by the path of a KMS-encrypted data key"),
+		passphrase: fs.String("credential-store-passphrase", os.Getenv("GH_PROXY_CREDENTIAL_STORE_PASSPHRASE"), "Passphrase encrypting the credential store"),
+	}
+}
+
+// open loads the credential store, returning its cipher to save it with.
+func (o *storeOptions) open(ctx context.Context) (*CredentialStore, *CredentialStoreCipher, error) {
+	if *o.path == "" {
+		return nil, nil, errors.New("--credential-store is required")
+	}
+	cipher, err := NewCredentialStoreCipher(ctx, *o.key, *o.passphrase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("NewCredentialStoreCipher failed: %w", err)
+	}
+	store, err := LoadCredentialStore(*o.path, cipher)
+	if err != nil {
+		return nil, nil, fmt.Errorf("LoadCredentialStore failed: %w", err)
+	}
+	return store, cipher, nil
+}
+
+// add adds the credential to the store, unless a credential with the same ID is already stored.
+func (s *CredentialStore) add(credential StoredCredential) error {
+	id := credential.ID()
+	if slices.ContainsFunc(s.Credentials, func(c StoredCredential) bool { return c.ID() == id }) {
+		return fmt.Errorf("%w: %s", ErrCredentialExists, id)
+	}
+	s.Credentials = append(s.Credentials, credential)
+	return nil
+}
+
+// credentialsAdd implements 'credentials add [--kind KIND] [--name NAME] [params]', reading the params from stdin
+// if they are not given (so they do not end up in the shell history).
+func credentialsAdd(ctx context.Context, args []string) error {
+	fs := pflag.NewFlagSet("credentials add", pflag.ContinueOnError)
+	options := storeFlags(fs)
+	kind := fs.String("kind", "token", "Type of the credential, one of oauth, app or token")
+	name := fs.String("name", "", "Name of the stored credential (ex: the login it belongs to)")
+	if err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+	var params string
+	switch len(fs.Args()) {
+	case 0:
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(nil, 1<<20)
+		var lines []string
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("(*bufio.Scanner).Scan failed: %w", err)
+		}
+		// A PEM private key of a GitHub App spans several lines.
+		params = strings.TrimSpace(strings.Join(lines, "\n"))
+	case 1:
+		params = fs.Arg(0)
+	default:
+		return errors.New("credentials add takes a single credential")
+	}
+	credential := StoredCredential{Kind: *kind, Params: params, Name: *name, Added: time.Now().UTC()}
+
+	// Parse the credential exactly as the proxy will.
+	var cfg Config
+	if err := (&CredentialStore{Credentials: []StoredCredential{credential}}).Apply(&cfg); err != nil {
+		return err
+	}
+	if _, err := NewCredentials(ctx, &cfg, http.DefaultTransport); err != nil {
+		return fmt.Errorf("NewCredentials failed: %w", err)
+	}
+
+	store, cipher, err := options.open(ctx)
+	if err != nil {
+		return err
+	}
+	if err := store.add(credential); err != nil {
+		return err
+	}
+	if err := store.Save(*options.path, cipher); err != nil {
+		return fmt.Errorf("(*CredentialStore).Save failed: %w", err)
+	}
+	fmt.Printf("added %s credential %s\n", credential.Kind, credential.ID())
+	return nil
+}
+
+// credentialsRemove implements 'credentials remove ID|NAME...'.
+func credentialsRemove(ctx context.Context, args []string) error {
+	fs := pflag.NewFlagSet("credentials remove", pflag.ContinueOnError)
+	options := storeFlags(fs)
+	if err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+	if len(fs.Args()) == 0 {
+		return errors.New("credentials remove requires the ID or name of a credential")
+	}
+	store, cipher, err := options.open(ctx)
+	if err != nil {
+		return err
+	}
+	for _, arg := range fs.Args() {
+		idx := slices.IndexFunc(store.Credentials, func(c StoredCredential) bool { return c.ID() == arg || (c.Name != "" && c.Name == arg) })
+		if idx < 0 {
+			return fmt.Errorf("%w: %s", ErrCredentialNotFound, arg)
+		}
+		fmt.Printf("removed %s credential %s\n", store.Credentials[idx].Kind, store.Credentials[idx].ID())
+		store.Credentials = slices.Delete(store.Credentials, idx, idx+1)
+	}
+	if err := store.Save(*options.path, cipher); err != nil {
+		return fmt.Errorf("(*CredentialStore).Save failed: %w", err)
+	}
+	return nil
+}
+
+// credentialsList implements 'credentials list', the secrets of the credentials are never printed.
+func credentialsList(ctx context.Context, args []string) error {
+	fs := pflag.NewFlagSet("credentials list", pflag.ContinueOnError)
+	options := storeFlags(fs)
+	if err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+	store, _, err := options.open(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tNAME\tADDED")
+	for _, credential := range store.Credentials {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", credential.ID(), credential.Kind, credential.Name, credential.Added.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
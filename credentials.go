@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ghauth "github.com/bored-engineer/github-auth-http-transport"
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
+)
+
+// Credential is a single authentication credential in the balancing pool.
+type Credential struct {
+	// ID is the (non-secret) identifier of the credential used for metric labels and logging.
+	ID string
+	// Kind is the type of credential, one of "oauth", "app" or "token".
+	Kind string
+	// Transport authenticates requests and tracks the rate-limits of the credential.
+	Transport *ghratelimit.Transport
+	// updated is the time (in Unix nanoseconds) the rate-limits were last updated by a response.
+	updated atomic.Int64
+	// gauges are the rateGauges of each resource, the labels are only resolved once rather than on every response.
+	gauges sync.Map
+}
+
+// rateGauges are the rate-limit gauges of a credential for a resource.
+type rateGauges struct {
+	remaining prometheus.Gauge
+	reset     prometheus.Gauge
+}
+
+// rateGauges returns the rate-limit gauges of the resource.
+func (c *Credential) rateGauges(resource ghratelimit.Resource) *rateGauges {
+	if gauges, ok := c.gauges.Load(resource); ok {
+		return gauges.(*rateGauges)
+	}
+	gauges, _ := c.gauges.LoadOrStore(resource, &rateGauges{
+		remaining: RateLimitRemaining.WithLabelValues(c.ID, resource.String()),
+		reset:     RateLimitReset.WithLabelValues(c.ID, resource.String()),
+	})
+	return gauges.(*rateGauges)
+}
+
+// Updated returns the time the rate-limits were last updated by a response (from traffic or polling).
+func (c *Credential) Updated() time.Time {
+	return time.Unix(0, c.updated.Load())
+}
+
+// NewCredential creates a Credential whose rate-limits are reported via the Prometheus metrics.
+func NewCredential(kind string, id string, base http.RoundTripper) *Credential {
+	credential := &Credential{
+		ID:   id,
+		Kind: kind,
+	}
+	credential.Transport = &ghratelimit.Transport{
+		Base: base,
+		Limits: ghratelimit.Limits{
+			Notify: func(resp *http.Response, resource ghratelimit.Resource, rate *ghratelimit.Rate) {
+				gauges := credential.rateGauges(resource)
+				gauges.remaining.Set(float64(rate.Remaining))
+				gauges.reset.Set(float64(rate.Reset))
+				// Rates shared by other replicas (without a response) don't reflect this replica's traffic.
+				if resp != nil {
+					credential.updated.Store(time.Now().UnixNano())
+				}
+			},
+		},
+	}
+	return credential
+}
+
+// tokenID returns the ID of a token credential, the base64-encoded SHA-256 of the token.
+func tokenID(token string) string {
+	hashed := sha256.Sum256([]byte(token))
+	return base64.StdEncoding.EncodeToString(hashed[:])
+}
+
+// NewCredentials creates a Credential for each of the configured OAuth clients, GitHub Apps and tokens.
+// The errors never include the secret parameters, only the index (or non-secret identifier) of the credential.
+func NewCredentials(ctx context.Context, cfg *Config, transport http.RoundTripper) ([]*Credential, error) {
+	var credentials []*Credential
+	var rules []ScopeRule
+	for _, spec := range cfg.AuthAppScope {
+		rule, err := ParseScopeRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("ParseScopeRule failed: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	apiURL, err := url.Parse(cfg.APIURL)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse failed: %w", err)
+	}
+	// If using OAuth credentials, just use basic auth.
+	for idx, params := range cfg.AuthOAuth {
+		clientID, clientSecret, ok := strings.Cut(params, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid OAuth client at index %d", idx)
+		}
+		authTransport, err := ghauth.Basic(transport, clientID, clientSecret)
+		if err != nil {
+			return nil, fmt.Errorf("ghauth.Basic for %q failed: %w", clientID, err)
+		}
+		credentials = append(credentials, NewCredential("oauth", clientID, authTransport))
+	}
+	// If using GitHub App credentials, use the GitHub App transport.
+	for idx, appParams := range cfg.AuthApp {
+		appID, appParams, ok := strings.Cut(appParams, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid GitHub App at index %d", idx)
+		}
+		installationID, privateKey, ok := strings.Cut(appParams, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid GitHub App %q at index %d", appID, idx)
+		}
+		ts, err := ghauth.App(ctx, appID, installationID, privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("ghauth.App for %q failed: %w", appID, err)
+		}
+		id := appID + ":" + installationID
+		if len(rules) == 0 {
+			credentials = append(credentials, NewCredential("app", id, &oauth2.Transport{
+				Base:   transport,
+				Source: ts,
+			}))
+			continue
+		}
+		key, err := parseAppKey(privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("parseAppKey for %q failed: %w", appID, err)
+		}
+		credentials = append(credentials, NewCredential("app", id, &ScopedTokenTransport{
+			Base:           transport,
+			Source:         ts,
+			URL:            apiURL,
+			Credential:     id,
+			AppID:          appID,
+			InstallationID: installationID,
+			Key:            key,
+			Rules:          rules,
+		}))
+	}
+	for _, token := range cfg.AuthToken {
+		credentials = append(credentials, NewCredential("token", tokenID(token), &oauth2.Transport{
+			Base:   transport,
+			Source: oauth2.StaticTokenSource(ghauth.Token(token)),
+		}))
+	}
+	return credentials, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// credentialStoreInterval is the interval the credential store file is checked for changes at.
+const credentialStoreInterval = 10 * time.Second
+
+// StoredCredential is a credential of the CredentialStore, in the same format as the corresponding --auth-* flag.
+type StoredCredential struct {
+	// Kind is the type of credential, one of "oauth", "app" or "token".
+	Kind   string `json:"kind"`
+	Params string `json:"params"`
+	// Name (optional) describes the credential, ex: the login it was created for.
+	Name  string    `json:"name,omitempty"`
+	Added time.Time `json:"added_at"`
+}
+
+// ID returns the ID the credential has in the pool (see NewCredentials).
+func (c StoredCredential) ID() string {
+	switch c.Kind {
+	case "token":
+		return tokenID(c.Params)
+	case "app":
+		appID, params, _ := strings.Cut(c.Params, ":")
+		installationID, _, _ := strings.Cut(params, ":")
+		return appID + ":" + installationID
+	}
+	clientID, _, _ := strings.Cut(c.Params, ":")
+	return clientID
+}
+
+// CredentialStore is a file of credentials managed by the proxy (see the login and credentials commands), optionally
+// encrypted, loaded in addition to the --auth-* flags and watched for changes while the proxy is running.
+type CredentialStore struct {
+	Credentials []StoredCredential `json:"credentials"`
+}
+
+// credentialStoreIterations is the number of PBKDF2 iterations deriving the key of a passphrase.
+const credentialStoreIterations = 600_000
+
+// credentialStoreAD is the additional data of the sealed credential stores.
+var credentialStoreAD = []byte("github-api-proxy credential store")
+
+// credentialStoreFile is the format of the credential store file, either the plaintext Credentials or the Sealed
+// (AES-256-GCM encrypted) JSON of the CredentialStore.
+type credentialStoreFile struct {
+	Credentials []StoredCredential `json:"credentials,omitempty"`
+	Sealed      []byte             `json:"sealed,omitempty"`
+	// KeyID identifies the EncryptionKey the store is sealed with, unless it is sealed with a passphrase.
+	KeyID      string `json:"key_id,omitempty"`
+	Salt       []byte `json:"salt,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+}
+
+// CredentialStoreCipher encrypts the credential store file, with either the Key or a key derived from the Passphrase.
+type CredentialStoreCipher struct {
+	Key        *EncryptionKey
+	Passphrase string
+}
+
+// NewCredentialStoreCipher returns the cipher of the key (in the format of LoadEncryptionKey) or the passphrase, nil
+// if neither is set (the store is plaintext).
+func NewCredentialStoreCipher(ctx context.Context, key string, passphrase string) (*CredentialStoreCipher, error) {
+	switch {
+	case key != "" && passphrase != "":
+		return nil, errors.New("only one of a key or passphrase can encrypt the credential store")
+	case key != "":
+		encryptionKey, err := LoadEncryptionKey(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("LoadEncryptionKey failed: %w", err)
+		}
+		return &CredentialStoreCipher{Key: encryptionKey}, nil
+	case passphrase != "":
+		return &CredentialStoreCipher{Passphrase: passphrase}, nil
+	}
+	return nil, nil
+}
+
+// key returns the key of the salt, derived from the passphrase.
+func (c *CredentialStoreCipher) key(salt []byte, iterations int) (*EncryptionKey, error) {
+	if c.Key != nil {
+		return c.Key, nil
+	}
+	derived, err := pbkdf2.Key(sha256.New, c.Passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("pbkdf2.Key failed: %w", err)
+	}
+	return NewEncryptionKey(derived)
+}
+
+// seal encrypts the JSON of the store.
+func (c *CredentialStoreCipher) seal(plaintext []byte) (*credentialStoreFile, error) {
+	file := &credentialStoreFile{}
+	if c.Key != nil {
+		file.KeyID = c.Key.ID
+	} else {
+		file.Salt = make([]byte, 16)
+		_, _ = rand.Read(file.Salt)
+		file.Iterations = credentialStoreIterations
+	}
+	key, err := c.key(file.Salt, file.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(plaintext)+key.aead.Overhead())
+	_, _ = rand.Read(nonce)
+	file.Sealed = key.aead.Seal(nonce, nonce, plaintext, credentialStoreAD)
+	return file, nil
+}
+
+// open decrypts the JSON of the store.
+func (c *CredentialStoreCipher) open(file *credentialStoreFile) ([]byte, error) {
+	if c.Key != nil && file.KeyID != c.Key.ID {
+		return nil, fmt.Errorf("the credential store is not encrypted with the key %s", c.Key.ID)
+	}
+	if c.Key == nil && file.KeyID != "" {
+		return nil, fmt.Errorf("the credential store is encrypted with the key %s, not a passphrase", file.KeyID)
+	}
+	key, err := c.key(file.Salt, file.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Sealed) < key.aead.NonceSize() {
+		return nil, errors.New("the sealed credential store is truncated")
+	}
+	nonce, sealed := file.Sealed[:key.aead.NonceSize()], file.Sealed[key.aead.NonceSize():]
+	plaintext, err := key.aead.Open(nil, nonce, sealed, credentialStoreAD)
+	if err != nil {
+		return nil, fmt.Errorf("(cipher.AEAD).Open failed (wrong key or passphrase?): %w", err)
+	}
+	return plaintext, nil
+}
+
+// LoadCredentialStore reads the credential store file, a missing file is an empty store. A sealed store requires the
+// cipher, a plaintext store is read as is (and sealed once saved with a cipher).
+func LoadCredentialStore(path string, cipher *CredentialStoreCipher) (*CredentialStore, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &CredentialStore{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("os.ReadFile failed: %w", err)
+	}
+	var file credentialStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed: %w", err)
+	}
+	if file.Sealed == nil {
+		return &CredentialStore{Credentials: file.Credentials}, nil
+	}
+	if cipher == nil {
+		return nil, errors.New("the credential store is encrypted, a key or passphrase is required")
+	}
+	plaintext, err := cipher.open(&file)
+	if err != nil {
+		return nil, err
+	}
+	var store CredentialStore
+	if err := json.Unmarshal(plaintext, &store); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed: %w", err)
+	}
+	return &store, nil
+}
+
+// Save atomically writes the credential store file (sealed with the cipher, if any), only readable by the owner.
+func (s *CredentialStore) Save(path string, cipher *CredentialStoreCipher) error {
+	file := &credentialStoreFile{Credentials: s.Credentials}
+	if cipher != nil {
+		plaintext, err := json.Marshal(s)
+		if err != nil {
+			return fmt.Errorf("json.Marshal failed: %w", err)
+		}
+		if file, err = cipher.seal(plaintext); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent failed: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp failed: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("(*os.File).Write failed: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("(*os.File).Close failed: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("os.Rename failed: %w", err)
+	}
+	return nil
+}
+
+// Apply adds the credentials of the store to the --auth-* flags of the configuration.
+func (s *CredentialStore) Apply(cfg *Config) error {
+	for idx, credential := range s.Credentials {
+		switch credential.Kind {
+		case "oauth":
+			cfg.AuthOAuth = append(cfg.AuthOAuth, credential.Params)
+		case "app":
+			cfg.AuthApp = append(cfg.AuthApp, credential.Params)
+		case "token":
+			cfg.AuthToken = append(cfg.AuthToken, credential.Params)
+		default:
+			return fmt.Errorf("unknown credential kind %q at index %d", credential.Kind, idx)
+		}
+	}
+	return nil
+}
+
+// credentials creates the Credential of each stored credential by ID, registering their secrets.
+func (s *CredentialStore) credentials(ctx context.Context, cfg *Config, transport http.RoundTripper) (map[string]*Credential, error) {
+	// Only the credentials of the store, with the same scoping of the GitHub Apps as the flags.
+	stored := Config{APIURL: cfg.APIURL, AuthAppScope: cfg.AuthAppScope}
+	if err := s.Apply(&stored); err != nil {
+		return nil, err
+	}
+	stored.RegisterSecrets(DefaultScrubber)
+	credentials, err := NewCredentials(ctx, &stored, transport)
+	if err != nil {
+		return nil, fmt.Errorf("NewCredentials failed: %w", err)
+	}
+	byID := make(map[string]*Credential, len(credentials))
+	for _, credential := range credentials {
+		byID[credential.ID] = credential
+	}
+	return byID, nil
+}
+
+// WatchCredentialStore adds the credentials added to the store file to the pool (and removes the removed ones) until
+// the context is cancelled, the credentials of the store at startup are already in the pool.
+func WatchCredentialStore(ctx context.Context, cfg *Config, cipher *CredentialStoreCipher, pool *CredentialPool, transport http.RoundTripper) {
+	path := cfg.CredentialStore
+	var modified time.Time
+	if info, err := os.Stat(path); err == nil {
+		modified = info.ModTime()
+	}
+	known := make(map[string]bool)
+	if store, err := LoadCredentialStore(path, cipher); err == nil {
+		if credentials, err := store.credentials(ctx, cfg, transport); err == nil {
+			for id := range credentials {
+				known[id] = true
+			}
+		}
+	}
+	ticker := time.NewTicker(credentialStoreInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modified) {
+			continue
+		}
+		modified = info.ModTime()
+		store, err := LoadCredentialStore(path, cipher)
+		if err != nil {
+			log.Error().Err(err).Str("path", path).Msg("LoadCredentialStore failed")
+			continue
+		}
+		credentials, err := store.credentials(ctx, cfg, transport)
+		if err != nil {
+			log.Error().Err(DefaultScrubber.ScrubError(err)).Str("path", path).Msg("(*CredentialStore).credentials failed")
+			continue
+		}
+		for id, credential := range credentials {
+			if known[id] {
+				continue
+			}
+			// A stored credential may also be configured by a flag.
+			if err := pool.Add(credential); err != nil && !errors.Is(err, ErrCredentialExists) {
+				log.Error().Err(err).Str("credential", id).Msg("(*CredentialPool).Add failed")
+				continue
+			}
+			known[id] = true
+			log.Warn().Str("credential", id).Str("kind", credential.Kind).Msg("credential added")
+		}
+		for id := range known {
+			if _, ok := credentials[id]; ok {
+				continue
+			}
+			if _, err := pool.Remove(id); err != nil {
+				log.Error().Err(err).Str("credential", id).Msg("(*CredentialPool).Remove failed")
+				continue
+			}
+			delete(known, id)
+			log.Warn().Str("credential", id).Msg("credential removed")
+		}
+	}
+}
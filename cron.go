@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is the set of values matched by a single cron field.
+type cronField map[int]bool
+
+// parseCronField parses a single cron field supporting "*", lists ("1,2"), ranges ("1-5") and steps ("*/15").
+func parseCronField(field string, low, high int) (cronField, error) {
+	matched := cronField{}
+	for part := range strings.SplitSeq(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step %q", part)
+			}
+			step = n
+		}
+		start, end := low, high
+		if rng != "*" {
+			startStr, endStr, isRange := strings.Cut(rng, "-")
+			n, err := strconv.Atoi(startStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			start, end = n, n
+			if isRange {
+				if end, err = strconv.Atoi(endStr); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			} else if hasStep {
+				end = high
+			}
+		}
+		if start < low || end > high || start > end {
+			return nil, fmt.Errorf("%q out of range [%d-%d]", part, low, high)
+		}
+		for n := start; n <= end; n += step {
+			matched[n] = true
+		}
+	}
+	return matched, nil
+}
+
+// CronSchedule is a parsed (standard, 5 field) cron expression.
+type CronSchedule struct {
+	minute, hour, dom, month, dow cronField
+}
+
+// ParseCron parses a standard 5 field cron expression: "minute hour day-of-month month day-of-week".
+func ParseCron(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in cron expression %q, got %d", expr, len(fields))
+	}
+	var s CronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid minute field: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid hour field: %w", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid day-of-month field: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid month field: %w", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid day-of-week field: %w", err)
+	}
+	if s.dow[7] {
+		s.dow[0] = true // Both 0 and 7 are Sunday
+	}
+	return &s, nil
+}
+
+// Matches reports if the (minute-truncated) time matches the schedule.
+func (s *CronSchedule) Matches(t time.Time) bool {
+	return s.minute[t.Minute()] && s.hour[t.Hour()] && s.dom[t.Day()] &&
+		s.month[int(t.Month())] && s.dow[int(t.Weekday())]
+}
+
+// CronWindow is a recurring window of time that starts at each match of the schedule and lasts for the duration.
+type CronWindow struct {
+	Schedule *CronSchedule
+	Duration time.Duration
+}
+
+// ParseCronWindow parses a cron expression followed by a duration, ex: "0 17 * * 5 64h".
+func ParseCronWindow(spec string) (*CronWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("expected a cron expression followed by a duration, got %q", spec)
+	}
+	schedule, err := ParseCron(strings.Join(fields[:5], " "))
+	if err != nil {
+		return nil, err
+	}
+	duration, err := time.ParseDuration(fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration: %w", err)
+	}
+	return &CronWindow{Schedule: schedule, Duration: duration}, nil
+}
+
+// Active reports if the time falls within any window started by the schedule.
+func (w *CronWindow) Active(t time.Time) bool {
+	t = t.Truncate(time.Minute)
+	for start := t; t.Sub(start) < w.Duration; start = start.Add(-time.Minute) {
+		if w.Schedule.Matches(start) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"cmp"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// DashboardError is a recent failed request shown on the dashboard.
+type DashboardError struct {
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Status  int       `json:"status,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// DashboardRate is the rate-limit of a single credential resource.
+type DashboardRate struct {
+	Credential string `json:"credential"`
+	Kind       string `json:"kind"`
+	Resource   string `json:"resource"`
+	Limit      uint64 `json:"limit"`
+	Remaining  uint64 `json:"remaining"`
+	Reset      uint64 `json:"reset"`
+}
+
+// DashboardRoute is the usage of a single route (across all clients) in the current usage window.
+type DashboardRoute struct {
+	Method   string `json:"method"`
+	Route    string `json:"route"`
+	Requests uint64 `json:"requests"`
+	Cached   uint64 `json:"cached"`
+	Errors   uint64 `json:"errors"`
+}
+
+// DashboardData is the snapshot rendered by the dashboard UI.
+type DashboardData struct {
+	Now         time.Time        `json:"now"`
+	WindowStart time.Time        `json:"window_start,omitzero"`
+	Requests    uint64           `json:"requests"`
+	Cached      uint64           `json:"cached"`
+	Rates       []DashboardRate  `json:"rates"`
+	Routes      []DashboardRoute `json:"routes"`
+	Errors      []DashboardError `json:"errors"`
+}
+
+// Dashboard serves the /admin/ui web UI, it also records the recent errors as a transport.
+type Dashboard struct {
+	Base  http.RoundTripper
+	Pool  *CredentialPool
+	Usage *UsageTransport
+	// Capacity is the number of recent errors retained.
+	Capacity int
+	// Top is the number of routes shown.
+	Top int
+
+	mu     sync.Mutex
+	errors []DashboardError
+}
+
+// record retains the error, discarding the oldest if at capacity.
+func (d *Dashboard) record(entry DashboardError) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.errors = append(d.errors, entry)
+	if len(d.errors) > d.Capacity {
+		d.errors = slices.Delete(d.errors, 0, len(d.errors)-d.Capacity)
+	}
+}
+
+func (d *Dashboard) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := d.Base.RoundTrip(req)
+	if err != nil {
+		d.record(DashboardError{Time: time.Now(), Method: req.Method, Path: req.URL.Path, Message: DefaultScrubber.ScrubError(err).Error()})
+	} else if resp.StatusCode >= 500 {
+		d.record(DashboardError{Time: time.Now(), Method: req.Method, Path: req.URL.Path, Status: resp.StatusCode})
+	}
+	return resp, err
+}
+
+// Data returns the current dashboard snapshot.
+func (d *Dashboard) Data() DashboardData {
+	data := DashboardData{Now: time.Now(), Rates: []DashboardRate{}, Routes: []DashboardRoute{}}
+	for _, credential := range d.Pool.Credentials() {
+		for resource, rate := range credential.Transport.Limits.Iter() {
+			data.Rates = append(data.Rates, DashboardRate{
+				Credential: credential.ID,
+				Kind:       credential.Kind,
+				Resource:   resource.String(),
+				Limit:      rate.Limit,
+				Remaining:  rate.Remaining,
+				Reset:      rate.Reset,
+			})
+		}
+	}
+	slices.SortFunc(data.Rates, func(a, b DashboardRate) int {
+		return cmp.Or(cmp.Compare(a.Resource, b.Resource), cmp.Compare(a.Credential, b.Credential))
+	})
+
+	if windows := d.Usage.Windows(0); len(windows) > 0 {
+		current := windows[len(windows)-1]
+		data.WindowStart = current.Start
+		routes := make(map[UsageKey]*DashboardRoute)
+		for _, count := range current.Counts {
+			data.Requests += count.Requests
+			data.Cached += count.Cached
+			key := UsageKey{Method: count.Method, Route: count.Route}
+			route, ok := routes[key]
+			if !ok {
+				route = &DashboardRoute{Method: count.Method, Route: count.Route}
+				routes[key] = route
+			}
+			route.Requests += count.Requests
+			route.Cached += count.Cached
+			route.Errors += count.Errors
+		}
+		for _, route := range routes {
+			data.Routes = append(data.Routes, *route)
+		}
+		slices.SortFunc(data.Routes, func(a, b DashboardRoute) int {
+			return cmp.Or(cmp.Compare(b.Requests, a.Requests), cmp.Compare(a.Route, b.Route))
+		})
+		if d.Top > 0 && len(data.Routes) > d.Top {
+			data.Routes = data.Routes[:d.Top]
+		}
+	}
+
+	d.mu.Lock()
+	data.Errors = slices.Clone(d.errors)
+	d.mu.Unlock()
+	slices.Reverse(data.Errors) // Newest first
+	if data.Errors == nil {
+		data.Errors = []DashboardError{}
+	}
+	return data
+}
+
+// ServeHTTP serves the UI at /admin/ui and its data at /admin/ui/data.
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	switch strings.TrimSuffix(req.URL.Path, "/") {
+	case "/admin/ui":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		_, _ = w.Write(dashboardHTML)
+	case "/admin/ui/data":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(d.Data()); err != nil {
+			log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	DeltaResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "delta_responses_total",
+		Subsystem: "github",
+		Help:      "Number of responses to delta requests by result (full, patch, skipped)",
+	}, []string{"result"})
+)
+
+// DeltaHeader is the request header opting in to delta responses, its value is the sync token of the last response
+// the client received (or any other value, ex: "start", for the first request).
+const DeltaHeader = "X-Proxy-Delta"
+
+// DeltaTokenHeader is the response header carrying the sync token of the (full) response.
+const DeltaTokenHeader = "X-Proxy-Delta-Token"
+
+// JSONPatchMediaType is the Content-Type of a delta response (RFC 6902).
+const JSONPatchMediaType = "application/json-patch+json"
+
+// maxDeltaBody is the maximum size of a response body kept for delta responses, larger responses are always full.
+const maxDeltaBody = 8 << 20
+
+// JSONPatchOp is a single operation of a JSON Patch (RFC 6902).
+type JSONPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// patchValue encodes the value of an add (or replace) operation, the values were decoded from JSON so always encode.
+func patchValue(value any) json.RawMessage {
+	b, _ := json.Marshal(value)
+	return b
+}
+
+// decodeJSON decodes the JSON value, preserving the precision of large integers (ex: database IDs).
+func decodeJSON(b []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("(*json.Decoder).Decode failed: %w", err)
+	}
+	return value, nil
+}
+
+// pointerToken escapes an object key (or array index) as a JSON pointer reference token (RFC 6901).
+func pointerToken(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// sameItem reports if the array items are the same item, objects with an "id" (ex: issues) are the same item even if
+// their other fields changed, other values only if they are equal.
+func sameItem(a, b any) bool {
+	ao, aok := a.(map[string]any)
+	bo, bok := b.(map[string]any)
+	if aok && bok {
+		if aid, ok := ao["id"]; ok {
+			return reflect.DeepEqual(aid, bo["id"])
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// jsonPatch appends the operations transforming the previous JSON value at the path into the current one. Arrays are
+// compared by trimming their common leading and trailing items, so items added to (or removed from) either end of a
+// list (ex: the newest items of a paginated list) are single operations instead of shifting every item.
+func jsonPatch(path string, previous, current any, ops []JSONPatchOp) []JSONPatchOp {
+	switch p := previous.(type) {
+	case map[string]any:
+		c, ok := current.(map[string]any)
+		if !ok {
+			break
+		}
+		for _, key := range slices.Sorted(maps.Keys(p)) {
+			if _, ok := c[key]; !ok {
+				ops = append(ops, JSONPatchOp{Op: "remove", Path: path + "/" + pointerToken(key)})
+			}
+		}
+		for _, key := range slices.Sorted(maps.Keys(c)) {
+			if pv, ok := p[key]; ok {
+				ops = jsonPatch(path+"/"+pointerToken(key), pv, c[key], ops)
+			} else {
+				ops = append(ops, JSONPatchOp{Op: "add", Path: path + "/" + pointerToken(key), Value: patchValue(c[key])})
+			}
+		}
+		return ops
+	case []any:
+		c, ok := current.([]any)
+		if !ok {
+			break
+		}
+		prefix := 0
+		for prefix < len(p) && prefix < len(c) && sameItem(p[prefix], c[prefix]) {
+			prefix++
+		}
+		suffix := 0
+		for suffix < len(p)-prefix && suffix < len(c)-prefix && sameItem(p[len(p)-1-suffix], c[len(c)-1-suffix]) {
+			suffix++
+		}
+		for idx := range prefix {
+			ops = jsonPatch(path+"/"+strconv.Itoa(idx), p[idx], c[idx], ops)
+		}
+		// The operations are applied in order, so the removed items are always at the (same) first differing index.
+		for range len(p) - prefix - suffix {
+			ops = append(ops, JSONPatchOp{Op: "remove", Path: path + "/" + strconv.Itoa(prefix)})
+		}
+		for idx := prefix; idx < len(c)-suffix; idx++ {
+			ops = append(ops, JSONPatchOp{Op: "add", Path: path + "/" + strconv.Itoa(idx), Value: patchValue(c[idx])})
+		}
+		for offset := range suffix {
+			ops = jsonPatch(path+"/"+strconv.Itoa(len(c)-suffix+offset), p[len(p)-suffix+offset], c[len(c)-suffix+offset], ops)
+		}
+		return ops
+	default:
+		if reflect.DeepEqual(previous, current) {
+			return ops
+		}
+	}
+	return append(ops, JSONPatchOp{Op: "replace", Path: path, Value: patchValue(current)})
+}
+
+// deltaToken returns the sync token of a response body.
+func deltaToken(body []byte) string {
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:16])
+}
+
+// deltaURL returns the (synthetic) URL of the last response of the URL to the client.
+func deltaURL(client string, u *url.URL) *url.URL {
+	key := sha256.New()
+	key.Write([]byte(client))
+	key.Write([]byte{0})
+	key.Write([]byte(u.String()))
+	return &url.URL{Scheme: "https", Host: DerivedHost, Path: "/delta/" + hex.EncodeToString(key.Sum(nil))}
+}
+
+// DeltaTransport returns only the changes since the last response to the client for the GET requests with the
+// DeltaHeader, ex: for pollers repeatedly fetching the same large list. The last (JSON) response of each URL is stored
+// per client (see ClientIdentity), if the token of the request matches it the response is a JSON Patch (RFC 6902) of
+// the added, removed and changed items instead of the full body. Every response has the DeltaTokenHeader to send next.
+type DeltaTransport struct {
+	Base    http.RoundTripper
+	Storage ghtransport.Storage
+}
+
+func (t *DeltaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := req.Header.Get(DeltaHeader)
+	if token == "" {
+		return t.Base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Del(DeltaHeader)
+	if req.Method != http.MethodGet {
+		return t.Base.RoundTrip(req)
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || !jsonMediaType(resp.Header) || resp.ContentLength > maxDeltaBody {
+		if err == nil {
+			DeltaResponses.WithLabelValues("skipped").Inc()
+		}
+		return resp, err
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		DeltaResponses.WithLabelValues("skipped").Inc()
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDeltaBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+	}
+	if len(body) > maxDeltaBody {
+		DeltaResponses.WithLabelValues("skipped").Inc()
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	current, err := decodeJSON(body)
+	if err != nil {
+		DeltaResponses.WithLabelValues("skipped").Inc()
+		return resp, nil
+	}
+
+	// Load the last response to the client, before it is replaced by this one.
+	snapshot := (&http.Request{Method: http.MethodGet, URL: deltaURL(ClientFromContext(req.Context()), req.URL)}).WithContext(req.Context())
+	var previous []byte
+	if cached, err := t.Storage.Get(req.Context(), snapshot); err != nil {
+		log.Warn().Err(err).Msg("(ghtransport.Storage).Get failed")
+	} else if cached != nil {
+		if cached.Header.Get(DeltaTokenHeader) == token {
+			if previous, err = io.ReadAll(cached.Body); err != nil {
+				log.Warn().Err(err).Msg("(*http.Response).Body.Read failed")
+				previous = nil
+			}
+		}
+		cached.Body.Close()
+	}
+	next := deltaToken(body)
+	if next != token {
+		if err := t.Storage.Put(req.Context(), &http.Response{
+			Status:        http.StatusText(http.StatusOK),
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/json"}, DeltaTokenHeader: {next}},
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       snapshot,
+		}); err != nil {
+			log.Warn().Err(err).Msg("(ghtransport.Storage).Put failed")
+		}
+	}
+	resp.Header.Set(DeltaTokenHeader, next)
+
+	if previous == nil {
+		DeltaResponses.WithLabelValues("full").Inc()
+		return resp, nil
+	}
+	last, err := decodeJSON(previous)
+	if err != nil {
+		DeltaResponses.WithLabelValues("full").Inc()
+		return resp, nil
+	}
+	patch, err := json.Marshal(jsonPatch("", last, current, []JSONPatchOp{}))
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed: %w", err)
+	}
+	DeltaResponses.WithLabelValues("patch").Inc()
+	resp.Body = io.NopCloser(bytes.NewReader(patch))
+	resp.ContentLength = int64(len(patch))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(patch)))
+	resp.Header.Set("Content-Type", JSONPatchMediaType)
+	resp.Header.Del("Etag")
+	return resp, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	DeprecatedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "deprecated_requests_total",
+		Subsystem: "github",
+		Help:      "Number of requests to endpoints that GitHub reported as deprecated via the Deprecation/Sunset headers",
+	}, []string{"method", "route", "client"})
+)
+
+// deprecationKey identifies a deprecated endpoint being called by a specific client.
+type deprecationKey struct {
+	Method string
+	Route  string
+	Client string
+}
+
+// deprecationUsage is the accumulated usage for a deprecationKey.
+type deprecationUsage struct {
+	Count       uint64
+	Deprecation string
+	Sunset      string
+}
+
+// DeprecationTransport tracks responses containing the Deprecation and/or Sunset headers.
+// https://datatracker.ietf.org/doc/html/rfc9745 and https://datatracker.ietf.org/doc/html/rfc8594
+type DeprecationTransport struct {
+	Base http.RoundTripper
+
+	mu    sync.Mutex
+	usage map[deprecationKey]*deprecationUsage
+}
+
+func (t *DeprecationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	deprecation, sunset := resp.Header.Get("Deprecation"), resp.Header.Get("Sunset")
+	if deprecation == "" && sunset == "" {
+		return resp, nil
+	}
+	key := deprecationKey{
+		Method: req.Method,
+		Route:  RouteTemplate(req.URL.Path),
+		Client: ClientFromContext(req.Context()),
+	}
+	DeprecatedRequests.WithLabelValues(key.Method, key.Route, ClientLabels.Value(key.Client)).Inc()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.usage == nil {
+		t.usage = make(map[deprecationKey]*deprecationUsage)
+	}
+	usage, ok := t.usage[key]
+	if !ok {
+		usage = &deprecationUsage{}
+		t.usage[key] = usage
+	}
+	usage.Count++
+	usage.Deprecation = deprecation
+	usage.Sunset = sunset
+	return resp, nil
+}
+
+// Report logs a warning for every deprecated endpoint called since the last report, then resets the usage.
+func (t *DeprecationTransport) Report() {
+	t.mu.Lock()
+	usage := t.usage
+	t.usage = nil
+	t.mu.Unlock()
+
+	for key, usage := range usage {
+		evt := log.Warn().
+			Str("method", key.Method).
+			Str("route", key.Route).
+			Uint64("count", usage.Count)
+		if key.Client != "" {
+			evt = evt.Str("client", key.Client)
+		}
+		if usage.Deprecation != "" {
+			evt = evt.Str("deprecation", usage.Deprecation)
+		}
+		if usage.Sunset != "" {
+			evt = evt.Str("sunset", usage.Sunset)
+		}
+		evt.Msg("deprecated endpoint called")
+	}
+}
+
+// Poll calls (*DeprecationTransport).Report every interval until the context is cancelled.
+func (t *DeprecationTransport) Poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			t.Report()
+			return
+		case <-ticker.C:
+			t.Report()
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	UpstreamDials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "upstream_dials_total",
+		Subsystem: "github",
+		Help:      "Number of dials of the resolved upstream addresses by address and result (connected, failed)",
+	}, []string{"address", "result"})
+	DNSRefreshes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "dns_refreshes_total",
+		Subsystem: "github",
+		Help:      "Number of periodic re-resolutions of the upstream hosts by result (unchanged, changed, error)",
+	}, []string{"result"})
+)
+
+// The address families a Dialer may prefer.
+const (
+	DialPreferIPv4 = "ipv4"
+	DialPreferIPv6 = "ipv6"
+)
+
+// resolvedHost is the cached addresses of a host.
+type resolvedHost struct {
+	addrs    []netip.Addr
+	resolved time.Time
+}
+
+// Dialer dials the upstream hosts by their resolved addresses, in order of the Prefer(red) address family (else as
+// resolved). The addresses are raced happy-eyeballs style: each dial is started FallbackDelay after the previous one
+// unless it failed already, the first connection wins (a negative FallbackDelay dials them one after the other).
+//
+// The addresses of a host are cached for the Refresh interval and re-resolved in the background by Run at that
+// interval too, the idle connections (to the stale addresses) are closed by OnChange once the addresses of a host change
+// so the long-lived keep-alive connections follow a DNS change (ex: during a GitHub incident).
+type Dialer struct {
+	Dialer        *net.Dialer
+	Resolver      *net.Resolver
+	Refresh       time.Duration
+	Prefer        string
+	FallbackDelay time.Duration
+	OnChange      func()
+
+	mu    sync.Mutex
+	hosts map[string]*resolvedHost
+}
+
+// lookup resolves the addresses of the host.
+func (d *Dialer) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	addrs, err := d.Resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("(*net.Resolver).LookupNetIP failed: %w", err)
+	}
+	for idx, addr := range addrs {
+		addrs[idx] = addr.Unmap()
+	}
+	// Keep the order of the resolver within each family.
+	switch d.Prefer {
+	case DialPreferIPv4:
+		slices.SortStableFunc(addrs, func(a, b netip.Addr) int { return boolCompare(b.Is4(), a.Is4()) })
+	case DialPreferIPv6:
+		slices.SortStableFunc(addrs, func(a, b netip.Addr) int { return boolCompare(b.Is6(), a.Is6()) })
+	}
+	return addrs, nil
+}
+
+// boolCompare orders false before true.
+func boolCompare(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
+
+// resolve returns the (cached) addresses of the host.
+func (d *Dialer) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if d.Refresh > 0 {
+		d.mu.Lock()
+		cached, ok := d.hosts[host]
+		d.mu.Unlock()
+		if ok && time.Since(cached.resolved) < d.Refresh {
+			return cached.addrs, nil
+		}
+	}
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.hosts == nil {
+		d.hosts = make(map[string]*resolvedHost)
+	}
+	d.hosts[host] = &resolvedHost{addrs: addrs, resolved: time.Now()}
+	return addrs, nil
+}
+
+// Run re-resolves the dialed hosts every Refresh interval until the context is cancelled.
+func (d *Dialer) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.Refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		d.mu.Lock()
+		hosts := make(map[string][]netip.Addr, len(d.hosts))
+		for host, cached := range d.hosts {
+			hosts[host] = cached.addrs
+		}
+		d.mu.Unlock()
+		changed := false
+		for host, previous := range hosts {
+			addrs, err := d.lookup(ctx, host)
+			if err != nil {
+				// Keep dialing the previous addresses, the resolver may be affected by the incident too.
+				DNSRefreshes.WithLabelValues("error").Inc()
+				log.Warn().Err(err).Str("host", host).Msg("DNS refresh failed")
+				continue
+			}
+			d.mu.Lock()
+			d.hosts[host] = &resolvedHost{addrs: addrs, resolved: time.Now()}
+			d.mu.Unlock()
+			if slices.Equal(addrs, previous) {
+				DNSRefreshes.WithLabelValues("unchanged").Inc()
+				continue
+			}
+			DNSRefreshes.WithLabelValues("changed").Inc()
+			log.Info().Str("host", host).Stringers("previous", stringers(previous)).Stringers("addresses", stringers(addrs)).Msg("upstream addresses changed")
+			changed = true
+		}
+		if changed && d.OnChange != nil {
+			d.OnChange()
+		}
+	}
+}
+
+// stringers returns the addresses as fmt.Stringers.
+func stringers(addrs []netip.Addr) []fmt.Stringer {
+	values := make([]fmt.Stringer, len(addrs))
+	for idx, addr := range addrs {
+		values[idx] = addr
+	}
+	return values
+}
+
+// dialResult is the outcome of the dial of an address.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// DialContext dials the address (a host and port) on the network, see net.Dialer.DialContext.
+func (d *Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("net.SplitHostPort failed: %w", err)
+	}
+	if _, err := netip.ParseAddr(host); err == nil || !strings.HasPrefix(network, "tcp") {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %q", host)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	dial := func(addr netip.Addr) {
+		conn, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err != nil {
+			if ctx.Err() == nil {
+				UpstreamDials.WithLabelValues(addr.String(), "failed").Inc()
+			}
+		} else {
+			UpstreamDials.WithLabelValues(addr.String(), "connected").Inc()
+		}
+		results <- dialResult{conn: conn, err: err}
+	}
+	var errs []error
+	started, pending := 0, 0
+	for started < len(addrs) || pending > 0 {
+		if started < len(addrs) && (pending == 0 || d.FallbackDelay >= 0) {
+			go dial(addrs[started])
+			started, pending = started+1, pending+1
+		}
+		var fallback <-chan time.Time
+		var timer *time.Timer
+		if started < len(addrs) && d.FallbackDelay >= 0 {
+			timer = time.NewTimer(d.FallbackDelay)
+			fallback = timer.C
+		}
+		select {
+		case <-fallback:
+			continue // Start the next dial
+		case result := <-results:
+			if timer != nil {
+				timer.Stop()
+			}
+			pending--
+			if result.err != nil {
+				errs = append(errs, result.err)
+				continue // Start the next dial right away
+			}
+			// Close the connections of the dials which lost the race.
+			go func() {
+				for range pending {
+					if loser := <-results; loser.conn != nil {
+						loser.conn.Close()
+					}
+				}
+			}()
+			return result.conn, nil
+		}
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ResponseValidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "response_validations_total",
+		Subsystem: "github",
+		Help:      "Number of sampled responses validated against the OpenAPI description by result (valid, drift, skipped)",
+	}, []string{"result"})
+	ResponseDrift = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "response_drift_total",
+		Subsystem: "github",
+		Help:      "Number of differences of the sampled responses from the schemas of the OpenAPI description by operation and kind (type, required, enum)",
+	}, []string{"operation", "kind"})
+)
+
+const (
+	// maxDrifts is the maximum number of differences recorded per response.
+	maxDrifts = 10
+	// maxDriftItems is the maximum number of items of each array that are validated.
+	maxDriftItems = 20
+)
+
+// schemaDrift is a difference of a value from its schema, at the JSON pointer of the value.
+type schemaDrift struct {
+	Pointer string
+	Kind    string
+	Message string
+}
+
+// jsonType returns the (schema) type of the decoded JSON value, integral numbers are an "integer".
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return ""
+}
+
+// driftValidator validates the decoded JSON values against the schemas of the Spec, collecting the differences.
+type driftValidator struct {
+	Spec   *OpenAPISpec
+	Drifts []schemaDrift
+}
+
+func (v *driftValidator) drift(pointer string, kind string, format string, args ...any) {
+	if len(v.Drifts) < maxDrifts {
+		v.Drifts = append(v.Drifts, schemaDrift{Pointer: pointer, Kind: kind, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// validate validates the value at the JSON pointer against the schema. The properties which are not in the schema are
+// not differences, GitHub adds fields to the responses without notice (and parsers ignore them).
+func (v *driftValidator) validate(pointer string, schema *OpenAPISchema, value any) {
+	schema = v.Spec.Resolve(schema)
+	if schema == nil || len(v.Drifts) >= maxDrifts || (value == nil && schema.Nullable) {
+		return
+	}
+	for _, sub := range schema.AllOf {
+		v.validate(pointer, sub, value)
+	}
+	if branches := append(slices.Clip(schema.AnyOf), schema.OneOf...); len(branches) > 0 {
+		matched := slices.ContainsFunc(branches, func(branch *OpenAPISchema) bool {
+			candidate := &driftValidator{Spec: v.Spec}
+			candidate.validate(pointer, branch, value)
+			return len(candidate.Drifts) == 0
+		})
+		if !matched {
+			v.drift(pointer, "type", "%s matches none of the %d alternatives", jsonType(value), len(branches))
+		}
+	}
+
+	actual := jsonType(value)
+	if types := schema.types(); len(types) > 0 && !slices.Contains(types, actual) && !(actual == "integer" && slices.Contains(types, "number")) {
+		v.drift(pointer, "type", "expected %v, got %s", types, actual)
+		return
+	}
+	if len(schema.Enum) > 0 && value != nil && !slices.Contains(schema.Enum, value) {
+		v.drift(pointer, "enum", "%v is not one of %v", value, schema.Enum)
+	}
+	switch value := value.(type) {
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := value[name]; !ok {
+				v.drift(pointer+"/"+name, "required", "required property is missing")
+			}
+		}
+		for name, property := range schema.Properties {
+			if item, ok := value[name]; ok {
+				v.validate(pointer+"/"+name, property, item)
+			}
+		}
+	case []any:
+		if schema.Items != nil {
+			for idx, item := range value[:min(len(value), maxDriftItems)] {
+				v.validate(pointer+"/"+strconv.Itoa(idx), schema.Items, item)
+			}
+		}
+	}
+}
+
+// DriftTransport validates a Sample of the JSON responses against the schemas of the OpenAPI Spec, counting the
+// differences (a missing required property, a value of another type or outside of its enum) so a drift of the shape
+// of the responses of GitHub is noticed before the parsers of the clients break. Each difference is logged at most
+// once an hour per operation.
+type DriftTransport struct {
+	Base   http.RoundTripper
+	Spec   *OpenAPISpec
+	Sample float64
+
+	mu     sync.Mutex
+	warned map[[3]string]time.Time
+}
+
+// warn reports if the difference of the operation should be logged.
+func (t *DriftTransport) warn(operation string, drift schemaDrift, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.warned == nil {
+		t.warned = make(map[[3]string]time.Time)
+	}
+	key := [3]string{operation, drift.Pointer, drift.Kind}
+	if now.Sub(t.warned[key]) < time.Hour {
+		return false
+	}
+	t.warned[key] = now
+	return true
+}
+
+// check validates the body of a response of the operation.
+func (t *DriftTransport) check(operation *OpenAPIOperation, schema *OpenAPISchema, body []byte) {
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		ResponseValidations.WithLabelValues("skipped").Inc()
+		return
+	}
+	validator := &driftValidator{Spec: t.Spec}
+	validator.validate("", schema, value)
+	if len(validator.Drifts) == 0 {
+		ResponseValidations.WithLabelValues("valid").Inc()
+		return
+	}
+	ResponseValidations.WithLabelValues("drift").Inc()
+	now := time.Now()
+	for _, drift := range validator.Drifts {
+		ResponseDrift.WithLabelValues(operation.ID, drift.Kind).Inc()
+		if t.warn(operation.ID, drift, now) {
+			log.Warn().Str("operation", operation.ID).Str("pointer", drift.Pointer).Str("kind", drift.Kind).Str("drift", drift.Message).Msg("response differs from the OpenAPI description")
+		}
+	}
+}
+
+func (t *DriftTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodHead || (t.Sample < 1 && rand.Float64() >= t.Sample) {
+		return t.Base.RoundTrip(req)
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || resp.Header.Get(ProxyErrorHeader) != "" || !jsonMediaType(resp.Header) || resp.ContentLength > maxCompareBody {
+		return resp, err
+	}
+	operation := t.Spec.Match(req.Method, req.URL.Path)
+	if operation == nil {
+		return resp, nil
+	}
+	schema := operation.Response(resp.StatusCode)
+	if schema == nil {
+		ResponseValidations.WithLabelValues("skipped").Inc()
+		return resp, nil
+	}
+	// Validated once the client read the entire body (see compareBody), after it was sent.
+	resp.Body = &compareBody{ReadCloser: resp.Body, done: func(b []byte, complete bool) {
+		if complete {
+			t.check(operation, schema, b)
+		}
+	}}
+	return resp, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bored-engineer/github-api-proxy/e2e/mock"
+)
+
+// BenchCacheControl is the Cache-Control of the mocked upstream during the benchmarks, like the real API.
+const BenchCacheControl = "private, max-age=60, s-maxage=60"
+
+// BenchSessionHeader is the request header keying the affinity sessions (see --affinity) of the contention scenario.
+const BenchSessionHeader = "X-Bench-Session"
+
+// benchSessions is the number of distinct sessions of the contention scenario.
+const benchSessions = 1024
+
+// BenchConfig configures the benchmarks.
+type BenchConfig struct {
+	// Duration is the duration of each scenario.
+	Duration    time.Duration
+	Concurrency int
+	// Contention is the concurrency of the credential selection scenario.
+	Contention int
+	// Scenarios (optional) only runs the named scenarios.
+	Scenarios []string
+	// Thresholds are the maximum p99 latency of each scenario, a regression beyond it fails the run (0 to only report).
+	Thresholds map[string]time.Duration
+	// Scaling (optional) repeats the contention scenario with a proxy limited to each GOMAXPROCS, see Efficiency.
+	Scaling []int
+	// Efficiency is the minimum throughput of each Scaling run relative to a linear scaling of the first one, a
+	// regression below it fails the run (0 to only report).
+	Efficiency float64
+	// Start starts another proxy under test with GOMAXPROCS procs, returning its base URL and a func stopping it.
+	Start func(ctx context.Context, procs int) (string, func(), error)
+	// Report (optional) is the path to write the JSON results to (ex: to compare them across CI runs).
+	Report string
+}
+
+// BenchResult is the outcome of a scenario.
+type BenchResult struct {
+	Scenario    string  `json:"scenario"`
+	Concurrency int     `json:"concurrency"`
+	Requests    int     `json:"requests"`
+	Failures    int     `json:"failures"`
+	Cached      int     `json:"cached"`
+	RPS         float64 `json:"rps"`
+	P50         float64 `json:"p50_ms"`
+	P90         float64 `json:"p90_ms"`
+	P99         float64 `json:"p99_ms"`
+	Threshold   float64 `json:"threshold_ms,omitempty"`
+	// Procs and Efficiency are only set for the Scaling runs.
+	Procs      int     `json:"procs,omitempty"`
+	Efficiency float64 `json:"efficiency,omitempty"`
+}
+
+// benchScenario is a benchmarked request path of the proxy.
+type benchScenario struct {
+	Name        string
+	Concurrency int
+	// Hits requires every response to be served from the cache.
+	Hits bool
+	// Request builds the nth request of the scenario.
+	Request func(ctx context.Context, n uint64) (*http.Request, error)
+}
+
+// benchHitIssues is the number of (warmed) issues read by the hit scenario.
+const benchHitIssues = 10
+
+// milliseconds converts the latency for the JSON results.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// runScenario drives the requests of the scenario through the proxy for the duration, numbered by n (shared by the
+// scenarios so the misses of one are not the hits of the next).
+func runScenario(ctx context.Context, client *http.Client, scenario *benchScenario, duration time.Duration, n *atomic.Uint64) *LoadResult {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	result := &LoadResult{statuses: make(map[int]int), proxyErrors: make(map[string]int)}
+	var wg sync.WaitGroup
+	for range scenario.Concurrency {
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				req, err := scenario.Request(ctx, n.Add(1))
+				if err != nil {
+					result.record(nil, err, 0)
+					continue
+				}
+				begin := time.Now()
+				resp, err := client.Do(req)
+				if ctx.Err() != nil {
+					return // Requests cancelled at the deadline are not counted
+				}
+				if err == nil {
+					_, _ = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+					}
+				}
+				result.record(resp, err, time.Since(begin))
+			}
+		})
+	}
+	wg.Wait()
+	return result
+}
+
+// benchScenarios returns the scenarios of the benchmarks against the proxy.
+func benchScenarios(proxyURL string, issues int, cfg *BenchConfig) []*benchScenario {
+	repo := proxyURL + "repos/" + mock.Owner + "/" + mock.Repo
+	// A distinct query string is a distinct cache key, the mock ignores it.
+	miss := func(ctx context.Context, n uint64) (*http.Request, error) {
+		return benchIssue(ctx, repo, 1+int(n%uint64(issues)), "?bench="+strconv.FormatUint(n, 10))
+	}
+	return []*benchScenario{
+		{Name: "hit", Concurrency: cfg.Concurrency, Hits: true, Request: func(ctx context.Context, n uint64) (*http.Request, error) {
+			return benchIssue(ctx, repo, 1+int(n%benchHitIssues), "")
+		}},
+		{Name: "miss", Concurrency: cfg.Concurrency, Request: miss},
+		// The sessions exercise the credential selection of the affinity (see --affinity) on top of the balancing.
+		{Name: "contention", Concurrency: cfg.Contention, Request: func(ctx context.Context, n uint64) (*http.Request, error) {
+			req, err := miss(ctx, n)
+			if err == nil {
+				req.Header.Set(BenchSessionHeader, strconv.FormatUint(n%benchSessions, 10))
+			}
+			return req, err
+		}},
+	}
+}
+
+// benchIssue returns a request reading the issue of the repo.
+func benchIssue(ctx context.Context, repo string, number int, query string) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, http.MethodGet, repo+"/issues/"+strconv.Itoa(number)+query, nil)
+}
+
+// measure runs the scenario, summarizing its result.
+func measure(ctx context.Context, client *http.Client, scenario *benchScenario, cfg *BenchConfig, n *atomic.Uint64) (BenchResult, time.Duration, error) {
+	start := time.Now()
+	result := runScenario(ctx, client, scenario, cfg.Duration, n)
+	elapsed := time.Since(start)
+	if err := ctx.Err(); err != nil {
+		return BenchResult{}, 0, err
+	}
+	slices.Sort(result.latencies)
+	p50, p90, p99 := percentile(result.latencies, 0.50), percentile(result.latencies, 0.90), percentile(result.latencies, 0.99)
+	r := BenchResult{
+		Scenario:    scenario.Name,
+		Concurrency: scenario.Concurrency,
+		Requests:    len(result.latencies) + result.failures,
+		Failures:    result.failures,
+		Cached:      result.cached,
+		RPS:         float64(len(result.latencies)+result.failures) / elapsed.Seconds(),
+		P50:         milliseconds(p50),
+		P90:         milliseconds(p90),
+		P99:         milliseconds(p99),
+		Threshold:   milliseconds(cfg.Thresholds[scenario.Name]),
+	}
+	fmt.Printf("%-15s  %11d  %8d  %8d  %6d  %8.0f  %6s  %6s  %6s\n", r.Scenario, r.Concurrency, r.Requests, r.Failures, r.Cached, r.RPS,
+		p50.Round(10*time.Microsecond), p90.Round(10*time.Microsecond), p99.Round(10*time.Microsecond))
+	return r, p99, nil
+}
+
+// Bench measures the latency of the cache hit path, the miss path and the credential selection under contention
+// against a mocked upstream without latency nor rate-limits (the proxy itself is measured), failing if the p99 latency
+// of a scenario regressed beyond its threshold. With Scaling it then measures the throughput of the credential
+// selection as the proxy is given more cores, failing if it scales less than linearly by the Efficiency.
+func Bench(ctx context.Context, env *Env, cfg *BenchConfig) error {
+	repo := env.ProxyURL + "repos/" + mock.Owner + "/" + mock.Repo
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: max(cfg.Concurrency, cfg.Contention)}}
+	// Warm the cache of the hit scenario.
+	for number := 1; number <= benchHitIssues; number++ {
+		req, err := benchIssue(ctx, repo, number, "")
+		if err != nil {
+			return fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("(*http.Client).Do failed: %w", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	var n atomic.Uint64
+	var results []BenchResult
+	var regressions []string
+	fmt.Println("SCENARIO         CONCURRENCY  REQUESTS  FAILURES  CACHED       RPS     P50     P90     P99")
+	for _, scenario := range benchScenarios(env.ProxyURL, env.Upstream.Issues, cfg) {
+		if len(cfg.Scenarios) > 0 && !slices.Contains(cfg.Scenarios, scenario.Name) {
+			continue
+		}
+		r, p99, err := measure(ctx, client, scenario, cfg, &n)
+		if err != nil {
+			return err
+		}
+		results = append(results, r)
+		if threshold := cfg.Thresholds[scenario.Name]; threshold > 0 && p99 > threshold {
+			regressions = append(regressions, fmt.Sprintf("%s p99 %s exceeds %s", scenario.Name, p99.Round(10*time.Microsecond), threshold))
+		}
+		if r.Failures > 0 {
+			regressions = append(regressions, fmt.Sprintf("%s had %d failures", scenario.Name, r.Failures))
+		}
+		if scenario.Hits && r.Cached < r.Requests {
+			regressions = append(regressions, fmt.Sprintf("%s only served %d of %d requests from the cache", scenario.Name, r.Cached, r.Requests))
+		}
+	}
+
+	// Repeat the contention scenario against a fresh proxy for each GOMAXPROCS, the harness itself (and the mocked
+	// upstream) compete for the same cores so it should run on a machine with more cores than the highest value.
+	var baseline float64
+	for idx, procs := range cfg.Scaling {
+		proxyURL, stop, err := cfg.Start(ctx, procs)
+		if err != nil {
+			return err
+		}
+		scenarios := benchScenarios(proxyURL, env.Upstream.Issues, cfg)
+		scenario := scenarios[slices.IndexFunc(scenarios, func(s *benchScenario) bool { return s.Name == "contention" })]
+		scenario.Name = "contention/" + strconv.Itoa(procs)
+		r, _, err := measure(ctx, client, scenario, cfg, &n)
+		stop()
+		if err != nil {
+			return err
+		}
+		if idx == 0 {
+			baseline = r.RPS / float64(procs)
+		}
+		r.Procs = procs
+		r.Efficiency = r.RPS / (baseline * float64(procs))
+		results = append(results, r)
+		fmt.Printf("  GOMAXPROCS=%d efficiency %.2f\n", procs, r.Efficiency)
+		if cfg.Efficiency > 0 && r.Efficiency < cfg.Efficiency {
+			regressions = append(regressions, fmt.Sprintf("GOMAXPROCS=%d efficiency %.2f is below %.2f", procs, r.Efficiency, cfg.Efficiency))
+		}
+		if r.Failures > 0 {
+			regressions = append(regressions, fmt.Sprintf("%s had %d failures", scenario.Name, r.Failures))
+		}
+	}
+
+	if cfg.Report != "" {
+		report, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return fmt.Errorf("json.MarshalIndent failed: %w", err)
+		}
+		if err := os.WriteFile(cfg.Report, append(report, '\n'), 0644); err != nil {
+			return fmt.Errorf("os.WriteFile failed: %w", err)
+		}
+	}
+	if len(regressions) > 0 {
+		return errors.New("benchmarks regressed: " + strings.Join(regressions, ", "))
+	}
+	return nil
+}
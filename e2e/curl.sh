@@ -0,0 +1,40 @@
+#!/usr/bin/env bash
+# Raw curl flows against the proxy, run by the e2e harness with PROXY_URL, ADMIN_URL and UPSTREAM_URL set.
+set -euo pipefail
+
+fail() {
+  echo "$1" >&2
+  exit 1
+}
+
+headers=$(mktemp)
+trap 'rm -f "$headers"' EXIT
+
+# Auth injection: no Authorization header is sent by the client.
+body=$(curl -sS -D "$headers" "${PROXY_URL}user")
+grep -q '"login":"octocat"' <<<"$body" || fail "auth injection: unexpected body: $body"
+
+# Pagination rewriting: the Link header must point at the proxy rather than the upstream.
+curl -sS -o /dev/null -D "$headers" "${PROXY_URL}repos/octocat/hello-world/issues?per_page=2"
+link=$(grep -i '^link:' "$headers" || true)
+[[ -n "$link" ]] || fail "pagination: missing Link header"
+[[ "$link" == *"$PROXY_URL"* ]] || fail "pagination: Link header was not rewritten: $link"
+[[ "$link" != *"$UPSTREAM_URL"* ]] || fail "pagination: Link header leaks the upstream: $link"
+
+# Pagination via the GHES-style /api/v3 prefix.
+status=$(curl -sS -o /dev/null -w '%{http_code}' "${PROXY_URL}api/v3/repos/octocat/hello-world/issues?page=2&per_page=2")
+[[ "$status" == 200 ]] || fail "pagination: /api/v3 prefix returned $status"
+
+# Caching: a repeated request is served from the cache.
+curl -sS -o /dev/null "${PROXY_URL}repos/octocat/hello-world/issues?page=3&per_page=2"
+curl -sS -o /dev/null -D "$headers" "${PROXY_URL}repos/octocat/hello-world/issues?page=3&per_page=2"
+grep -qi '^x-cached-request-id:' "$headers" || fail "caching: response was not served from the cache"
+
+# Error translation: upstream errors pass through, proxy errors are GitHub-shaped.
+status=$(curl -sS -o /dev/null -w '%{http_code}' "${PROXY_URL}repos/octocat/missing")
+[[ "$status" == 404 ]] || fail "errors: missing repository returned $status"
+curl -sS -o /dev/null -X POST "${ADMIN_URL}admin/freeze"
+body=$(curl -sS -D "$headers" -X POST -d '{"title":"frozen"}' "${PROXY_URL}repos/octocat/hello-world/issues")
+curl -sS -o /dev/null -X DELETE "${ADMIN_URL}admin/freeze"
+grep -q '"documentation_url"' <<<"$body" || fail "errors: proxy error was not GitHub-shaped: $body"
+grep -qi '^x-proxy-error: frozen' "$headers" || fail "errors: missing X-Proxy-Error header"
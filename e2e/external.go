@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Octokit runs the octokit.js flows in a container (host networking, so it can reach the loopback proxy).
+func Octokit(ctx context.Context, env *Env, dir string, image string) error {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return fmt.Errorf("%w: docker was not found", ErrSkipped)
+	}
+	cmd := exec.CommandContext(ctx, docker, "run", "--rm",
+		"--network", "host",
+		"-e", "PROXY_URL="+env.ProxyURL,
+		"-e", "ADMIN_URL="+env.AdminURL,
+		"-v", absPath(dir)+":/e2e",
+		"-w", "/e2e",
+		image,
+		"sh", "-c", "npm install --no-audit --no-fund --silent && node test.mjs",
+	)
+	return runCommand(cmd)
+}
+
+// Curl runs the raw curl flows script.
+func Curl(ctx context.Context, env *Env, script string) error {
+	if _, err := exec.LookPath("curl"); err != nil {
+		return fmt.Errorf("%w: curl was not found", ErrSkipped)
+	}
+	cmd := exec.CommandContext(ctx, "bash", script)
+	cmd.Env = append(os.Environ(),
+		"PROXY_URL="+env.ProxyURL,
+		"ADMIN_URL="+env.AdminURL,
+		"UPSTREAM_URL="+env.UpstreamURL,
+	)
+	return runCommand(cmd)
+}
+
+// runCommand runs the command, including its output in the returned error if it fails.
+func runCommand(cmd *exec.Cmd) error {
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w\n%s", strings.Join(cmd.Args, " "), err, output)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+module github.com/bored-engineer/github-api-proxy/e2e
+
+go 1.25.5
+
+require (
+	github.com/google/go-github/v72 v72.0.0
+	github.com/spf13/pflag v1.0.10
+)
+
+require github.com/google/go-querystring v1.1.0 // indirect
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bored-engineer/github-api-proxy/e2e/mock"
+	"github.com/google/go-github/v72/github"
+)
+
+// adminRequest performs a request against the admin API of the proxy.
+func adminRequest(ctx context.Context, env *Env, method string, path string) error {
+	req, err := http.NewRequestWithContext(ctx, method, env.AdminURL+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("(*http.Client).Do failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned %d", method, path, resp.StatusCode)
+	}
+	return nil
+}
+
+// GoGitHub runs the go-github flows, the client is unauthenticated so every success relies on the proxy's credential.
+func GoGitHub(ctx context.Context, env *Env) error {
+	client := github.NewClient(nil)
+	baseURL, err := url.Parse(env.ProxyURL)
+	if err != nil {
+		return fmt.Errorf("url.Parse failed: %w", err)
+	}
+	client.BaseURL = baseURL
+
+	// Auth injection
+	user, _, err := client.Users.Get(ctx, "")
+	if err != nil {
+		return fmt.Errorf("auth injection: (*github.UsersService).Get failed: %w", err)
+	}
+	if user.GetLogin() != mock.Owner {
+		return fmt.Errorf("auth injection: got login %q, expected %q", user.GetLogin(), mock.Owner)
+	}
+
+	// Pagination rewriting
+	var issues []*github.Issue
+	opts := &github.IssueListByRepoOptions{ListOptions: github.ListOptions{PerPage: 2}}
+	for {
+		page, resp, err := client.Issues.ListByRepo(ctx, mock.Owner, mock.Repo, opts)
+		if err != nil {
+			return fmt.Errorf("pagination: (*github.IssuesService).ListByRepo failed: %w", err)
+		}
+		if link := resp.Header.Get("Link"); strings.Contains(link, env.UpstreamURL) || (link != "" && !strings.Contains(link, env.ProxyURL)) {
+			return fmt.Errorf("pagination: Link header was not rewritten to the proxy: %s", link)
+		}
+		issues = append(issues, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.ListOptions.Page = resp.NextPage
+	}
+	if len(issues) != env.Upstream.Issues {
+		return fmt.Errorf("pagination: got %d issues, expected %d", len(issues), env.Upstream.Issues)
+	}
+
+	// Caching, the second request must be revalidated upstream (304) and served from the cache.
+	path := "/repos/" + mock.Owner + "/" + mock.Repo
+	before := env.Upstream.Hits(path)
+	for range 2 {
+		if _, _, err := client.Repositories.Get(ctx, mock.Owner, mock.Repo); err != nil {
+			return fmt.Errorf("caching: (*github.RepositoriesService).Get failed: %w", err)
+		}
+	}
+	_, resp, err := client.Repositories.Get(ctx, mock.Owner, mock.Repo)
+	if err != nil {
+		return fmt.Errorf("caching: (*github.RepositoriesService).Get failed: %w", err)
+	}
+	if resp.Header.Get("X-Cached-Request-Id") == "" {
+		return errors.New("caching: response was not served from the cache")
+	}
+	if after := env.Upstream.Hits(path); after.OK-before.OK > 1 || after.NotModified-before.NotModified < 2 {
+		return fmt.Errorf("caching: upstream served %d full and %d conditional responses, expected at most 1 and 2", after.OK-before.OK, after.NotModified-before.NotModified)
+	}
+
+	// Upstream errors are passed through.
+	var errResp *github.ErrorResponse
+	if _, _, err := client.Repositories.Get(ctx, mock.Owner, "missing"); !errors.As(err, &errResp) || errResp.Response.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("errors: expected a 404 *github.ErrorResponse, got %v", err)
+	}
+
+	// Errors generated by the proxy are translated into GitHub-shaped errors.
+	if err := adminRequest(ctx, env, http.MethodPost, "/admin/freeze"); err != nil {
+		return fmt.Errorf("errors: %w", err)
+	}
+	_, _, err = client.Issues.Create(ctx, mock.Owner, mock.Repo, &github.IssueRequest{Title: github.Ptr("frozen")})
+	if err := adminRequest(ctx, env, http.MethodDelete, "/admin/freeze"); err != nil {
+		return fmt.Errorf("errors: %w", err)
+	}
+	if !errors.As(err, &errResp) || errResp.Response.StatusCode != http.StatusServiceUnavailable {
+		return fmt.Errorf("errors: expected a 503 *github.ErrorResponse during a freeze, got %v", err)
+	}
+	if errResp.Message == "" || !strings.Contains(errResp.DocumentationURL, "github-api-proxy") {
+		return fmt.Errorf("errors: proxy error was not GitHub-shaped: %+v", errResp)
+	}
+	created, _, err := client.Issues.Create(ctx, mock.Owner, mock.Repo, &github.IssueRequest{Title: github.Ptr("thawed")})
+	if err != nil {
+		return fmt.Errorf("errors: (*github.IssuesService).Create failed after the freeze: %w", err)
+	}
+	if created.GetTitle() != "thawed" {
+		return fmt.Errorf("errors: created issue has title %q", created.GetTitle())
+	}
+
+	return nil
+}
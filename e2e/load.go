@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/github-api-proxy/e2e/mock"
+)
+
+// LoadConfig configures the load test.
+type LoadConfig struct {
+	Duration    time.Duration
+	Concurrency int
+	// WriteRatio and SearchRatio are the fractions of requests that create an issue or search, the rest are reads
+	// of a random issue (so the cache hit rate depends on the number of issues).
+	WriteRatio  float64
+	SearchRatio float64
+}
+
+// LoadResult aggregates the responses observed by the load generator.
+type LoadResult struct {
+	mu          sync.Mutex
+	statuses    map[int]int
+	proxyErrors map[string]int
+	cached      int
+	failures    int
+	latencies   []time.Duration
+}
+
+func (r *LoadResult) record(resp *http.Response, err error, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.failures++
+		return
+	}
+	r.statuses[resp.StatusCode]++
+	if reason := resp.Header.Get("X-Proxy-Error"); reason != "" {
+		r.proxyErrors[reason]++
+	}
+	if resp.Header.Get("X-Cached-Request-Id") != "" {
+		r.cached++
+	}
+	r.latencies = append(r.latencies, latency)
+}
+
+// percentile returns the latency percentile of the (sorted) latencies.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	return latencies[min(int(float64(len(latencies))*p), len(latencies)-1)]
+}
+
+// loadRequest builds a random request of the load mix.
+func loadRequest(ctx context.Context, env *Env, cfg *LoadConfig) (*http.Request, error) {
+	repo := env.ProxyURL + "repos/" + mock.Owner + "/" + mock.Repo
+	switch n := rand.Float64(); {
+	case n < cfg.WriteRatio:
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, repo+"/issues", bytes.NewReader([]byte(`{"title":"load"}`)))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	case n < cfg.WriteRatio+cfg.SearchRatio:
+		return http.NewRequestWithContext(ctx, http.MethodGet, env.ProxyURL+"search/issues?q="+strconv.Itoa(rand.IntN(100)), nil)
+	default:
+		return http.NewRequestWithContext(ctx, http.MethodGet, repo+"/issues/"+strconv.Itoa(1+rand.IntN(env.Upstream.Issues)), nil)
+	}
+}
+
+// Load drives a mix of reads, searches and writes through the proxy for the duration, then reports the responses seen
+// by the clients and the per-token usage seen by the rate-limited upstream.
+func Load(ctx context.Context, env *Env, cfg *LoadConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: cfg.Concurrency}}
+	result := &LoadResult{statuses: make(map[int]int), proxyErrors: make(map[string]int)}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range cfg.Concurrency {
+		wg.Go(func() {
+			for ctx.Err() == nil {
+				req, err := loadRequest(ctx, env, cfg)
+				if err != nil {
+					result.record(nil, err, 0)
+					continue
+				}
+				begin := time.Now()
+				resp, err := client.Do(req)
+				if ctx.Err() != nil {
+					return // Requests cancelled at the deadline are not counted
+				}
+				if err == nil {
+					_, _ = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				result.record(resp, err, time.Since(begin))
+			}
+		})
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Report what the clients observed.
+	result.mu.Lock()
+	defer result.mu.Unlock()
+	slices.Sort(result.latencies)
+	total := len(result.latencies) + result.failures
+	fmt.Printf("requests      %d (%.1f/s)\n", total, float64(total)/elapsed.Seconds())
+	fmt.Printf("failures      %d\n", result.failures)
+	fmt.Printf("cached        %d\n", result.cached)
+	fmt.Printf("latency       p50=%s p95=%s p99=%s\n",
+		percentile(result.latencies, 0.50).Round(time.Millisecond),
+		percentile(result.latencies, 0.95).Round(time.Millisecond),
+		percentile(result.latencies, 0.99).Round(time.Millisecond),
+	)
+	for _, status := range slices.Sorted(maps.Keys(result.statuses)) {
+		fmt.Printf("status %d    %d\n", status, result.statuses[status])
+	}
+	for _, reason := range slices.Sorted(maps.Keys(result.proxyErrors)) {
+		fmt.Printf("proxy error   %s: %d\n", reason, result.proxyErrors[reason])
+	}
+
+	// Report what the upstream observed, an even split of the usage shows the balancing is working.
+	stats := env.Upstream.RateLimits.Stats()
+	fmt.Println("\nTOKEN          CORE  SEARCH  PRIMARY REJECTED  SECONDARY REJECTED")
+	for _, token := range slices.Sorted(maps.Keys(stats)) {
+		s := stats[token]
+		fmt.Printf("%-13s  %4d  %6d  %16d  %18d\n", token, s.Used["core"], s.Used["search"], s.Primary, s.Secondary)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+// Command e2e runs client library compatibility flows (go-github, octokit.js and raw curl) against the proxy with a
+// mocked upstream, validating pagination rewriting, caching, auth injection and error translation end to end. With
+// --load it instead load tests the proxy against an upstream enforcing realistic primary and secondary rate-limits, and
+// with --bench it benchmarks the latency of the cache hit and miss paths against thresholds.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bored-engineer/github-api-proxy/e2e/mock"
+	"github.com/spf13/pflag"
+)
+
+// Token is the credential configured in the proxy, clients never send it themselves.
+const Token = "e2e-token"
+
+// Env describes the running proxy and mocked upstream to each suite.
+type Env struct {
+	// ProxyURL is the base URL of the proxy (with a trailing slash).
+	ProxyURL string
+	// AdminURL is the base URL of the admin API of the proxy (with a trailing slash), see --admin-listen.
+	AdminURL string
+	// UpstreamURL is the base URL of the mocked upstream (with a trailing slash).
+	UpstreamURL string
+	Upstream    *mock.Upstream
+}
+
+// Suite is a set of client flows run against the proxy, a skipped suite returns ErrSkipped.
+type Suite struct {
+	Name string
+	Run  func(ctx context.Context, env *Env) error
+}
+
+// ErrSkipped is returned (wrapped) by a suite that cannot run in this environment.
+var ErrSkipped = errors.New("skipped")
+
+// lockedBuffer collects the proxy logs, which are only printed if a suite fails.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// freeAddr returns a free loopback address for the proxy to listen on.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("net.Listen failed: %w", err)
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// waitReady polls /readyz until the proxy reports ready.
+func waitReady(ctx context.Context, proxyURL string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, proxyURL+"readyz", nil)
+		if err != nil {
+			return fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+		}
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("proxy was not ready within %s", timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// startProxy starts the proxy under test with the serve flags (on free addresses) and GOMAXPROCS procs (0 for the
+// default), returning its base URL, the base URL of its admin API, its logs and a func stopping it.
+func startProxy(ctx context.Context, bin string, args []string, procs int) (string, string, *lockedBuffer, func(), error) {
+	addr, err := freeAddr()
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	adminAddr, err := freeAddr()
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+	proxyURL := "http://" + addr + "/"
+	logs := &lockedBuffer{}
+	cmd := exec.CommandContext(ctx, bin, append([]string{"serve", "--listen", addr, "--admin-listen", adminAddr}, args...)...)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	if procs > 0 {
+		cmd.Env = append(os.Environ(), "GOMAXPROCS="+strconv.Itoa(procs))
+	}
+	if err := cmd.Start(); err != nil {
+		return "", "", nil, nil, fmt.Errorf("(*exec.Cmd).Start failed: %w", err)
+	}
+	stop := func() {
+		_ = cmd.Process.Signal(os.Interrupt)
+		_ = cmd.Wait()
+	}
+	if err := waitReady(ctx, proxyURL, 30*time.Second); err != nil {
+		stop()
+		fmt.Fprint(os.Stderr, logs.String())
+		return "", "", nil, nil, err
+	}
+	return proxyURL, "http://" + adminAddr + "/", logs, stop, nil
+}
+
+func run(ctx context.Context) error {
+	proxyBin := pflag.String("proxy", "../github-api-proxy", "Path to the github-api-proxy binary under test")
+	proxyArgs := pflag.StringArray("proxy-arg", nil, "Additional flag passed to the proxy (ex: --proxy-arg=--max-inflight=8)")
+	curlScript := pflag.String("curl", "curl.sh", "Path to the curl flows script")
+	octokitDir := pflag.String("octokit", "octokit", "Path to the octokit.js flows")
+	octokitImage := pflag.String("octokit-image", "node:20", "Container image used to run the octokit.js flows")
+	only := pflag.StringSlice("suite", nil, "Only run the named suites (go-github, octokit, curl)")
+	load := pflag.Bool("load", false, "Run a load test against a rate-limited upstream instead of the suites")
+	var loadConfig LoadConfig
+	pflag.DurationVar(&loadConfig.Duration, "load-duration", 30*time.Second, "Duration of the load test")
+	pflag.IntVar(&loadConfig.Concurrency, "load-concurrency", 32, "Number of concurrent clients")
+	pflag.Float64Var(&loadConfig.WriteRatio, "load-write-ratio", 0.05, "Fraction of requests that create an issue")
+	pflag.Float64Var(&loadConfig.SearchRatio, "load-search-ratio", 0.05, "Fraction of requests that search")
+	tokens := pflag.Int("load-tokens", 3, "Number of tokens configured in the proxy during the load test")
+	issues := pflag.Int("load-issues", 1000, "Number of distinct issues read during the load test")
+	latency := pflag.Duration("upstream-latency", 50*time.Millisecond, "Latency of the upstream during the load test")
+	var limits mock.RateLimits
+	pflag.IntVar(&limits.Core, "core-limit", 5000, "Core requests allowed per token per --core-window")
+	pflag.DurationVar(&limits.Window, "core-window", time.Hour, "Duration of the core rate-limit window")
+	pflag.IntVar(&limits.Search, "search-limit", 30, "Search requests allowed per token per minute")
+	pflag.IntVar(&limits.MaxConcurrent, "secondary-concurrency", 10, "Concurrent requests per token before the secondary limit triggers")
+	pflag.IntVar(&limits.WritesPerMinute, "secondary-writes", 80, "Mutating requests per token per minute before the secondary limit triggers")
+	pflag.DurationVar(&limits.RetryAfter, "secondary-retry-after", time.Minute, "Retry-After returned by the secondary limit")
+	bench := pflag.Bool("bench", false, "Benchmark the cache hit and miss paths and the credential selection instead of the suites")
+	var benchConfig BenchConfig
+	pflag.DurationVar(&benchConfig.Duration, "bench-duration", 10*time.Second, "Duration of each benchmark scenario")
+	pflag.IntVar(&benchConfig.Concurrency, "bench-concurrency", 8, "Number of concurrent clients of the hit and miss scenarios")
+	pflag.IntVar(&benchConfig.Contention, "bench-contention", 128, "Number of concurrent clients of the credential selection (contention) scenario")
+	pflag.StringSliceVar(&benchConfig.Scenarios, "bench-scenario", nil, "Only run the named scenarios (hit, miss, contention)")
+	benchP99 := pflag.StringToString("bench-p99", nil, "Maximum p99 latency of each scenario, ex: hit=2ms,miss=10ms (a regression fails the run)")
+	pflag.StringVar(&benchConfig.Report, "bench-report", "", "Path to write the JSON results of the benchmarks to")
+	pflag.IntSliceVar(&benchConfig.Scaling, "bench-scaling", nil, "GOMAXPROCS of the proxy to repeat the contention scenario with, ex: 1,2,4,8,16 (to measure its scaling)")
+	pflag.Float64Var(&benchConfig.Efficiency, "bench-efficiency", 0, "Minimum scaling efficiency of --bench-scaling relative to its first value, ex: 0.7 (a regression fails the run)")
+	benchTokens := pflag.Int("bench-tokens", 16, "Number of tokens configured in the proxy during the benchmarks")
+	pflag.Parse()
+
+	benchConfig.Thresholds = make(map[string]time.Duration)
+	for scenario, raw := range *benchP99 {
+		threshold, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid --bench-p99 %s=%s: %w", scenario, raw, err)
+		}
+		benchConfig.Thresholds[scenario] = threshold
+	}
+
+	// Start the mocked upstream.
+	upstream := &mock.Upstream{Tokens: []string{Token}, Issues: 5}
+	switch {
+	case *load:
+		upstream = &mock.Upstream{Issues: *issues, RateLimits: &limits, Latency: *latency}
+		for i := range *tokens {
+			upstream.Tokens = append(upstream.Tokens, fmt.Sprintf("%s-%d", Token, i+1))
+		}
+	case *bench:
+		// Neither latency nor rate-limits, only the proxy itself is measured.
+		upstream = &mock.Upstream{Issues: *issues, CacheControl: BenchCacheControl}
+		for i := range *benchTokens {
+			upstream.Tokens = append(upstream.Tokens, fmt.Sprintf("%s-%d", Token, i+1))
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("net.Listen failed: %w", err)
+	}
+	go func() { _ = http.Serve(listener, upstream) }()
+	defer listener.Close()
+
+	// Start the proxy under test pointed at the mocked upstream.
+	env := &Env{
+		UpstreamURL: "http://" + listener.Addr().String() + "/",
+		Upstream:    upstream,
+	}
+	args := []string{
+		"--url", env.UpstreamURL,
+		"--ready-credentials", strconv.Itoa(len(upstream.Tokens)),
+	}
+	for _, token := range upstream.Tokens {
+		args = append(args, "--auth-token", token)
+	}
+	if *bench {
+		args = append(args, "--cache-freshness", "--affinity", "1m", "--affinity-header", BenchSessionHeader)
+	}
+	args = append(args, *proxyArgs...)
+	proxyURL, adminURL, logs, stop, err := startProxy(ctx, *proxyBin, args, 0)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	env.ProxyURL = proxyURL
+	env.AdminURL = adminURL
+
+	if *load {
+		return Load(ctx, env, &loadConfig)
+	}
+	if *bench {
+		benchConfig.Start = func(ctx context.Context, procs int) (string, func(), error) {
+			proxyURL, _, _, stop, err := startProxy(ctx, *proxyBin, args, procs)
+			return proxyURL, stop, err
+		}
+		return Bench(ctx, env, &benchConfig)
+	}
+
+	suites := []Suite{
+		{Name: "go-github", Run: GoGitHub},
+		{Name: "octokit", Run: func(ctx context.Context, env *Env) error {
+			return Octokit(ctx, env, *octokitDir, *octokitImage)
+		}},
+		{Name: "curl", Run: func(ctx context.Context, env *Env) error {
+			return Curl(ctx, env, *curlScript)
+		}},
+	}
+	var failed []string
+	for _, suite := range suites {
+		if len(*only) > 0 && !slices.Contains(*only, suite.Name) {
+			continue
+		}
+		start := time.Now()
+		err := suite.Run(ctx, env)
+		switch {
+		case errors.Is(err, ErrSkipped):
+			fmt.Printf("SKIP %s: %s\n", suite.Name, err)
+		case err != nil:
+			failed = append(failed, suite.Name)
+			fmt.Printf("FAIL %s: %s\n", suite.Name, err)
+		default:
+			fmt.Printf("ok   %s (%s)\n", suite.Name, time.Since(start).Round(time.Millisecond))
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "--- proxy logs ---\n%s", logs.String())
+		return fmt.Errorf("suites failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// absPath resolves the path relative to the working directory, for mounting into containers.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := run(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,289 @@
+// Package mock implements a mocked GitHub REST API upstream for exercising the proxy end to end.
+package mock
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Owner and Repo name the only repository served by the mock, every other repository is a 404.
+const (
+	Owner = "octocat"
+	Repo  = "hello-world"
+)
+
+// Hits counts the requests served for a path.
+type Hits struct {
+	// OK is the number of full (200) responses.
+	OK int
+	// NotModified is the number of conditional requests answered with a 304.
+	NotModified int
+}
+
+// Upstream is a mocked GitHub REST API, it requires one of the Tokens for every request (so the proxy must inject
+// it), paginates issues with absolute Link headers and answers conditional requests like the real API.
+type Upstream struct {
+	// Tokens are the only credentials accepted by the mock.
+	Tokens []string
+	// Issues is the number of issues in the repository.
+	Issues int
+	// RateLimits (optional) enforces realistic primary and secondary rate-limits per token.
+	RateLimits *RateLimits
+	// Latency (optional) delays every response, so concurrency (and the secondary limit) comes into play.
+	Latency time.Duration
+	// CacheControl (optional) is the Cache-Control of the JSON responses, ex: "private, max-age=60, s-maxage=60" like
+	// the real API, so they can be served fresh from the cache (see --cache-freshness).
+	CacheControl string
+
+	requestID atomic.Uint64
+	mu        sync.Mutex
+	hits      map[string]*Hits
+	mux       *http.ServeMux
+	once      sync.Once
+}
+
+// Hits returns the number of requests served for the path.
+func (u *Upstream) Hits(path string) Hits {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if hits, ok := u.hits[path]; ok {
+		return *hits
+	}
+	return Hits{}
+}
+
+// record counts a request for the path.
+func (u *Upstream) record(path string, notModified bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.hits == nil {
+		u.hits = make(map[string]*Hits)
+	}
+	hits, ok := u.hits[path]
+	if !ok {
+		hits = &Hits{}
+		u.hits[path] = hits
+	}
+	if notModified {
+		hits.NotModified++
+	} else {
+		hits.OK++
+	}
+}
+
+// Error writes a GitHub API error response.
+func Error(w http.ResponseWriter, statusCode int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"message":           message,
+		"documentation_url": "https://docs.github.com/rest",
+		"status":            strconv.Itoa(statusCode),
+	})
+}
+
+// token returns the token of the request, or false if it is not one of the accepted tokens.
+func (u *Upstream) token(req *http.Request) (string, bool) {
+	scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "token") && !strings.EqualFold(scheme, "bearer") {
+		return "", false
+	}
+	return token, slices.Contains(u.Tokens, token)
+}
+
+// rateLimitHeaders sets the X-RateLimit-* headers the real API returns on every response.
+func rateLimitHeaders(h http.Header) {
+	h.Set("X-RateLimit-Limit", "5000")
+	h.Set("X-RateLimit-Remaining", "4999")
+	h.Set("X-RateLimit-Used", "1")
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	h.Set("X-RateLimit-Resource", "core")
+}
+
+// writeJSON writes a 200 (or 304 if the request's If-None-Match matches the ETag) JSON response.
+func (u *Upstream) writeJSON(w http.ResponseWriter, req *http.Request, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	if u.CacheControl != "" {
+		w.Header().Set("Cache-Control", u.CacheControl)
+	}
+	w.Header().Set("X-GitHub-Request-Id", fmt.Sprintf("E2E:%d", u.requestID.Add(1)))
+	if req.Header.Get("If-None-Match") == etag {
+		u.record(req.URL.Path, true)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	u.record(req.URL.Path, false)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	_, _ = w.Write(body)
+}
+
+// issue returns the mocked issue.
+func issue(number int) map[string]any {
+	return map[string]any{
+		"number": number,
+		"title":  fmt.Sprintf("Issue %d", number),
+		"state":  "open",
+	}
+}
+
+func (u *Upstream) rateLimit(w http.ResponseWriter, req *http.Request) {
+	if u.RateLimits != nil {
+		token, _ := u.token(req)
+		u.writeJSON(w, req, u.RateLimits.rateLimit(token))
+		return
+	}
+	rate := map[string]any{
+		"limit":     5000,
+		"used":      1,
+		"remaining": 4999,
+		"reset":     time.Now().Add(time.Hour).Unix(),
+	}
+	u.writeJSON(w, req, map[string]any{
+		"resources": map[string]any{"core": rate},
+		"rate":      rate,
+	})
+}
+
+func (u *Upstream) user(w http.ResponseWriter, req *http.Request) {
+	u.writeJSON(w, req, map[string]any{"login": Owner, "id": 1})
+}
+
+func (u *Upstream) repo(w http.ResponseWriter, req *http.Request) {
+	if req.PathValue("owner") != Owner || req.PathValue("repo") != Repo {
+		Error(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	u.writeJSON(w, req, map[string]any{
+		"id":        1,
+		"name":      Repo,
+		"full_name": Owner + "/" + Repo,
+	})
+}
+
+func (u *Upstream) listIssues(w http.ResponseWriter, req *http.Request) {
+	if req.PathValue("owner") != Owner || req.PathValue("repo") != Repo {
+		Error(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+	page = max(page, 1)
+	perPage, _ := strconv.Atoi(req.URL.Query().Get("per_page"))
+	if perPage <= 0 {
+		perPage = 30
+	}
+	last := max((u.Issues+perPage-1)/perPage, 1)
+
+	// Like the real API, the Link header uses absolute URLs of the upstream.
+	link := func(page int, rel string) string {
+		return fmt.Sprintf(`<http://%s%s?page=%d&per_page=%d>; rel="%s"`, req.Host, req.URL.Path, page, perPage, rel)
+	}
+	var links []string
+	if page < last {
+		links = append(links, link(page+1, "next"), link(last, "last"))
+	}
+	if page > 1 {
+		links = append(links, link(1, "first"), link(page-1, "prev"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	issues := []map[string]any{}
+	for number := (page-1)*perPage + 1; number <= min(page*perPage, u.Issues); number++ {
+		issues = append(issues, issue(number))
+	}
+	u.writeJSON(w, req, issues)
+}
+
+func (u *Upstream) getIssue(w http.ResponseWriter, req *http.Request) {
+	number, err := strconv.Atoi(req.PathValue("number"))
+	if req.PathValue("owner") != Owner || req.PathValue("repo") != Repo || err != nil || number < 1 || number > u.Issues {
+		Error(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	u.writeJSON(w, req, issue(number))
+}
+
+func (u *Upstream) searchIssues(w http.ResponseWriter, req *http.Request) {
+	u.writeJSON(w, req, map[string]any{
+		"total_count":        0,
+		"incomplete_results": false,
+		"items":              []any{},
+	})
+}
+
+func (u *Upstream) createIssue(w http.ResponseWriter, req *http.Request) {
+	if req.PathValue("owner") != Owner || req.PathValue("repo") != Repo {
+		Error(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	var body struct {
+		Title string `json:"title"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Title == "" {
+		Error(w, http.StatusUnprocessableEntity, "Validation Failed")
+		return
+	}
+	u.record(req.URL.Path, false)
+	created := issue(u.Issues + 1)
+	created["title"] = body.Title
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(created)
+}
+
+func (u *Upstream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	u.once.Do(func() {
+		u.mux = http.NewServeMux()
+		u.mux.HandleFunc("GET /rate_limit", u.rateLimit)
+		u.mux.HandleFunc("GET /user", u.user)
+		u.mux.HandleFunc("GET /repos/{owner}/{repo}", u.repo)
+		u.mux.HandleFunc("GET /repos/{owner}/{repo}/issues", u.listIssues)
+		u.mux.HandleFunc("POST /repos/{owner}/{repo}/issues", u.createIssue)
+		u.mux.HandleFunc("GET /repos/{owner}/{repo}/issues/{number}", u.getIssue)
+		u.mux.HandleFunc("GET /search/issues", u.searchIssues)
+		u.mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+			Error(w, http.StatusNotFound, "Not Found")
+		})
+	})
+	token, ok := u.token(req)
+	if !ok {
+		Error(w, http.StatusUnauthorized, "Bad credentials")
+		return
+	}
+	if u.RateLimits == nil {
+		rateLimitHeaders(w.Header())
+	} else if req.URL.Path != "/rate_limit" {
+		rw, release, ok := u.RateLimits.acquire(w, req, token)
+		if !ok {
+			return
+		}
+		defer release()
+		w = rw
+	}
+	if u.Latency > 0 {
+		select {
+		case <-time.After(u.Latency):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	u.mux.ServeHTTP(w, req)
+}
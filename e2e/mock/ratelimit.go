@@ -0,0 +1,227 @@
+package mock
+
+import (
+	"cmp"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimits configures the rate-limits enforced by the mocked upstream per token, mirroring the real API:
+// the primary limits are per resource (core and search) over fixed windows and conditional requests answered with a
+// 304 are free, the secondary limits reject too many concurrent requests or content-creating (write) requests.
+type RateLimits struct {
+	// Core is the number of core requests allowed per Window (defaults to 5000).
+	Core int
+	// Window is the duration of the core window (defaults to 1h).
+	Window time.Duration
+	// Search is the number of search requests allowed per minute (defaults to 30).
+	Search int
+	// MaxConcurrent is the maximum number of concurrent requests per token before the secondary limit triggers.
+	MaxConcurrent int
+	// WritesPerMinute is the maximum number of mutating requests per token per minute.
+	WritesPerMinute int
+	// RetryAfter is the Retry-After returned when the secondary limit triggers (defaults to 60s).
+	RetryAfter time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*tokenState
+}
+
+// TokenStats is the usage of a single token observed by the mocked upstream.
+type TokenStats struct {
+	// Used is the number of requests counted against each primary limit (by resource).
+	Used map[string]int `json:"used"`
+	// Primary is the number of requests rejected because a primary limit was exhausted.
+	Primary int `json:"primary_rejected"`
+	// Secondary is the number of requests rejected by a secondary limit.
+	Secondary int `json:"secondary_rejected"`
+}
+
+// window is a fixed primary rate-limit window.
+type window struct {
+	limit int
+	used  int
+	reset time.Time
+}
+
+// tokenState is the rate-limit state of a single token.
+type tokenState struct {
+	windows  map[string]*window
+	inflight int
+	writes   []time.Time
+	stats    TokenStats
+}
+
+// resource returns the rate-limit resource of the request path.
+func resource(path string) string {
+	if strings.HasPrefix(path, "/search/") {
+		return "search"
+	}
+	return "core"
+}
+
+// state returns the (locked) state of the token.
+func (r *RateLimits) state(token string) *tokenState {
+	if r.tokens == nil {
+		r.tokens = make(map[string]*tokenState)
+	}
+	state, ok := r.tokens[token]
+	if !ok {
+		state = &tokenState{
+			windows: make(map[string]*window),
+			stats:   TokenStats{Used: make(map[string]int)},
+		}
+		r.tokens[token] = state
+	}
+	return state
+}
+
+// window returns the current window of the resource, starting a new one if the previous window has reset.
+func (r *RateLimits) window(state *tokenState, resource string, now time.Time) *window {
+	w, ok := state.windows[resource]
+	if !ok || !now.Before(w.reset) {
+		limit, duration := cmp.Or(r.Core, 5000), cmp.Or(r.Window, time.Hour)
+		if resource == "search" {
+			limit, duration = cmp.Or(r.Search, 30), time.Minute
+		}
+		w = &window{limit: limit, reset: now.Add(duration)}
+		state.windows[resource] = w
+	}
+	return w
+}
+
+// Stats returns the usage of each token.
+func (r *RateLimits) Stats() map[string]TokenStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make(map[string]TokenStats, len(r.tokens))
+	for token, state := range r.tokens {
+		stats[token] = TokenStats{Used: maps.Clone(state.stats.Used), Primary: state.stats.Primary, Secondary: state.stats.Secondary}
+	}
+	return stats
+}
+
+// headers sets the X-RateLimit-* headers of the window.
+func headers(h http.Header, resource string, w *window) {
+	h.Set("X-RateLimit-Limit", strconv.Itoa(w.limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(max(w.limit-w.used, 0)))
+	h.Set("X-RateLimit-Used", strconv.Itoa(w.used))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(w.reset.Unix(), 10))
+	h.Set("X-RateLimit-Resource", resource)
+}
+
+// mutating reports if the request creates content and counts against the writes secondary limit.
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPatch, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// acquire checks the limits for the request, it returns false (having written the error response) if the request is
+// rejected, otherwise the returned release function must be called once the request completes.
+func (r *RateLimits) acquire(rw http.ResponseWriter, req *http.Request, token string) (http.ResponseWriter, func(), bool) {
+	now := time.Now()
+	res := resource(req.URL.Path)
+
+	r.mu.Lock()
+	state := r.state(token)
+	w := r.window(state, res, now)
+	if w.used >= w.limit {
+		state.stats.Primary++
+		headers(rw.Header(), res, w)
+		r.mu.Unlock()
+		Error(rw, http.StatusForbidden, "API rate limit exceeded for user ID 1.")
+		return nil, nil, false
+	}
+	secondary := r.MaxConcurrent > 0 && state.inflight >= r.MaxConcurrent
+	if !secondary && mutating(req.Method) && r.WritesPerMinute > 0 {
+		cutoff := now.Add(-time.Minute)
+		for len(state.writes) > 0 && state.writes[0].Before(cutoff) {
+			state.writes = state.writes[1:]
+		}
+		if len(state.writes) >= r.WritesPerMinute {
+			secondary = true
+		} else {
+			state.writes = append(state.writes, now)
+		}
+	}
+	if secondary {
+		state.stats.Secondary++
+		r.mu.Unlock()
+		rw.Header().Set("Retry-After", strconv.Itoa(int(cmp.Or(r.RetryAfter, time.Minute)/time.Second)))
+		Error(rw, http.StatusForbidden, "You have exceeded a secondary rate limit. Please wait a few minutes before you try again.")
+		return nil, nil, false
+	}
+	// Reserve the request against the primary limit, it is refunded if the response is a 304.
+	w.used++
+	state.stats.Used[res]++
+	state.inflight++
+	r.mu.Unlock()
+
+	release := func() {
+		r.mu.Lock()
+		state.inflight--
+		r.mu.Unlock()
+	}
+	return &rateWriter{ResponseWriter: rw, limits: r, state: state, window: w, resource: res}, release, true
+}
+
+// rateWriter sets the rate-limit headers when the status is written, refunding the reserved request if it is a 304
+// (conditional requests answered with a 304 are free).
+type rateWriter struct {
+	http.ResponseWriter
+	limits   *RateLimits
+	state    *tokenState
+	window   *window
+	resource string
+	wrote    bool
+}
+
+func (w *rateWriter) WriteHeader(statusCode int) {
+	if !w.wrote {
+		w.wrote = true
+		w.limits.mu.Lock()
+		if statusCode == http.StatusNotModified {
+			w.window.used--
+			w.state.stats.Used[w.resource]--
+		}
+		headers(w.Header(), w.resource, w.window)
+		w.limits.mu.Unlock()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *rateWriter) Write(p []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// rateLimit returns the /rate_limit body for the current windows of the token, requests to /rate_limit are free.
+func (r *RateLimits) rateLimit(token string) map[string]any {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := r.state(token)
+	resources := make(map[string]any)
+	for _, res := range []string{"core", "search"} {
+		w := r.window(state, res, now)
+		resources[res] = map[string]any{
+			"limit":     w.limit,
+			"used":      w.used,
+			"remaining": max(w.limit-w.used, 0),
+			"reset":     w.reset.Unix(),
+		}
+	}
+	return map[string]any{
+		"resources": resources,
+		"rate":      resources["core"],
+	}
+}
@@ -0,0 +1,39 @@
+// octokit.js flows against the proxy, run by the e2e harness with PROXY_URL and ADMIN_URL set.
+import assert from "node:assert/strict";
+import { Octokit } from "@octokit/rest";
+
+const baseUrl = process.env.PROXY_URL.replace(/\/$/, "");
+const adminUrl = process.env.ADMIN_URL.replace(/\/$/, "");
+const octokit = new Octokit({ baseUrl }); // Unauthenticated, the proxy injects the credential
+
+// Auth injection
+const { data: user } = await octokit.rest.users.getAuthenticated();
+assert.equal(user.login, "octocat", "auth injection");
+
+// Pagination rewriting, octokit follows the Link header so it must point at the proxy.
+const issues = await octokit.paginate(octokit.rest.issues.listForRepo, {
+  owner: "octocat",
+  repo: "hello-world",
+  per_page: 2,
+});
+assert.equal(issues.length, 5, "pagination");
+
+// Caching
+await octokit.rest.repos.get({ owner: "octocat", repo: "hello-world" });
+const cached = await octokit.rest.repos.get({ owner: "octocat", repo: "hello-world" });
+assert.ok(cached.headers["x-cached-request-id"], "caching");
+
+// Error translation
+await assert.rejects(octokit.rest.repos.get({ owner: "octocat", repo: "missing" }), { status: 404 });
+await fetch(adminUrl + "/admin/freeze", { method: "POST" });
+try {
+  await assert.rejects(
+    octokit.rest.issues.create({ owner: "octocat", repo: "hello-world", title: "frozen" }),
+    (err) => err.status === 503 && err.response.data.documentation_url.includes("github-api-proxy"),
+    "errors",
+  );
+} finally {
+  await fetch(adminUrl + "/admin/freeze", { method: "DELETE" });
+}
+
+console.log("ok");
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// CacheReencrypted counts the cached responses re-encrypted with the current key when read, by what they were
+// previously stored as (plaintext or rotated).
+var CacheReencrypted = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:      "cache_reencrypted_total",
+		Help:      "Cached responses re-encrypted with the current key when read, by what they were stored as (plaintext, rotated)",
+		Subsystem: "github",
+	},
+	[]string{"from"},
+)
+
+// EncryptionHeader identifies the key of an encrypted cached response, it is only ever seen by the storage backend.
+const EncryptionHeader = "X-Proxy-Cache-Encryption"
+
+// EncryptionKey is an AES-256 key used to encrypt the cached responses.
+type EncryptionKey struct {
+	// ID is the first 4 bytes of the SHA-256 of the key, hex-encoded.
+	ID   string
+	aead cipher.AEAD
+}
+
+// NewEncryptionKey creates an EncryptionKey from the raw 32-byte key.
+func NewEncryptionKey(key []byte) (*EncryptionKey, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key length %d, must be 32 bytes", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher failed: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cipher.NewGCM failed: %w", err)
+	}
+	hash := sha256.Sum256(key)
+	return &EncryptionKey{ID: hex.EncodeToString(hash[:4]), aead: aead}, nil
+}
+
+// decodeKeyFile decodes the contents of a key file, which may be raw, hex or base64 encoded.
+func decodeKeyFile(b []byte) []byte {
+	trimmed := strings.TrimSpace(string(b))
+	if decoded, err := hex.DecodeString(trimmed); err == nil {
+		return decoded
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(trimmed); err == nil {
+		return decoded
+	}
+	return b
+}
+
+// LoadEncryptionKey loads the key from the spec: either the path of a file containing the key ("file:" prefix
+// optional), or "kms:" followed by the path of a file containing a data key encrypted by AWS KMS.
+func LoadEncryptionKey(ctx context.Context, spec string) (*EncryptionKey, error) {
+	kind, path, ok := strings.Cut(spec, ":")
+	if !ok {
+		kind, path = "file", spec
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile failed: %w", err)
+	}
+	key := decodeKeyFile(b)
+	switch kind {
+	case "file":
+	case "kms":
+		awsConfig, err := LoadAWSConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("LoadAWSConfig failed: %w", err)
+		}
+		out, err := kms.NewFromConfig(awsConfig).Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: key})
+		if err != nil {
+			return nil, fmt.Errorf("(*kms.Client).Decrypt failed: %w", err)
+		}
+		key = out.Plaintext
+	default:
+		return nil, fmt.Errorf("unknown key source %q", kind)
+	}
+	return NewEncryptionKey(key)
+}
+
+// EncryptedStorage encrypts the cached responses (headers and body) with AES-256-GCM before they reach the storage
+// backend. The first of the Keys encrypts, all of them decrypt, so keys can be rotated by prepending a new key.
+// Responses stored as plaintext (ex: before encryption was enabled) or with a rotated key are re-encrypted with the
+// current key as they are read, unless RejectPlaintext is set in which case plaintext responses are cache misses.
+type EncryptedStorage struct {
+	Storage ghtransport.Storage
+	Keys    []*EncryptionKey
+	// RejectPlaintext treats responses stored as plaintext as cache misses, once all responses have been migrated.
+	RejectPlaintext bool
+}
+
+// seal encrypts the serialized response, it is stored as the body of a placeholder response. The cache key is bound as
+// the additional data so a stored response cannot be swapped for another.
+func (s *EncryptedStorage) seal(req *http.Request, value []byte) *http.Response {
+	key := s.Keys[0]
+	nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(value)+key.aead.Overhead())
+	_, _ = rand.Read(nonce)
+	sealed := key.aead.Seal(nonce, nonce, value, []byte(req.URL.String()))
+	return &http.Response{
+		Status:     strconv.Itoa(http.StatusOK) + " " + http.StatusText(http.StatusOK),
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":   []string{"application/octet-stream"},
+			EncryptionHeader: []string{key.ID},
+		},
+		Body:          io.NopCloser(bytes.NewReader(sealed)),
+		ContentLength: int64(len(sealed)),
+		Request:       req,
+	}
+}
+
+// open decrypts the body of a placeholder response with the identified key.
+func (s *EncryptedStorage) open(req *http.Request, id string, sealed []byte) ([]byte, error) {
+	for _, key := range s.Keys {
+		if key.ID != id {
+			continue
+		}
+		if len(sealed) < key.aead.NonceSize() {
+			return nil, errors.New("encrypted response is truncated")
+		}
+		nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+		// Decrypt in place, the sealed response is not used afterwards.
+		value, err := key.aead.Open(ciphertext[:0], nonce, ciphertext, []byte(req.URL.String()))
+		if err != nil {
+			return nil, fmt.Errorf("(cipher.AEAD).Open failed: %w", err)
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("unknown encryption key %q", id)
+}
+
+func (s *EncryptedStorage) Get(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := s.Storage.Get(ctx, req)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	id := resp.Header.Get(EncryptionHeader)
+	if id == "" && s.RejectPlaintext {
+		resp.Body.Close()
+		return nil, nil
+	}
+	var value []byte
+	if id == "" {
+		if value, err = httputil.DumpResponse(resp, true); err != nil {
+			return nil, fmt.Errorf("httputil.DumpResponse failed: %w", err)
+		}
+	} else {
+		sealed, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+		}
+		if value, err = s.open(req, id, sealed); err != nil {
+			// Ex: the key was removed, treat it as a miss so the response is fetched (and stored) again.
+			log.Warn().Err(err).Str("url", req.URL.String()).Msg("(*EncryptedStorage).open failed")
+			return nil, nil
+		}
+	}
+	// Migrate responses stored as plaintext or with a rotated key to the current key.
+	if id != s.Keys[0].ID {
+		from := "rotated"
+		if id == "" {
+			from = "plaintext"
+		}
+		if err := s.Storage.Put(ctx, s.seal(req, value)); err != nil {
+			log.Warn().Err(err).Str("url", req.URL.String()).Msg("(ghtransport.Storage).Put failed")
+		} else {
+			CacheReencrypted.WithLabelValues(from).Inc()
+		}
+	}
+	resp, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(value)), req)
+	if err != nil {
+		return nil, fmt.Errorf("http.ReadResponse failed: %w", err)
+	}
+	return resp, nil
+}
+
+func (s *EncryptedStorage) Put(ctx context.Context, resp *http.Response) error {
+	value, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return fmt.Errorf("httputil.DumpResponse failed: %w", err)
+	}
+	return s.Storage.Put(ctx, s.seal(resp.Request, value))
+}
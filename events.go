@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	EventFeeds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "event_feeds",
+		Subsystem: "github",
+		Help:      "Number of events feeds currently polled upstream on behalf of the subscribers",
+	})
+	EventSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "event_subscribers",
+		Subsystem: "github",
+		Help:      "Number of clients currently subscribed to an events feed",
+	})
+	EventsDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "events_delivered_total",
+		Subsystem: "github",
+		Help:      "Number of events sent to the subscribers by result (delivered, dropped)",
+	}, []string{"result"})
+)
+
+// DefaultEventsInterval is the minimum interval the events feeds are polled at, GitHub's default X-Poll-Interval.
+const DefaultEventsInterval = 60 * time.Second
+
+// maxRecentEvents is the number of recent events of a feed kept to dedupe the polls and replay to the subscribers
+// resuming from a Last-Event-ID, the events API never returns more than 300 events.
+const maxRecentEvents = 300
+
+// eventsPath matches the paths of the events API which can be subscribed to.
+var eventsPath = regexp.MustCompile(`^/(events|repos/[^/]+/[^/]+/events|orgs/[^/]+/events|users/[^/]+/events(/public)?|networks/[^/]+/[^/]+/events)$`)
+
+// Event is a single event of an events feed.
+type Event struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"-"`
+}
+
+// eventFeed polls a single events path upstream for as long as it has subscribers.
+type eventFeed struct {
+	// parent is the synthetic request the polls are made as, with the identity of the first subscriber.
+	parent *http.Request
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	recent      []Event // Oldest first
+	subscribers map[chan Event]struct{}
+}
+
+// EventHub emulates long-polling of the events API: each events path (per tenant) is polled upstream by a single
+// consumer through the Handler (ex: the proxy, so the unchanged polls are free conditional requests), at the
+// X-Poll-Interval GitHub requests, and the new events are fanned out to every subscriber.
+type EventHub struct {
+	Handler http.Handler
+	// Interval is the minimum interval between the polls of a feed, DefaultEventsInterval if zero.
+	Interval time.Duration
+
+	mu    sync.Mutex
+	feeds map[string]*eventFeed
+}
+
+// Subscribe subscribes to the events of the path, as the client and tenant of the context. If lastID (optional) is
+// a recent event, the events after it are replayed first. The events are received until the cancel func is called.
+func (h *EventHub) Subscribe(ctx context.Context, path string, lastID string) (<-chan Event, func()) {
+	key := path
+	if tenant := TenantFromContext(ctx); tenant != nil {
+		key = tenant.Name + "\x00" + path
+	}
+	ch := make(chan Event, maxRecentEvents)
+
+	h.mu.Lock()
+	feed, ok := h.feeds[key]
+	if !ok {
+		feedCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		parent := (&http.Request{
+			Method: http.MethodGet,
+			Header: http.Header{"Accept": {"application/vnd.github+json"}},
+		}).WithContext(feedCtx)
+		feed = &eventFeed{parent: parent, cancel: cancel, subscribers: make(map[chan Event]struct{})}
+		if h.feeds == nil {
+			h.feeds = make(map[string]*eventFeed)
+		}
+		h.feeds[key] = feed
+		EventFeeds.Inc()
+		go h.poll(feed, path)
+	}
+	feed.mu.Lock()
+	feed.subscribers[ch] = struct{}{}
+	if idx := slices.IndexFunc(feed.recent, func(event Event) bool { return event.ID == lastID }); lastID != "" && idx >= 0 {
+		for _, event := range feed.recent[idx+1:] {
+			ch <- event
+		}
+	}
+	feed.mu.Unlock()
+	h.mu.Unlock()
+	EventSubscribers.Inc()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			EventSubscribers.Dec()
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			feed.mu.Lock()
+			delete(feed.subscribers, ch)
+			empty := len(feed.subscribers) == 0
+			feed.mu.Unlock()
+			if empty {
+				// The last subscriber left, stop polling upstream.
+				delete(h.feeds, key)
+				EventFeeds.Dec()
+				feed.cancel()
+			}
+		})
+	}
+}
+
+// fetch polls the events of the path once, returning the new events (oldest first) and the poll interval.
+func (h *EventHub) fetch(feed *eventFeed, path string) ([]Event, time.Duration, error) {
+	interval := cmp.Or(h.Interval, DefaultEventsInterval)
+	resp := subrequest(h.Handler, feed.parent, http.MethodGet, path+"?per_page=100", nil, nil)
+	if seconds, err := strconv.Atoi(resp.header.Get("X-Poll-Interval")); err == nil {
+		interval = max(interval, time.Duration(seconds)*time.Second)
+	}
+	if resp.status != http.StatusOK {
+		return nil, interval, fmt.Errorf("unexpected status %d", resp.status)
+	}
+	var events []json.RawMessage
+	if err := json.Unmarshal(resp.body.Bytes(), &events); err != nil {
+		return nil, interval, fmt.Errorf("json.Unmarshal failed: %w", err)
+	}
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	var fresh []Event
+	// The events are returned newest first.
+	for _, data := range slices.Backward(events) {
+		var event Event
+		if err := json.Unmarshal(data, &event); err != nil || event.ID == "" {
+			continue
+		}
+		if slices.ContainsFunc(feed.recent, func(recent Event) bool { return recent.ID == event.ID }) {
+			continue
+		}
+		// Each line of a Server-Sent Event is a field, the (pretty-printed) event must be a single line.
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, data); err != nil {
+			continue
+		}
+		event.Data = compact.Bytes()
+		fresh = append(fresh, event)
+	}
+	return fresh, interval, nil
+}
+
+// poll polls the feed until it is cancelled, delivering the new events to the subscribers.
+func (h *EventHub) poll(feed *eventFeed, path string) {
+	ctx := feed.parent.Context()
+	for first := true; ; first = false {
+		fresh, interval, err := h.fetch(feed, path)
+		if err != nil && ctx.Err() == nil {
+			log.Warn().Err(err).Str("path", path).Msg("(*EventHub).fetch failed")
+		}
+		feed.mu.Lock()
+		if feed.recent = append(feed.recent, fresh...); len(feed.recent) > maxRecentEvents {
+			feed.recent = slices.Clone(feed.recent[len(feed.recent)-maxRecentEvents:])
+		}
+		// The events before the first poll are only replayed (see Subscribe), they are not new.
+		for ch := range feed.subscribers {
+			if first {
+				break
+			}
+			for _, event := range fresh {
+				select {
+				case ch <- event:
+					EventsDelivered.WithLabelValues("delivered").Inc()
+				default:
+					EventsDelivered.WithLabelValues("dropped").Inc() // The subscriber is not keeping up
+				}
+			}
+		}
+		feed.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// EventStreamHandler implements the /events/stream API: GET streams the events of the path (ex:
+// /repos/octocat/hello-world/events) as Server-Sent Events until the client disconnects, resuming after the
+// Last-Event-ID (if it is a recent event).
+type EventStreamHandler struct {
+	Hub *EventHub
+}
+
+// heartbeatInterval is the interval of the comments keeping idle event streams alive.
+const heartbeatInterval = 30 * time.Second
+
+// writeEvent writes the event as a Server-Sent Event, the id is the Last-Event-ID of a resuming client.
+func writeEvent(w http.ResponseWriter, event Event) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	return err
+}
+
+// ServeEvents streams the events of the channel to the client as Server-Sent Events, until the client disconnects.
+// The filter (optional) reports if each event is sent, and may rewrite it.
+func ServeEvents(w http.ResponseWriter, req *http.Request, events <-chan Event, filter func(Event) (Event, bool)) {
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{}) // The stream outlives the --write-timeout
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprint(w, ": subscribed\n\n"); err != nil {
+		return
+	}
+	_ = rc.Flush()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			if filter != nil {
+				var ok bool
+				if event, ok = filter(event); !ok {
+					continue
+				}
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (h *EventStreamHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Query().Get("path"), "/api/v3")
+	if !eventsPath.MatchString(path) {
+		WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The path parameter must be an events API path, ex: /repos/octocat/hello-world/events")
+		return
+	}
+	events, cancel := h.Hub.Subscribe(req.Context(), path, req.Header.Get("Last-Event-ID"))
+	defer cancel()
+	ServeEvents(w, req, events, nil)
+}
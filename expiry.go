@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	CredentialExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "credential_expiry_days",
+		Subsystem: "github",
+		Help:      "Days until the credential expires, from the GitHub-Authentication-Token-Expiration header (fine-grained and expiring personal access tokens only)",
+	}, []string{"client_id"})
+)
+
+// TokenExpirationHeader is the response header GitHub sets with the expiration of the (expiring) token of the request.
+const TokenExpirationHeader = "GitHub-Authentication-Token-Expiration"
+
+// tokenExpirationLayouts are the formats of the TokenExpirationHeader, ex: "2026-03-10 20:23:28 UTC".
+var tokenExpirationLayouts = []string{"2006-01-02 15:04:05 MST", "2006-01-02 15:04:05 -0700"}
+
+// parseTokenExpiration parses the value of the TokenExpirationHeader.
+func parseTokenExpiration(value string) (time.Time, error) {
+	for _, layout := range tokenExpirationLayouts {
+		if expires, err := time.Parse(layout, value); err == nil {
+			return expires, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid token expiration %q", value)
+}
+
+// ExpiryTransport tracks the expiration of a credential from the TokenExpirationHeader of its responses (including the
+// rate-limit polls, so idle credentials are tracked too), as personal access tokens otherwise expire silently. Once
+// the credential expires within the Warning it is logged (and, if set, alerted via the Alerter) at most once a day.
+type ExpiryTransport struct {
+	Base       http.RoundTripper
+	Credential string
+	Warning    time.Duration
+	Alerter    *Alerter
+
+	mu     sync.Mutex
+	warned time.Time
+}
+
+// warn reports if the expiration of the credential should be warned about.
+func (t *ExpiryTransport) warn(expires time.Time, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if expires.Sub(now) > t.Warning || now.Sub(t.warned) < 24*time.Hour {
+		return false
+	}
+	t.warned = now
+	return true
+}
+
+func (t *ExpiryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	value := resp.Header.Get(TokenExpirationHeader)
+	if value == "" {
+		return resp, nil
+	}
+	expires, err := parseTokenExpiration(value)
+	if err != nil {
+		log.Warn().Err(err).Str("credential", t.Credential).Msg("parseTokenExpiration failed")
+		return resp, nil
+	}
+	now := time.Now()
+	CredentialExpiry.WithLabelValues(t.Credential).Set(expires.Sub(now).Hours() / 24)
+	if t.warn(expires, now) {
+		text := fmt.Sprintf("Credential %s expires in %.1f days (%s), rotate it", t.Credential, expires.Sub(now).Hours()/24, expires.Format(time.DateOnly))
+		if !now.Before(expires) {
+			text = fmt.Sprintf("Credential %s expired on %s", t.Credential, expires.Format(time.DateOnly))
+		}
+		if t.Alerter != nil {
+			t.Alerter.Fire(Alert{Kind: "credential_expiring", Credential: t.Credential, Text: text})
+		} else {
+			log.Warn().Str("credential", t.Credential).Time("expires", expires).Msg(text)
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	UpstreamActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "upstream_active",
+		Subsystem: "github",
+		Help:      "Whether the upstream is the one the requests are currently sent to",
+	}, []string{"upstream"})
+	UpstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "upstream_healthy",
+		Subsystem: "github",
+		Help:      "Whether the upstream passed its last health check",
+	}, []string{"upstream"})
+	UpstreamFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "upstream_failovers_total",
+		Subsystem: "github",
+		Help:      "Number of switches of the active upstream by the upstream switched to",
+	}, []string{"upstream"})
+)
+
+// healthTimeout bounds each health check of an upstream.
+const healthTimeout = 5 * time.Second
+
+// FailoverTransport sends the requests (addressed to the first of the Upstreams, ex: a GitHub Enterprise Server
+// primary) to the first healthy upstream, in order of preference (ex: its replicas). The upstreams are checked
+// actively every interval (any response below a 500 is healthy, a rate limited server is reachable) and passively:
+// a connection error marks the active upstream unhealthy, retrying the replayable requests on the next one. The
+// requests fail back to a preferred upstream once it is healthy again.
+//
+// The requests are addressed (and cached) by the URL of the first upstream whichever is active, so the cache entries
+// are shared by the upstreams (and by the replicas of the proxy sharing the storage), which assumes they serve the
+// same data: the ETags of a replica match those of the primary, a stale (lagging) replica is revalidated like a
+// modified resource. The Link headers of the responses are rewritten to the URL of the first upstream.
+type FailoverTransport struct {
+	Base      http.RoundTripper
+	Upstreams []*url.URL
+
+	active  atomic.Int32
+	mu      sync.Mutex
+	healthy []bool
+}
+
+// NewFailoverTransport returns a FailoverTransport for the upstreams (all assumed healthy until checked).
+func NewFailoverTransport(base http.RoundTripper, upstreams []*url.URL) *FailoverTransport {
+	t := &FailoverTransport{
+		Base:      base,
+		Upstreams: upstreams,
+		healthy:   make([]bool, len(upstreams)),
+	}
+	for idx, upstream := range upstreams {
+		t.healthy[idx] = true
+		UpstreamHealthy.WithLabelValues(upstream.String()).Set(1)
+		UpstreamActive.WithLabelValues(upstream.String()).Set(0)
+	}
+	UpstreamActive.WithLabelValues(upstreams[0].String()).Set(1)
+	return t
+}
+
+// set records the health of the upstream, switching the active upstream to the first healthy one (or keeping it if
+// none is healthy).
+func (t *FailoverTransport) set(idx int, healthy bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.healthy[idx] = healthy
+	if healthy {
+		UpstreamHealthy.WithLabelValues(t.Upstreams[idx].String()).Set(1)
+	} else {
+		UpstreamHealthy.WithLabelValues(t.Upstreams[idx].String()).Set(0)
+	}
+	active := int(t.active.Load())
+	for candidate, ok := range t.healthy {
+		if ok {
+			if candidate != active {
+				log.Warn().Str("from", t.Upstreams[active].String()).Str("to", t.Upstreams[candidate].String()).Msg("upstream failover")
+				UpstreamFailovers.WithLabelValues(t.Upstreams[candidate].String()).Inc()
+				UpstreamActive.WithLabelValues(t.Upstreams[active].String()).Set(0)
+				UpstreamActive.WithLabelValues(t.Upstreams[candidate].String()).Set(1)
+				t.active.Store(int32(candidate))
+			}
+			return
+		}
+	}
+}
+
+// check performs the health check of the upstream.
+func (t *FailoverTransport) check(ctx context.Context, upstream *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream.String(), nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("(http.RoundTripper).RoundTrip failed: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unhealthy status %s", resp.Status)
+	}
+	return nil
+}
+
+// Run checks the health of the upstreams every interval until the context is cancelled.
+func (t *FailoverTransport) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for idx, upstream := range t.Upstreams {
+			err := t.check(ctx, upstream)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Debug().Err(err).Str("upstream", upstream.String()).Msg("upstream health check failed")
+			}
+			t.set(idx, err == nil)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rewrite returns the request addressed to the upstream instead of the first upstream.
+func (t *FailoverTransport) rewrite(req *http.Request, upstream *url.URL) *http.Request {
+	req = req.Clone(req.Context())
+	primary := t.Upstreams[0]
+	req.URL.Scheme, req.URL.Host = upstream.Scheme, upstream.Host
+	if rest, ok := strings.CutPrefix(req.URL.Path, strings.TrimSuffix(primary.Path, "/")); ok {
+		req.URL.Path = strings.TrimSuffix(upstream.Path, "/") + rest
+		req.URL.RawPath = ""
+	}
+	req.Host = ""
+	return req
+}
+
+// replayable reports if the request can be sent again after a connection error.
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func (t *FailoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		idx := int(t.active.Load())
+		upstream, out := t.Upstreams[idx], req
+		if idx > 0 {
+			out = t.rewrite(req, upstream)
+		}
+		// The body of the previous attempt was consumed.
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("(*http.Request).GetBody failed: %w", err)
+			}
+			if out == req {
+				out = req.Clone(req.Context())
+			}
+			out.Body = body
+		}
+		resp, err := t.Base.RoundTrip(out)
+		if err != nil {
+			if req.Context().Err() == nil && t.failed(idx, req) {
+				traceRetry(req.Context())
+				continue
+			}
+			return nil, err
+		}
+		// The links of the responses point to the first upstream, as if it had served them.
+		if link := resp.Header.Get("Link"); idx > 0 && link != "" {
+			resp.Header.Set("Link", strings.ReplaceAll(link, upstream.String(), t.Upstreams[0].String()))
+		}
+		return resp, nil
+	}
+}
+
+// failed marks the upstream unhealthy after a connection error, reporting if the request should be retried on the
+// newly active upstream.
+func (t *FailoverTransport) failed(idx int, req *http.Request) bool {
+	t.set(idx, false)
+	return int(t.active.Load()) != idx && replayable(req)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// FieldsHeader is the request header used to opt-in to response field filtering.
+// The value is a comma-separated list of dot-separated field paths, ex: "name,commit.sha".
+const FieldsHeader = "X-Proxy-Fields"
+
+// fieldTree is a parsed set of field paths, a nil/empty tree selects the entire value.
+type fieldTree map[string]fieldTree
+
+// parseFields parses the FieldsHeader value into a fieldTree.
+func parseFields(value string) fieldTree {
+	tree := fieldTree{}
+	for path := range strings.SplitSeq(value, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		node := tree
+		for name := range strings.SplitSeq(path, ".") {
+			child, ok := node[name]
+			if !ok {
+				child = fieldTree{}
+				node[name] = child
+			}
+			node = child
+		}
+	}
+	return tree
+}
+
+// fieldsSuffix returns the suffix of the entity tags of the responses pruned to the field list (in any order).
+func fieldsSuffix(value string) string {
+	var paths []string
+	for path := range strings.SplitSeq(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	slices.Sort(paths)
+	hash := sha256.Sum256([]byte(strings.Join(slices.Compact(paths), ",")))
+	return "-fields-" + hex.EncodeToString(hash[:4])
+}
+
+// fieldsETag derives the entity tag of the pruned representation from the entity tag of the full response, so it is
+// never mistaken for the latter (ex: by a shared cache) or for another field list. The pruning is deterministic, the
+// derived tag is as weak (or strong) as the full one.
+func fieldsETag(etag string, suffix string) string {
+	weak, opaque, _ := strings.Cut(etag, `"`)
+	return weak + `"` + strings.TrimSuffix(opaque, `"`) + suffix + `"`
+}
+
+// fullETags replaces the derived entity tags of the If-None-Match header (see fieldsETag) by those of the full
+// responses, so the conditional requests of the clients keep being answered with a 304 Not Modified.
+func fullETags(ifNoneMatch string, suffix string) string {
+	candidates := strings.Split(ifNoneMatch, ",")
+	for idx, candidate := range candidates {
+		candidate = strings.TrimSpace(candidate)
+		if full, ok := strings.CutSuffix(candidate, suffix+`"`); ok {
+			candidate = full + `"`
+		}
+		candidates[idx] = candidate
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// prune removes any fields from the JSON value that are not selected by the fieldTree.
+// Arrays are pruned element-wise so the same paths apply to list responses.
+func (tree fieldTree) prune(value any) any {
+	if len(tree) == 0 {
+		return value
+	}
+	switch v := value.(type) {
+	case []any:
+		for idx, elem := range v {
+			v[idx] = tree.prune(elem)
+		}
+		return v
+	case map[string]any:
+		pruned := make(map[string]any, len(tree))
+		for name, child := range tree {
+			if elem, ok := v[name]; ok {
+				pruned[name] = child.prune(elem)
+			}
+		}
+		return pruned
+	default:
+		return value
+	}
+}
+
+// FieldsTransport prunes JSON response bodies to the fields requested via the FieldsHeader.
+// It must wrap the caching transport so the cache continues to store the full response bodies. The pruned responses
+// carry an entity tag derived from the field list (see fieldsETag), and every response varies by the FieldsHeader.
+type FieldsTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *FieldsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	value := req.Header.Get(FieldsHeader)
+	if value == "" {
+		resp, err := t.Base.RoundTrip(req)
+		if err == nil {
+			resp.Header.Add("Vary", FieldsHeader)
+		}
+		return resp, err
+	}
+	tree := parseFields(value)
+	suffix := fieldsSuffix(value)
+
+	// Never send the header upstream, and let the transport negotiate (and decode) the compression.
+	req = req.Clone(req.Context())
+	req.Header.Del(FieldsHeader)
+	req.Header.Del("Accept-Encoding")
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" && len(tree) > 0 {
+		req.Header.Set("If-None-Match", fullETags(ifNoneMatch, suffix))
+	}
+
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	resp.Header.Add("Vary", FieldsHeader)
+	if len(tree) == 0 {
+		return resp, nil
+	}
+
+	// The client only has the pruned representation.
+	if resp.StatusCode == http.StatusNotModified {
+		if etag := resp.Header.Get("Etag"); etag != "" {
+			resp.Header.Set("Etag", fieldsETag(etag, suffix))
+		}
+		return resp, nil
+	}
+
+	// Only successful, uncompressed JSON responses can be filtered.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || req.Method == http.MethodHead {
+		return resp, nil
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return resp, nil
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		return nil, fmt.Errorf("(*http.Response).Body.Close failed: %w", err)
+	}
+
+	var decoded any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&decoded); err != nil {
+		// Not actually JSON, return the original body untouched.
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp, nil
+	}
+	filtered, err := json.Marshal(tree.prune(decoded))
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal failed: %w", err)
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(filtered))
+	resp.ContentLength = int64(len(filtered))
+	resp.Header.Del("Content-Length")
+	if etag := resp.Header.Get("Etag"); etag != "" {
+		resp.Header.Set("Etag", fieldsETag(etag, suffix))
+	}
+	return resp, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	RateLimitExhaustion = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "rate_limit_exhaustion_minutes",
+		Subsystem: "github",
+		Help:      "Estimated minutes until the remaining quota of the credential pool is exhausted at the recent consumption rate, by resource (+Inf if it is not being consumed)",
+	}, []string{"resource"})
+	RateLimitConsumption = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "rate_limit_consumption_per_minute",
+		Subsystem: "github",
+		Help:      "Recent consumption rate of the quota of the credential pool in requests per minute, by resource",
+	}, []string{"resource"})
+)
+
+const (
+	// forecastInterval is the interval the rate-limits of the pool are sampled at.
+	forecastInterval = 30 * time.Second
+	// forecastWeight is the weight of each new sample in the exponentially weighted consumption rate.
+	forecastWeight = 0.2
+)
+
+// forecastKey identifies the rate-limit of a resource of a credential.
+type forecastKey struct {
+	credential *Credential
+	resource   ghratelimit.Resource
+}
+
+// Forecaster estimates when the quota of the Pool is exhausted from the recent consumption rate of each resource, so
+// alerts can fire on the trend rather than only once the quota is exhausted.
+type Forecaster struct {
+	Pool *CredentialPool
+
+	samples map[forecastKey]ghratelimit.Rate
+	rates   map[ghratelimit.Resource]float64
+}
+
+// consumed returns the requests consumed since the previous sample of the rate-limit, across a reset they are the
+// requests used in the new window.
+func consumed(previous ghratelimit.Rate, current *ghratelimit.Rate) uint64 {
+	if previous.Reset != current.Reset {
+		return current.Used
+	}
+	if current.Remaining >= previous.Remaining {
+		return 0
+	}
+	return previous.Remaining - current.Remaining
+}
+
+// sample samples the rate-limits of the pool, updating the gauges.
+func (f *Forecaster) sample(elapsed time.Duration) {
+	samples := make(map[forecastKey]ghratelimit.Rate, len(f.samples))
+	usage := make(map[ghratelimit.Resource]uint64)
+	remaining := make(map[ghratelimit.Resource]uint64)
+	now := UpstreamNow().Unix()
+	for _, credential := range f.Pool.Credentials() {
+		for resource, rate := range credential.Transport.Limits.Iter() {
+			key := forecastKey{credential, resource}
+			samples[key] = *rate
+			// Only the resources sampled before have a consumption.
+			if previous, ok := f.samples[key]; ok {
+				usage[resource] += consumed(previous, rate)
+			}
+			if rate.Reset > 0 && int64(rate.Reset) <= now {
+				remaining[resource] += rate.Limit
+			} else {
+				remaining[resource] += rate.Remaining
+			}
+		}
+	}
+	f.samples = samples
+
+	if f.rates == nil {
+		f.rates = make(map[ghratelimit.Resource]float64)
+	}
+	for resource, used := range usage {
+		perMinute := float64(used) / elapsed.Minutes()
+		rate, ok := f.rates[resource]
+		if ok {
+			rate += forecastWeight * (perMinute - rate)
+		} else {
+			rate = perMinute
+		}
+		f.rates[resource] = rate
+		RateLimitConsumption.WithLabelValues(resource.String()).Set(rate)
+		if rate > 0 {
+			RateLimitExhaustion.WithLabelValues(resource.String()).Set(float64(remaining[resource]) / rate)
+		} else {
+			RateLimitExhaustion.WithLabelValues(resource.String()).Set(math.Inf(1))
+		}
+	}
+}
+
+// Run samples the rate-limits of the pool until the context is cancelled.
+func (f *Forecaster) Run(ctx context.Context) {
+	ticker := time.NewTicker(forecastInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	f.sample(forecastInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			f.sample(now.Sub(last))
+			last = now
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	FreezeActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "freeze_active",
+		Subsystem: "github",
+		Help:      "Whether mutating requests are currently frozen (1) or not (0)",
+	})
+	FreezeRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name:      "freeze_rejected_total",
+		Subsystem: "github",
+		Help:      "Number of mutating requests rejected during a freeze",
+	})
+)
+
+// FreezeTransport rejects (or queues) mutating requests during a change freeze, reads are passed through untouched.
+// A freeze is active if it was manually enabled (via the admin API) or the time falls within any of the Windows.
+type FreezeTransport struct {
+	Base http.RoundTripper
+	// Windows are the recurring (scheduled) freeze windows.
+	Windows []*CronWindow
+	// Queue holds mutating requests until the freeze ends (or the request is cancelled) instead of rejecting them.
+	Queue bool
+	// Now returns the current time, if nil time.Now is used.
+	Now func() time.Time
+
+	manual atomic.Bool
+
+	mu          sync.Mutex
+	checkedAt   time.Time
+	checkedIsOn bool
+}
+
+// SetFrozen manually enables (or disables) the freeze.
+func (t *FreezeTransport) SetFrozen(frozen bool) {
+	t.manual.Store(frozen)
+}
+
+// scheduled reports if a scheduled window is active, the result is cached for the current minute.
+func (t *FreezeTransport) scheduled() bool {
+	now := time.Now()
+	if t.Now != nil {
+		now = t.Now()
+	}
+	minute := now.Truncate(time.Minute)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !minute.Equal(t.checkedAt) {
+		t.checkedAt = minute
+		t.checkedIsOn = false
+		for _, window := range t.Windows {
+			if window.Active(minute) {
+				t.checkedIsOn = true
+				break
+			}
+		}
+	}
+	return t.checkedIsOn
+}
+
+// Frozen reports if the freeze is currently active.
+func (t *FreezeTransport) Frozen() bool {
+	frozen := t.manual.Load() || t.scheduled()
+	if frozen {
+		FreezeActive.Set(1)
+	} else {
+		FreezeActive.Set(0)
+	}
+	return frozen
+}
+
+func (t *FreezeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !mutating(req.Method) || !t.Frozen() {
+		return t.Base.RoundTrip(req)
+	}
+	// The GraphQL queries are reads, even though they are POSTed.
+	req, write, err := mutatingRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if !write {
+		return t.Base.RoundTrip(req)
+	}
+	if !t.Queue {
+		FreezeRejected.Inc()
+		return ProxyResponse(req, http.StatusServiceUnavailable, ReasonFrozen, "Mutating requests are frozen during a change freeze, retry later"), nil
+	}
+	// Hold the request until the freeze ends
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for t.Frozen() {
+		select {
+		case <-ticker.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return t.Base.RoundTrip(req)
+}
+
+// ServeHTTP implements the /admin/freeze API: GET returns the status, POST enables and DELETE disables the freeze.
+func (t *FreezeTransport) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		t.SetFrozen(true)
+		log.Warn().Msg("change freeze enabled")
+	case http.MethodDelete:
+		t.SetFrozen(false)
+		log.Warn().Msg("change freeze disabled")
+	default:
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]bool{
+		"frozen":    t.Frozen(),
+		"manual":    t.manual.Load(),
+		"scheduled": t.scheduled(),
+	}); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	CacheFreshness = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "cache_freshness_total",
+		Subsystem: "github",
+		Help:      "Number of cached responses by freshness (fresh, stale, revalidate), only fresh responses skip the conditional request",
+	}, []string{"result"})
+)
+
+// parseCacheControl parses the Cache-Control header into its (lowercase) directives and their (unquoted) values.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, val := range header.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(val, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+// seconds returns the delta-seconds value of the directive, if it is present and valid.
+func seconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshnessLifetime returns the freshness lifetime of the (shared) cached response per RFC 9111 section 4.2.1, no
+// heuristic freshness is applied so responses without explicit freshness are always revalidated.
+func freshnessLifetime(header http.Header, directives map[string]string) time.Duration {
+	if _, ok := directives["no-cache"]; ok {
+		return 0
+	}
+	if _, ok := directives["no-store"]; ok {
+		return 0
+	}
+	if lifetime, ok := seconds(directives, "s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := seconds(directives, "max-age"); ok {
+		return lifetime
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0 // An invalid Expires represents a time in the past
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			return 0
+		}
+		return max(expiresAt.Sub(date), 0)
+	}
+	return 0
+}
+
+// currentAge returns the age of the cached response per RFC 9111 section 4.2.3, simplified as the request and
+// response times of the original response are not stored.
+func currentAge(header http.Header, now time.Time) time.Duration {
+	var age time.Duration
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		age = max(now.Sub(date), 0)
+	}
+	if n, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && n > 0 {
+		age += time.Duration(n) * time.Second
+	}
+	return age
+}
+
+// identicalVary reports if the request headers nominated by the Vary header of the cached response are identical to
+// those of the request it was stored for (see ghtransport.VaryPrefix).
+func identicalVary(req *http.Request, cached *http.Response) bool {
+	for _, val := range cached.Header.Values("Vary") {
+		for header := range strings.FieldsFuncSeq(val, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}) {
+			if header == "*" {
+				return false
+			}
+			value := req.Header.Get(header)
+			if http.CanonicalHeaderKey(header) == "Authorization" && value != "" {
+				value = ghtransport.HashToken(value)
+			}
+			if value != cached.Header.Get(ghtransport.VaryPrefix+header) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// FreshnessTransport honors the freshness of the cached responses (Cache-Control s-maxage, max-age or Expires from
+// the upstream), serving fresh responses directly from storage without the conditional request. Stale responses,
+// and any the client requests be revalidated (Cache-Control no-cache, max-age or min-fresh), fall through to the
+// conditional (ETag-based) caching of the Base. Responses are only fresh for the request headers they Vary by, so
+// a response marked private is only ever served fresh to the same credential.
+type FreshnessTransport struct {
+	Base    http.RoundTripper
+	Storage ghtransport.Storage
+}
+
+// revalidate reports if the request directives require the cached response be revalidated at its age and lifetime.
+func revalidate(req *http.Request, age, lifetime time.Duration) bool {
+	directives := parseCacheControl(req.Header)
+	if len(directives) == 0 && strings.EqualFold(req.Header.Get("Pragma"), "no-cache") {
+		return true
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return true
+	}
+	if maxAge, ok := seconds(directives, "max-age"); ok && age > maxAge {
+		return true
+	}
+	if minFresh, ok := seconds(directives, "min-fresh"); ok && lifetime-age < minFresh {
+		return true
+	}
+	return false
+}
+
+// freshen revalidates the stale cached response, storing the Date and freshness of the upstream response (RFC 9111
+// section 4.3.4) if it was not modified so the cached response is fresh again. The Base does not store the headers of
+// a 304 Not Modified response, the cached response would otherwise be stale until the resource is modified.
+func (t *FreshnessTransport) freshen(req *http.Request, cached *http.Response) (*http.Response, error) {
+	body, err := io.ReadAll(cached.Body)
+	cached.Body.Close()
+	if err != nil {
+		return t.Base.RoundTrip(req)
+	}
+	resp, err := t.Base.RoundTrip(req)
+	// The unchanged ETag identifies the cached response was not modified (or re-stored identically by the Base).
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Etag") == "" || resp.Header.Get("Etag") != cached.Header.Get("Etag") {
+		return resp, err
+	}
+	for _, key := range []string{"Date", "Cache-Control", "Expires", "Age"} {
+		if vals := resp.Header.Values(key); len(vals) > 0 {
+			cached.Header[key] = vals
+		} else {
+			delete(cached.Header, key)
+		}
+	}
+	cached.Body = io.NopCloser(bytes.NewReader(body))
+	cached.ContentLength = int64(len(body))
+	cached.Request = req
+	if err := t.Storage.Put(req.Context(), cached); err != nil {
+		log.Warn().Err(err).Str("url", req.URL.String()).Msg("(ghtransport.Storage).Put failed")
+	}
+	return resp, nil
+}
+
+func (t *FreshnessTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || req.Header.Get("Range") != "" {
+		return t.Base.RoundTrip(req)
+	}
+	cached, err := t.Storage.Get(req.Context(), req)
+	if err != nil || cached == nil {
+		return t.Base.RoundTrip(req) // The Base will surface the error (or miss) itself
+	}
+	now := time.Now()
+	lifetime := freshnessLifetime(cached.Header, parseCacheControl(cached.Header))
+	age := currentAge(cached.Header, now)
+	result := "fresh"
+	switch {
+	case lifetime == 0 || !identicalVary(req, cached):
+		// Without freshness (or for different request headers) the response can only be revalidated by the Base.
+		CacheFreshness.WithLabelValues("stale").Inc()
+		_, _ = io.Copy(io.Discard, cached.Body)
+		cached.Body.Close()
+		return t.Base.RoundTrip(req)
+	case lifetime <= age:
+		result = "stale"
+	case revalidate(req, age, lifetime):
+		result = "revalidate"
+	}
+	CacheFreshness.WithLabelValues(result).Inc()
+	if result != "fresh" {
+		return t.freshen(req, cached)
+	}
+	for key := range cached.Header {
+		if strings.HasPrefix(key, ghtransport.VaryPrefix) {
+			delete(cached.Header, key)
+		}
+	}
+	cached.Header.Set("Age", strconv.Itoa(int(age/time.Second)))
+	if vals := cached.Header.Values("X-Github-Request-Id"); len(vals) > 0 {
+		cached.Header[ghtransport.CachedRequestIDHeader] = vals
+	} else {
+		cached.Header.Set(ghtransport.CachedRequestIDHeader, "fresh")
+	}
+	if req.Method == http.MethodHead {
+		cached.Body.Close()
+		cached.Body = http.NoBody
+		cached.ContentLength = 0
+	}
+	cached.Request = req
+	return cached, nil
+}
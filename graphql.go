@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	GraphQLCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "graphql_cache_requests_total",
+		Subsystem: "github",
+		Help:      "Number of GraphQL requests by cache result (hit, miss, bypass, not_modified, uncacheable)",
+	}, []string{"result"})
+	GraphQLPersistedQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "graphql_persisted_queries_total",
+		Subsystem: "github",
+		Help:      "Number of GraphQL persisted query lookups by result (hit, not_found, registered, mismatch)",
+	}, []string{"result"})
+	GraphQLRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name:      "graphql_rejected_total",
+		Subsystem: "github",
+		Help:      "Number of GraphQL queries rejected because their estimated cost exceeded the maximum",
+	})
+)
+
+// GraphQLCacheHeader is the response header set on GraphQL responses served from the cache.
+const GraphQLCacheHeader = "X-Proxy-GraphQL-Cache"
+
+// ProxyCacheHeader is the response header marking whether a GraphQL result was served from the cache (hit), fetched
+// from the upstream (miss) or fetched because the request had the CacheBypassHeader (bypass).
+const ProxyCacheHeader = "X-Proxy-Cache"
+
+// GraphQLCostHeader is the response header carrying the estimated cost (in points) of the GraphQL operation.
+const GraphQLCostHeader = "X-Proxy-GraphQL-Cost"
+
+// PriorityHeader is the request header which (with any value) marks a request as high priority, ex: to allow an
+// expensive GraphQL query.
+const PriorityHeader = "X-Proxy-Priority"
+
+// graphqlStoredHeader records when a GraphQL result was cached (in Unix seconds), the upstream Date may be skewed.
+const graphqlStoredHeader = "X-Proxy-GraphQL-Stored"
+
+// graphqlRequest is the body of a GraphQL request, extensions.persistedQuery follows the Apollo automatic persisted
+// queries protocol.
+type graphqlRequest struct {
+	Query         string          `json:"query,omitempty"`
+	OperationName string          `json:"operationName,omitempty"`
+	Variables     json.RawMessage `json:"variables,omitempty"`
+	Extensions    *struct {
+		PersistedQuery *struct {
+			Version    int    `json:"version"`
+			SHA256Hash string `json:"sha256Hash"`
+		} `json:"persistedQuery,omitempty"`
+	} `json:"extensions,omitempty"`
+}
+
+// readOnly reports if every operation of the GraphQL document is a query, it only needs to scan the (unnested)
+// definitions so the strings, block strings and comments are skipped without fully parsing the document.
+func readOnly(document string) bool {
+	depth := 0
+	for i := 0; i < len(document); i++ {
+		switch c := document[i]; {
+		case c == '#':
+			for i < len(document) && document[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(document[i:], `"""`):
+			end := strings.Index(document[i+3:], `"""`)
+			if end < 0 {
+				return false
+			}
+			i += end + 5
+		case c == '"':
+			for i++; i < len(document) && document[i] != '"'; i++ {
+				if document[i] == '\\' {
+					i++
+				}
+			}
+		case c == '{' || c == '(' || c == '[':
+			depth++
+		case c == '}' || c == ')' || c == ']':
+			depth--
+		case depth == 0 && (c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'):
+			start := i
+			for i < len(document) && (document[i] == '_' || 'a' <= document[i] && document[i] <= 'z' || 'A' <= document[i] && document[i] <= 'Z' || '0' <= document[i] && document[i] <= '9') {
+				i++
+			}
+			if name := document[start:i]; name == "mutation" || name == "subscription" {
+				return false
+			}
+			i--
+		}
+	}
+	return true
+}
+
+// normalizeVariables re-encodes the variables with sorted keys and no insignificant whitespace, omitted (or null)
+// variables are equivalent to an empty object.
+func normalizeVariables(variables json.RawMessage) ([]byte, error) {
+	if len(variables) == 0 || string(variables) == "null" {
+		return []byte("{}"), nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(variables))
+	decoder.UseNumber() // Preserve the precision of large integers (ex: database IDs)
+	var parsed any
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("(*json.Decoder).Decode failed: %w", err)
+	}
+	return json.Marshal(parsed)
+}
+
+// queryHash returns the hex-encoded SHA-256 of the query text, as used by the persisted queries protocol.
+func queryHash(query string) string {
+	hash := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(hash[:])
+}
+
+// graphqlError returns a GraphQL error response generated by the proxy itself, it is always 200 OK and shaped as the
+// clients of the persisted queries protocol expect.
+func graphqlError(req *http.Request, reason string, message string, code string) *http.Response {
+	body, _ := json.Marshal(map[string]any{
+		"errors": []map[string]any{{
+			"message":    message,
+			"extensions": map[string]string{"code": code},
+		}},
+	})
+	return &http.Response{
+		Status:     strconv.Itoa(http.StatusOK) + " " + http.StatusText(http.StatusOK),
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":   []string{"application/json; charset=utf-8"},
+			ProxyErrorHeader: []string{reason},
+		},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// GraphQLTransport supports persisted GraphQL queries and caches the results of read-only queries for a TTL, GraphQL
+// responses have no ETag so are otherwise never cached and every identical query spends rate-limit points. Clients
+// send the SHA-256 hash of the query (see graphqlRequest) and only include the query text if the proxy responds that
+// it is not found. The query texts and results are kept in the Storage, results are keyed by the query hash, the
+// operation name and the normalized variables (and the namespace, Accept header, tenant, etc, see KeyStorage).
+type GraphQLTransport struct {
+	Base    http.RoundTripper
+	Storage ghtransport.Storage
+	// Persisted enables the persisted queries protocol.
+	Persisted bool
+	// TTL (optional) is the duration to cache the results of read-only queries for.
+	TTL time.Duration
+	// MaxCost (optional) is the maximum estimated cost (in points) of an operation without the PriorityHeader.
+	MaxCost int
+	// Fallback answers the simple repository queries from the cached REST responses (see planFallback).
+	Fallback bool
+	Shadow   PolicyShadow
+}
+
+// persistedURL returns the (synthetic) URL persisting the text of the query hash.
+func persistedURL(hash string) *url.URL {
+	return &url.URL{Scheme: "https", Host: DerivedHost, Path: "/graphql/persisted/" + hash}
+}
+
+// load returns the stored text of the persisted query hash, if any.
+func (t *GraphQLTransport) load(req *http.Request, hash string) (string, error) {
+	resp, err := t.Storage.Get(req.Context(), &http.Request{Method: http.MethodGet, URL: persistedURL(hash)})
+	if err != nil || resp == nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	query, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+	}
+	return string(query), nil
+}
+
+// store persists the response (or query text) for the request.
+func (t *GraphQLTransport) store(req *http.Request, header http.Header, body []byte) error {
+	return t.Storage.Put(req.Context(), &http.Response{
+		Status:        http.StatusText(http.StatusOK),
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	})
+}
+
+// resultRequest returns the (synthetic) GET request keying the cached result of the query, it shares the headers of
+// the GraphQL request so the result is partitioned exactly as the cached REST responses.
+func resultRequest(req *http.Request, gql *graphqlRequest) (*http.Request, error) {
+	variables, err := normalizeVariables(gql.Variables)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.New()
+	for _, part := range [][]byte{[]byte(queryHash(gql.Query)), []byte(gql.OperationName), variables} {
+		key.Write(part)
+		key.Write([]byte{0})
+	}
+	keyed := req.Clone(req.Context())
+	keyed.Method = http.MethodGet
+	keyed.Body = nil
+	keyed.URL.RawQuery = url.Values{"result": {hex.EncodeToString(key.Sum(nil))}}.Encode()
+	return keyed, nil
+}
+
+func (t *GraphQLTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || ghratelimit.InferResource(req) != ghratelimit.ResourceGraphQL || req.Body == nil {
+		return t.Base.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("(*http.Request).Body.Read failed: %w", err)
+	}
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	var gql graphqlRequest
+	if err := json.Unmarshal(body, &gql); err != nil {
+		return t.Base.RoundTrip(req) // Let the upstream reject the malformed request
+	}
+
+	// Resolve (or register) the persisted query, the upstream never sees the extension.
+	if t.Persisted && gql.Extensions != nil && gql.Extensions.PersistedQuery != nil {
+		hash := strings.ToLower(gql.Extensions.PersistedQuery.SHA256Hash)
+		switch {
+		case gql.Query == "":
+			query, err := t.load(req, hash)
+			if err != nil {
+				log.Warn().Err(err).Str("hash", hash).Msg("(*GraphQLTransport).load failed")
+			}
+			if query == "" {
+				GraphQLPersistedQueries.WithLabelValues("not_found").Inc()
+				return graphqlError(req, ReasonQueryNotFound, "PersistedQueryNotFound", "PERSISTED_QUERY_NOT_FOUND"), nil
+			}
+			GraphQLPersistedQueries.WithLabelValues("hit").Inc()
+			gql.Query = query
+		case queryHash(gql.Query) != hash:
+			GraphQLPersistedQueries.WithLabelValues("mismatch").Inc()
+			return graphqlError(req, ReasonQueryMismatch, "provided sha does not match query", "INTERNAL_SERVER_ERROR"), nil
+		default:
+			if err := t.store(&http.Request{Method: http.MethodGet, URL: persistedURL(hash)}, http.Header{
+				"Content-Type": []string{"application/graphql"},
+			}, []byte(gql.Query)); err != nil {
+				log.Warn().Err(err).Str("hash", hash).Msg("(*GraphQLTransport).store failed")
+			}
+			GraphQLPersistedQueries.WithLabelValues("registered").Inc()
+		}
+		gql.Extensions = nil
+		if body, err = json.Marshal(&gql); err != nil {
+			return nil, fmt.Errorf("json.Marshal failed: %w", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Del("Content-Length")
+	}
+
+	// Estimate the cost of the operation, expensive operations are rejected unless the client requests priority.
+	priority := req.Header.Get(PriorityHeader) != ""
+	req.Header.Del(PriorityHeader)
+	var estimate *GraphQLEstimate
+	if gql.Query != "" {
+		if e, err := estimateCost(&gql); err == nil {
+			estimate = &e
+		}
+	}
+	if estimate != nil && t.MaxCost > 0 && estimate.Cost > t.MaxCost {
+		if !priority && t.Shadow.Deny(req, ReasonQueryCost) {
+			GraphQLRejected.Inc()
+			resp := ProxyResponse(req, http.StatusForbidden, ReasonQueryCost, fmt.Sprintf(
+				"The estimated cost of the GraphQL query (%d points, %d nodes) exceeds the maximum of %d points, send the %s header to allow it",
+				estimate.Cost, estimate.Nodes, t.MaxCost, PriorityHeader,
+			))
+			resp.Header.Set(GraphQLCostHeader, strconv.Itoa(estimate.Cost))
+			return resp, nil
+		}
+		log.Warn().Int("cost", estimate.Cost).Int("nodes", estimate.Nodes).Msg("expensive GraphQL query allowed by priority")
+	}
+
+	if t.Fallback && gql.Query != "" {
+		if plan, ok := planFallback(&gql); ok {
+			if resp, ok := t.fallback(req, plan); ok {
+				return resp, nil
+			}
+		}
+	}
+
+	resp, err := t.result(req, &gql)
+	if err == nil && estimate != nil {
+		resp.Header.Set(GraphQLCostHeader, strconv.Itoa(estimate.Cost))
+	}
+	return resp, err
+}
+
+// resultETag returns the (strong) entity tag of a GraphQL result, the hash of its body.
+func resultETag(result []byte) string {
+	hash := sha256.Sum256(result)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// notModified reports if the If-None-Match request header matches the entity tag.
+func notModified(ifNoneMatch string, etag string) bool {
+	for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// conditional replaces the GraphQL result with a 304 Not Modified response if the client already has it.
+func conditional(resp *http.Response, ifNoneMatch string) *http.Response {
+	if ifNoneMatch == "" || !notModified(ifNoneMatch, resp.Header.Get("Etag")) {
+		return resp
+	}
+	GraphQLCacheRequests.WithLabelValues("not_modified").Inc()
+	resp.Body.Close()
+	resp.Status = strconv.Itoa(http.StatusNotModified) + " " + http.StatusText(http.StatusNotModified)
+	resp.StatusCode = http.StatusNotModified
+	resp.Body = http.NoBody
+	resp.ContentLength = 0
+	resp.Header.Del("Content-Length")
+	return resp
+}
+
+// result returns the (possibly cached) result of the GraphQL request. GraphQL has no entity tags so the proxy hashes
+// the results of read-only queries instead, a client sending the hash in If-None-Match gets a 304 Not Modified if
+// the result is unchanged. The CacheBypassHeader skips the cached result (but the fresh result is still cached).
+func (t *GraphQLTransport) result(req *http.Request, gql *graphqlRequest) (*http.Response, error) {
+	if gql.Query == "" || !readOnly(gql.Query) {
+		GraphQLCacheRequests.WithLabelValues("uncacheable").Inc()
+		return t.Base.RoundTrip(req)
+	}
+	// The upstream never sees the (proxy-generated) entity tag.
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	req.Header.Del("If-None-Match")
+	bypass := req.Header.Get(CacheBypassHeader) != ""
+
+	var keyed *http.Request
+	if t.TTL > 0 {
+		keyed, _ = resultRequest(req, gql) // Invalid variables are left for the upstream to reject
+	}
+	if keyed != nil && !bypass {
+		if cached, err := t.Storage.Get(req.Context(), keyed); err != nil {
+			log.Warn().Err(err).Msg("(ghtransport.Storage).Get failed")
+		} else if cached != nil {
+			stored, err := strconv.ParseInt(cached.Header.Get(graphqlStoredHeader), 10, 64)
+			if age := time.Since(time.Unix(stored, 0)); err == nil && age < t.TTL {
+				GraphQLCacheRequests.WithLabelValues("hit").Inc()
+				cached.Header.Set(GraphQLCacheHeader, "hit")
+				cached.Header.Set(ProxyCacheHeader, "hit")
+				cached.Header.Del(graphqlStoredHeader)
+				cached.Header.Set("Age", strconv.Itoa(int(age/time.Second)))
+				// Mark the response as cached, ex: so it does not count against the quota of the tenant.
+				if vals := cached.Header.Values("X-Github-Request-Id"); len(vals) > 0 {
+					cached.Header[ghtransport.CachedRequestIDHeader] = vals
+				} else {
+					cached.Header.Set(ghtransport.CachedRequestIDHeader, "graphql")
+				}
+				cached.Request = req
+				return conditional(cached, ifNoneMatch), nil
+			}
+			cached.Body.Close()
+		}
+	}
+	marker := "miss"
+	switch {
+	case keyed == nil:
+		marker = ""
+		GraphQLCacheRequests.WithLabelValues("uncacheable").Inc()
+	case bypass:
+		marker = "bypass"
+		GraphQLCacheRequests.WithLabelValues("bypass").Inc()
+	default:
+		GraphQLCacheRequests.WithLabelValues("miss").Inc()
+	}
+
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get(ProxyErrorHeader) != "" {
+		return resp, err
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return resp, nil
+	}
+	result, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(result))
+	// Never cache (or hash) partial results or errors (ex: rate limited).
+	var parsed struct {
+		Errors json.RawMessage `json:"errors"`
+	}
+	if err := json.Unmarshal(result, &parsed); err != nil || (len(parsed.Errors) > 0 && string(parsed.Errors) != "null") {
+		return resp, nil
+	}
+	resp.Header.Set("Etag", resultETag(result))
+	if marker != "" {
+		resp.Header.Set(ProxyCacheHeader, marker)
+	}
+	if keyed != nil {
+		header := resp.Header.Clone()
+		header.Del(ProxyCacheHeader)
+		header.Set(graphqlStoredHeader, strconv.FormatInt(time.Now().Unix(), 10))
+		if err := t.store(keyed, header, result); err != nil {
+			log.Warn().Err(err).Msg("(*GraphQLTransport).store failed")
+		}
+	}
+	return conditional(resp, ifNoneMatch), nil
+}
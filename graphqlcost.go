@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// gqlToken is a lexical token of a GraphQL document, the kind is the punctuator itself or one of "name", "int",
+// "float", "string" and "" (the end of the document).
+type gqlToken struct {
+	kind  string
+	value string
+}
+
+// gqlLex splits the GraphQL document into tokens, ignoring whitespace, commas and comments.
+func gqlLex(document string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	isName := func(c byte, first bool) bool {
+		return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || (!first && '0' <= c && c <= '9')
+	}
+	for i := 0; i < len(document); {
+		c := document[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(document) && document[i] != '\n' && document[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(document[i:], "..."):
+			tokens = append(tokens, gqlToken{kind: "..."})
+			i += 3
+		case strings.ContainsRune("!$&()/:=@[]{}|", rune(c)):
+			tokens = append(tokens, gqlToken{kind: string(c)})
+			i++
+		case strings.HasPrefix(document[i:], `"""`):
+			end := strings.Index(document[i+3:], `"""`)
+			if end < 0 {
+				return nil, errors.New("unterminated block string")
+			}
+			tokens = append(tokens, gqlToken{kind: "string", value: document[i+3 : i+3+end]})
+			i += end + 6
+		case c == '"':
+			j := i + 1
+			for ; j < len(document) && document[j] != '"'; j++ {
+				if document[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(document) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, gqlToken{kind: "string", value: document[i+1 : j]})
+			i = j + 1
+		case c == '-' || '0' <= c && c <= '9':
+			j, kind := i+1, "int"
+			for ; j < len(document) && strings.IndexByte("0123456789.eE+-", document[j]) >= 0; j++ {
+				if document[j] == '.' || document[j] == 'e' || document[j] == 'E' {
+					kind = "float"
+				}
+			}
+			tokens = append(tokens, gqlToken{kind: kind, value: document[i:j]})
+			i = j
+		case isName(c, true):
+			j := i + 1
+			for j < len(document) && isName(document[j], false) {
+				j++
+			}
+			tokens = append(tokens, gqlToken{kind: "name", value: document[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+// gqlSelection is a field (with its arguments and selections) or a fragment spread in a selection set.
+type gqlSelection struct {
+	Field string
+	// Alias (optional) is the key of the field in the response.
+	Alias string
+	Args  map[string]any
+	// Spread is the name of the spread fragment, Selections of an inline fragment are merged into the parent.
+	Spread     string
+	Selections []*gqlSelection
+}
+
+// Key returns the key of the field in the response.
+func (s *gqlSelection) Key() string {
+	if s.Alias != "" {
+		return s.Alias
+	}
+	return s.Field
+}
+
+// gqlOperation is an operation definition of a GraphQL document.
+type gqlOperation struct {
+	Kind       string // query, mutation or subscription
+	Name       string
+	Defaults   map[string]any
+	Selections []*gqlSelection
+}
+
+// gqlDocument is the (partially) parsed GraphQL document, sufficient to estimate the cost of an operation.
+type gqlDocument struct {
+	Operations []*gqlOperation
+	Fragments  map[string][]*gqlSelection
+}
+
+// gqlVariable is a reference to a variable in an argument value.
+type gqlVariable string
+
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+}
+
+func (p *gqlParser) peek() gqlToken {
+	if p.pos >= len(p.tokens) {
+		return gqlToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *gqlParser) next() gqlToken {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *gqlParser) expect(kind string) (gqlToken, error) {
+	token := p.next()
+	if token.kind != kind {
+		return token, fmt.Errorf("expected %q, found %q", kind, token.kind+token.value)
+	}
+	return token, nil
+}
+
+// value parses an argument (or default) value, variables are returned as a gqlVariable.
+func (p *gqlParser) value() (any, error) {
+	token := p.next()
+	switch token.kind {
+	case "$":
+		name, err := p.expect("name")
+		return gqlVariable(name.value), err
+	case "int", "float":
+		return json.Number(token.value), nil
+	case "string":
+		return token.value, nil
+	case "name":
+		switch token.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return token.value, nil // An enum value
+	case "[":
+		var list []any
+		for p.peek().kind != "]" {
+			item, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		p.next()
+		return list, nil
+	case "{":
+		object := make(map[string]any)
+		for p.peek().kind != "}" {
+			name, err := p.expect("name")
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if object[name.value], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return object, nil
+	}
+	return nil, fmt.Errorf("unexpected value %q", token.kind+token.value)
+}
+
+// arguments parses the (optional) arguments of a field or directive.
+func (p *gqlParser) arguments() (map[string]any, error) {
+	if p.peek().kind != "(" {
+		return nil, nil
+	}
+	p.next()
+	args := make(map[string]any)
+	for p.peek().kind != ")" {
+		name, err := p.expect("name")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name.value], err = p.value(); err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+	return args, nil
+}
+
+// directives skips the (optional) directives.
+func (p *gqlParser) directives() error {
+	for p.peek().kind == "@" {
+		p.next()
+		if _, err := p.expect("name"); err != nil {
+			return err
+		}
+		if _, err := p.arguments(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typeRef skips a type reference, ex: [String!]!
+func (p *gqlParser) typeRef() error {
+	if p.peek().kind == "[" {
+		p.next()
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if _, err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.expect("name"); err != nil {
+		return err
+	}
+	if p.peek().kind == "!" {
+		p.next()
+	}
+	return nil
+}
+
+// selectionSet parses a selection set, including the opening brace.
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if _, err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []*gqlSelection
+	for p.peek().kind != "}" {
+		if p.peek().kind == "" {
+			return nil, errors.New("unterminated selection set")
+		}
+		if p.peek().kind == "..." {
+			p.next()
+			if token := p.peek(); token.kind == "name" && token.value != "on" {
+				p.next()
+				selections = append(selections, &gqlSelection{Spread: token.value})
+				if err := p.directives(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if p.peek().kind == "name" {
+				p.next() // on
+				if _, err := p.expect("name"); err != nil {
+					return nil, err
+				}
+			}
+			if err := p.directives(); err != nil {
+				return nil, err
+			}
+			inline, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			selections = append(selections, inline...)
+			continue
+		}
+		name, err := p.expect("name")
+		if err != nil {
+			return nil, err
+		}
+		selection := &gqlSelection{Field: name.value}
+		if p.peek().kind == ":" { // The name was an alias
+			p.next()
+			if name, err = p.expect("name"); err != nil {
+				return nil, err
+			}
+			selection.Alias, selection.Field = selection.Field, name.value
+		}
+		if selection.Args, err = p.arguments(); err != nil {
+			return nil, err
+		}
+		if err := p.directives(); err != nil {
+			return nil, err
+		}
+		if p.peek().kind == "{" {
+			if selection.Selections, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		selections = append(selections, selection)
+	}
+	p.next()
+	return selections, nil
+}
+
+// ParseGraphQL parses the operations and fragments of the GraphQL document.
+func ParseGraphQL(document string) (*gqlDocument, error) {
+	tokens, err := gqlLex(document)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	doc := &gqlDocument{Fragments: make(map[string][]*gqlSelection)}
+	for p.peek().kind != "" {
+		token := p.peek()
+		switch {
+		case token.kind == "{":
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, &gqlOperation{Kind: "query", Selections: selections})
+		case token.kind == "name" && token.value == "fragment":
+			p.next()
+			name, err := p.expect("name")
+			if err != nil {
+				return nil, err
+			}
+			if on := p.next(); on.kind != "name" || on.value != "on" {
+				return nil, fmt.Errorf("expected \"on\", found %q", on.kind+on.value)
+			}
+			if _, err := p.expect("name"); err != nil {
+				return nil, err
+			}
+			if err := p.directives(); err != nil {
+				return nil, err
+			}
+			if doc.Fragments[name.value], err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		case token.kind == "name" && (token.value == "query" || token.value == "mutation" || token.value == "subscription"):
+			p.next()
+			operation := &gqlOperation{Kind: token.value, Defaults: make(map[string]any)}
+			if p.peek().kind == "name" {
+				operation.Name = p.next().value
+			}
+			if p.peek().kind == "(" {
+				p.next()
+				for p.peek().kind != ")" {
+					if _, err := p.expect("$"); err != nil {
+						return nil, err
+					}
+					name, err := p.expect("name")
+					if err != nil {
+						return nil, err
+					}
+					if _, err := p.expect(":"); err != nil {
+						return nil, err
+					}
+					if err := p.typeRef(); err != nil {
+						return nil, err
+					}
+					if p.peek().kind == "=" {
+						p.next()
+						if operation.Defaults[name.value], err = p.value(); err != nil {
+							return nil, err
+						}
+					}
+					if err := p.directives(); err != nil {
+						return nil, err
+					}
+				}
+				p.next()
+			}
+			if err := p.directives(); err != nil {
+				return nil, err
+			}
+			if operation.Selections, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, operation)
+		default:
+			return nil, fmt.Errorf("unexpected definition %q", token.kind+token.value)
+		}
+	}
+	return doc, nil
+}
+
+// Operation returns the operation with the name, or the only operation if the name is empty.
+func (d *gqlDocument) Operation(name string) (*gqlOperation, error) {
+	for _, operation := range d.Operations {
+		if name == "" && len(d.Operations) == 1 || operation.Name == name && name != "" {
+			return operation, nil
+		}
+	}
+	if name == "" {
+		return nil, errors.New("an operationName is required for a document with multiple operations")
+	}
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+// GraphQLEstimate is the estimated cost of a GraphQL operation, calculated as GitHub does before executing it.
+type GraphQLEstimate struct {
+	// Cost is the estimated rate-limit points, the number of requests divided by 100 (rounded, minimum of 1).
+	Cost int
+	// Nodes is the maximum number of nodes the operation can return (GitHub rejects more than 500,000).
+	Nodes int
+}
+
+// resolve returns the value of the variable from the values or defaults, other argument values are returned as is.
+func resolve(value any, variables, defaults map[string]any) any {
+	variable, ok := value.(gqlVariable)
+	if !ok {
+		return value
+	}
+	if value, ok := variables[string(variable)]; ok {
+		return value
+	}
+	return defaults[string(variable)]
+}
+
+// pageSize returns the first (or last) argument of a connection, resolving variables from the values or defaults.
+func pageSize(args map[string]any, variables, defaults map[string]any) (int, bool) {
+	for _, name := range []string{"first", "last"} {
+		value, ok := args[name]
+		if !ok {
+			continue
+		}
+		switch v := resolve(value, variables, defaults).(type) {
+		case json.Number:
+			if n, err := strconv.Atoi(v.String()); err == nil {
+				return n, true
+			}
+		case float64:
+			return int(v), true
+		}
+	}
+	return 0, false
+}
+
+// Estimate estimates the cost of the operation, assuming every connection returns its full first (or last) page.
+func (d *gqlDocument) Estimate(operation *gqlOperation, variables map[string]any) GraphQLEstimate {
+	var requests, nodes float64
+	var walk func(selections []*gqlSelection, multiplier float64, depth int)
+	walk = func(selections []*gqlSelection, multiplier float64, depth int) {
+		if depth > 100 { // Ex: a fragment cycle, which GitHub would reject anyway
+			return
+		}
+		for _, selection := range selections {
+			if selection.Spread != "" {
+				walk(d.Fragments[selection.Spread], multiplier, depth+1)
+				continue
+			}
+			childMultiplier := multiplier
+			if size, ok := pageSize(selection.Args, variables, operation.Defaults); ok {
+				requests += multiplier
+				nodes += multiplier * float64(size)
+				childMultiplier = multiplier * float64(size)
+			}
+			walk(selection.Selections, childMultiplier, depth+1)
+		}
+	}
+	walk(operation.Selections, 1, 0)
+	return GraphQLEstimate{
+		Cost:  int(max(math.Round(requests/100), 1)),
+		Nodes: int(min(nodes, math.MaxInt32)),
+	}
+}
+
+// estimateCost estimates the cost of the operation of the GraphQL request.
+func estimateCost(gql *graphqlRequest) (GraphQLEstimate, error) {
+	doc, err := ParseGraphQL(gql.Query)
+	if err != nil {
+		return GraphQLEstimate{}, fmt.Errorf("ParseGraphQL failed: %w", err)
+	}
+	operation, err := doc.Operation(gql.OperationName)
+	if err != nil {
+		return GraphQLEstimate{}, err
+	}
+	var variables map[string]any
+	if len(gql.Variables) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(gql.Variables))
+		decoder.UseNumber()
+		if err := decoder.Decode(&variables); err != nil {
+			return GraphQLEstimate{}, fmt.Errorf("(*json.Decoder).Decode failed: %w", err)
+		}
+	}
+	return doc.Estimate(operation, variables), nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	GraphQLFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "graphql_rest_fallback_total",
+		Subsystem: "github",
+		Help:      "Number of GraphQL queries eligible for the REST fallback by result (served, uncached, failed)",
+	}, []string{"result"})
+)
+
+// GraphQLFallbackHeader is the response header set on GraphQL responses answered from the cached REST responses.
+const GraphQLFallbackHeader = "X-Proxy-GraphQL-Fallback"
+
+// The scalar fields of the GraphQL objects supported by the REST fallback, mapped to the keys of the REST responses.
+var (
+	repositoryFields = map[string]string{
+		"name":           "name",
+		"nameWithOwner":  "full_name",
+		"description":    "description",
+		"url":            "html_url",
+		"homepageUrl":    "homepage",
+		"isPrivate":      "private",
+		"isFork":         "fork",
+		"isArchived":     "archived",
+		"isTemplate":     "is_template",
+		"isDisabled":     "disabled",
+		"stargazerCount": "stargazers_count",
+		"forkCount":      "forks_count",
+		"createdAt":      "created_at",
+		"updatedAt":      "updated_at",
+		"pushedAt":       "pushed_at",
+	}
+	ownerFields = map[string]string{
+		"login": "login",
+		"url":   "html_url",
+	}
+	releaseFields = map[string]string{
+		"tagName":      "tag_name",
+		"name":         "name",
+		"url":          "html_url",
+		"description":  "body",
+		"createdAt":    "created_at",
+		"publishedAt":  "published_at",
+		"isPrerelease": "prerelease",
+		"isDraft":      "draft",
+	}
+)
+
+// selectScalars answers the selections from the REST object, it fails if any selection is not a supported scalar.
+func selectScalars(selections []*gqlSelection, typename string, fields map[string]string, object map[string]any) (map[string]any, bool) {
+	result := make(map[string]any, len(selections))
+	for _, selection := range selections {
+		if selection.Spread != "" || selection.Args != nil || selection.Selections != nil {
+			return nil, false
+		}
+		if selection.Field == "__typename" {
+			result[selection.Key()] = typename
+			continue
+		}
+		key, ok := fields[selection.Field]
+		if !ok {
+			return nil, false
+		}
+		result[selection.Key()] = object[key]
+	}
+	return result, true
+}
+
+// restFallback is the REST equivalent of a supported GraphQL query.
+type restFallback struct {
+	owner, name string
+	repository  []*gqlSelection
+	key         string
+	// release is if the latest release is selected, it is fetched separately.
+	release bool
+}
+
+// planFallback returns the REST equivalent of the GraphQL query, if it only selects the supported fields of a single
+// repository (its metadata, default branch, owner and latest release).
+func planFallback(gql *graphqlRequest) (*restFallback, bool) {
+	doc, err := ParseGraphQL(gql.Query)
+	if err != nil || len(doc.Fragments) > 0 {
+		return nil, false
+	}
+	operation, err := doc.Operation(gql.OperationName)
+	if err != nil || operation.Kind != "query" || len(operation.Selections) != 1 {
+		return nil, false
+	}
+	var variables map[string]any
+	if len(gql.Variables) > 0 {
+		if err := json.Unmarshal(gql.Variables, &variables); err != nil {
+			return nil, false
+		}
+	}
+	selection := operation.Selections[0]
+	if selection.Field != "repository" || selection.Selections == nil {
+		return nil, false
+	}
+	plan := &restFallback{repository: selection.Selections, key: selection.Key()}
+	for name, value := range selection.Args {
+		value, _ := resolve(value, variables, operation.Defaults).(string)
+		switch name {
+		case "owner":
+			plan.owner = value
+		case "name":
+			plan.name = value
+		case "followRenames":
+		default:
+			return nil, false
+		}
+	}
+	if plan.owner == "" || plan.name == "" {
+		return nil, false
+	}
+	for _, selection := range plan.repository {
+		if selection.Field == "latestRelease" {
+			plan.release = true
+		}
+	}
+	return plan, true
+}
+
+// answer builds the GraphQL data of the repository from the REST responses, release is nil if there is none.
+func (plan *restFallback) answer(repository, release map[string]any) (map[string]any, bool) {
+	var scalars []*gqlSelection
+	nested := make(map[string]any)
+	for _, selection := range plan.repository {
+		var value any
+		var ok bool
+		switch selection.Field {
+		case "visibility":
+			if selection.Args != nil || selection.Selections != nil {
+				return nil, false
+			}
+			visibility, _ := repository["visibility"].(string)
+			value, ok = strings.ToUpper(visibility), visibility != ""
+		case "defaultBranchRef":
+			if branch, _ := repository["default_branch"].(string); branch != "" && selection.Args == nil {
+				value, ok = selectScalars(selection.Selections, "Ref", map[string]string{"name": "name"}, map[string]any{"name": branch})
+			}
+		case "owner":
+			if owner, _ := repository["owner"].(map[string]any); owner != nil && selection.Args == nil {
+				typename, _ := owner["type"].(string)
+				value, ok = selectScalars(selection.Selections, typename, ownerFields, owner)
+			}
+		case "latestRelease":
+			if selection.Args != nil {
+				return nil, false
+			}
+			value, ok = nil, true
+			if release != nil {
+				value, ok = selectScalars(selection.Selections, "Release", releaseFields, release)
+			}
+		default:
+			scalars = append(scalars, selection)
+			continue
+		}
+		if !ok {
+			return nil, false
+		}
+		nested[selection.Key()] = value
+	}
+	result, ok := selectScalars(scalars, "Repository", repositoryFields, repository)
+	if !ok {
+		return nil, false
+	}
+	for key, value := range nested {
+		result[key] = value
+	}
+	return map[string]any{plan.key: result}, true
+}
+
+// rest fetches the REST response through the Base, only if it is already cached so the fallback never costs more than
+// the conditional request of a cached response (which is free) or nothing at all if it is fresh.
+func (t *GraphQLTransport) rest(req *http.Request, path string) (map[string]any, *http.Response, error) {
+	base := strings.TrimSuffix(req.URL.Path, "graphql")
+	if strings.HasSuffix(base, "/api/") {
+		base += "v3/" // GitHub Enterprise Server serves GraphQL from /api/graphql but REST from /api/v3
+	}
+	rest := req.Clone(req.Context())
+	rest.Method = http.MethodGet
+	rest.Body = nil
+	rest.ContentLength = 0
+	rest.Header.Del("Content-Type")
+	rest.Header.Del("Content-Length")
+	rest.Header.Set("Accept", "application/vnd.github+json")
+	rest.URL = req.URL.ResolveReference(&url.URL{Path: base + path})
+	cached, err := t.Storage.Get(req.Context(), rest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("(ghtransport.Storage).Get failed: %w", err)
+	}
+	if cached == nil {
+		return nil, nil, nil
+	}
+	cached.Body.Close()
+	resp, err := t.Base.RoundTrip(rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, nil
+	}
+	var object map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return nil, nil, fmt.Errorf("(*json.Decoder).Decode failed: %w", err)
+	}
+	return object, resp, nil
+}
+
+// fallback answers a supported GraphQL query from the cached REST responses, if they are all cached.
+func (t *GraphQLTransport) fallback(req *http.Request, plan *restFallback) (*http.Response, bool) {
+	repoPath := "repos/" + url.PathEscape(plan.owner) + "/" + url.PathEscape(plan.name)
+	repository, resp, err := t.rest(req, repoPath)
+	if err != nil || resp == nil || repository == nil {
+		GraphQLFallbacks.WithLabelValues(map[bool]string{true: "failed", false: "uncached"}[err != nil]).Inc()
+		return nil, false
+	}
+	requestID := resp.Header.Values(ghtransport.CachedRequestIDHeader)
+	var release map[string]any
+	if plan.release {
+		release, resp, err = t.rest(req, repoPath+"/releases/latest")
+		if err != nil || resp == nil || (release == nil && resp.StatusCode != http.StatusNotFound) {
+			GraphQLFallbacks.WithLabelValues(map[bool]string{true: "failed", false: "uncached"}[err != nil]).Inc()
+			return nil, false
+		}
+	}
+	data, ok := plan.answer(repository, release)
+	if !ok {
+		return nil, false
+	}
+	body, err := json.Marshal(map[string]any{"data": data})
+	if err != nil {
+		GraphQLFallbacks.WithLabelValues("failed").Inc()
+		return nil, false
+	}
+	GraphQLFallbacks.WithLabelValues("served").Inc()
+	header := http.Header{
+		"Content-Type":        []string{"application/json; charset=utf-8"},
+		GraphQLFallbackHeader: []string{"rest"},
+	}
+	// Mark the response as cached, ex: so it does not count against the quota of the tenant.
+	if len(requestID) > 0 {
+		header[ghtransport.CachedRequestIDHeader] = requestID
+	} else {
+		header.Set(ghtransport.CachedRequestIDHeader, "rest")
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(http.StatusOK) + " " + http.StatusText(http.StatusOK),
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, true
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// harDefaultRequests is the number of requests captured if neither a number of requests nor a duration is given.
+	harDefaultRequests = 100
+	// harMaxRequests bounds the number of requests (and therefore the memory) of a capture.
+	harMaxRequests = 10000
+	// harMaxBody is the maximum size of a request or response body included in a capture, larger bodies are omitted.
+	harMaxBody = 1 << 20
+)
+
+// harRedactedHeaders are the headers whose values are always redacted from a capture.
+var harRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Hub-Signature", "X-Hub-Signature-256"}
+
+// harRedactedParams are the query parameters whose values are always redacted from a capture.
+var harRedactedParams = []string{"access_token", "client_secret", "code", "state"}
+
+// HARNameValue is a header or query parameter of a HAR entry.
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARPostData is the body of a HAR request.
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARRequest is the request of a HAR entry.
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARContent is the body of a HAR response.
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARResponse is the response of a HAR entry, the status is 0 if the proxy failed to get a response.
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARTimings are the timings (in milliseconds) of a HAR entry, the proxy only distinguishes the wait for the response
+// headers from the receipt of the body.
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// HAREntry is a captured request and its response.
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+// HARCreator is the application which created a HAR file.
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HARLog is the log of a HAR file.
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+	Comment string     `json:"comment,omitempty"`
+}
+
+// HAR is a HAR 1.2 file, see http://www.softwareishard.com/blog/har-12-spec/.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// harVersion returns the version of the proxy (its module version), if known.
+func harVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return ""
+}
+
+// HARCapture is the status of a capture.
+type HARCapture struct {
+	Active   bool      `json:"active"`
+	Started  time.Time `json:"started"`
+	Until    time.Time `json:"until,omitzero"`
+	Requests int       `json:"requests"`
+	Entries  int       `json:"entries"`
+}
+
+// harCapture is a capture in progress (or completed), the requests are counted as they start so exactly the next
+// Requests are captured even if their responses complete out of order.
+type harCapture struct {
+	started  time.Time
+	until    time.Time
+	requests int
+	stopped  bool
+	seen     int
+	pending  int
+	entries  []HAREntry
+}
+
+// capturing reports if the capture records the requests started at the time.
+func (c *harCapture) capturing(now time.Time) bool {
+	return !c.stopped && c.seen < c.requests && (c.until.IsZero() || now.Before(c.until))
+}
+
+// HARRecorder captures the requests (and their responses) into a HAR file once a capture is started via the admin API,
+// ex: to attach to a bug report against a client tool. The secrets are redacted: the authentication headers, cookies
+// and known secret query parameters are replaced and the headers, URLs and textual bodies are scrubbed (see Scrubber),
+// the binary (or compressed) and large bodies are omitted.
+type HARRecorder struct {
+	Base http.RoundTripper
+
+	mu      sync.Mutex
+	capture *harCapture
+}
+
+// Start starts a capture of the next requests (at most harMaxRequests) or those within the duration (if positive),
+// whichever ends first, replacing any previous capture.
+func (r *HARRecorder) Start(requests int, duration time.Duration) HARCapture {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.capture = &harCapture{started: now, requests: min(requests, harMaxRequests)}
+	if duration > 0 {
+		r.capture.until = now.Add(duration)
+	}
+	return r.status()
+}
+
+// Stop stops the capture in progress, the captured requests remain downloadable.
+func (r *HARRecorder) Stop() HARCapture {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.capture != nil {
+		r.capture.stopped = true
+	}
+	return r.status()
+}
+
+func (r *HARRecorder) status() HARCapture {
+	if r.capture == nil {
+		return HARCapture{}
+	}
+	return HARCapture{
+		Active:   r.capture.capturing(time.Now()) || r.capture.pending > 0,
+		Started:  r.capture.started,
+		Until:    r.capture.until,
+		Requests: r.capture.requests,
+		Entries:  len(r.capture.entries),
+	}
+}
+
+// HAR returns the HAR file of the current (or last) capture, if any.
+func (r *HARRecorder) HAR() *HAR {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.capture == nil {
+		return nil
+	}
+	har := &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "github-api-proxy", Version: harVersion()},
+		Entries: append([]HAREntry{}, r.capture.entries...),
+	}}
+	if r.capture.pending > 0 {
+		har.Log.Comment = fmt.Sprintf("%d requests were still in progress", r.capture.pending)
+	}
+	return har
+}
+
+// begin reports if the request is captured, returning the capture it belongs to.
+func (r *HARRecorder) begin(now time.Time) *harCapture {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.capture == nil || !r.capture.capturing(now) {
+		return nil
+	}
+	r.capture.seen++
+	r.capture.pending++
+	if !r.capture.capturing(now) {
+		log.Info().Int("requests", r.capture.seen).Msg("HAR capture completed")
+	}
+	return r.capture
+}
+
+// finish records the entry of the capture.
+func (r *HARRecorder) finish(capture *harCapture, entry HAREntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	capture.pending--
+	capture.entries = append(capture.entries, entry)
+}
+
+// harHeaders returns the redacted headers.
+func harHeaders(header http.Header) []HARNameValue {
+	values := []HARNameValue{}
+	for _, name := range slices.Sorted(maps.Keys(header)) {
+		for _, value := range header[name] {
+			if matchHeader(harRedactedHeaders, name) {
+				value = Redacted
+			}
+			values = append(values, HARNameValue{Name: name, Value: DefaultScrubber.ScrubString(value)})
+		}
+	}
+	return values
+}
+
+// harURL returns the redacted URL and its query parameters.
+func harURL(u *url.URL) (string, []HARNameValue) {
+	u = &url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	query := u.Query()
+	params := []HARNameValue{}
+	for name, vs := range query {
+		for idx := range vs {
+			for _, redacted := range harRedactedParams {
+				if strings.EqualFold(name, redacted) {
+					vs[idx] = Redacted
+				}
+			}
+			vs[idx] = DefaultScrubber.ScrubString(vs[idx])
+			params = append(params, HARNameValue{Name: name, Value: vs[idx]})
+		}
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = query.Encode()
+	}
+	return u.String(), params
+}
+
+// harBody returns the redacted text of a body, or why it was omitted.
+func harBody(header http.Header, body []byte, complete bool) (string, string) {
+	switch {
+	case len(body) == 0 && complete:
+		return "", ""
+	case !complete:
+		return "", fmt.Sprintf("body omitted, larger than %d bytes or not entirely read", harMaxBody)
+	case !scrubbable(header):
+		return "", "body omitted, not textual (or compressed)"
+	}
+	return DefaultScrubber.ScrubString(string(body)), ""
+}
+
+// harMediaType returns the media type of the body.
+func harMediaType(header http.Header) string {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+func (r *HARRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	capture := r.begin(start)
+	if capture == nil {
+		return r.Base.RoundTrip(req)
+	}
+
+	entry := HAREntry{StartedDateTime: start}
+	if client := ClientFromContext(req.Context()); client != "" {
+		entry.Comment = "client " + client
+	}
+	entry.Request = HARRequest{
+		Method:      req.Method,
+		HTTPVersion: req.Proto,
+		Cookies:     []HARNameValue{},
+		Headers:     harHeaders(req.Header),
+		HeadersSize: -1,
+		BodySize:    req.ContentLength,
+	}
+	entry.Request.URL, entry.Request.QueryString = harURL(req.URL)
+	// The request body is captured as it is sent upstream, usually entirely once the response arrives.
+	var mu sync.Mutex
+	var requestBody *HARPostData
+	var requestSize int64
+	if req.Body != nil && req.Body != http.NoBody {
+		header := req.Header.Clone()
+		body := &compareBody{ReadCloser: req.Body, limit: harMaxBody}
+		body.done = func(b []byte, complete bool) {
+			text, comment := harBody(header, b, complete)
+			mu.Lock()
+			defer mu.Unlock()
+			requestBody = &HARPostData{MimeType: harMediaType(header), Text: text, Comment: comment}
+			requestSize = body.read
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	finishRequest := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case requestBody != nil:
+			entry.Request.PostData, entry.Request.BodySize = requestBody, requestSize
+		case entry.Request.BodySize != 0:
+			entry.Request.PostData = &HARPostData{MimeType: harMediaType(req.Header), Comment: "body omitted, not entirely sent"}
+		}
+	}
+
+	resp, err := r.Base.RoundTrip(req)
+	wait := time.Since(start)
+	if err != nil {
+		finishRequest()
+		entry.Time = float64(wait) / float64(time.Millisecond)
+		entry.Timings = HARTimings{Wait: entry.Time}
+		entry.Response = HARResponse{Cookies: []HARNameValue{}, Headers: []HARNameValue{}, HeadersSize: -1, BodySize: -1}
+		entry.Response.Content.Comment = "no response: " + DefaultScrubber.ScrubError(err).Error()
+		r.finish(capture, entry)
+		return nil, err
+	}
+	entry.Response = HARResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+		HTTPVersion: resp.Proto,
+		Cookies:     []HARNameValue{},
+		Headers:     harHeaders(resp.Header),
+		RedirectURL: DefaultScrubber.ScrubString(resp.Header.Get("Location")),
+		HeadersSize: -1,
+	}
+	entry.Response.Content.MimeType = harMediaType(resp.Header)
+	body := &compareBody{ReadCloser: resp.Body, limit: harMaxBody}
+	body.done = func(b []byte, complete bool) {
+		finishRequest()
+		entry.Time = float64(time.Since(start)) / float64(time.Millisecond)
+		entry.Timings = HARTimings{Wait: float64(wait) / float64(time.Millisecond), Receive: entry.Time - float64(wait)/float64(time.Millisecond)}
+		entry.Response.BodySize, entry.Response.Content.Size = body.read, body.read
+		entry.Response.Content.Text, entry.Response.Content.Comment = harBody(resp.Header, b, complete)
+		r.finish(capture, entry)
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// harRequests returns the positive number of requests of the query parameter, if any.
+func harRequests(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	requests, err := strconv.Atoi(value)
+	if err != nil || requests <= 0 {
+		return 0, fmt.Errorf("the requests must be a positive integer")
+	}
+	return requests, nil
+}
+
+// ServeHTTP implements the /admin/har API: POST starts a capture of the next requests (the requests query parameter)
+// or those within a duration (the duration query parameter, ex: 5m), GET downloads the HAR file of the capture (even
+// while in progress) and DELETE stops it. POST and DELETE respond with the HARCapture.
+func (r *HARRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var resp any
+	switch req.Method {
+	case http.MethodGet:
+		har := r.HAR()
+		if har == nil {
+			WriteProxyError(w, http.StatusNotFound, ReasonInvalidRequest, "No capture was started, start one with a POST")
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"github-api-proxy-%s.har\"", time.Now().UTC().Format("20060102T150405Z")))
+		resp = har
+	case http.MethodPost:
+		requests, err := harRequests(req.URL.Query().Get("requests"))
+		if err != nil {
+			WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The requests must be a positive integer")
+			return
+		}
+		var duration time.Duration
+		if value := req.URL.Query().Get("duration"); value != "" {
+			if duration, err = time.ParseDuration(value); err != nil || duration <= 0 {
+				WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The duration must be a positive Go duration, ex: 5m")
+				return
+			}
+		}
+		if requests == 0 {
+			requests = harMaxRequests
+			if duration == 0 {
+				requests = harDefaultRequests
+			}
+		}
+		resp = r.Start(requests, duration)
+		log.Warn().Int("requests", requests).Dur("duration", duration).Msg("HAR capture started")
+	case http.MethodDelete:
+		resp = r.Stop()
+		log.Warn().Msg("HAR capture stopped")
+	default:
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
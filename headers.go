@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ProxyHeaderPrefix is the prefix of request headers consumed by the proxy itself (ex: X-Proxy-Fields).
+// They are always allowed inbound, the ProxyHeaderTransport strips those left before the request is sent upstream.
+const ProxyHeaderPrefix = "X-Proxy-"
+
+// ProxyHeaderTransport strips the request headers of the proxy (see ProxyHeaderPrefix) its features did not consume
+// (ex: the X-Proxy-Snapshot of a request not served from a snapshot, the X-Proxy-Priority of a REST request). It is
+// the innermost transport of the requests sent upstream, so none reach GitHub whichever features are enabled.
+type ProxyHeaderTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *ProxyHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var stripped *http.Request
+	for name := range req.Header {
+		if matchHeader([]string{ProxyHeaderPrefix + "*"}, name) {
+			if stripped == nil {
+				stripped = req.Clone(req.Context())
+			}
+			delete(stripped.Header, name)
+		}
+	}
+	if stripped != nil {
+		req = stripped
+	}
+	return t.Base.RoundTrip(req)
+}
+
+// DefaultRequestHeaders are the inbound request headers which are forwarded upstream by default.
+var DefaultRequestHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Cache-Control",
+	"Content-Type",
+	"Idempotency-Key",
+	"If-Match",
+	"If-Modified-Since",
+	"If-None-Match",
+	"If-Unmodified-Since",
+	"Pragma",
+	"Range",
+	"User-Agent",
+	"X-GitHub-Api-Version",
+}
+
+// DefaultResponseDeny are the upstream response headers which are stripped by default.
+var DefaultResponseDeny = []string{
+	"Set-Cookie",
+}
+
+// HeaderRules is an allowlist-based header filter for a single direction.
+// A header passes if it matches any Allow pattern and no Deny pattern.
+// Patterns are case-insensitive header names, optionally ending in "*" to match a prefix ("*" matches everything).
+type HeaderRules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// matchHeader reports if the (canonical) header name matches any of the patterns.
+func matchHeader(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter removes any headers that do not pass the rules.
+func (r *HeaderRules) Filter(header http.Header) {
+	for name := range header {
+		if !matchHeader(r.Allow, name) || matchHeader(r.Deny, name) {
+			header.Del(name)
+		}
+	}
+}
+
+// HeaderRoute is the header policy for all paths beginning with Prefix.
+type HeaderRoute struct {
+	Prefix   string      `json:"prefix"`
+	Request  HeaderRules `json:"request"`
+	Response HeaderRules `json:"response"`
+}
+
+// HeaderPolicy filters the headers flowing between the clients and the upstream in both directions.
+type HeaderPolicy struct {
+	// Default is applied to any path that does not match a more specific route.
+	Default HeaderRoute `json:"default"`
+	// Routes override the Default for specific path prefixes, the longest matching prefix wins.
+	Routes []HeaderRoute `json:"routes,omitempty"`
+}
+
+// NewHeaderPolicy creates a HeaderPolicy with the default rules.
+// Unless passthrough is enabled, inbound Authorization (and Cookie) headers are stripped.
+func NewHeaderPolicy(passthrough bool) *HeaderPolicy {
+	policy := &HeaderPolicy{
+		Default: HeaderRoute{
+			Request: HeaderRules{
+				Allow: append([]string{ProxyHeaderPrefix + "*"}, DefaultRequestHeaders...),
+				Deny:  []string{"Cookie"},
+			},
+			Response: HeaderRules{
+				Allow: []string{"*"},
+				Deny:  DefaultResponseDeny,
+			},
+		},
+	}
+	if passthrough {
+		policy.Default.Request.Allow = append(policy.Default.Request.Allow, "Authorization")
+	}
+	return policy
+}
+
+// LoadRoutes reads additional per-route rules from a JSON file, ex:
+// {"routes": [{"prefix": "/repos/", "request": {"allow": ["Accept"]}, "response": {"allow": ["*"], "deny": ["Link"]}}]}
+func (p *HeaderPolicy) LoadRoutes(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("os.ReadFile failed: %w", err)
+	}
+	var parsed HeaderPolicy
+	if err := json.Unmarshal(b, &parsed); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %w", err)
+	}
+	p.Routes = append(p.Routes, parsed.Routes...)
+	return nil
+}
+
+// route returns the most specific route for the path.
+func (p *HeaderPolicy) route(path string) *HeaderRoute {
+	path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, "/api/v3"), "/")
+	best := &p.Default
+	for idx := range p.Routes {
+		route := &p.Routes[idx]
+		if strings.HasPrefix(path, route.Prefix) && len(route.Prefix) > len(best.Prefix) {
+			best = route
+		}
+	}
+	return best
+}
+
+// upgradeHeaders are required for protocol upgrades (ex: WebSocket) and always forwarded when upgrading.
+var upgradeHeaders = []string{"Connection", "Upgrade", "Sec-WebSocket-*", "Te"}
+
+// FilterRequest removes the inbound request headers which must not be forwarded upstream.
+func (p *HeaderPolicy) FilterRequest(req *http.Request) {
+	rules := p.route(req.URL.Path).Request
+	if req.Header.Get("Upgrade") != "" {
+		rules.Allow = append(slices.Clip(rules.Allow), upgradeHeaders...)
+	}
+	rules.Filter(req.Header)
+}
+
+// FilterResponse removes the upstream response headers which must not be returned to the client.
+func (p *HeaderPolicy) FilterResponse(resp *http.Response) {
+	p.route(resp.Request.URL.Path).Response.Filter(resp.Header)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	HedgedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "hedged_requests_total",
+		Subsystem: "github",
+		Help:      "Number of requests which exceeded the P95 latency of their route by result (won, lost, skipped)",
+	}, []string{"result"})
+)
+
+const (
+	// hedgeSamples is the number of recent latencies of each route the P95 is computed from.
+	hedgeSamples = 128
+	// hedgeMinSamples is the number of latencies of a route required before its requests are hedged.
+	hedgeMinSamples = 20
+	// hedgeBurst is the maximum number of hedges the budget accumulates.
+	hedgeBurst = 10
+)
+
+// latencyWindow is a ring buffer of the recent latencies of a route.
+type latencyWindow struct {
+	samples [hedgeSamples]time.Duration
+	count   int
+}
+
+func (w *latencyWindow) add(latency time.Duration) {
+	w.samples[w.count%hedgeSamples] = latency
+	w.count++
+}
+
+// p95 returns the 95th percentile of the recent latencies.
+func (w *latencyWindow) p95() time.Duration {
+	samples := slices.Clone(w.samples[:min(w.count, hedgeSamples)])
+	slices.Sort(samples)
+	return samples[len(samples)*95/100]
+}
+
+// hedgeAttempt is the outcome of an attempt of a hedged request.
+type hedgeAttempt struct {
+	resp  *http.Response
+	err   error
+	hedge bool
+}
+
+// HedgeTransport hedges the read-only requests to the paths matching the Patterns: if the upstream has not responded
+// within the P95 latency of the route (once known, and at least the MinDelay) a second attempt is sent with another
+// credential of the Pool, the first response wins and the other attempt is cancelled. To avoid wasting quota at most
+// the Budget fraction of the requests are hedged (with bursts of up to hedgeBurst), only to a credential with quota
+// left, and the requests pinned to a credential (see CredentialOverrideHandler) are never hedged.
+type HedgeTransport struct {
+	Base     http.RoundTripper
+	Pool     *CredentialPool
+	Patterns []string
+	Budget   float64
+	MinDelay time.Duration
+
+	mu        sync.Mutex
+	latencies map[string]*latencyWindow
+	tokens    float64
+}
+
+// hedgeable reports if the request may be hedged.
+func (t *HedgeTransport) hedgeable(req *http.Request) bool {
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	if CredentialFromContext(req.Context()) != "" || StreamingFromContext(req.Context()) {
+		return false
+	}
+	p := "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/api/v3"), "/")
+	return slices.ContainsFunc(t.Patterns, func(pattern string) bool {
+		ok, _ := path.Match(pattern, p)
+		return ok
+	})
+}
+
+// delay credits the budget with a request to the route, returning the delay before it is hedged (if known).
+func (t *HedgeTransport) delay(route string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tokens = min(t.tokens+t.Budget, hedgeBurst)
+	window, ok := t.latencies[route]
+	if !ok || window.count < hedgeMinSamples {
+		return 0, false
+	}
+	return max(window.p95(), t.MinDelay), true
+}
+
+// spend reports if the budget allows a hedge, spending it.
+func (t *HedgeTransport) spend() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// record records the latency of a request to the route.
+func (t *HedgeTransport) record(route string, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.latencies == nil {
+		t.latencies = make(map[string]*latencyWindow)
+	}
+	window, ok := t.latencies[route]
+	if !ok {
+		window = &latencyWindow{}
+		t.latencies[route] = window
+	}
+	window.add(latency)
+}
+
+func (t *HedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.hedgeable(req) {
+		return t.Base.RoundTrip(req)
+	}
+	route := RouteTemplate(req.URL.Path)
+	start := time.Now()
+	delay, ok := t.delay(route)
+	primary := t.Pool.Best(req)
+	if !ok || primary == nil {
+		resp, err := t.Base.RoundTrip(req)
+		if err == nil {
+			t.record(route, time.Since(start))
+		}
+		return resp, err
+	}
+
+	// Both attempts are pinned, so the hedge is guaranteed to use another credential than the primary.
+	attempts := make(chan hedgeAttempt, 2)
+	cancels := make(map[bool]context.CancelFunc, 2)
+	attempt := func(credential string, hedge bool) {
+		ctx, cancel := context.WithCancel(WithCredential(req.Context(), credential))
+		cancels[hedge] = cancel
+		go func() {
+			resp, err := t.Base.RoundTrip(req.Clone(ctx))
+			attempts <- hedgeAttempt{resp: resp, err: err, hedge: hedge}
+		}()
+	}
+	attempt(primary.ID, false)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending, hedged := 1, false
+	for {
+		select {
+		case <-timer.C:
+			alternate := t.Pool.Best(req, primary.ID)
+			if alternate == nil || !usable(alternate, ghratelimit.InferResource(req)) || !t.spend() {
+				HedgedRequests.WithLabelValues("skipped").Inc()
+				continue
+			}
+			attempt(alternate.ID, true)
+			pending, hedged = pending+1, true
+		case result := <-attempts:
+			pending--
+			if result.err != nil && pending > 0 {
+				cancels[result.hedge]()
+				continue // Wait for the other attempt
+			}
+			if hedged {
+				if result.hedge {
+					HedgedRequests.WithLabelValues("won").Inc()
+				} else {
+					HedgedRequests.WithLabelValues("lost").Inc()
+				}
+			}
+			// Cancel the other attempt, discarding its response if it still arrives.
+			if pending > 0 {
+				cancels[!result.hedge]()
+				go func() {
+					if loser := <-attempts; loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}()
+			}
+			if result.err != nil {
+				cancels[result.hedge]()
+				return nil, result.err
+			}
+			t.record(route, time.Since(start))
+			result.resp.Body = &releaseBody{ReadCloser: result.resp.Body, release: cancels[result.hedge]}
+			return result.resp, nil
+		}
+	}
+}
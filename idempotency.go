@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	IdempotentRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "idempotent_requests_total",
+		Subsystem: "github",
+		Help:      "Number of mutations with an Idempotency-Key by result (stored, replayed, in_use, mismatch, skipped)",
+	}, []string{"result"})
+)
+
+// IdempotencyKeyHeader is the request header identifying a mutation across the retries of the client.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayHeader is set on the responses replayed for a duplicate Idempotency-Key.
+const IdempotentReplayHeader = "X-Proxy-Idempotent-Replayed"
+
+const (
+	// idempotencyRequestHeader is the stored fingerprint of the request of an Idempotency-Key.
+	idempotencyRequestHeader = "X-Proxy-Idempotency-Request"
+	// idempotencyStoredHeader is the stored time (in Unix seconds) of the outcome of an Idempotency-Key.
+	idempotencyStoredHeader = "X-Proxy-Idempotency-Stored"
+	// maxIdempotentBody is the maximum size of a request (or response) body of an Idempotency-Key, the outcomes of
+	// larger mutations are not stored.
+	maxIdempotentBody = 8 << 20
+)
+
+// IdempotencyTransport implements the Idempotency-Key header for mutations, which GitHub does not support: the first
+// outcome of each key (per client, see ClientIdentity) is stored for the TTL and replayed for the duplicate requests,
+// so a client retrying a mutation which actually succeeded upstream (ex: after a timeout) does not create the issue
+// or comment twice. A duplicate of a request still in flight is rejected with a 409, a different request reusing
+// the key with a 422. Errors of the proxy itself, rate-limits and server errors are not stored so they can be retried.
+type IdempotencyTransport struct {
+	Base    http.RoundTripper
+	Storage ghtransport.Storage
+	TTL     time.Duration
+
+	inflight sync.Map
+}
+
+// idempotencyURL returns the (synthetic) URL of the outcome of the Idempotency-Key of the client.
+func idempotencyURL(client string, key string) *url.URL {
+	hash := sha256.New()
+	hash.Write([]byte(client))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+	return &url.URL{Scheme: "https", Host: DerivedHost, Path: "/idempotency/" + hex.EncodeToString(hash.Sum(nil))}
+}
+
+// idempotencyFingerprint returns the fingerprint of a mutation, a key must only be reused by the same request.
+func idempotencyFingerprint(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(req.Method))
+	hash.Write([]byte{0})
+	hash.Write([]byte(req.URL.RequestURI()))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// storable reports if the outcome of a mutation is final, ie the retry of the client would not be expected to differ.
+func storable(resp *http.Response) bool {
+	if resp.Header.Get(ProxyErrorHeader) != "" || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return false
+	}
+	return resp.StatusCode != http.StatusForbidden || resp.Header.Get("X-Ratelimit-Remaining") != "0"
+}
+
+// replay returns the stored outcome of the key, or nil if there is none (or it expired).
+func (t *IdempotencyTransport) replay(req *http.Request, stored *http.Request, fingerprint string) (*http.Response, error) {
+	cached, err := t.Storage.Get(req.Context(), stored)
+	if err != nil {
+		log.Warn().Err(err).Msg("(ghtransport.Storage).Get failed")
+		return nil, nil
+	}
+	if cached == nil {
+		return nil, nil
+	}
+	if seconds, err := strconv.ParseInt(cached.Header.Get(idempotencyStoredHeader), 10, 64); err != nil || time.Since(time.Unix(seconds, 0)) > t.TTL {
+		cached.Body.Close()
+		return nil, nil
+	}
+	if cached.Header.Get(idempotencyRequestHeader) != fingerprint {
+		cached.Body.Close()
+		IdempotentRequests.WithLabelValues("mismatch").Inc()
+		return ProxyResponse(req, http.StatusUnprocessableEntity, ReasonIdempotencyMismatch, "The Idempotency-Key was already used by a different request"), nil
+	}
+	IdempotentRequests.WithLabelValues("replayed").Inc()
+	cached.Header.Del(idempotencyRequestHeader)
+	cached.Header.Del(idempotencyStoredHeader)
+	cached.Header.Set(IdempotentReplayHeader, "true")
+	cached.Request = req
+	return cached, nil
+}
+
+func (t *IdempotencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := req.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		return t.Base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Del(IdempotencyKeyHeader)
+	if !mutating(req.Method) {
+		return t.Base.RoundTrip(req)
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, maxIdempotentBody+1))
+		if err != nil {
+			req.Body.Close()
+			return nil, fmt.Errorf("(*http.Request).Body.Read failed: %w", err)
+		}
+		// Too large to store, forward the body as a whole (the part read followed by the rest).
+		if len(body) > maxIdempotentBody {
+			IdempotentRequests.WithLabelValues("skipped").Inc()
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			return t.Base.RoundTrip(req)
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	fingerprint := idempotencyFingerprint(req, body)
+	stored := (&http.Request{Method: http.MethodGet, URL: idempotencyURL(ClientFromContext(req.Context()), key)}).WithContext(req.Context())
+
+	// Duplicates racing the first request are rejected, rather than sent upstream before its outcome is known.
+	if _, loaded := t.inflight.LoadOrStore(stored.URL.Path, struct{}{}); loaded {
+		IdempotentRequests.WithLabelValues("in_use").Inc()
+		return ProxyResponse(req, http.StatusConflict, ReasonIdempotencyInUse, "A request with the same Idempotency-Key is in progress, retry later"), nil
+	}
+	defer t.inflight.Delete(stored.URL.Path)
+	if resp, err := t.replay(req, stored, fingerprint); resp != nil || err != nil {
+		return resp, err
+	}
+
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || !storable(resp) {
+		return resp, err
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxIdempotentBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+	}
+	if len(content) > maxIdempotentBody {
+		IdempotentRequests.WithLabelValues("skipped").Inc()
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(content), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(content))
+
+	// Store the outcome even if the client went away, it is the one most likely to retry.
+	header := resp.Header.Clone()
+	header.Set(idempotencyRequestHeader, fingerprint)
+	header.Set(idempotencyStoredHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	if err := t.Storage.Put(context.WithoutCancel(req.Context()), &http.Response{
+		Status:        resp.Status,
+		StatusCode:    resp.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(content)),
+		ContentLength: int64(len(content)),
+		Request:       stored,
+	}); err != nil {
+		log.Warn().Err(err).Msg("(ghtransport.Storage).Put failed")
+		return resp, nil
+	}
+	IdempotentRequests.WithLabelValues("stored").Inc()
+	return resp, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestIdempotencyTransportSkipsLargeBodies(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), maxIdempotentBody+1<<20)
+	var forwarded []byte
+	transport := &IdempotencyTransport{
+		Base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			var err error
+			if forwarded, err = io.ReadAll(req.Body); err != nil {
+				t.Fatalf("io.ReadAll failed: %v", err)
+			}
+			if req.ContentLength != int64(len(forwarded)) {
+				t.Errorf("got a Content-Length of %d for a body of %d bytes", req.ContentLength, len(forwarded))
+			}
+			return jsonResponse(req, `{}`), nil
+		}),
+		Storage: NewMemoryStorage(1 << 20),
+	}
+	req := httptest.NewRequest(http.MethodPost, "https://api.github.com/repos/octocat/hello-world/issues", bytes.NewReader(body))
+	req.Header.Set(IdempotencyKeyHeader, strconv.Itoa(len(body)))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("(*IdempotencyTransport).RoundTrip failed: %v", err)
+	}
+	readBody(t, resp)
+	if !bytes.Equal(forwarded, body) {
+		t.Errorf("forwarded %d of the %d bytes of the body", len(forwarded), len(body))
+	}
+}
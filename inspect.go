@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	bboltstorage "github.com/bored-engineer/github-conditional-http-transport/bbolt"
+	"github.com/bored-engineer/github-conditional-http-transport/memory"
+	pebblestorage "github.com/bored-engineer/github-conditional-http-transport/pebble"
+	redisstorage "github.com/bored-engineer/github-conditional-http-transport/redis"
+	s3storage "github.com/bored-engineer/github-conditional-http-transport/s3"
+	"github.com/rs/zerolog/log"
+)
+
+// CacheInspection describes the cached response of a URL, as reported by /admin/cache/inspect.
+type CacheInspection struct {
+	URL    string `json:"url"`
+	Key    string `json:"key"`
+	Cached bool   `json:"cached"`
+	// Tier is the backend holding the response, ex: "bbolt" or "local"/"shared" for the tiers of the sidecar mode.
+	Tier         string     `json:"tier,omitempty"`
+	Status       int        `json:"status,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+	LastModified string     `json:"last_modified,omitempty"`
+	Date         *time.Time `json:"date,omitempty"`
+	Size         int64      `json:"size,omitempty"`
+	Age          int64      `json:"age_seconds,omitempty"`
+	CacheControl string     `json:"cache_control,omitempty"`
+	// Lifetime is the freshness lifetime (see FreshnessTransport), zero if every request is revalidated.
+	Lifetime int64 `json:"freshness_lifetime_seconds,omitempty"`
+	Fresh    bool  `json:"fresh"`
+}
+
+// storageTier returns the name of the backend (or tier) of the storage holding the cached response of the request,
+// the wrapping storages are walked as the response is stored at the same key by each of them.
+func storageTier(ctx context.Context, storage ghtransport.Storage, req *http.Request) (string, error) {
+	switch s := storage.(type) {
+	case *KeyStorage:
+		return storageTier(ctx, s.Storage, s.key(req))
+	case *ScrubStorage:
+		return storageTier(ctx, s.Storage, req)
+	case *StreamingStorage:
+		return storageTier(ctx, s.Storage, req)
+	case *EncryptedStorage:
+		return storageTier(ctx, s.Storage, req)
+	case *BreakerStorage:
+		return storageTier(ctx, s.Storage, req)
+	case *ReplicatedStorage:
+		return storageTier(ctx, s.Local, req)
+	case *MeshStorage:
+		return storageTier(ctx, s.Local, req)
+	case *TieredStorage:
+		// The tiers are checked directly, the Get of the TieredStorage would promote the response to the local tier.
+		for _, tier := range []struct {
+			name    string
+			storage ghtransport.Storage
+		}{{"local", s.Local}, {"shared", s.Shared}} {
+			resp, err := tier.storage.Get(ctx, req)
+			if err != nil {
+				return "", fmt.Errorf("(ghtransport.Storage).Get failed: %w", err)
+			}
+			if resp != nil {
+				resp.Body.Close()
+				return tier.name, nil
+			}
+		}
+		return "", nil
+	case *MemoryStorage, *memory.Storage:
+		return "memory", nil
+	case *bboltstorage.Storage:
+		return "bbolt", nil
+	case *pebblestorage.Storage:
+		return "pebble", nil
+	case *redisstorage.Storage:
+		return "redis", nil
+	case *s3storage.Storage, *HashedS3Storage:
+		return "s3", nil
+	default:
+		return fmt.Sprintf("%T", storage), nil
+	}
+}
+
+// InspectStorage returns the inspection of the cached response of the request, if any.
+func InspectStorage(ctx context.Context, storage ghtransport.Storage, req *http.Request) (*CacheInspection, error) {
+	inspection := &CacheInspection{URL: req.URL.String(), Key: req.URL.String()}
+	if keyed, ok := storage.(*KeyStorage); ok {
+		// The fragment is already escaped by the KeyStorage, (*url.URL).String would escape it again.
+		key := *keyed.key(req).URL
+		fragment := key.Fragment
+		key.Fragment = ""
+		if inspection.Key = key.String(); fragment != "" {
+			inspection.Key += "#" + fragment
+		}
+	}
+	tier, err := storageTier(ctx, storage, req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := storage.Get(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("(ghtransport.Storage).Get failed: %w", err)
+	}
+	if resp == nil {
+		return inspection, nil
+	}
+	defer resp.Body.Close()
+	size, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("io.Copy failed: %w", err)
+	}
+	lifetime := freshnessLifetime(resp.Header, parseCacheControl(resp.Header))
+	age := currentAge(resp.Header, time.Now())
+	inspection.Cached = true
+	inspection.Tier = tier
+	inspection.Status = resp.StatusCode
+	inspection.ETag = resp.Header.Get("Etag")
+	inspection.LastModified = resp.Header.Get("Last-Modified")
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		inspection.Date = &date
+	}
+	inspection.Size = size
+	inspection.Age = int64(age / time.Second)
+	inspection.CacheControl = strings.Join(resp.Header.Values("Cache-Control"), ", ")
+	inspection.Lifetime = int64(lifetime / time.Second)
+	inspection.Fresh = lifetime > age && identicalVary(req, resp)
+	return inspection, nil
+}
+
+// CacheInspectHandler implements the /admin/cache/inspect API: GET reports whether the url (a path, optionally with
+// the /api/v3 prefix and a query) is cached. The cache key headers (ex: Accept) of the request to the API are used
+// to find the response, and the (optional) tenant parameter selects the cache partition of a tenant.
+type CacheInspectHandler struct {
+	Storage ghtransport.Storage
+	// URL is the upstream URL, the url is resolved relative to it.
+	URL *url.URL
+}
+
+func (h *CacheInspectHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	query := req.URL.Query()
+	target, err := url.Parse(query.Get("url"))
+	if err != nil || target.Path == "" {
+		WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The url parameter must be the path of a cached response")
+		return
+	}
+	ctx := req.Context()
+	if tenant := query.Get("tenant"); tenant != "" {
+		ctx = WithTenant(ctx, &Tenant{Name: tenant})
+	}
+	inspect := &http.Request{
+		Method: http.MethodGet,
+		URL:    h.URL.JoinPath(strings.TrimPrefix(target.Path, "/api/v3")),
+		Header: req.Header.Clone(),
+	}
+	inspect.URL.RawQuery = target.RawQuery
+	inspect = inspect.WithContext(ctx)
+	inspection, err := InspectStorage(ctx, h.Storage, inspect)
+	if err != nil {
+		log.Error().Err(err).Str("url", inspect.URL.String()).Msg("InspectStorage failed")
+		WriteProxyError(w, http.StatusInternalServerError, ReasonInternal, "Failed to inspect the cache")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(inspection); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	WriteInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Name:      "write_invalidated_responses_total",
+		Subsystem: "github",
+		Help:      "Number of cached responses invalidated by successful mutations of their path",
+	})
+)
+
+// invalidateTimeout bounds the invalidation of the cached responses after a mutation.
+const invalidateTimeout = 10 * time.Second
+
+// InvalidateTransport purges the cached responses of the path of every successful PUT, PATCH or DELETE (and those
+// under it, ex: /repos/o/r/issues/1/comments for /repos/o/r/issues/1) in every cache partition before the response is
+// returned, so the subsequent reads fetch the modified resource instead of serving the cached one until it is
+// revalidated.
+type InvalidateTransport struct {
+	Base    http.RoundTripper
+	Storage ghtransport.Storage
+	// URL is the upstream URL, the Exclude prefixes are relative to it.
+	URL *url.URL
+	// Exclude (optional) are the path prefixes (ex: /repos/o/r/contents/) whose mutations never invalidate.
+	Exclude []string
+}
+
+// excluded reports if the invalidation of the (upstream) path is disabled.
+func (t *InvalidateTransport) excluded(path string) bool {
+	path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, strings.TrimSuffix(t.URL.Path, "/")), "/")
+	for _, prefix := range t.Exclude {
+		if strings.HasPrefix(path, "/"+strings.TrimPrefix(strings.TrimPrefix(prefix, "/api/v3"), "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *InvalidateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Method {
+	case http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return t.Base.RoundTrip(req)
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || resp.StatusCode < 200 || resp.StatusCode >= 300 || t.excluded(req.URL.Path) {
+		return resp, err
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), invalidateTimeout)
+	defer cancel()
+	purged, err := PurgePath(ctx, t.Storage, req.URL)
+	if err != nil {
+		log.Warn().Err(err).Str("path", req.URL.Path).Msg("PurgePath failed")
+		return resp, nil
+	}
+	WriteInvalidations.Add(float64(purged))
+	if purged > 0 {
+		log.Debug().Str("path", req.URL.Path).Int("purged", purged).Msg("cache invalidated by mutation")
+	}
+	return resp, nil
+}
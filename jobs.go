@@ -0,0 +1,355 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	JobsPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "jobs_pending",
+		Subsystem: "github",
+		Help:      "Number of deferred mutations queued or running",
+	})
+	JobAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "job_attempts_total",
+		Subsystem: "github",
+		Help:      "Number of attempts of the deferred mutations by result (succeeded, failed, retried, rate_limited)",
+	}, []string{"result"})
+)
+
+// AsyncHeader is the request header deferring a mutation to the JobQueue, ex: "X-Proxy-Async: true".
+const AsyncHeader = "X-Proxy-Async"
+
+const (
+	// DefaultJobWorkers is the number of deferred mutations executed at a time.
+	DefaultJobWorkers = 2
+	// DefaultMaxJobs is the maximum number of deferred mutations queued (or running) at a time.
+	DefaultMaxJobs = 10000
+	// maxJobBody is the maximum size of the body of a deferred mutation.
+	maxJobBody = 8 << 20
+	// jobRetention is how long the finished jobs can be queried for.
+	jobRetention = time.Hour
+	// jobQuotaInterval is the interval the remaining quota is checked at while a job waits for it.
+	jobQuotaInterval = 10 * time.Second
+	// jobMaxBackoff bounds the exponential backoff between the retries of a job.
+	jobMaxBackoff = 5 * time.Minute
+)
+
+// Job statuses, a job is queued until it is running and then either succeeded or failed (possibly after retries).
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job is a deferred mutation, as returned by the /jobs API.
+type Job struct {
+	ID       string    `json:"id"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Created  time.Time `json:"created_at"`
+	Updated  time.Time `json:"updated_at"`
+	// RetryAt is when the next attempt of a job is scheduled, if it is being retried.
+	RetryAt time.Time `json:"retry_at,omitzero"`
+	// Response is the response of the last attempt, once the job is finished.
+	Response *BatchResponse `json:"response,omitempty"`
+
+	// parent is the request the job is executed as, with the identity (and headers) of the client.
+	parent  *http.Request
+	body    []byte
+	retries int
+}
+
+// JobQueue defers the mutations with the AsyncHeader (ex: bulk label updates which are not time-critical): they are
+// accepted with a 202 and the Job, and executed in the background through the Handler once the remaining quota of
+// the Pool (optional) is above the Reserve. Rate-limited attempts are retried once the rate-limit resets, server
+// errors up to Retries times with an exponential backoff. Other requests are passed through to the Handler. The
+// jobs are kept in memory, they do not survive restarts.
+type JobQueue struct {
+	Handler http.Handler
+	Pool    *CredentialPool
+	// Reserve is the quota left for the other clients, the jobs wait while the remaining quota is at most Reserve.
+	Reserve uint64
+	// Retries is the maximum number of retries of a job failing with a server error.
+	Retries int
+	// Workers is the number of jobs executed at a time, DefaultJobWorkers if zero.
+	Workers int
+
+	limit int
+	queue chan *Job
+
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	pending int // Queued or running
+}
+
+// NewJobQueue creates a JobQueue executing the jobs through the handler, with at most limit (DefaultMaxJobs if zero)
+// jobs queued at a time. The jobs are only executed once Run is called.
+func NewJobQueue(handler http.Handler, limit int) *JobQueue {
+	if limit <= 0 {
+		limit = DefaultMaxJobs
+	}
+	return &JobQueue{
+		Handler: handler,
+		limit:   limit,
+		queue:   make(chan *Job, limit),
+		jobs:    make(map[string]*Job),
+	}
+}
+
+// Get returns a copy of the job, if it exists and belongs to the client.
+func (q *JobQueue) Get(id string, client string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok || ClientFromContext(job.parent.Context()) != client {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Cancel removes the job if it is still queued and belongs to the client.
+func (q *JobQueue) Cancel(id string, client string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok || ClientFromContext(job.parent.Context()) != client || job.Status != JobQueued {
+		return Job{}, false
+	}
+	delete(q.jobs, id)
+	q.pending--
+	JobsPending.Dec()
+	return *job, true
+}
+
+func (q *JobQueue) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if async, _ := strconv.ParseBool(req.Header.Get(AsyncHeader)); !async || !mutating(req.Method) {
+		req.Header.Del(AsyncHeader)
+		q.Handler.ServeHTTP(w, req)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxJobBody))
+	if err != nil {
+		WriteProxyError(w, http.StatusRequestEntityTooLarge, ReasonInvalidRequest, "The body of a deferred mutation must not exceed "+strconv.Itoa(maxJobBody)+" bytes")
+		return
+	}
+	// The job outlives the request, but keeps the identity of the client.
+	parent := req.Clone(context.WithoutCancel(req.Context()))
+	parent.Header.Del(AsyncHeader)
+	parent.Body = nil
+	now := time.Now()
+	job := &Job{
+		ID:      rand.Text(),
+		Method:  req.Method,
+		Path:    "/" + strings.TrimPrefix(req.URL.RequestURI(), "/"),
+		Status:  JobQueued,
+		Created: now,
+		Updated: now,
+		parent:  parent,
+		body:    body,
+	}
+
+	q.mu.Lock()
+	if q.pending >= q.limit {
+		q.mu.Unlock()
+		WriteProxyError(w, http.StatusServiceUnavailable, ReasonQueueFull, "Too many deferred mutations are queued")
+		return
+	}
+	q.jobs[job.ID] = job
+	q.pending++
+	snapshot := *job
+	q.mu.Unlock()
+	JobsPending.Inc()
+	q.queue <- job
+	log.Debug().Str("job", job.ID).Str("method", job.Method).Str("path", job.Path).Msg("mutation deferred")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
+
+// wait waits until the remaining quota of the Pool for the job is above the Reserve.
+func (q *JobQueue) wait(ctx context.Context, job *Job) error {
+	if q.Pool == nil {
+		return nil
+	}
+	resource := ghratelimit.InferResource(job.parent)
+	for {
+		remaining, known := budget(q.Pool, TenantFromContext(job.parent.Context()), resource, time.Now())
+		if !known || remaining > q.Reserve {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jobQuotaInterval):
+		}
+	}
+}
+
+// retryDelay returns the delay before retrying a failed attempt, if it was rate-limited and if it is retried at all.
+// Rate-limited attempts are retried once the rate-limit resets (or after the Retry-After), they are not counted towards
+// the Retries.
+func retryDelay(resp *bufferedResponse, retries int, now time.Time) (time.Duration, bool, bool) {
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(resp.header.Get("Retry-After")); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	}
+	if resp.status == http.StatusTooManyRequests || (resp.status == http.StatusForbidden && (delay > 0 || resp.header.Get("X-Ratelimit-Remaining") == "0")) {
+		if reset, err := strconv.ParseInt(resp.header.Get("X-Ratelimit-Reset"), 10, 64); err == nil && delay == 0 {
+			delay = time.Unix(reset, 0).Sub(now)
+		}
+		return max(delay, time.Second), true, true
+	}
+	if resp.status < 500 || resp.status == http.StatusNotImplemented {
+		return 0, false, false
+	}
+	if delay == 0 {
+		delay = min(time.Second<<retries, jobMaxBackoff)
+	}
+	return delay, false, true
+}
+
+// execute makes an attempt of the job, scheduling its retry if it failed.
+func (q *JobQueue) execute(ctx context.Context, job *Job) {
+	if err := q.wait(ctx, job); err != nil {
+		return // Shutting down, the job is never executed
+	}
+	q.mu.Lock()
+	if _, ok := q.jobs[job.ID]; !ok {
+		q.mu.Unlock()
+		return // Cancelled
+	}
+	job.Status = JobRunning
+	job.Attempts++
+	job.RetryAt = time.Time{}
+	job.Updated = time.Now()
+	q.mu.Unlock()
+
+	resp := subrequest(q.Handler, job.parent, job.Method, job.Path, nil, job.body)
+	now := time.Now()
+	delay, limited, retry := retryDelay(resp, job.retries, now)
+	response := batchResponse(resp)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.Updated = now
+	job.Response = &response
+	switch {
+	case retry && limited:
+		JobAttempts.WithLabelValues("rate_limited").Inc()
+	case retry && job.retries < q.Retries:
+		JobAttempts.WithLabelValues("retried").Inc()
+		job.retries++
+	case resp.status < 400:
+		JobAttempts.WithLabelValues("succeeded").Inc()
+		job.Status = JobSucceeded
+		q.pending--
+		JobsPending.Dec()
+		return
+	default:
+		JobAttempts.WithLabelValues("failed").Inc()
+		job.Status = JobFailed
+		q.pending--
+		JobsPending.Dec()
+		log.Warn().Str("job", job.ID).Str("method", job.Method).Str("path", job.Path).Int("status", resp.status).Msg("deferred mutation failed")
+		return
+	}
+	job.Status = JobQueued
+	job.RetryAt = now.Add(delay)
+	time.AfterFunc(delay, func() { q.queue <- job })
+}
+
+// prune removes the jobs finished for longer than the jobRetention.
+func (q *JobQueue) prune(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, job := range q.jobs {
+		if (job.Status == JobSucceeded || job.Status == JobFailed) && now.Sub(job.Updated) > jobRetention {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// Run executes the queued jobs with the Workers until the context is cancelled.
+func (q *JobQueue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range cmp.Or(q.Workers, DefaultJobWorkers) {
+		wg.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-q.queue:
+					q.execute(ctx, job)
+				}
+			}
+		})
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case now := <-ticker.C:
+			q.prune(now)
+		}
+	}
+}
+
+// JobHandler implements the /jobs/{id} API: GET returns the Job, DELETE cancels it if it is still queued. Only the
+// client which deferred the mutation can see its job.
+type JobHandler struct {
+	Queue *JobQueue
+}
+
+func (h *JobHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/jobs/")
+	client := ClientFromContext(req.Context())
+	var job Job
+	var ok bool
+	switch req.Method {
+	case http.MethodGet:
+		job, ok = h.Queue.Get(id, client)
+	case http.MethodDelete:
+		if job, ok = h.Queue.Cancel(id, client); !ok {
+			if _, exists := h.Queue.Get(id, client); exists {
+				WriteProxyError(w, http.StatusConflict, ReasonInvalidRequest, "The job is no longer queued")
+				return
+			}
+		}
+	default:
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !ok {
+		WriteProxyError(w, http.StatusNotFound, ReasonInvalidRequest, "The job does not exist")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// LabelOther is the metric label value of the values beyond the cardinality cap of a LabelValues.
+const LabelOther = "(other)"
+
+var (
+	// APIVersionLabels caps the api_version label to the REST API versions released by GitHub (and the --api-version).
+	// https://docs.github.com/en/rest/about-the-rest-api/api-versions
+	APIVersionLabels = &LabelValues{Known: []string{"2022-11-28", "2026-03-10"}}
+	// ClientLabels caps the client label (the ClientIdentity is set by the clients or their IP address).
+	ClientLabels = &LabelValues{Max: 100}
+	// TeamLabels caps the team label (the TeamHeader is set by the clients).
+	TeamLabels = &LabelValues{Max: 100}
+)
+
+// LabelValues caps the cardinality of a metric label whose values are chosen by the clients: the Known values and the
+// first Max distinct other ones (per process) are kept, the following are all LabelOther, so a client sending random
+// values cannot blow up the metrics. The empty value (ex: the header is not set) is always kept.
+type LabelValues struct {
+	Known []string
+	Max   int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// Value returns the (capped) label value of the value.
+func (l *LabelValues) Value(value string) string {
+	if value == "" || slices.Contains(l.Known, value) {
+		return value
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[value]; ok {
+		return value
+	}
+	if len(l.seen) >= l.Max {
+		return LabelOther
+	}
+	if l.seen == nil {
+		l.seen = make(map[string]struct{})
+	}
+	l.seen[value] = struct{}{}
+	return value
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	LeaderElected = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "leader",
+		Subsystem: "github",
+		Help:      "Whether this replica is currently the elected leader (1) or not (0)",
+	})
+)
+
+// acquireLeaderScript acquires (or renews) the leader lock if it is free (or already held by this replica).
+var acquireLeaderScript = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+if not holder then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// releaseLeaderScript releases the leader lock only if it is held by this replica.
+var releaseLeaderScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Leader elects a single replica as the leader using a lock (with a TTL) in Redis.
+type Leader struct {
+	Client *redis.Client
+	// Key is the Redis key holding the lock.
+	Key string
+	// ID uniquely identifies this replica.
+	ID string
+	// TTL is the expiry of the lock, it is renewed every third of the TTL.
+	TTL time.Duration
+
+	leader atomic.Bool
+}
+
+// IsLeader reports if this replica is currently the leader.
+func (l *Leader) IsLeader() bool {
+	return l.leader.Load()
+}
+
+// acquire attempts to acquire (or renew) the lock.
+func (l *Leader) acquire(ctx context.Context) error {
+	acquired, err := acquireLeaderScript.Run(ctx, l.Client, []string{l.Key}, l.ID, l.TTL.Milliseconds()).Int()
+	if err != nil {
+		l.setLeader(false)
+		return fmt.Errorf("(*redis.Script).Run failed: %w", err)
+	}
+	l.setLeader(acquired == 1)
+	return nil
+}
+
+func (l *Leader) setLeader(leader bool) {
+	if l.leader.Swap(leader) != leader {
+		log.Info().Bool("leader", leader).Str("id", l.ID).Msg("leadership changed")
+	}
+	if leader {
+		LeaderElected.Set(1)
+	} else {
+		LeaderElected.Set(0)
+	}
+}
+
+// Run participates in the election until the context is cancelled, releasing the lock (if held) on exit.
+func (l *Leader) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.TTL / 3)
+	defer ticker.Stop()
+	for {
+		if err := l.acquire(ctx); err != nil {
+			log.Error().Err(err).Msg("(*Leader).acquire failed")
+		}
+		select {
+		case <-ctx.Done():
+			if l.IsLeader() {
+				if err := releaseLeaderScript.Run(context.WithoutCancel(ctx), l.Client, []string{l.Key}, l.ID).Err(); err != nil {
+					log.Error().Err(err).Msg("(*redis.Script).Run failed")
+				}
+				l.setLeader(false)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ListenerConfig is an address the proxy serves the same handler on, with its own (optional) TLS certificate.
+type ListenerConfig struct {
+	Addr    string
+	TLSCert string
+	TLSKey  string
+	// ProxyProtocol reads the PROXY protocol header of every connection (see ProxyListener).
+	ProxyProtocol bool
+}
+
+// TLS reports if the listener serves TLS.
+func (l ListenerConfig) TLS() bool {
+	return l.TLSCert != "" && l.TLSKey != ""
+}
+
+// ParseListener parses a listener in the format '<addr>[,cert=<path>,key=<path>][,proxy-protocol]', ex:
+// '0.0.0.0:8443,cert=tls.crt,key=tls.key'.
+func ParseListener(spec string) (ListenerConfig, error) {
+	addr, options, _ := strings.Cut(spec, ",")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return ListenerConfig{}, fmt.Errorf("invalid listener address %q: %w", addr, err)
+	}
+	listener := ListenerConfig{Addr: addr}
+	if options != "" {
+		for option := range strings.SplitSeq(options, ",") {
+			name, value, _ := strings.Cut(option, "=")
+			switch name {
+			case "cert":
+				listener.TLSCert = value
+			case "key":
+				listener.TLSKey = value
+			case "proxy-protocol":
+				listener.ProxyProtocol = true
+			default:
+				return ListenerConfig{}, fmt.Errorf("unknown listener option %q in %q", name, spec)
+			}
+		}
+	}
+	if (listener.TLSCert == "") != (listener.TLSKey == "") {
+		return ListenerConfig{}, fmt.Errorf("listener %q requires both cert and key for TLS", addr)
+	}
+	return listener, nil
+}
+
+// Listeners returns the configured listeners, the --listen address (with --tls-cert and --tls-key) is always first.
+func (c *Config) Listeners() ([]ListenerConfig, error) {
+	listeners := []ListenerConfig{{Addr: c.ListenAddr, TLSCert: c.TLSCert, TLSKey: c.TLSKey, ProxyProtocol: c.ProxyProtocol}}
+	for _, spec := range c.Listener {
+		listener, err := ParseListener(spec)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
@@ -25,53 +34,328 @@ var (
 			0.95: 0.005,
 			0.99: 0.001,
 		},
-	}, []string{"status"})
+	}, []string{"status", "api_version"})
 )
 
+// logMaxBody is the maximum size of an error response body included in its log line.
+const logMaxBody = 4 << 10
+
+// LogRoute is the logging of the requests to the paths beginning with Prefix: their log lines are at the Level
+// ("disabled" to drop them), only 1 in Sample of the lines of the successful responses are logged and, with
+// BodyOnError, the lines of the error responses (400 and above) include the beginning of their body. The failed
+// requests (without any response) are always logged as errors.
+type LogRoute struct {
+	Prefix      string        `json:"prefix"`
+	Level       zerolog.Level `json:"level"`
+	Sample      uint64        `json:"sample,omitempty"`
+	BodyOnError bool          `json:"body_on_error,omitempty"`
+
+	count *atomic.Uint64
+}
+
+// DefaultLogRoutes are the routes logged by default, the polling of the rate limit API is not.
+var DefaultLogRoutes = []LogRoute{
+	{Prefix: "/", Level: zerolog.InfoLevel},
+	{Prefix: "/rate_limit", Level: zerolog.Disabled},
+}
+
+// ParseLogRoute parses the logging of a route in the format "<prefix>=<level>[,sample=<n>][,body-on-error]", ex:
+// "/repos/=warn,sample=100,body-on-error".
+func ParseLogRoute(spec string) (LogRoute, error) {
+	prefix, value, ok := strings.Cut(spec, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return LogRoute{}, fmt.Errorf("invalid log route %q, expected <prefix>=<level>[,sample=<n>][,body-on-error]", spec)
+	}
+	options := strings.Split(value, ",")
+	route := LogRoute{Prefix: prefix}
+	if err := route.Level.UnmarshalText([]byte(options[0])); err != nil || options[0] == "" {
+		return LogRoute{}, fmt.Errorf("invalid log level %q, expected trace, debug, info, warn, error or disabled", options[0])
+	}
+	for _, option := range options[1:] {
+		switch name, value, _ := strings.Cut(option, "="); name {
+		case "sample":
+			sample, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || sample == 0 {
+				return LogRoute{}, fmt.Errorf("invalid sample %q, expected a positive integer", value)
+			}
+			route.Sample = sample
+		case "body-on-error":
+			route.BodyOnError = true
+		default:
+			return LogRoute{}, fmt.Errorf("unknown log route option %q", option)
+		}
+	}
+	return route, nil
+}
+
+// LoggingTransport logs each proxied request on a single line (with its client, cache outcome, credential and upstream
+// attempts, see AttemptTransport and CredentialTraceTransport) per the most specific of the Routes (see LogRoute)
+// matching its path, the routes can be changed at runtime via the /admin/log-routes API.
 type LoggingTransport struct {
 	Base http.RoundTripper
+
+	mu     sync.RWMutex
+	routes []LogRoute
 }
 
-func (t *LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+// NewLoggingTransport returns a LoggingTransport with the DefaultLogRoutes overridden by the routes.
+func NewLoggingTransport(base http.RoundTripper, routes []LogRoute) *LoggingTransport {
+	t := &LoggingTransport{Base: base}
+	for _, route := range append(slices.Clone(DefaultLogRoutes), routes...) {
+		t.SetRoute(route)
+	}
+	return t
+}
+
+// SetRoute adds (or replaces) the logging of the route prefix.
+func (t *LoggingTransport) SetRoute(route LogRoute) {
+	route.count = &atomic.Uint64{}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes = slices.DeleteFunc(t.routes, func(r LogRoute) bool { return r.Prefix == route.Prefix })
+	t.routes = append(t.routes, route)
+	slices.SortFunc(t.routes, func(a, b LogRoute) int { return strings.Compare(a.Prefix, b.Prefix) })
+}
+
+// DeleteRoute removes the logging of the route prefix, reporting if it existed.
+func (t *LoggingTransport) DeleteRoute(prefix string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count := len(t.routes)
+	t.routes = slices.DeleteFunc(t.routes, func(r LogRoute) bool { return r.Prefix == prefix })
+	return len(t.routes) < count
+}
+
+// Routes returns the logging of the routes, sorted by prefix.
+func (t *LoggingTransport) Routes() []LogRoute {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return slices.Clone(t.routes)
+}
+
+// route returns the most specific route matching the path, any path is logged at the info level without a route.
+func (t *LoggingTransport) route(path string) LogRoute {
+	path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, "/api/v3"), "/")
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	match := LogRoute{Level: zerolog.InfoLevel}
+	for _, route := range t.routes {
+		if strings.HasPrefix(path, route.Prefix) && len(route.Prefix) > len(match.Prefix) {
+			match = route
+		}
+	}
+	return match
+}
+
+// errorBody returns the beginning of the body of the error response, leaving the body intact for the caller.
+func errorBody(resp *http.Response) string {
+	if !scrubbable(resp.Header) {
+		return ""
+	}
+	prefix, err := io.ReadAll(io.LimitReader(resp.Body, logMaxBody))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), resp.Body), resp.Body}
+	if err != nil {
+		return ""
+	}
+	return string(prefix)
+}
+
+// requestTrace collects the story of a request across the transports for its log line: the credential it was sent
+// with and its upstream attempts.
+type requestTrace struct {
+	mu         sync.Mutex
+	credential *Credential
+	attempts   int
+	upstream   time.Duration
+	status     int
+	// authorization is only hashed if the request is logged.
+	authorization string
+	apiVersion    string
+	remaining     string
+	resource      string
+}
+
+type traceKey struct{}
+
+// withTrace returns a copy of the context carrying a new trace of the request.
+func withTrace(ctx context.Context) (context.Context, *requestTrace) {
+	trace := &requestTrace{}
+	return context.WithValue(ctx, traceKey{}, trace), trace
+}
+
+// traceFromContext returns the trace of the request from the context, if any.
+func traceFromContext(ctx context.Context) *requestTrace {
+	trace, _ := ctx.Value(traceKey{}).(*requestTrace)
+	return trace
+}
+
+// traceRetry records a retry of the request (ex: on another upstream) within an attempt in its trace, if any.
+func traceRetry(ctx context.Context) {
+	if trace := traceFromContext(ctx); trace != nil {
+		trace.mu.Lock()
+		trace.attempts++
+		trace.mu.Unlock()
+	}
+}
+
+// CredentialTraceTransport records the Credential a request was sent with in its trace.
+type CredentialTraceTransport struct {
+	Base       http.RoundTripper
+	Credential *Credential
+}
+
+func (t *CredentialTraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if trace := traceFromContext(req.Context()); trace != nil {
+		trace.mu.Lock()
+		trace.credential = t.Credential
+		trace.mu.Unlock()
+	}
+	return t.Base.RoundTrip(req)
+}
+
+// statusLabels are the metric label values of the status codes, formatting them would allocate on every request.
+var statusLabels = func() (labels [600]string) {
+	for code := range labels {
+		labels[code] = strconv.Itoa(code)
+	}
+	return labels
+}()
+
+// statusLabel returns the metric label value of the status code.
+func statusLabel(code int) string {
+	if code >= 0 && code < len(statusLabels) {
+		return statusLabels[code]
+	}
+	return strconv.Itoa(code)
+}
+
+// AttemptTransport tracks the latency of each attempt of a request upstream, recording it in the trace of the request.
+type AttemptTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *AttemptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	// Perform the request, tracking how long it takes.
 	start := time.Now()
 	resp, err := t.Base.RoundTrip(req)
 	duration := time.Since(start)
 	if resp != nil {
-		Latency.WithLabelValues(strconv.Itoa(resp.StatusCode)).Observe(duration.Seconds())
+		Latency.WithLabelValues(statusLabel(resp.StatusCode), APIVersionLabels.Value(req.Header.Get(APIVersionHeader))).Observe(duration.Seconds())
 	}
-
-	// Skip logging if the request is for the rate limit API
-	if req.URL.Path == "/rate_limit" {
+	trace := traceFromContext(req.Context())
+	if trace == nil {
+		return resp, err
+	}
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	trace.attempts++
+	// A failed (ex: hedged and cancelled) attempt does not overwrite the details of a successful one.
+	if err != nil && trace.attempts > 1 {
 		return resp, err
 	}
+	trace.upstream = duration
+	trace.apiVersion = req.Header.Get(APIVersionHeader)
+	trace.authorization = req.Header.Get("Authorization")
+	if resp != nil {
+		trace.status = resp.StatusCode
+		trace.remaining = resp.Header.Get("X-RateLimit-Remaining")
+		trace.resource = resp.Header.Get("X-RateLimit-Resource")
+	}
+	return resp, err
+}
+
+// cacheOutcome returns how the cache served the response: a "hit" without any upstream attempt, "revalidated" by a
+// conditional request (the upstream responded with a 304), a "miss" (or "bypass" for the requests which are never
+// cached) sent upstream, or "proxy" for the responses of the proxy itself (ex: a rejection).
+func cacheOutcome(req *http.Request, resp *http.Response, trace *requestTrace) string {
+	switch {
+	case resp.Header.Get(ProxyErrorHeader) != "":
+		return "proxy"
+	case trace.attempts == 0:
+		return "hit"
+	case trace.status == http.StatusNotModified && resp.StatusCode != http.StatusNotModified:
+		return "revalidated"
+	case req.Method != http.MethodGet && req.Method != http.MethodHead:
+		return "bypass"
+	}
+	return "miss"
+}
+
+func (t *LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Perform the request, tracking how long it takes.
+	ctx, trace := withTrace(req.Context())
+	start := time.Now()
+	resp, err := t.Base.RoundTrip(req.WithContext(ctx))
+	duration := time.Since(start)
 
-	// Initialize the log event (error vs info) with the duration.
+	// Initialize the log event (error vs the level of the route) with the duration, sampling the successful responses.
+	route := t.route(req.URL.Path)
 	var evt *zerolog.Event
-	if err != nil {
+	switch {
+	case err != nil:
 		evt = log.Error().Err(err)
-	} else {
-		evt = log.Info()
+	case route.Level == zerolog.Disabled:
+		return resp, nil
+	case resp.StatusCode < http.StatusBadRequest && route.Sample > 1:
+		if route.count.Add(1)%route.Sample != 1 {
+			return resp, nil
+		}
+		evt = log.WithLevel(route.Level).Uint64("sample", route.Sample)
+	default:
+		evt = log.WithLevel(route.Level)
+	}
+	// Skip building the fields (ex: the URL, the hashed token) below the global level.
+	if !evt.Enabled() {
+		return resp, err
 	}
 	evt = evt.Dur("duration", duration)
 
-	// Add the request details (if not nil).
-	if req != nil {
-		evt = evt.Str("method", req.Method)
-		evt = evt.Str("url", req.URL.String())
+	// Add the request details.
+	evt = evt.Str("method", req.Method)
+	evt = evt.Str("url", req.URL.String())
 
-		if req.RemoteAddr != "" {
-			evt = evt.Str("remote_addr", req.RemoteAddr)
-		}
+	if req.RemoteAddr != "" {
+		evt = evt.Str("remote_addr", req.RemoteAddr)
+	}
 
-		if userAgent := req.Header.Get("User-Agent"); userAgent != "" {
-			evt = evt.Str("user_agent", userAgent)
-		}
+	if client := ClientFromContext(req.Context()); client != "" {
+		evt = evt.Str("client", client)
+	}
 
-		if authorization := req.Header.Get("Authorization"); authorization != "" {
-			evt = evt.Str("hashed_token", ghtransport.HashToken(authorization))
-		}
+	if userAgent := req.Header.Get("User-Agent"); userAgent != "" {
+		evt = evt.Str("user_agent", userAgent)
+	}
+
+	// Add the credential and the upstream attempts of the request.
+	trace.mu.Lock()
+	if trace.credential != nil {
+		evt = evt.Str("credential", trace.credential.ID).Str("credential_kind", trace.credential.Kind)
+	}
+	if trace.authorization != "" {
+		evt = evt.Str("hashed_token", ghtransport.HashToken(trace.authorization))
+	}
+	if trace.apiVersion != "" {
+		evt = evt.Str("api_version", trace.apiVersion)
+	}
+	if trace.attempts > 0 {
+		evt = evt.Dur("upstream_duration", trace.upstream)
+	}
+	if trace.attempts > 1 {
+		evt = evt.Int("retries", trace.attempts-1)
 	}
+	if remaining, err := strconv.ParseUint(trace.remaining, 10, 64); err == nil {
+		evt = evt.Uint64("ratelimit_remaining", remaining)
+	}
+	if trace.resource != "" {
+		evt = evt.Str("ratelimit_resource", trace.resource)
+	}
+	if resp != nil {
+		evt = evt.Str("cache", cacheOutcome(req, resp, trace))
+	}
+	trace.mu.Unlock()
 
 	// If the response is not nil, add the response details.
 	if resp != nil {
@@ -93,19 +377,50 @@ func (t *LoggingTransport) RoundTrip(req *http.Request) (*http.Response, error)
 			evt = evt.Str("content_type", contentType)
 		}
 
-		if remaining := resp.Header.Get("X-RateLimit-Remaining"); remaining != "" {
-			if i, err := strconv.ParseUint(remaining, 10, 64); err == nil {
-				evt = evt.Uint64("ratelimit_remaining", i)
-			}
+		if reason := resp.Header.Get(ProxyErrorHeader); reason != "" {
+			evt = evt.Str("reason", reason)
 		}
+	}
 
-		if resource := resp.Header.Get("X-RateLimit-Resource"); resource != "" {
-			evt = evt.Str("ratelimit_resource", resource)
+	// Include the beginning of the body of the error responses.
+	if resp != nil && resp.StatusCode >= http.StatusBadRequest && route.BodyOnError && req.Method != http.MethodHead {
+		if body := errorBody(resp); body != "" {
+			evt = evt.Str("body", body)
 		}
 	}
 
 	// Fire the log event.
 	evt.Msg("HTTP request")
 
-	return resp, nil
+	return resp, err
+}
+
+// ServeHTTP implements the /admin/log-routes API: GET lists the routes, POST adds (or replaces) the LogRoute of the JSON
+// body and DELETE removes the route of the prefix query parameter.
+func (t *LoggingTransport) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		route := LogRoute{Level: zerolog.InfoLevel}
+		if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&route); err != nil || !strings.HasPrefix(route.Prefix, "/") {
+			WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The body must be a JSON object with the prefix (beginning with /), level and optional sample and body_on_error of the route")
+			return
+		}
+		t.SetRoute(route)
+		log.Warn().Str("prefix", route.Prefix).Stringer("log_level", route.Level).Uint64("sample", route.Sample).Bool("body_on_error", route.BodyOnError).Msg("log route set")
+	case http.MethodDelete:
+		prefix := req.URL.Query().Get("prefix")
+		if !t.DeleteRoute(prefix) {
+			WriteProxyError(w, http.StatusNotFound, ReasonInvalidRequest, "No route has the prefix")
+			return
+		}
+		log.Warn().Str("prefix", prefix).Msg("log route removed")
+	default:
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.Routes()); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
 }
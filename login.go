@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	ghauth "github.com/bored-engineer/github-auth-http-transport"
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
+)
+
+// login implements 'login --client-id ID --credential-store PATH', running the OAuth device flow of GitHub and storing
+// the token in the credential store (see storeFlags), which a running proxy with the same store adds to its pool.
+func login(ctx context.Context, args []string) error {
+	fs := pflag.NewFlagSet("login", pflag.ContinueOnError)
+	clientID := fs.String("client-id", os.Getenv("GH_PROXY_LOGIN_CLIENT_ID"), "Client ID of the OAuth App (with the device flow enabled) to authorize")
+	scopes := fs.StringSlice("scope", nil, "OAuth scopes to request, ex: repo,read:org")
+	options := storeFlags(fs)
+	name := fs.String("name", "", "Name of the stored credential (ex: the login it belongs to)")
+	githubURL := fs.String("github-url", "https://"+ghauth.Host(), "URL of the GitHub server the device flow runs against")
+	if err := parseAdminFlags(fs, args); err != nil {
+		return err
+	}
+	if *clientID == "" {
+		return errors.New("login requires --client-id")
+	}
+	// Fail before the device flow if the store cannot be updated.
+	store, cipher, err := options.open(ctx)
+	if err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(*githubURL, "/")
+	config := &oauth2.Config{
+		ClientID: *clientID,
+		Scopes:   *scopes,
+		Endpoint: oauth2.Endpoint{
+			DeviceAuthURL: base + "/login/device/code",
+			TokenURL:      base + "/login/oauth/access_token",
+		},
+	}
+	auth, err := config.DeviceAuth(ctx)
+	if err != nil {
+		return fmt.Errorf("(*oauth2.Config).DeviceAuth failed: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Open %s and enter the code %s (expires in %s)\n", auth.VerificationURI, auth.UserCode, time.Until(auth.Expiry).Round(time.Second))
+	token, err := config.DeviceAccessToken(ctx, auth)
+	if err != nil {
+		return fmt.Errorf("(*oauth2.Config).DeviceAccessToken failed: %w", err)
+	}
+
+	if err := store.add(StoredCredential{
+		Kind:   "token",
+		Params: token.AccessToken,
+		Name:   *name,
+		Added:  time.Now().UTC(),
+	}); err != nil {
+		return err
+	}
+	if err := store.Save(*options.path, cipher); err != nil {
+		return fmt.Errorf("(*CredentialStore).Save failed: %w", err)
+	}
+	fmt.Printf("stored the token in %s\n", *options.path)
+	return nil
+}
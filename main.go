@@ -1,29 +1,23 @@
 package main
 
 import (
+	"cmp"
 	"context"
-	"crypto/sha256"
-	"encoding/base64"
 	"errors"
+	stdlog "log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	ghauth "github.com/bored-engineer/github-auth-http-transport"
+	"github.com/bored-engineer/github-api-proxy/middleware"
 	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
-	bboltstorage "github.com/bored-engineer/github-conditional-http-transport/bbolt"
-	"github.com/bored-engineer/github-conditional-http-transport/memory"
-	pebblestorage "github.com/bored-engineer/github-conditional-http-transport/pebble"
-	redisstorage "github.com/bored-engineer/github-conditional-http-transport/redis"
-	s3storage "github.com/bored-engineer/github-conditional-http-transport/s3"
-	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
 	ratelimit "github.com/bored-engineer/ratelimit-transport"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -31,8 +25,6 @@ import (
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/spf13/pflag"
-	"golang.org/x/oauth2"
 )
 
 var (
@@ -58,192 +50,781 @@ var (
 func main() {
 	// Initialize zerolog
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	logOutput := &ScrubWriter{Writer: os.Stderr, Scrubber: DefaultScrubber}
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: logOutput})
+	stdlog.SetOutput(logOutput)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
-	apiURL := pflag.String("url", "https://api.github.com/", "GitHub API URL")
-	listenAddr := pflag.String("listen", "127.0.0.1:44879", "Address to listen on")
-	tlsCert := pflag.String("tls-cert", "", "TLS certificate file to use")
-	tlsKey := pflag.String("tls-key", "", "TLS key file to use")
-	pebbleDBPath := pflag.String("pebble-db", "", "Path to PebbleDB to use for caching")
-	boltDBPath := pflag.String("bbolt-db", "", "Path to BoltDB to use for caching")
-	boltDBBucket := pflag.String("bbolt-bucket", "github-api-proxy", "BoltDB bucket to use for caching")
-	s3Bucket := pflag.String("s3-bucket", "", "S3 bucket to use")
-	s3Region := pflag.String("s3-region", "", "S3 region to use")
-	s3Endpoint := pflag.String("s3-endpoint", "", "S3 endpoint to use")
-	s3Prefix := pflag.String("s3-prefix", "", "S3 prefix to use")
-	redisAddr := pflag.String("redis-addr", "", "Redis address to use")
-	redisUsername := pflag.String("redis-username", "", "Redis username to use")
-	redisPassword := pflag.String("redis-password", "", "Redis password to use")
-	redisDB := pflag.Int("redis-db", 0, "Redis database to use")
-	authOAuth := pflag.StringSlice("auth-oauth", nil, "OAuth clients for GitHub API authentication in the format 'client_id:client_secret'")
-	authApp := pflag.StringSlice("auth-app", nil, "GitHub App clients for GitHub API authentication in the format 'app_id:installation_id:private_key'")
-	authToken := pflag.StringSlice("auth-token", nil, "GitHub personal access tokens for GitHub API authentication")
-	rph := pflag.Int("rph", 0, "maximum requests per hour (per authentication token)")
-	rateInterval := pflag.Duration("rate-interval", 60*time.Second, "Interval for rate limit checks")
-	pflag.Parse()
-
-	proxyURL, err := url.Parse(*apiURL)
+	if err := Run(ctx, os.Args[1:]); err != nil {
+		log.Fatal().Err(err).Msg("Run failed")
+	}
+}
+
+// Serve runs the proxy until the context is cancelled.
+func Serve(ctx context.Context, cfg *Config) {
+	// Register all of the configured secrets so they are scrubbed from every sink.
+	cfg.RegisterSecrets(DefaultScrubber)
+
+	proxyURL, err := url.Parse(cfg.APIURL)
 	if err != nil {
 		log.Fatal().Err(err).Msg("url.Parse failed")
 	}
 
+	allowed, err := ParseCIDRs(cfg.AllowCIDR)
+	if err != nil {
+		log.Fatal().Err(err).Msg("ParseCIDRs failed")
+	}
+
+	listeners, err := cfg.Listeners()
+	if err != nil {
+		log.Fatal().Err(err).Msg("(*Config).Listeners failed")
+	}
+	proxyTrusted, err := ParseCIDRs(cfg.ProxyProtocolTrusted)
+	if err != nil {
+		log.Fatal().Err(err).Msg("ParseCIDRs failed")
+	}
+
+	// Only forward the allowed headers in each direction.
+	credentialed := cfg.Credentialed()
+	policy := NewHeaderPolicy(cfg.AuthPassthrough || !credentialed)
+	policy.Default.Request.Allow = append(policy.Default.Request.Allow, cfg.HeaderAllow...)
+	policy.Default.Response.Deny = append(policy.Default.Response.Deny, cfg.HeaderDeny...)
+	if cfg.HeaderPolicy != "" {
+		if err := policy.LoadRoutes(cfg.HeaderPolicy); err != nil {
+			log.Fatal().Err(err).Str("path", cfg.HeaderPolicy).Msg("(*HeaderPolicy).LoadRoutes failed")
+		}
+	}
+
+	// Sidecars are only reachable from within the pod and keep a minimal footprint.
+	if cfg.Sidecar {
+		if !loopback(cfg.ListenAddr) {
+			log.Fatal().Str("listen", cfg.ListenAddr).Msg("--sidecar requires a loopback --listen address")
+		}
+		if cfg.PebbleDBPath != "" || cfg.BoltDBPath != "" || cfg.S3Bucket != "" {
+			log.Fatal().Msg("--sidecar only supports the in-memory cache (with an optional --redis-addr shared tier)")
+		}
+		if _, ok := os.LookupEnv("GOMEMLIMIT"); !ok {
+			debug.SetMemoryLimit(SidecarMemoryLimit)
+		}
+	}
+
+	switch cfg.S3KeyHash {
+	case S3KeyHashNever, S3KeyHashLong, S3KeyHashAlways:
+	default:
+		log.Fatal().Str("s3-key-hash", cfg.S3KeyHash).Msg("--s3-key-hash must be never, long or always")
+	}
+	if (len(cfg.S3ReplicateTo) > 0 || cfg.S3ReadThrough != "") && cfg.S3Bucket == "" {
+		log.Fatal().Msg("--s3-replicate-to and --s3-read-through require --s3-bucket")
+	}
+	if len(cfg.MeshPeer) > 0 && (cfg.MeshURL == "" || cfg.MeshSecret == "") {
+		log.Fatal().Msg("--mesh-peer requires --mesh-url and --mesh-secret")
+	}
+	// Only log (and count) the denials of the shadowed policies.
+	shadow, err := NewPolicyShadow(cfg.ShadowPolicy)
+	if err != nil {
+		log.Fatal().Err(err).Msg("NewPolicyShadow failed")
+	}
+	// Load the plugins before resolving the custom transports they register.
+	if cfg.MiddlewareDir != "" {
+		if err := LoadMiddlewarePlugins(cfg.MiddlewareDir); err != nil {
+			log.Fatal().Err(err).Str("path", cfg.MiddlewareDir).Msg("LoadMiddlewarePlugins failed")
+		}
+	}
+	middlewares, err := cfg.Middlewares()
+	if err != nil {
+		log.Fatal().Err(err).Msg("(*Config).Middlewares failed")
+	}
+	if len(cfg.Script) > 0 && cfg.ScriptTimeout <= 0 {
+		log.Fatal().Msg("--script-timeout must be positive")
+	}
+	if len(cfg.WASMFilter) > 0 && (cfg.WASMTimeout <= 0 || cfg.WASMMemory <= 0) {
+		log.Fatal().Msg("--wasm-filter requires a positive --wasm-timeout and --wasm-memory")
+	}
+	if len(cfg.CacheChunkPath) > 0 && cfg.CacheChunkSize <= 0 {
+		log.Fatal().Msg("--cache-chunk-size must be positive")
+	}
+	if cfg.StorageTimeout > 0 && (cfg.StorageWorkers < 1 || cfg.StorageFailures < 1) {
+		log.Fatal().Msg("--storage-timeout requires a positive --storage-workers and --storage-failures")
+	}
+	for _, interval := range cfg.intervals() {
+		if interval.value <= 0 {
+			log.Fatal().Msg("--" + interval.flag + " must be positive")
+		}
+	}
+	if cfg.MetricLabelValues < 0 {
+		log.Fatal().Msg("--metric-label-values must not be negative")
+	}
+	ClientLabels.Max, TeamLabels.Max = cfg.MetricLabelValues, cfg.MetricLabelValues
+
 	// Setup the relevant storage backend, defaulting to in-memory.
-	var storage ghtransport.Storage
-	if *pebbleDBPath != "" {
-		pebbleStorage, err := pebblestorage.Open(*pebbleDBPath, nil)
-		if err != nil {
-			log.Fatal().Err(err).Msg("pebblestorage.Open failed")
+	storage, closeStorage, err := OpenStorage(ctx, cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("OpenStorage failed")
+	}
+	defer func() {
+		if err := closeStorage(); err != nil {
+			log.Fatal().Err(err).Msg("closeStorage failed")
 		}
-		defer func() {
-			if err := pebbleStorage.DB.Close(); err != nil {
-				log.Fatal().Err(err).Msg("(*pebble.DB).Close failed")
+	}()
+
+	// Warm the page cache of the BoltDB file while serving.
+	if cfg.BoltDBPreload && cfg.BoltDBPath != "" {
+		go func() {
+			start := time.Now()
+			if err := PreloadFile(ctx, cfg.BoltDBPath); err != nil {
+				log.Warn().Err(err).Msg("PreloadFile failed")
+				return
 			}
+			log.Info().Dur("duration", time.Since(start)).Msg("preloaded the BoltDB file")
 		}()
-		storage = pebbleStorage
-	} else if *boltDBPath != "" {
-		boltStorage, err := bboltstorage.Open(*boltDBPath, 0600, nil, []byte(*boltDBBucket))
-		if err != nil {
-			log.Fatal().Err(err).Msg("bboltstorage.Open failed")
+	}
+
+	// Restore the generation of the cache namespace, following the bumps by other replicas.
+	keyed := storage.(*KeyStorage)
+	namespace := keyed.Namespace
+	if err := namespace.Load(ctx); err != nil {
+		log.Warn().Err(err).Msg("(*CacheNamespace).Load failed")
+	}
+	go namespace.Poll(ctx, cfg.CacheNamespaceRefresh)
+
+	// Bound the time waiting for the upstream to respond.
+	upstream := http.DefaultTransport.(*http.Transport).Clone()
+	upstream.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout
+
+	// Dial the resolved addresses of the upstream (in order of preference), following the DNS changes.
+	dialer := &Dialer{
+		Dialer:        &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		Resolver:      net.DefaultResolver,
+		Refresh:       cfg.DNSRefresh,
+		Prefer:        cfg.DialPrefer,
+		FallbackDelay: cfg.DialFallbackDelay,
+		OnChange:      upstream.CloseIdleConnections,
+	}
+	upstream.DialContext = dialer.DialContext
+	if cfg.DNSRefresh > 0 {
+		go dialer.Run(ctx)
+	}
+
+	// Strip the headers of the proxy its features did not consume, none must reach the upstream.
+	var base http.RoundTripper = &ProxyHeaderTransport{Base: upstream}
+
+	// Identify the proxy in the User-Agent of every request sent upstream, including the health checks.
+	if cfg.UpstreamUserAgent != "" {
+		base = &UserAgentTransport{
+			Base:      base,
+			UserAgent: cfg.UpstreamUserAgent,
+			Replace:   cfg.UserAgentMode == UserAgentReplace,
 		}
-		defer func() {
-			if err := boltStorage.DB.Close(); err != nil {
-				log.Fatal().Err(err).Msg("(*bbolt.DB).Close failed")
+	}
+
+	// Wrap the requests sent upstream by the custom transports, ex: signing them with an internal key.
+	base, err = WrapMiddlewares(base, middlewares, middleware.StageUpstream)
+	if err != nil {
+		log.Fatal().Err(err).Msg("WrapMiddlewares failed")
+	}
+
+	// Fail over to the next healthy upstream (ex: a GitHub Enterprise Server replica) if the primary is unreachable.
+	if len(cfg.FailoverURL) > 0 {
+		upstreams := []*url.URL{proxyURL}
+		for _, raw := range cfg.FailoverURL {
+			u, err := url.Parse(raw)
+			if err != nil {
+				log.Fatal().Err(err).Str("url", raw).Msg("url.Parse failed")
 			}
-		}()
-		storage = boltStorage
-	} else if *s3Bucket != "" {
-		cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(*s3Region))
+			upstreams = append(upstreams, u)
+		}
+		failover := NewFailoverTransport(base, upstreams)
+		go failover.Run(ctx, cfg.HealthInterval)
+		base = failover
+	}
+
+	// Trace the upstream attempts _before_ the caching, the hits never reach the upstream.
+	var transport http.RoundTripper = &AttemptTransport{
+		Base: &SkewTransport{
+			Base: base,
+		},
+	}
+
+	// Limit the number of in-flight requests to the upstream.
+	if cfg.MaxInflight > 0 {
+		transport = NewConcurrencyTransport(transport, cfg.MaxInflight, cfg.MaxQueue, cfg.QueueRetryAfter)
+	}
+
+	// Setup the caching transport as the base transport, streaming stored bodies to the client as they are written.
+	uncached := transport
+	transport = ghtransport.NewTransport(&TeeStorage{
+		Storage: storage,
+		MaxBody: cfg.CacheMaxBody,
+	}, transport)
+
+	// Serve the cached responses which are still fresh (per the upstream Cache-Control) without revalidating them.
+	if cfg.CacheFreshness {
+		transport = &FreshnessTransport{
+			Base:    transport,
+			Storage: storage,
+		}
+	}
+
+	// Cache the very large responses as chunks, serving the Range requests of the clients from them.
+	if len(cfg.CacheChunkPath) > 0 {
+		transport = &ChunkedTransport{
+			Base:      transport,
+			Upstream:  uncached,
+			Storage:   storage,
+			Patterns:  cfg.CacheChunkPath,
+			ChunkSize: cfg.CacheChunkSize,
+		}
+	}
+
+	rateLimitURL := proxyURL.ResolveReference(&url.URL{
+		Path: "/rate_limit",
+	})
+
+	// Alert on the exhaustion of the quota and the failing credentials.
+	var alerter *Alerter
+	if cfg.AlertWebhook != "" {
+		alerter = &Alerter{
+			Webhook:  cfg.AlertWebhook,
+			Client:   &http.Client{Timeout: alertTimeout},
+			Cooldown: cfg.AlertCooldown,
+		}
+	}
+
+	// If credentials were provided, balancing requests across them.
+	var credentials []*Credential
+	var pool *CredentialPool
+	credentialBase := transport
+	if credentialed {
+		credentials, err = NewCredentials(ctx, cfg, credentialBase)
 		if err != nil {
-			log.Fatal().Err(err).Msg("config.LoadDefaultConfig failed")
+			log.Fatal().Err(err).Msg("NewCredentials failed")
 		}
-		if *s3Region != "" {
-			cfg.Region = *s3Region
+		// If coordinating with other replicas, share the rate-limits and divide the RPH between them.
+		var coordinator *Coordinator
+		var leader *Leader
+		if cfg.CoordinateRedisAddr != "" {
+			coordinator = NewCoordinator(redis.NewClient(&redis.Options{
+				Addr:     cfg.CoordinateRedisAddr,
+				Username: cfg.RedisUsername,
+				Password: cfg.RedisPassword,
+				DB:       cfg.RedisDB,
+				Dialer:   RedisDialer(),
+			}), cfg.CoordinatePrefix)
+			if cfg.LeaderElection {
+				leader = &Leader{
+					Client: coordinator.Client,
+					Key:    cfg.CoordinatePrefix + "leader",
+					ID:     coordinator.ID,
+					TTL:    3 * cfg.CoordinateInterval,
+				}
+				go leader.Run(ctx)
+			}
+		} else if cfg.LeaderElection {
+			log.Fatal().Msg("--leader-election requires --coordinate-redis-addr")
 		}
-		s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-			if *s3Endpoint != "" {
-				o.BaseEndpoint = aws.String(*s3Endpoint)
-				// https://xuanwo.io/links/2025/02/aws_s3_sdk_breaks_its_compatible_services/
-				o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
-				o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		// Wrap each credential's transport as it joins the pool (including those added at runtime).
+		pool = NewCredentialPool(ctx, func(ctx context.Context, credential *Credential) {
+			transport := credential.Transport
+			// If RPH is set, wrap each individual transport in a rate-limiting transport.
+			if coordinator != nil && cfg.RPH > 0 {
+				limiter := NewDividedLimiter(cfg.RPH, time.Hour)
+				coordinator.AddLimiter(limiter)
+				transport.Base = &ratelimit.Transport{
+					Base:    transport.Base,
+					Limiter: limiter,
+				}
+			} else {
+				transport.Base = ratelimit.New(transport.Base, cfg.RPH, ratelimit.Per(time.Hour))
 			}
+			// If adaptive pacing is enabled, wrap each individual transport using its own rate-limit state.
+			if cfg.Adaptive {
+				transport.Base = &AdaptiveTransport{
+					Base:    transport.Base,
+					Limits:  &transport.Limits,
+					Burst:   cfg.AdaptiveBurst,
+					MaxWait: cfg.AdaptiveMaxWait,
+				}
+			}
+			// Track the expiration of the (personal access) token of the credential.
+			transport.Base = &ExpiryTransport{
+				Base:       transport.Base,
+				Credential: credential.ID,
+				Warning:    cfg.TokenExpiryWarning,
+				Alerter:    alerter,
+			}
+			// Alert once the requests of the credential start failing.
+			if alerter != nil {
+				transport.Base = &CredentialAlertTransport{
+					Base:       transport.Base,
+					Credential: credential.ID,
+					Alerter:    alerter,
+					Threshold:  cfg.AlertFailures,
+				}
+			}
+			// Record the credential of the requests in their log line.
+			transport.Base = &CredentialTraceTransport{
+				Base:       transport.Base,
+				Credential: credential,
+			}
+			// Poll the rate limits for each transport.
+			go PollCredential(ctx, credential, cfg.RateInterval, cfg.RateJitter, rateLimitURL, leader)
 		})
-		s3Storage, err := s3storage.New(s3Client, *s3Bucket, *s3Prefix)
-		if err != nil {
-			log.Fatal().Err(err).Msg("s3storage.New failed")
-		}
-		storage = s3Storage
-	} else if *redisAddr != "" {
-		redisClient := redis.NewClient(&redis.Options{
-			Addr:     *redisAddr,
-			Username: *redisUsername,
-			Password: *redisPassword,
-			DB:       *redisDB,
-		})
-		storage = redisstorage.New(redisClient)
+		if cfg.Affinity > 0 {
+			pool.Affinity = &Affinity{Header: cfg.AffinityHeader, Window: cfg.Affinity}
+		}
+		if err := pool.Add(credentials...); err != nil {
+			log.Fatal().Err(err).Msg("(*CredentialPool).Add failed")
+		}
+		if cfg.CredentialStore != "" {
+			cipher, err := NewCredentialStoreCipher(ctx, cfg.CredentialKey, cfg.CredentialPassphrase)
+			if err != nil {
+				log.Fatal().Err(err).Msg("NewCredentialStoreCipher failed")
+			}
+			go WatchCredentialStore(ctx, cfg, cipher, pool, credentialBase)
+		}
+		if alerter != nil {
+			go alerter.WatchQuota(ctx, pool, cfg.AlertQuota)
+		}
+		// Forecast the exhaustion of the quota from the recent consumption.
+		go (&Forecaster{Pool: pool}).Run(ctx)
+		if coordinator != nil {
+			coordinator.Pool = pool
+			go coordinator.Poll(ctx, cfg.CoordinateInterval)
+		}
+		transport = pool
 	} else {
-		storage = memory.NewStorage()
+		// If RPH is set, wrap the main transport in a rate-limiting transport.
+		if cfg.RPH > 0 {
+			transport = ratelimit.New(transport, cfg.RPH, ratelimit.Per(time.Hour))
+		}
 	}
 
-	// Implement the logging _before_ the caching
-	var transport http.RoundTripper = &LoggingTransport{
-		Base: http.DefaultTransport,
+	// Hedge the slow read-only requests of the latency-sensitive routes with another credential.
+	if len(cfg.HedgePath) > 0 {
+		if pool == nil {
+			log.Fatal().Msg("--hedge-path requires credentials")
+		}
+		if pool.Affinity != nil {
+			log.Fatal().Msg("--hedge-path conflicts with --affinity")
+		}
+		transport = &HedgeTransport{
+			Base:     transport,
+			Pool:     pool,
+			Patterns: cfg.HedgePath,
+			Budget:   cfg.HedgeBudget,
+			MinDelay: cfg.HedgeMinDelay,
+		}
 	}
 
-	// Setup the caching transport as the base transport.
-	transport = ghtransport.NewTransport(storage, transport)
+	// Hint how many more pages the pool can afford on paginated responses.
+	if cfg.BudgetHeader {
+		transport = &BudgetTransport{
+			Base: transport,
+			Pool: pool,
+		}
+	}
 
-	// If credentials were provided, balancing requests across them.
-	if len(*authOAuth) > 0 || len(*authApp) > 0 || len(*authToken) > 0 {
-		var balancing ghratelimit.BalancingTransport
-		// If using OAuth credentials, just use basic auth.
-		for _, params := range *authOAuth {
-			clientID, clientSecret, ok := strings.Cut(params, ":")
-			if !ok {
-				log.Fatal().Str("params", params).Msg("invalid OAuth client")
+	// Revalidate the cached responses of the mutated paths, keeping the reads coherent with the writes.
+	if cfg.WriteRevalidate {
+		transport = &RevalidateTransport{
+			Base:    transport,
+			Storage: keyed,
+		}
+	}
+
+	// Purge the cached responses of the mutated paths, they are fetched again by the subsequent reads.
+	if cfg.WriteInvalidate {
+		transport = &InvalidateTransport{
+			Base:    transport,
+			Storage: storage,
+			URL:     proxyURL,
+			Exclude: cfg.WriteInvalidateSkip,
+		}
+	}
+
+	// Briefly cache the negative responses (ex: probes for optional files) which the conditional caching cannot.
+	if cfg.NegativeCacheTTL > 0 {
+		transport = &NegativeCacheTransport{
+			Base:     transport,
+			Keys:     keyed,
+			TTL:      cfg.NegativeCacheTTL,
+			Statuses: cfg.NegativeCacheStatus,
+		}
+	}
+
+	// Resolve the persisted GraphQL queries, reject the expensive queries, answer the simple queries from the REST cache
+	// and cache the results of the read-only queries.
+	if cfg.GraphQLPersisted || cfg.GraphQLCacheTTL > 0 || cfg.GraphQLMaxCost > 0 || cfg.GraphQLRESTFallback {
+		transport = &GraphQLTransport{
+			Base:      transport,
+			Storage:   storage,
+			Persisted: cfg.GraphQLPersisted,
+			TTL:       cfg.GraphQLCacheTTL,
+			MaxCost:   cfg.GraphQLMaxCost,
+			Fallback:  cfg.GraphQLRESTFallback,
+			Shadow:    shadow,
+		}
+	}
+
+	// Reject (or queue) mutating requests during change freezes.
+	freezer := &FreezeTransport{
+		Base:  transport,
+		Queue: cfg.FreezeQueue,
+	}
+	for _, spec := range cfg.FreezeSchedule {
+		window, err := ParseCronWindow(spec)
+		if err != nil {
+			log.Fatal().Err(err).Str("spec", spec).Msg("ParseCronWindow failed")
+		}
+		freezer.Windows = append(freezer.Windows, window)
+	}
+	freezer.SetFrozen(cfg.Freeze)
+	transport = freezer
+
+	// Smooth out bursts of mutating requests, independent of the read path.
+	if cfg.WriteRPM > 0 || cfg.WriteConcurrency > 0 {
+		transport = NewWriteTransport(transport, cfg.WriteRPM, cfg.WriteConcurrency)
+	}
+
+	// Inject the default API version _before_ the caching so it is included in the cache key.
+	transport = &APIVersionTransport{
+		Base:    transport,
+		Version: cfg.APIVersion,
+	}
+	if cfg.APIVersion != "" && !slices.Contains(APIVersionLabels.Known, cfg.APIVersion) {
+		APIVersionLabels.Known = append(APIVersionLabels.Known, cfg.APIVersion)
+	}
+
+	// Normalize the Accept header _before_ the caching too, so equivalent requests share the cache key.
+	if cfg.NormalizeAccept || len(cfg.AcceptRewrite) > 0 {
+		accept := &AcceptTransport{
+			Base:     transport,
+			Previews: DefaultGraduatedPreviews,
+		}
+		for _, spec := range cfg.AcceptRewrite {
+			rule, err := ParseAcceptRule(spec)
+			if err != nil {
+				log.Fatal().Err(err).Str("rule", spec).Msg("ParseAcceptRule failed")
 			}
-			authTransport, err := ghauth.Basic(transport, clientID, clientSecret)
+			accept.Rules = append(accept.Rules, rule)
+		}
+		transport = accept
+	}
+
+	// Reject the requests which do not match the OpenAPI description _before_ the caching, they never reach GitHub.
+	var spec *OpenAPISpec
+	if cfg.OpenAPISpec != "" {
+		spec, err = LoadOpenAPISpec(ctx, cfg.OpenAPISpec)
+		if err != nil {
+			log.Fatal().Err(err).Str("spec", cfg.OpenAPISpec).Msg("LoadOpenAPISpec failed")
+		}
+	}
+	if cfg.ValidateRequests {
+		if spec == nil {
+			log.Fatal().Msg("--validate-requests requires --openapi-spec")
+		}
+		transport = &ValidateTransport{
+			Base: transport,
+			Spec: spec,
+		}
+	}
+
+	// Compare the responses to those of a secondary upstream (ex: during a migration), with the default API version.
+	if cfg.CompareURL != "" {
+		compareURL, err := url.Parse(cfg.CompareURL)
+		if err != nil {
+			log.Fatal().Err(err).Msg("url.Parse failed")
+		}
+		compare := NewCompareTransport(transport, proxyURL, compareURL, cfg.CompareConcurrency)
+		compare.Transport = upstream
+		compare.Token = cfg.CompareAuthToken
+		compare.Ignore = cfg.CompareIgnore
+		compare.Sample = cfg.CompareSample
+		if cfg.CompareLog != "" {
+			f, err := os.OpenFile(cfg.CompareLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 			if err != nil {
-				log.Fatal().Err(err).Str("client_id", clientID).Msg("ghauth.Basic failed")
+				log.Fatal().Err(err).Msg("os.OpenFile failed")
 			}
-			balancing = append(balancing, &ghratelimit.Transport{
-				Base: authTransport,
-				Limits: ghratelimit.Limits{
-					Notify: func(resp *http.Response, resource ghratelimit.Resource, rate *ghratelimit.Rate) {
-						RateLimitRemaining.WithLabelValues(clientID, resource.String()).Set(float64(rate.Remaining))
-						RateLimitReset.WithLabelValues(clientID, resource.String()).Set(float64(rate.Reset))
-					},
-				},
-			})
-		}
-		// If using GitHub App credentials, use the GitHub App transport.
-		for _, appParams := range *authApp {
-			appID, appParams, ok := strings.Cut(appParams, ":")
-			if !ok {
-				log.Fatal().Str("params", appParams).Msg("invalid GitHub App")
+			defer f.Close()
+			compare.Log = f
+		}
+		transport = compare
+	}
+
+	// Validate a sample of the responses against the OpenAPI description, including those served from the cache.
+	if cfg.ValidateResponses > 0 {
+		if spec == nil {
+			log.Fatal().Msg("--validate-responses requires --openapi-spec")
+		}
+		transport = &DriftTransport{
+			Base:   transport,
+			Spec:   spec,
+			Sample: cfg.ValidateResponses,
+		}
+	}
+
+	// Track deprecated endpoints, including those served from the cache.
+	deprecation := &DeprecationTransport{
+		Base: transport,
+	}
+	go deprecation.Poll(ctx, cfg.DeprecationInterval)
+	transport = deprecation
+
+	// Aggregate the usage analytics, persisting them in the storage backend.
+	usage := &UsageTransport{
+		Base:      transport,
+		Storage:   storage,
+		Retention: cfg.UsageRetention,
+	}
+	if cfg.UsageUserAgents > 0 {
+		usage.UserAgents = &UserAgents{Max: cfg.UsageUserAgents}
+	}
+	if err := usage.Load(ctx); err != nil {
+		log.Warn().Err(err).Msg("(*UsageTransport).Load failed")
+	}
+	go usage.Poll(ctx, cfg.UsageWindow)
+	transport = usage
+
+	// Attribute the requests (and their rate-limit cost) to teams for chargeback.
+	team := &TeamTransport{
+		Base: transport,
+	}
+	if cfg.TeamReport != "" {
+		go team.Poll(ctx, cfg.TeamReportInterval, cfg.TeamReport)
+	}
+	transport = team
+
+	// Enforce the quota of each tenant, the credential subset and cache partition are applied further down.
+	var tenancy *Tenancy
+	if cfg.Tenants != "" {
+		tenancy, err = LoadTenancy(cfg.Tenants)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cfg.Tenants).Msg("LoadTenancy failed")
+		}
+		for _, tenant := range tenancy.Tenants {
+			for _, id := range tenant.Credentials {
+				if pool.Get(id) == nil {
+					log.Warn().Str("tenant", tenant.Name).Str("credential", id).Msg("tenant credential is not configured")
+				}
 			}
-			installationID, privateKey, ok := strings.Cut(appParams, ":")
-			if !ok {
-				log.Fatal().Str("params", appParams).Msg("invalid GitHub App")
+		}
+		transport = &TenantTransport{
+			Base:   transport,
+			Shadow: shadow,
+		}
+	}
+
+	// Let the trusted clients pin the credential of their requests.
+	var overrides *OverridePolicy
+	if cfg.CredentialOverrides != "" {
+		overrides, err = LoadOverridePolicy(cfg.CredentialOverrides)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cfg.CredentialOverrides).Msg("LoadOverridePolicy failed")
+		}
+		for _, grant := range overrides.Grants {
+			covered := false
+			for _, credential := range pool.Credentials() {
+				covered = covered || grant.covers(credential.ID)
+			}
+			if !covered {
+				log.Warn().Str("grant", grant.Name).Strs("credentials", grant.Credentials).Msg("grant credentials match no configured credential")
 			}
-			ts, err := ghauth.App(ctx, appID, installationID, privateKey)
+		}
+	}
+
+	// Set aside quota of the pool for the batch jobs which reserved it.
+	var reservations *ReservationTransport
+	if cfg.Reservations {
+		if pool == nil {
+			log.Fatal().Msg("--reservations requires credentials")
+		}
+		reservations = &ReservationTransport{
+			Base:   transport,
+			Pool:   pool,
+			Shadow: shadow,
+		}
+		transport = reservations
+	}
+
+	// Filter response fields _after_ the caching so the full bodies are cached.
+	transport = &FieldsTransport{
+		Base: transport,
+	}
+
+	// Respond with only the changes since the last response to the (opted-in) polling clients.
+	if cfg.Delta {
+		transport = &DeltaTransport{
+			Base:    transport,
+			Storage: storage,
+		}
+	}
+
+	// Replay the outcomes of the mutations for the retries with the same Idempotency-Key.
+	if cfg.IdempotencyTTL > 0 {
+		transport = &IdempotencyTransport{
+			Base:    transport,
+			Storage: storage,
+			TTL:     cfg.IdempotencyTTL,
+		}
+	}
+
+	// Scrub any secrets from the errors and responses returned to the clients.
+	if cfg.ScrubResponses {
+		transport = &ScrubTransport{
+			Base:     transport,
+			Scrubber: DefaultScrubber,
+		}
+	}
+
+	// Enforce the overall (per-route) deadlines, including any time spent queueing.
+	timeouts := &TimeoutTransport{
+		Base:    transport,
+		Default: cfg.Timeout,
+	}
+	for _, spec := range cfg.RouteTimeout {
+		route, err := ParseRouteTimeout(spec)
+		if err != nil {
+			log.Fatal().Err(err).Str("spec", spec).Msg("ParseRouteTimeout failed")
+		}
+		timeouts.Routes = append(timeouts.Routes, route)
+	}
+	transport = timeouts
+
+	// Detect (and optionally block) the anomalous behaviour of the clients.
+	var anomalies *AnomalyTransport
+	if cfg.AnomalyDetection {
+		anomalies = &AnomalyTransport{
+			Base:       transport,
+			RateFactor: cfg.AnomalyRateFactor,
+			MinRate:    cfg.AnomalyMinRate,
+			Webhook:    cfg.AnomalyWebhook,
+			Client:     &http.Client{Timeout: alertTimeout},
+			Block:      cfg.AnomalyBlock,
+			Shadow:     shadow,
+		}
+		for _, spec := range cfg.AnomalyEndpoint {
+			rule, err := ParseAnomalyRule(spec)
 			if err != nil {
-				log.Fatal().Err(err).Str("app_id", appID).Msg("ghauth.App failed")
+				log.Fatal().Err(err).Str("spec", spec).Msg("ParseAnomalyRule failed")
 			}
-			balancing = append(balancing, &ghratelimit.Transport{
-				Base: &oauth2.Transport{
-					Base:   transport,
-					Source: ts,
-				},
-				Limits: ghratelimit.Limits{
-					Notify: func(resp *http.Response, resource ghratelimit.Resource, rate *ghratelimit.Rate) {
-						RateLimitRemaining.WithLabelValues(appID+":"+installationID, resource.String()).Set(float64(rate.Remaining))
-						RateLimitReset.WithLabelValues(appID+":"+installationID, resource.String()).Set(float64(rate.Reset))
-					},
-				},
-			})
-		}
-		for _, token := range *authToken {
-			hashed := sha256.Sum256([]byte(token))
-			hashedToken := base64.StdEncoding.EncodeToString(hashed[:])
-			balancing = append(balancing, &ghratelimit.Transport{
-				Base: &oauth2.Transport{
-					Base:   transport,
-					Source: oauth2.StaticTokenSource(ghauth.Token(token)),
-				},
-				Limits: ghratelimit.Limits{
-					Notify: func(resp *http.Response, resource ghratelimit.Resource, rate *ghratelimit.Rate) {
-						RateLimitRemaining.WithLabelValues(hashedToken, resource.String()).Set(float64(rate.Remaining))
-						RateLimitReset.WithLabelValues(hashedToken, resource.String()).Set(float64(rate.Reset))
-					},
-				},
-			})
-		}
-		// If RPH is set, wrap each individual transport in a rate-limiting transport.
-		for _, transport := range balancing {
-			transport.Base = ratelimit.New(transport.Base, *rph, ratelimit.Per(time.Hour))
-		}
-		// Poll the rate limits for each transport.
-		go balancing.Poll(ctx, *rateInterval, proxyURL.ResolveReference(&url.URL{
-			Path: "/rate_limit",
-		}))
-		transport = balancing
-	} else {
-		// If RPH is set, wrap the main transport in a rate-limiting transport.
-		if *rph > 0 {
-			transport = ratelimit.New(transport, *rph, ratelimit.Per(time.Hour))
+			anomalies.Endpoints = append(anomalies.Endpoints, rule)
+		}
+		transport = anomalies
+	}
+
+	// Record the recent errors for the dashboard UI.
+	dashboard := &Dashboard{
+		Base:     transport,
+		Pool:     pool,
+		Usage:    usage,
+		Capacity: 50,
+		Top:      20,
+	}
+	transport = dashboard
+
+	// Track the availability and latency objectives of the requests, as seen by the clients.
+	var slo *SLOTracker
+	if cfg.SLOAvailability > 0 || cfg.SLOLatency > 0 {
+		slo = &SLOTracker{
+			Base:          transport,
+			Availability:  cfg.SLOAvailability,
+			Latency:       cfg.SLOLatency,
+			LatencyTarget: cfg.SLOLatencyTarget,
+			Period:        cfg.SLOPeriod,
 		}
+		go slo.Run(ctx, sloInterval)
+		transport = slo
 	}
 
+	// Call the hooks of the (experimental) WASM filters on the requests of the clients and their final responses.
+	if len(cfg.WASMFilter) > 0 {
+		var filters []*WASMFilter
+		for _, path := range cfg.WASMFilter {
+			filter, err := LoadWASMFilter(ctx, path, cfg.WASMTimeout, cfg.WASMMemory)
+			if err != nil {
+				log.Fatal().Err(err).Str("path", path).Msg("LoadWASMFilter failed")
+			}
+			defer filter.Close(context.WithoutCancel(ctx))
+			filters = append(filters, filter)
+		}
+		transport = &FilterTransport{
+			Base:    transport,
+			Filters: filters,
+		}
+	}
+
+	// Run the hooks of the scripts on the requests of the clients and their final responses.
+	if len(cfg.Script) > 0 {
+		var scripts []*Script
+		for _, path := range cfg.Script {
+			script, err := LoadScript(path, cfg.ScriptTimeout)
+			if err != nil {
+				log.Fatal().Err(err).Str("path", path).Msg("LoadScript failed")
+			}
+			scripts = append(scripts, script)
+		}
+		transport = &ScriptTransport{
+			Base:    transport,
+			Scripts: scripts,
+		}
+	}
+
+	// Sign the final response bodies (after the hooks of the filters and the scripts, which may modify them), streaming
+	// responses are never signed.
+	var signer *Signer
+	if cfg.SignKey != "" {
+		signer, err = LoadSigner(cfg.SignKey)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cfg.SignKey).Msg("LoadSigner failed")
+		}
+		transport = &SigningTransport{
+			Base:   transport,
+			Signer: signer,
+		}
+	}
+
+	// Stream SSE, WebSocket and the configured paths to the clients without buffering.
+	transport = &StreamTransport{
+		Base:     transport,
+		Patterns: cfg.StreamPath,
+	}
+
+	// Wrap the requests of the clients by the custom transports.
+	transport, err = WrapMiddlewares(transport, middlewares, middleware.StageClient)
+	if err != nil {
+		log.Fatal().Err(err).Msg("WrapMiddlewares failed")
+	}
+
+	// Log each request once its cache outcome, credential and upstream attempts are known.
+	var logRoutes []LogRoute
+	for _, spec := range cfg.LogRoute {
+		route, err := ParseLogRoute(spec)
+		if err != nil {
+			log.Fatal().Err(err).Str("spec", spec).Msg("ParseLogRoute failed")
+		}
+		logRoutes = append(logRoutes, route)
+	}
+	logging := NewLoggingTransport(transport, logRoutes)
+	transport = logging
+
+	// Capture the requests into a HAR file once started via the admin API (ex: to attach to a bug report).
+	recorder := &HARRecorder{
+		Base: transport,
+	}
+	transport = recorder
+
 	// Setup the reverse proxy.
 	proxy := &httputil.ReverseProxy{
 		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out = pr.Out.WithContext(WithRequestURI(pr.Out.Context(), pr.In.RequestURI))
 			pr.SetURL(proxyURL)
+			policy.FilterRequest(pr.Out)
 			pr.SetXForwarded()
 		},
 		ModifyResponse: func(resp *http.Response) error {
+			policy.FilterResponse(resp)
 			// Replace the GitHub API URL with the proxy URL in the Link header.
 			if link := resp.Header.Get("Link"); link != "" {
 				resp.Header.Set("Link", strings.ReplaceAll(
@@ -254,36 +835,254 @@ func main() {
 			}
 			return nil
 		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			err = DefaultScrubber.ScrubError(err)
+			if errors.Is(err, context.Canceled) {
+				return // The client went away, nothing to respond to
+			}
+			log.Error().Err(err).Str("method", req.Method).Str("path", req.URL.Path).Msg("proxy error")
+			if timedOut(err) {
+				WriteProxyError(w, http.StatusGatewayTimeout, ReasonTimeout, "The upstream did not respond in time")
+				return
+			}
+			WriteProxyError(w, http.StatusBadGateway, ReasonUpstreamUnreachable, "The proxy failed to reach the upstream")
+		},
 		Transport: transport,
 	}
 
+	// Refuse to report ready until enough credentials validate and the storage backend is writable.
+	if cfg.ReadyCredentials > len(credentials) {
+		log.Fatal().Int("ready_credentials", cfg.ReadyCredentials).Int("credentials", len(credentials)).Msg("--ready-credentials exceeds the configured credentials")
+	}
+	readiness := &Readiness{
+		Credentials:    credentials,
+		MinCredentials: cfg.ReadyCredentials,
+		Storage:        storage,
+		URL:            rateLimitURL,
+	}
+
 	// Setup the HTTP router.
 	mux := http.NewServeMux()
-	mux.Handle("/", proxy)
+	// Resolve the identity (and tenant) of the inbound clients.
+	identify := func(h http.Handler) http.Handler {
+		h = &CredentialOverrideHandler{Handler: h, Policy: overrides, Pool: pool}
+		if tenancy != nil {
+			h = &TenantHandler{Handler: h, Tenancy: tenancy, Shadow: shadow}
+		}
+		return &ClientHandler{Handler: h}
+	}
+	var handler http.Handler = proxy
+	// Defer the (opted-in) mutations to the background until the quota allows.
+	var jobs *JobQueue
+	if cfg.Jobs {
+		jobs = NewJobQueue(proxy, cfg.JobsMax)
+		jobs.Pool = pool
+		jobs.Reserve = uint64(max(cfg.JobsReserve, 0))
+		jobs.Retries = cfg.JobsRetries
+		jobs.Workers = cfg.JobsWorkers
+		go jobs.Run(ctx)
+		handler = jobs
+	}
+	// Serve the listings started with the X-Proxy-Snapshot header from a consistent prefetched snapshot.
+	if cfg.PaginationSnapshot > 0 {
+		handler = &SnapshotHandler{Handler: handler, Pool: pool, TTL: cfg.PaginationSnapshot, MaxPages: cfg.SnapshotPages}
+	}
+	handler = identify(handler)
+	// Collapse the pollers of the events API into a single upstream consumer per feed, and fan out the webhooks.
+	hub := &EventHub{Handler: proxy, Interval: cfg.EventsInterval}
+	subscribe := &SubscribeHandler{Events: hub}
+	if cfg.WebhookSecret != "" {
+		subscribe.Webhooks = &WebhookHub{}
+	}
+	mux.Handle("/", handler)
 	mux.Handle("/metrics", promhttp.Handler())
-	mux.Handle("/api/v3/", http.StripPrefix("/api/v3/", proxy))
+	mux.Handle("/readyz", readiness)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	// The admin API is only served on its own listener, see --admin-listen.
+	admin := http.NewServeMux()
+	mux.HandleFunc("/admin/", adminNotFound)
+	admin.Handle("/admin/usage", usage)
+	if spec != nil {
+		coverage := &CoverageReporter{Spec: spec, Usage: usage}
+		go coverage.Run(ctx, cfg.CoverageInterval)
+		admin.Handle("/admin/coverage", coverage)
+	}
+	admin.Handle("/admin/freeze", freezer)
+	if anomalies != nil {
+		admin.Handle("/admin/anomalies", anomalies)
+	}
+	if reservations != nil {
+		admin.Handle("/admin/reservations", reservations)
+	}
+	if pool != nil {
+		mux.Handle("/proxy/rate_limit", identify(&RateLimitHandler{Pool: pool, Reservations: reservations}))
+	}
+	// Answer the /rate_limit API (ex: the backoff of go-github and octokit) for the whole pool rather than a credential.
+	if cfg.RateLimitOverride {
+		if pool == nil {
+			log.Fatal().Msg("--rate-limit-override requires credentials")
+		}
+		override := identify(&RateLimitHandler{Pool: pool, Reservations: reservations, Override: true})
+		mux.Handle("/rate_limit", override)
+		mux.Handle("/api/v3/rate_limit", override)
+	}
+	admin.Handle("/admin/cache", &CacheHandler{Storage: storage, URL: proxyURL})
+	admin.Handle("/admin/cache/inspect", &CacheInspectHandler{Storage: storage, URL: proxyURL})
+	admin.Handle("/admin/cache/namespace", namespace)
+	// The peers of the mesh reach it at the --mesh-url, authenticated by the (required) --mesh-secret.
+	if keyed.Mesh != nil {
+		go keyed.Mesh.Run(ctx, cfg.MeshInterval)
+		mux.Handle("/admin/mesh", keyed.Mesh)
+	}
+	// The public key is needed by the consumers verifying the signatures.
+	if signer != nil {
+		mux.Handle("/admin/signing-key", signer)
+		admin.Handle("/admin/signing-key", signer)
+	}
+	admin.Handle("/admin/har", recorder)
+	if slo != nil {
+		admin.Handle("/admin/slo", slo)
+	}
+	admin.Handle("/admin/log-routes", logging)
+	admin.Handle("/admin/ui", dashboard)
+	admin.Handle("/admin/ui/", dashboard)
+	mux.Handle("/api/v3/", http.StripPrefix("/api/v3/", handler))
+	mux.Handle("/events/stream", identify(&EventStreamHandler{Hub: hub}))
+	mux.Handle("/subscribe", identify(subscribe))
+	if subscribe.Webhooks != nil {
+		mux.Handle("/webhooks", &WebhookHandler{Secret: cfg.WebhookSecret, Hub: subscribe.Webhooks})
+	}
+	if jobs != nil {
+		mux.Handle("/jobs/", identify(&JobHandler{Queue: jobs}))
+	}
+	mux.Handle("/batch", &BatchHandler{Handler: handler, Concurrency: cfg.BulkConcurrency})
+	mux.Handle("/bulk/dependency-graph", &DependencyGraphHandler{Handler: handler, Concurrency: cfg.BulkConcurrency})
+	if cfg.Sidecar {
+		scheme := "http"
+		if cfg.TLSCert != "" && cfg.TLSKey != "" {
+			scheme = "https"
+		}
+		mux.Handle("/env", &EnvHandler{URL: &url.URL{Scheme: scheme, Host: cfg.ListenAddr}})
+	}
 
-	// Start the HTTP server.
-	server := &http.Server{
-		Addr:    *listenAddr,
-		Handler: mux,
+	// Protect against slow clients, the http.Server falls back to the read timeout for any unset timeouts.
+	guard := &ConnGuard{
+		PerIP:         cfg.MaxConnsPerIP,
+		HeaderTimeout: cmp.Or(cfg.ReadHeaderTimeout, cfg.ReadTimeout),
+		IdleTimeout:   cmp.Or(cfg.IdleTimeout, cfg.ReadTimeout),
 	}
-	go func() {
-		if *tlsCert != "" && *tlsKey != "" {
-			if err := server.ListenAndServeTLS(*tlsCert, *tlsKey); !errors.Is(err, http.ErrServerClosed) {
-				log.Fatal().Err(err).Msg("(*http.Server).ListenAndServeTLS failed")
+
+	// Start an HTTP server for each listener, all serving the same handler.
+	var servers []*http.Server
+	for _, lc := range listeners {
+		server := &http.Server{
+			Addr:              lc.Addr,
+			ReadTimeout:       cfg.ReadTimeout,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			ConnState:         guard.ConnState,
+			Handler: &CIDRHandler{
+				Handler: mux,
+				Allowed: allowed,
+				Shadow:  shadow,
+			},
+		}
+		listener, err := net.Listen("tcp", lc.Addr)
+		if err != nil {
+			log.Fatal().Err(err).Msg("net.Listen failed")
+		}
+		// Read the real client address first, so the per-IP limits apply to it.
+		if lc.ProxyProtocol {
+			listener = NewProxyListener(listener, proxyTrusted, cfg.ReadHeaderTimeout)
+		}
+		listener = guard.Listener(listener)
+		go func() {
+			if lc.TLS() {
+				if err := server.ServeTLS(listener, lc.TLSCert, lc.TLSKey); !errors.Is(err, http.ErrServerClosed) {
+					log.Fatal().Err(err).Msg("(*http.Server).ServeTLS failed")
+				}
+			} else {
+				if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+					log.Fatal().Err(err).Msg("(*http.Server).Serve failed")
+				}
+			}
+		}()
+		servers = append(servers, server)
+	}
+
+	// Serve the admin API on its own listener, by default only reachable from the host itself.
+	if cfg.AdminListenAddr != "" {
+		server := &http.Server{
+			Addr:              cfg.AdminListenAddr,
+			ReadHeaderTimeout: cmp.Or(cfg.ReadHeaderTimeout, cfg.ReadTimeout),
+			IdleTimeout:       cmp.Or(cfg.IdleTimeout, cfg.ReadTimeout),
+			Handler:           &AdminHandler{Handler: admin, Token: cfg.AdminToken},
+		}
+		adminListener, err := net.Listen("tcp", cfg.AdminListenAddr)
+		if err != nil {
+			log.Fatal().Err(err).Msg("net.Listen failed")
+		}
+		go func() {
+			if err := server.Serve(adminListener); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal().Err(err).Msg("(*http.Server).Serve failed")
 			}
-		} else {
-			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-				log.Fatal().Err(err).Msg("(*http.Server).ListenAndServe failed")
+		}()
+		servers = append(servers, server)
+	}
+
+	// Serve the gRPC control-plane API (with mutual TLS) on its own listener.
+	if cfg.GRPCListenAddr != "" {
+		tlsConfig, err := ControlTLSConfig(cfg)
+		if err != nil {
+			log.Fatal().Err(err).Msg("ControlTLSConfig failed")
+		}
+		controlListener, err := net.Listen("tcp", cfg.GRPCListenAddr)
+		if err != nil {
+			log.Fatal().Err(err).Msg("net.Listen failed")
+		}
+		go func() {
+			if err := ServeControl(ctx, controlListener, tlsConfig, &ControlService{
+				Config:       cfg,
+				Pool:         pool,
+				Storage:      storage,
+				URL:          proxyURL,
+				Transport:    credentialBase,
+				Reservations: reservations,
+			}); err != nil {
+				log.Fatal().Err(err).Msg("ServeControl failed")
 			}
+		}()
+	}
+
+	go func() {
+		if err := readiness.Wait(ctx, time.Second, cfg.StartupTimeout); err != nil {
+			// Shutting down before being ready is not a failure.
+			if ctx.Err() == nil {
+				log.Fatal().Err(err).Msg("(*Readiness).Wait failed")
+			}
+			return
 		}
+		log.Info().Msg("ready")
 	}()
 
 	// When an interrupt is received, gracefully shut down the HTTP server.
 	<-ctx.Done()
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal().Err(err).Msg("(*http.Server).Shutdown failed")
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Fatal().Err(err).Msg("(*http.Server).Shutdown failed")
+		}
 	}
 
+	// Persist the final usage analytics snapshot before the storage backend is closed.
+	if err := usage.Save(context.Background()); err != nil {
+		log.Error().Err(err).Msg("(*UsageTransport).Save failed")
+	}
+	if cfg.TeamReport != "" {
+		if err := team.WriteReport(cfg.TeamReport); err != nil {
+			log.Error().Err(err).Str("path", cfg.TeamReport).Msg("(*TeamTransport).WriteReport failed")
+		}
+	}
 }
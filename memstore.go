@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	MemoryCacheBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "cache_memory_bytes",
+			Help:      "Bytes of responses held by the in-memory cache",
+			Subsystem: "github",
+		},
+	)
+	MemoryCacheEvictions = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "cache_evictions_total",
+			Help:      "Responses evicted from the in-memory cache to stay within the memory budget",
+			Subsystem: "github",
+		},
+	)
+	MemoryCacheRejected = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "cache_admission_rejected_total",
+			Help:      "Responses not admitted to the in-memory cache because they were requested less frequently than the responses they would evict",
+			Subsystem: "github",
+		},
+	)
+)
+
+// InternalHost is the host of the synthetic URLs used to store the proxy's own (small) state (ex: usage analytics).
+const InternalHost = "github-api-proxy.invalid"
+
+// DerivedHost is the host of the synthetic URLs used to store the (potentially large) responses derived by the proxy
+// for its clients (ex: the last body of a delta response, the outcome of an idempotency key). Unlike the InternalHost
+// state they are evicted like the cached responses, a derived response must be recoverable once missing.
+const DerivedHost = "derived.github-api-proxy.invalid"
+
+// proxyHost reports if the host is that of the synthetic URLs of the proxy (InternalHost or DerivedHost), which are
+// neither namespaced nor shared with the mesh.
+func proxyHost(host string) bool {
+	return host == InternalHost || host == DerivedHost
+}
+
+// memoryEntry is a single stored response.
+type memoryEntry struct {
+	key   string
+	value []byte
+}
+
+// size is the number of bytes accounted against the budget for the entry.
+func (e *memoryEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+// internal reports if the entry stores the proxy's own state, which is always admitted and never evicted.
+func (e *memoryEntry) internal() bool {
+	return strings.HasPrefix(e.key, "https://"+InternalHost+"/")
+}
+
+// MemoryStorage is an in-memory storage bounded by a memory budget, evicting the least recently used responses.
+// A TinyLFU admission policy protects the hot working set: a new response is only admitted if it has been requested
+// more frequently than every response it would evict, so a burst of large unique responses cannot flush the cache.
+type MemoryStorage struct {
+	// Budget is the maximum number of bytes of stored responses.
+	Budget int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+	size    int64
+	sketch  *countMinSketch
+}
+
+// NewMemoryStorage returns an empty MemoryStorage bounded by the budget.
+func NewMemoryStorage(budget int64) *MemoryStorage {
+	// Assume an average response of ~4KiB when sizing the frequency sketch.
+	return &MemoryStorage{
+		Budget:  budget,
+		entries: make(map[string]*list.Element),
+		sketch:  newCountMinSketch(budget / 4096),
+	}
+}
+
+func (s *MemoryStorage) Get(ctx context.Context, req *http.Request) (*http.Response, error) {
+	key := req.URL.String()
+	s.mu.Lock()
+	s.sketch.Increment(key)
+	elem, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	s.lru.MoveToFront(elem)
+	value := elem.Value.(*memoryEntry).value
+	s.mu.Unlock()
+
+	// The entire response is in memory, a buffer larger than it would be wasted.
+	resp, err := http.ReadResponse(bufio.NewReaderSize(bytes.NewReader(value), min(len(value), 4096)), nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.ReadResponse failed: %w", err)
+	}
+	return resp, nil
+}
+
+func (s *MemoryStorage) Put(ctx context.Context, resp *http.Response) error {
+	value, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return fmt.Errorf("httputil.DumpResponse failed: %w", err)
+	}
+	entry := &memoryEntry{key: resp.Request.URL.String(), value: value}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() { MemoryCacheBytes.Set(float64(s.size)) }()
+
+	// Replacing an existing response never requires admission, it is already part of the working set.
+	if elem, ok := s.entries[entry.key]; ok {
+		s.size += entry.size() - elem.Value.(*memoryEntry).size()
+		elem.Value = entry
+		s.lru.MoveToFront(elem)
+		s.evict(elem)
+		return nil
+	}
+	if entry.size() > s.Budget && !entry.internal() {
+		MemoryCacheRejected.Inc()
+		return nil
+	}
+
+	// Find the least recently used victims that must be evicted to fit the response, rejecting it if any of them
+	// are requested at least as frequently.
+	frequency := s.sketch.Estimate(entry.key)
+	var freed int64
+	for elem := s.lru.Back(); elem != nil && s.size-freed+entry.size() > s.Budget; elem = elem.Prev() {
+		victim := elem.Value.(*memoryEntry)
+		if victim.internal() {
+			continue
+		}
+		if !entry.internal() && s.sketch.Estimate(victim.key) >= frequency {
+			MemoryCacheRejected.Inc()
+			return nil
+		}
+		freed += victim.size()
+	}
+
+	s.entries[entry.key] = s.lru.PushFront(entry)
+	s.size += entry.size()
+	s.evict(nil)
+	return nil
+}
+
+// evict removes the least recently used (non-internal) responses until the budget is satisfied, never evicting keep.
+func (s *MemoryStorage) evict(keep *list.Element) {
+	for elem := s.lru.Back(); elem != nil && s.size > s.Budget; {
+		prev := elem.Prev()
+		if entry := elem.Value.(*memoryEntry); elem != keep && !entry.internal() {
+			s.remove(elem)
+			MemoryCacheEvictions.Inc()
+		}
+		elem = prev
+	}
+}
+
+// remove deletes the (locked) element.
+func (s *MemoryStorage) remove(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*memoryEntry)
+	delete(s.entries, entry.key)
+	s.size -= entry.size()
+}
+
+// DeletePrefix deletes every stored response whose URL begins with the prefix (and the remainder of which is matched),
+// returning the number deleted.
+func (s *MemoryStorage) DeletePrefix(prefix string, match func(rest string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int
+	for key, elem := range s.entries {
+		if strings.HasPrefix(key, prefix) && match(key[len(prefix):]) {
+			s.remove(elem)
+			deleted++
+		}
+	}
+	MemoryCacheBytes.Set(float64(s.size))
+	return deleted
+}
+
+// countMinSketch estimates the (recent) request frequency of each key using 4 rows of saturating counters, all of
+// the counters are halved periodically so the frequencies decay and the working set can change over time.
+type countMinSketch struct {
+	seed     maphash.Seed
+	rows     [4][]uint8
+	mask     uint64
+	samples  int
+	resetAt  int
+	maxCount uint8
+}
+
+// newCountMinSketch returns a sketch sized for (approximately) the number of keys.
+func newCountMinSketch(keys int64) *countMinSketch {
+	width := 1 << bits.Len64(uint64(min(max(keys, 1<<10), 1<<22)-1)) // Next power of two
+	s := &countMinSketch{
+		seed:     maphash.MakeSeed(),
+		mask:     uint64(width - 1),
+		resetAt:  10 * width,
+		maxCount: 15,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// indexes returns the counter index of the key in each row.
+func (s *countMinSketch) indexes(key string) [4]uint64 {
+	hash := maphash.String(s.seed, key)
+	h1, h2 := hash, hash>>32|hash<<32
+	var indexes [4]uint64
+	for i := range indexes {
+		indexes[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return indexes
+}
+
+// Increment records a request for the key.
+func (s *countMinSketch) Increment(key string) {
+	for i, index := range s.indexes(key) {
+		if s.rows[i][index] < s.maxCount {
+			s.rows[i][index]++
+		}
+	}
+	if s.samples++; s.samples >= s.resetAt {
+		for _, row := range s.rows {
+			for i := range row {
+				row[i] >>= 1
+			}
+		}
+		s.samples /= 2
+	}
+}
+
+// Estimate returns the estimated (recent) request frequency of the key.
+func (s *countMinSketch) Estimate(key string) uint8 {
+	estimate := s.maxCount
+	for i, index := range s.indexes(key) {
+		estimate = min(estimate, s.rows[i][index])
+	}
+	return estimate
+}
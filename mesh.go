@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	MeshFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "mesh_fetches_total",
+		Subsystem: "github",
+		Help:      "Number of local cache misses fetched from the replica advertising them by result (hit, miss, failed)",
+	}, []string{"result"})
+	MeshAdvertisements = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "mesh_advertisements_total",
+		Subsystem: "github",
+		Help:      "Number of advertisements of the recently cached keys to the peer replicas by result (sent, failed)",
+	}, []string{"result"})
+)
+
+// MeshSecretHeader is the request header authenticating the replicas of the mesh to each other.
+const MeshSecretHeader = "X-Proxy-Mesh-Secret"
+
+// The defaults of the mesh, see MeshStorage.
+const (
+	DefaultMeshInterval = 5 * time.Second
+	DefaultMeshKeys     = 100000
+	meshTimeout         = 2 * time.Second
+)
+
+// MeshAdvertisement is the body of the advertisement of the keys recently cached by a replica.
+type MeshAdvertisement struct {
+	// URL is the URL the replica is reachable at by its peers.
+	URL  string   `json:"url"`
+	Keys []string `json:"keys"`
+}
+
+// MeshStorage is a ghtransport.Storage shared by a mesh of replicas (each with its own Local cache, ex: in-memory):
+// periodically (see Run) a replica advertises the keys it cached since the previous advertisement to its Peers, which
+// remember the replica of the MaxKeys most recently advertised keys. A local miss of an advertised key is then fetched from the
+// replica advertising it (and cached locally) rather than from upstream. The mesh is best-effort, a key the replica no
+// longer has (or an unreachable replica) is a miss as usual.
+type MeshStorage struct {
+	Local ghtransport.Storage
+	// URL is the URL this replica is reachable at by its peers (ex: http://10.0.0.1:44879).
+	URL string
+	// Peers are the URLs of the other replicas.
+	Peers []string
+	// Secret (optional) authenticates the replicas to each other, see MeshSecretHeader.
+	Secret  string
+	MaxKeys int
+
+	mu     sync.Mutex
+	recent []string
+	index  map[string]string
+	order  []string
+}
+
+// advertised returns the replica advertising the key, if any.
+func (m *MeshStorage) advertised(key string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.index[key]
+}
+
+// learn remembers the replica advertising the keys, forgetting the oldest keys beyond MaxKeys.
+func (m *MeshStorage) learn(peer string, keys []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.index == nil {
+		m.index = make(map[string]string)
+	}
+	for _, key := range keys {
+		if _, ok := m.index[key]; !ok {
+			m.order = append(m.order, key)
+		}
+		m.index[key] = peer
+	}
+	for len(m.order) > m.MaxKeys {
+		delete(m.index, m.order[0])
+		m.order = m.order[1:]
+	}
+}
+
+// forget forgets the replica advertising the key, it no longer has it.
+func (m *MeshStorage) forget(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.index, key)
+}
+
+// fetch fetches the stored response of the request from the peer, nil if it does not have it.
+func (m *MeshStorage) fetch(ctx context.Context, peer string, req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, meshTimeout)
+	defer cancel()
+	meshReq, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/admin/mesh?key="+url.QueryEscape(req.URL.String()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+	}
+	meshReq.Header.Set(MeshSecretHeader, m.Secret)
+	meshResp, err := http.DefaultClient.Do(meshReq)
+	if err != nil {
+		return nil, fmt.Errorf("(*http.Client).Do failed: %w", err)
+	}
+	defer meshResp.Body.Close()
+	switch meshResp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %d", meshResp.StatusCode)
+	}
+	// Buffer the response, the request context is cancelled once returned.
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(meshResp.Body); err != nil {
+		return nil, fmt.Errorf("(*bytes.Buffer).ReadFrom failed: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), req)
+	if err != nil {
+		return nil, fmt.Errorf("http.ReadResponse failed: %w", err)
+	}
+	return resp, nil
+}
+
+func (m *MeshStorage) Get(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := m.Local.Get(ctx, req)
+	if err != nil || resp != nil {
+		return resp, err
+	}
+	key := req.URL.String()
+	peer := m.advertised(key)
+	if peer == "" {
+		return nil, nil
+	}
+	resp, err = m.fetch(ctx, peer, req)
+	if err != nil {
+		MeshFetches.WithLabelValues("failed").Inc()
+		log.Warn().Err(err).Str("peer", peer).Str("url", key).Msg("(*MeshStorage).fetch failed")
+		return nil, nil
+	}
+	if resp == nil {
+		MeshFetches.WithLabelValues("miss").Inc()
+		m.forget(key)
+		return nil, nil
+	}
+	MeshFetches.WithLabelValues("hit").Inc()
+	if err := m.Local.Put(ctx, resp); err != nil {
+		log.Warn().Err(err).Msg("(*MeshStorage).Local.Put failed")
+	}
+	return resp, nil
+}
+
+func (m *MeshStorage) Put(ctx context.Context, resp *http.Response) error {
+	if err := m.Local.Put(ctx, resp); err != nil {
+		return err
+	}
+	// The state of the proxy itself (ex: the usage analytics) is not shared.
+	if proxyHost(resp.Request.URL.Host) {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.recent) < m.MaxKeys {
+		m.recent = append(m.recent, resp.Request.URL.String())
+	}
+	return nil
+}
+
+// advertise sends the keys cached since the previous advertisement to every peer.
+func (m *MeshStorage) advertise(ctx context.Context) {
+	m.mu.Lock()
+	keys := m.recent
+	m.recent = nil
+	m.mu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+	body, err := json.Marshal(MeshAdvertisement{URL: m.URL, Keys: keys})
+	if err != nil {
+		log.Error().Err(err).Msg("json.Marshal failed")
+		return
+	}
+	for _, peer := range m.Peers {
+		if err := m.send(ctx, peer, body); err != nil {
+			MeshAdvertisements.WithLabelValues("failed").Inc()
+			log.Warn().Err(err).Str("peer", peer).Msg("(*MeshStorage).send failed")
+			continue
+		}
+		MeshAdvertisements.WithLabelValues("sent").Inc()
+	}
+}
+
+// send sends the advertisement to the peer.
+func (m *MeshStorage) send(ctx context.Context, peer string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, meshTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/admin/mesh", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(MeshSecretHeader, m.Secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("(*http.Client).Do failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Run advertises the recently cached keys to the peers every interval until the context is cancelled.
+func (m *MeshStorage) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.advertise(ctx)
+	}
+}
+
+// ServeHTTP implements the /admin/mesh API of the peers: GET ?key= returns the stored response of the key (in its
+// HTTP/1.1 wire format), POST records a MeshAdvertisement.
+func (m *MeshStorage) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get(MeshSecretHeader)), []byte(m.Secret)) != 1 {
+		WriteProxyError(w, http.StatusForbidden, ReasonMeshSecret, "Missing or invalid "+MeshSecretHeader+" header")
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		key, err := url.Parse(req.URL.Query().Get("key"))
+		if err != nil || key.Host == "" || proxyHost(key.Host) {
+			WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "Invalid key")
+			return
+		}
+		stored := (&http.Request{Method: http.MethodGet, URL: key, Header: make(http.Header)}).WithContext(req.Context())
+		resp, err := m.Local.Get(req.Context(), stored)
+		if err != nil {
+			log.Error().Err(err).Msg("(ghtransport.Storage).Get failed")
+			WriteProxyError(w, http.StatusInternalServerError, ReasonInternal, "Failed to read the cache")
+			return
+		}
+		if resp == nil {
+			WriteProxyError(w, http.StatusNotFound, ReasonInvalidRequest, "The key is not cached")
+			return
+		}
+		defer resp.Body.Close()
+		w.Header().Set("Content-Type", "message/http")
+		if err := resp.Write(w); err != nil {
+			log.Error().Err(err).Msg("(*http.Response).Write failed")
+		}
+	case http.MethodPost:
+		var advertisement MeshAdvertisement
+		if err := json.NewDecoder(req.Body).Decode(&advertisement); err != nil || advertisement.URL == "" {
+			WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "Invalid advertisement")
+			return
+		}
+		m.learn(advertisement.URL, advertisement.Keys)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"plugin"
+	"slices"
+	"strings"
+
+	"github.com/bored-engineer/github-api-proxy/middleware"
+)
+
+// MiddlewareConfig is a custom transport enabled by the --middleware flag, see the middleware package.
+type MiddlewareConfig struct {
+	Name  string
+	Stage middleware.Stage
+	// Options are the remaining options of the flag, passed to the Wrap of the middleware.
+	Options map[string]string
+}
+
+// ParseMiddleware parses a --middleware flag: '<name>[,stage=upstream|client][,<key>=<value>...]'.
+func ParseMiddleware(spec string) (MiddlewareConfig, error) {
+	name, options, _ := strings.Cut(spec, ",")
+	if name == "" {
+		return MiddlewareConfig{}, fmt.Errorf("missing middleware name in %q", spec)
+	}
+	config := MiddlewareConfig{Name: name, Stage: middleware.StageUpstream, Options: make(map[string]string)}
+	if options != "" {
+		for option := range strings.SplitSeq(options, ",") {
+			key, value, ok := strings.Cut(option, "=")
+			if !ok || key == "" {
+				return MiddlewareConfig{}, fmt.Errorf("invalid middleware option %q in %q, expected <key>=<value>", option, spec)
+			}
+			if key == "stage" {
+				switch stage := middleware.Stage(value); stage {
+				case middleware.StageUpstream, middleware.StageClient:
+					config.Stage = stage
+				default:
+					return MiddlewareConfig{}, fmt.Errorf("unknown middleware stage %q in %q, expected %q or %q", value, spec, middleware.StageUpstream, middleware.StageClient)
+				}
+				continue
+			}
+			config.Options[key] = value
+		}
+	}
+	return config, nil
+}
+
+// LoadMiddlewarePlugins opens the Go plugins (*.so) of the directory, each registering its middlewares from its init
+// function. A plugin must be built with the same Go version and versions of the shared modules as the proxy.
+func LoadMiddlewarePlugins(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("os.Stat failed: %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return fmt.Errorf("filepath.Glob failed: %w", err)
+	}
+	for _, path := range paths {
+		if _, err := plugin.Open(path); err != nil {
+			return fmt.Errorf("plugin.Open(%q) failed: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Middlewares returns the configured middlewares, each of which must be registered.
+func (c *Config) Middlewares() ([]MiddlewareConfig, error) {
+	var configs []MiddlewareConfig
+	for _, spec := range c.Middleware {
+		config, err := ParseMiddleware(spec)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := middleware.Lookup(config.Name); !ok {
+			return nil, fmt.Errorf("unknown middleware %q, registered are %v", config.Name, middleware.Names())
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// WrapMiddlewares wraps the transport by the middlewares of the stage, the first one configured is the outermost (it
+// sees the requests first and the responses last).
+func WrapMiddlewares(transport http.RoundTripper, configs []MiddlewareConfig, stage middleware.Stage) (http.RoundTripper, error) {
+	for _, config := range slices.Backward(configs) {
+		if config.Stage != stage {
+			continue
+		}
+		m, _ := middleware.Lookup(config.Name)
+		wrapped, err := m.Wrap(transport, config.Options)
+		if err != nil {
+			return nil, fmt.Errorf("middleware %q failed: %w", config.Name, err)
+		}
+		transport = wrapped
+	}
+	return transport, nil
+}
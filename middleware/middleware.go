@@ -0,0 +1,87 @@
+// Package middleware is the extension point of github-api-proxy: the custom transports registered here (ex: signing
+// the requests sent upstream with an internal key) are enabled by name with the --middleware flag, without forking the
+// proxy. A middleware is registered from the init function of its package, which is either imported at build-time (a
+// file next to the main.go of the proxy importing it, ex: import _ "example.com/proxy-signing") or built as a Go
+// plugin (go build -buildmode=plugin) loaded from the --middleware-dir directory:
+//
+//	func init() {
+//		middleware.Register("signing", middleware.Func(func(base http.RoundTripper, options map[string]string) (http.RoundTripper, error) {
+//			key, err := os.ReadFile(options["key"])
+//			if err != nil {
+//				return nil, fmt.Errorf("os.ReadFile failed: %w", err)
+//			}
+//			return &SigningTransport{Base: base, Key: key}, nil
+//		}))
+//	}
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Stage is the position of a middleware in the transport chain of the proxy.
+type Stage string
+
+const (
+	// StageUpstream wraps each request sent upstream, after the cache lookup and the credential selection (so the
+	// requests are already authenticated), including the retries and the health checks.
+	StageUpstream Stage = "upstream"
+	// StageClient wraps each request of the clients before the cache lookup, the credential selection and the tenant
+	// quotas, its responses are the final ones (including the cache hits).
+	StageClient Stage = "client"
+)
+
+// Middleware is a custom transport of the proxy, the transport it returns must be safe for concurrent use.
+type Middleware interface {
+	// Wrap returns the transport wrapping the base transport, the options are those of its --middleware flag.
+	Wrap(base http.RoundTripper, options map[string]string) (http.RoundTripper, error)
+}
+
+// Func adapts a function to the Middleware interface.
+type Func func(base http.RoundTripper, options map[string]string) (http.RoundTripper, error)
+
+func (f Func) Wrap(base http.RoundTripper, options map[string]string) (http.RoundTripper, error) {
+	return f(base, options)
+}
+
+var (
+	mu          sync.RWMutex
+	middlewares = make(map[string]Middleware)
+)
+
+// Register makes the middleware available by the name, it panics if the name is already registered (like the
+// drivers of database/sql).
+func Register(name string, m Middleware) {
+	mu.Lock()
+	defer mu.Unlock()
+	if m == nil {
+		panic("middleware: Register middleware is nil")
+	}
+	if _, dup := middlewares[name]; dup {
+		panic(fmt.Sprintf("middleware: Register called twice for middleware %q", name))
+	}
+	middlewares[name] = m
+}
+
+// Lookup returns the middleware registered by the name.
+func Lookup(name string) (Middleware, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	m, ok := middlewares[name]
+	return m, ok
+}
+
+// Names returns the sorted names of the registered middlewares.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(middlewares))
+	for name := range middlewares {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
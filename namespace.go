@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	CacheGeneration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "cache_namespace_generation",
+		Subsystem: "github",
+		Help:      "Current generation of the cache namespace, bumping it invalidates every cached response",
+	})
+)
+
+// NamespaceURL is the (synthetic) URL used to persist the cache namespace generation in the storage backend.
+var NamespaceURL = &url.URL{
+	Scheme: "https",
+	Host:   InternalHost,
+	Path:   "/admin/cache/namespace",
+}
+
+// CacheNamespace is the namespace incorporated into every cache key (see KeyStorage). Bumping the generation
+// invalidates the entire cache instantly without deleting anything, the orphaned responses are never read again
+// (until evicted or purged). The generation is persisted in the storage backend so it survives restarts and is
+// shared by every replica using the same backend.
+type CacheNamespace struct {
+	// Base (optional) is the static namespace, ex: from --cache-namespace.
+	Base    string
+	Storage ghtransport.Storage
+
+	mu         sync.Mutex
+	generation atomic.Int64
+}
+
+// String returns the namespace of the cache keys, empty for the default namespace so existing keys are unchanged.
+func (n *CacheNamespace) String() string {
+	if n == nil {
+		return ""
+	}
+	var parts []string
+	if n.Base != "" {
+		parts = append(parts, n.Base)
+	}
+	if generation := n.generation.Load(); generation > 0 {
+		parts = append(parts, strconv.FormatInt(generation, 10))
+	}
+	return strings.Join(parts, ".")
+}
+
+// Generation returns the current generation of the namespace.
+func (n *CacheNamespace) Generation() int64 {
+	return n.generation.Load()
+}
+
+// observe adopts the generation if it is newer, generations never go backwards.
+func (n *CacheNamespace) observe(generation int64) {
+	for {
+		current := n.generation.Load()
+		if generation <= current {
+			return
+		}
+		if n.generation.CompareAndSwap(current, generation) {
+			CacheGeneration.Set(float64(generation))
+			log.Info().Int64("generation", generation).Msg("cache namespace changed")
+			return
+		}
+	}
+}
+
+// Load reads the persisted generation from the storage backend.
+func (n *CacheNamespace) Load(ctx context.Context) error {
+	resp, err := n.Storage.Get(ctx, &http.Request{Method: http.MethodGet, URL: NamespaceURL})
+	if err != nil {
+		return fmt.Errorf("(Storage).Get failed: %w", err)
+	}
+	if resp == nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+	}
+	generation, err := strconv.ParseInt(strings.TrimSpace(string(body)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("strconv.ParseInt failed: %w", err)
+	}
+	n.observe(generation)
+	return nil
+}
+
+// Bump increments (and persists) the generation, returning the new generation.
+func (n *CacheNamespace) Bump(ctx context.Context) (int64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// Another replica may have bumped the generation since it was last loaded.
+	if err := n.Load(ctx); err != nil {
+		return 0, fmt.Errorf("(*CacheNamespace).Load failed: %w", err)
+	}
+	generation := n.generation.Load() + 1
+	body := []byte(strconv.FormatInt(generation, 10))
+	if err := n.Storage.Put(ctx, &http.Response{
+		Status:     http.StatusText(http.StatusOK),
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": []string{"text/plain"},
+		},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       &http.Request{Method: http.MethodGet, URL: NamespaceURL},
+	}); err != nil {
+		return 0, fmt.Errorf("(Storage).Put failed: %w", err)
+	}
+	n.observe(generation)
+	return generation, nil
+}
+
+// Poll reloads the generation every interval until the context is cancelled, picking up bumps by other replicas.
+func (n *CacheNamespace) Poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := n.Load(ctx); err != nil {
+				log.Warn().Err(err).Msg("(*CacheNamespace).Load failed")
+			}
+		}
+	}
+}
+
+// ServeHTTP implements the /admin/cache/namespace API: GET returns the current namespace, POST bumps it.
+func (n *CacheNamespace) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		generation, err := n.Bump(req.Context())
+		if err != nil {
+			log.Error().Err(err).Msg("(*CacheNamespace).Bump failed")
+			WriteProxyError(w, http.StatusInternalServerError, ReasonInternal, "Failed to bump the cache namespace")
+			return
+		}
+		log.Warn().Int64("generation", generation).Msg("cache namespace bumped")
+	default:
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"namespace":  n.String(),
+		"generation": n.Generation(),
+	}); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
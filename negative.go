@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	NegativeCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "negative_cache_requests_total",
+		Subsystem: "github",
+		Help:      "Number of requests eligible for negative caching by result (hit, miss, bypass)",
+	}, []string{"result"})
+)
+
+// NegativeCacheHeader is the response header set on responses served from the negative cache.
+const NegativeCacheHeader = "X-Proxy-Negative-Cache"
+
+// CacheBypassHeader is the request header which (with any value) bypasses the negative cache, ex: to check if a
+// probed file was just created, and the cached result of a GraphQL query.
+const CacheBypassHeader = "X-Proxy-Cache-Bypass"
+
+// DefaultNegativeStatuses are the response statuses negatively cached by default.
+var DefaultNegativeStatuses = []int{
+	http.StatusNotFound,
+	http.StatusGone,
+}
+
+// negativeEntry is a single negatively cached response.
+type negativeEntry struct {
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// NegativeCacheTransport caches "negative" responses (404 and 410 by default) for a short TTL, they have no ETag so
+// are otherwise never cached and each repeated probe (ex: for an optional .github/CODEOWNERS) consumes rate-limit.
+// The responses are held in memory and keyed exactly as the cache (see KeyStorage), varied by the Authorization of
+// the request (if any) as the visibility of a resource depends on the credential.
+type NegativeCacheTransport struct {
+	Base http.RoundTripper
+	Keys *KeyStorage
+	TTL  time.Duration
+	// Statuses are the response statuses to cache, ex: DefaultNegativeStatuses.
+	Statuses []int
+
+	mu      sync.Mutex
+	entries map[string]*negativeEntry
+	swept   time.Time
+}
+
+// key returns the negative cache key of the request.
+func (t *NegativeCacheTransport) key(req *http.Request) string {
+	key := t.Keys.key(req).URL.String()
+	if authorization := req.Header.Get("Authorization"); authorization != "" {
+		key += "#" + ghtransport.HashToken(authorization)
+	}
+	return key
+}
+
+// load returns the unexpired entry for the key, if any.
+func (t *NegativeCacheTransport) load(key string, now time.Time) *negativeEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+// store saves the entry, sweeping the expired entries at most once per TTL.
+func (t *NegativeCacheTransport) store(key string, entry *negativeEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries == nil {
+		t.entries = make(map[string]*negativeEntry)
+	}
+	if entry.stored.Sub(t.swept) >= t.TTL {
+		for k, e := range t.entries {
+			if !entry.stored.Before(e.expires) {
+				delete(t.entries, k)
+			}
+		}
+		t.swept = entry.stored
+	}
+	t.entries[key] = entry
+}
+
+func (t *NegativeCacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.Base.RoundTrip(req)
+	}
+	if req.Header.Get(CacheBypassHeader) != "" {
+		NegativeCacheRequests.WithLabelValues("bypass").Inc()
+		req = req.Clone(req.Context())
+		req.Header.Del(CacheBypassHeader)
+		return t.Base.RoundTrip(req)
+	}
+	key := t.key(req)
+	now := time.Now()
+	if entry := t.load(key, now); entry != nil {
+		NegativeCacheRequests.WithLabelValues("hit").Inc()
+		header := entry.header.Clone()
+		header.Set(NegativeCacheHeader, "hit")
+		header.Set("Age", strconv.Itoa(int(now.Sub(entry.stored)/time.Second)))
+		// Mark the response as cached, ex: so it does not count against the quota of the tenant.
+		header[ghtransport.CachedRequestIDHeader] = header["X-Github-Request-Id"]
+		if len(header[ghtransport.CachedRequestIDHeader]) == 0 {
+			header.Set(ghtransport.CachedRequestIDHeader, "negative")
+		}
+		return &http.Response{
+			Status:        strconv.Itoa(entry.status) + " " + http.StatusText(entry.status),
+			StatusCode:    entry.status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(entry.body)),
+			ContentLength: int64(len(entry.body)),
+			Request:       req,
+		}, nil
+	}
+	NegativeCacheRequests.WithLabelValues("miss").Inc()
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || !slices.Contains(t.Statuses, resp.StatusCode) || resp.Header.Get(ProxyErrorHeader) != "" {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		return nil, fmt.Errorf("(*http.Response).Body.Close failed: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	t.store(key, &negativeEntry{
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    body,
+		stored:  now,
+		expires: now.Add(t.TTL),
+	})
+	return resp, nil
+}
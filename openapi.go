@@ -0,0 +1,287 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// openAPIMethods are the keys of an OpenAPI path item which are operations.
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// openAPIGreedy are the names of the path parameters which may contain slashes (ex: the {path} of the contents API),
+// matching all the remaining segments of a path if they are the last segment of an operation.
+var openAPIGreedy = []string{"{path}", "{ref}", "{basehead}"}
+
+// OpenAPISchema is the subset of a (JSON) schema of a parameter or response that is validated.
+type OpenAPISchema struct {
+	Ref string `json:"$ref"`
+	// Type is the type of the value, a list of types in OpenAPI 3.1 (where "null" replaces Nullable).
+	Type       any                       `json:"type"`
+	Nullable   bool                      `json:"nullable"`
+	Enum       []any                     `json:"enum"`
+	Minimum    *float64                  `json:"minimum"`
+	Maximum    *float64                  `json:"maximum"`
+	Properties map[string]*OpenAPISchema `json:"properties"`
+	Required   []string                  `json:"required"`
+	Items      *OpenAPISchema            `json:"items"`
+	AllOf      []*OpenAPISchema          `json:"allOf"`
+	AnyOf      []*OpenAPISchema          `json:"anyOf"`
+	OneOf      []*OpenAPISchema          `json:"oneOf"`
+}
+
+// types returns the types of the schema, including "null" if it is nullable.
+func (s *OpenAPISchema) types() []string {
+	var types []string
+	switch t := s.Type.(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, value := range t {
+			if name, ok := value.(string); ok {
+				types = append(types, name)
+			}
+		}
+	}
+	if s.Nullable && len(types) > 0 {
+		types = append(types, "null")
+	}
+	return types
+}
+
+// OpenAPIParameter is a (resolved) parameter of an operation.
+type OpenAPIParameter struct {
+	Ref      string        `json:"$ref"`
+	Name     string        `json:"name"`
+	In       string        `json:"in"`
+	Required bool          `json:"required"`
+	Schema   OpenAPISchema `json:"schema"`
+}
+
+// OpenAPIResponse is a (resolved) response of an operation, by media type.
+type OpenAPIResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema *OpenAPISchema `json:"schema"`
+	} `json:"content"`
+}
+
+// OpenAPIOperation is an operation of an OpenAPI description.
+type OpenAPIOperation struct {
+	ID         string                      `json:"operationId"`
+	Summary    string                      `json:"summary"`
+	Deprecated bool                        `json:"deprecated"`
+	Parameters []OpenAPIParameter          `json:"parameters"`
+	Responses  map[string]*OpenAPIResponse `json:"responses"`
+	Method     string                      `json:"-"`
+	Path       string                      `json:"-"`
+
+	segments []string
+}
+
+// Response returns the schema of the JSON responses of the operation with the status code, or nil if there is none.
+func (o *OpenAPIOperation) Response(statusCode int) *OpenAPISchema {
+	code := strconv.Itoa(statusCode)
+	for _, key := range []string{code, code[:1] + "XX", "default"} {
+		response, ok := o.Responses[key]
+		if !ok || response == nil {
+			continue
+		}
+		for media, content := range response.Content {
+			if strings.Contains(media, "json") && content.Schema != nil {
+				return content.Schema
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// OpenAPISpec is the subset of an OpenAPI description (ex: the api.github.com.json of
+// https://github.com/github/rest-api-description) the traffic is mapped onto and validated against.
+type OpenAPISpec struct {
+	Title      string
+	Version    string
+	Operations []*OpenAPIOperation
+	// Schemas are the components the $ref of the schemas point to, by name.
+	Schemas map[string]*OpenAPISchema
+}
+
+// Resolve returns the schema the $ref of the schema points to (if any), or nil if it does not exist.
+func (s *OpenAPISpec) Resolve(schema *OpenAPISchema) *OpenAPISchema {
+	for range 32 { // A (broken) description may $ref itself
+		if schema == nil || schema.Ref == "" {
+			return schema
+		}
+		name, _ := strings.CutPrefix(schema.Ref, "#/components/schemas/")
+		schema = s.Schemas[name]
+	}
+	return nil
+}
+
+// LoadOpenAPISpec loads the OpenAPI description (JSON or YAML) from the file or http(s) URL.
+func LoadOpenAPISpec(ctx context.Context, location string) (*OpenAPISpec, error) {
+	var b []byte
+	if strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "http://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, fmt.Errorf("http.NewRequestWithContext failed: %w", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("(*http.Client).Do failed: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		if b, err = io.ReadAll(resp.Body); err != nil {
+			return nil, fmt.Errorf("io.ReadAll failed: %w", err)
+		}
+	} else {
+		var err error
+		if b, err = os.ReadFile(location); err != nil {
+			return nil, fmt.Errorf("os.ReadFile failed: %w", err)
+		}
+	}
+	// The YAML descriptions are converted to JSON, the (much larger) JSON descriptions are decoded as is.
+	if !json.Valid(b) {
+		var doc any
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return nil, fmt.Errorf("yaml.Unmarshal failed: %w", err)
+		}
+		var err error
+		if b, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("json.Marshal failed: %w", err)
+		}
+	}
+
+	var doc struct {
+		Info       struct{ Title, Version string }
+		Paths      map[string]map[string]json.RawMessage
+		Components struct {
+			Parameters map[string]OpenAPIParameter
+			Responses  map[string]*OpenAPIResponse
+			Schemas    map[string]*OpenAPISchema
+		}
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed: %w", err)
+	}
+	resolve := func(parameters []OpenAPIParameter) []OpenAPIParameter {
+		for idx, parameter := range parameters {
+			if name, ok := strings.CutPrefix(parameter.Ref, "#/components/parameters/"); ok {
+				parameters[idx] = doc.Components.Parameters[name]
+			}
+		}
+		return parameters
+	}
+	spec := &OpenAPISpec{Title: doc.Info.Title, Version: doc.Info.Version, Schemas: doc.Components.Schemas}
+	for path, item := range doc.Paths {
+		// The parameters of the path item apply to each of its operations (unless overridden).
+		var shared []OpenAPIParameter
+		if raw, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(raw, &shared); err != nil {
+				return nil, fmt.Errorf("json.Unmarshal of the parameters of %s failed: %w", path, err)
+			}
+			shared = resolve(shared)
+		}
+		for _, method := range openAPIMethods {
+			raw, ok := item[method]
+			if !ok {
+				continue
+			}
+			operation := &OpenAPIOperation{Method: strings.ToUpper(method), Path: path}
+			if err := json.Unmarshal(raw, operation); err != nil {
+				return nil, fmt.Errorf("json.Unmarshal of %s %s failed: %w", method, path, err)
+			}
+			operation.Parameters = resolve(operation.Parameters)
+			for code, response := range operation.Responses {
+				if name, ok := strings.CutPrefix(response.Ref, "#/components/responses/"); response != nil && ok {
+					operation.Responses[code] = doc.Components.Responses[name]
+				}
+			}
+			for _, parameter := range shared {
+				if !slices.ContainsFunc(operation.Parameters, func(p OpenAPIParameter) bool { return p.Name == parameter.Name && p.In == parameter.In }) {
+					operation.Parameters = append(operation.Parameters, parameter)
+				}
+			}
+			operation.segments = strings.Split(strings.Trim(path, "/"), "/")
+			spec.Operations = append(spec.Operations, operation)
+		}
+	}
+	if len(spec.Operations) == 0 {
+		return nil, fmt.Errorf("no operations found in %q", location)
+	}
+	slices.SortFunc(spec.Operations, func(a, b *OpenAPIOperation) int {
+		return cmp.Or(strings.Compare(a.Path, b.Path), strings.Compare(a.Method, b.Method))
+	})
+	return spec, nil
+}
+
+// match returns the number of literal segments of the operation matching the segments of a path (or route), -1 if
+// it does not match. The variables match any segment (and a greedy last variable all the remaining segments).
+func (o *OpenAPIOperation) match(segments []string) int {
+	greedy := slices.Contains(openAPIGreedy, o.segments[len(o.segments)-1])
+	if len(segments) != len(o.segments) && (!greedy || len(segments) < len(o.segments)) {
+		return -1
+	}
+	literals := 0
+	for idx, segment := range o.segments {
+		if strings.HasPrefix(segment, "{") {
+			continue
+		}
+		if segment != segments[idx] {
+			return -1
+		}
+		literals++
+	}
+	return literals
+}
+
+// openAPISegments returns the segments of the path (or route), without the /api/v3 prefix of GitHub Enterprise Server.
+func openAPISegments(path string) []string {
+	return strings.Split(strings.Trim(strings.TrimPrefix(path, "/api/v3"), "/"), "/")
+}
+
+// Lookup returns the operation of the method and path (or route, see RouteTemplate) and the methods of the path,
+// the operation is nil if there is none. If several operations match the one with the most literal segments wins
+// (ex: /repos/{owner}/{repo}/pulls/comments over /repos/{owner}/{repo}/pulls/{pull_number}).
+func (s *OpenAPISpec) Lookup(method string, path string) (*OpenAPIOperation, []string) {
+	segments := openAPISegments(path)
+	var best *OpenAPIOperation
+	bestLiterals := -1
+	var methods []string
+	var pathLiterals int
+	for _, operation := range s.Operations {
+		literals := operation.match(segments)
+		if literals < 0 {
+			continue
+		}
+		if len(methods) == 0 || literals > pathLiterals {
+			methods, pathLiterals = nil, literals
+		}
+		if literals == pathLiterals && !slices.Contains(methods, operation.Method) {
+			methods = append(methods, operation.Method)
+		}
+		if operation.Method == method && literals > bestLiterals {
+			best, bestLiterals = operation, literals
+		}
+	}
+	return best, methods
+}
+
+// Match returns the operation of the method and path (or route), or nil if there is none (see Lookup).
+func (s *OpenAPISpec) Match(method string, path string) *OpenAPIOperation {
+	operation, _ := s.Lookup(method, path)
+	return operation
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	CredentialOverrides = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "credential_overrides_total",
+		Subsystem: "github",
+		Help:      "Number of requests pinning their credential by grant and result (pinned, denied, unknown_credential)",
+	}, []string{"grant", "result"})
+)
+
+// CredentialHeader is the request header pinning the request to the credential with the ID, bypassing the balancing
+// of the pool. It is only honored if a CredentialGrant of the OverridePolicy allows it.
+const CredentialHeader = "X-Proxy-Credential"
+
+// CredentialTokenHeader is the request header carrying the secret token authenticating a CredentialHeader.
+const CredentialTokenHeader = "X-Proxy-Credential-Token"
+
+// CredentialGrant allows the inbound clients matching all of its (set) conditions to pin the credentials matching its
+// Credentials, a grant must at least be authenticated by a token or the source network.
+type CredentialGrant struct {
+	// Name identifies the grant in the metric labels and logs.
+	Name string `json:"name"`
+	// Tokens are the hex-encoded SHA-256 hashes of the tokens, one of which the CredentialTokenHeader must carry.
+	Tokens []string `json:"token_sha256,omitempty"`
+	// CIDRs match the remote address of the inbound client.
+	CIDRs []string `json:"cidrs,omitempty"`
+	// Clients are path.Match patterns matched against the inbound client identity (see ClientHeader).
+	Clients []string `json:"clients,omitempty"`
+	// Credentials are path.Match patterns matched against the pinned credential ID, ex: "12345:*" for every
+	// installation of a GitHub App.
+	Credentials []string `json:"credentials"`
+
+	prefixes []netip.Prefix
+	hashes   [][]byte
+}
+
+// covers reports if the credential matches the Credentials of the grant.
+func (g *CredentialGrant) covers(credential string) bool {
+	return slices.ContainsFunc(g.Credentials, func(pattern string) bool {
+		ok, _ := path.Match(pattern, credential)
+		return ok
+	})
+}
+
+// allows reports if the grant allows the inbound client to pin the credential.
+func (g *CredentialGrant) allows(req *http.Request, token string, credential string) bool {
+	if !g.covers(credential) {
+		return false
+	}
+	if len(g.hashes) > 0 {
+		hash := sha256.Sum256([]byte(token))
+		if token == "" || !slices.ContainsFunc(g.hashes, func(h []byte) bool { return subtle.ConstantTimeCompare(h, hash[:]) == 1 }) {
+			return false
+		}
+	}
+	if len(g.prefixes) > 0 {
+		addr, ok := remoteAddr(req)
+		if !ok || !slices.ContainsFunc(g.prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+			return false
+		}
+	}
+	if len(g.Clients) > 0 {
+		client := ClientFromContext(req.Context())
+		if !slices.ContainsFunc(g.Clients, func(pattern string) bool {
+			ok, _ := path.Match(pattern, client)
+			return ok
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// OverridePolicy is the configuration of the grants allowing trusted clients to pin the credential of their requests,
+// loaded from a JSON file.
+type OverridePolicy struct {
+	Grants []*CredentialGrant `json:"grants"`
+}
+
+// LoadOverridePolicy loads the grants from the JSON file.
+func LoadOverridePolicy(file string) (*OverridePolicy, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile failed: %w", err)
+	}
+	var policy OverridePolicy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed: %w", err)
+	}
+	names := make(map[string]bool, len(policy.Grants))
+	for _, grant := range policy.Grants {
+		if grant.Name == "" || names[grant.Name] {
+			return nil, fmt.Errorf("grant names must be unique and non-empty: %q", grant.Name)
+		}
+		names[grant.Name] = true
+		if len(grant.Tokens) == 0 && len(grant.CIDRs) == 0 {
+			return nil, fmt.Errorf("grant %q must be authenticated by token_sha256 or cidrs", grant.Name)
+		}
+		if len(grant.Credentials) == 0 {
+			return nil, fmt.Errorf("grant %q does not allow any credentials", grant.Name)
+		}
+		for _, pattern := range slices.Concat(grant.Clients, grant.Credentials) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q of grant %q: %w", pattern, grant.Name, err)
+			}
+		}
+		for _, token := range grant.Tokens {
+			hash, err := hex.DecodeString(token)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid token_sha256 %q of grant %q, expected a hex-encoded SHA-256", token, grant.Name)
+			}
+			grant.hashes = append(grant.hashes, hash)
+		}
+		prefixes, err := ParseCIDRs(grant.CIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("ParseCIDRs of grant %q failed: %w", grant.Name, err)
+		}
+		grant.prefixes = prefixes
+	}
+	return &policy, nil
+}
+
+// Grant returns the first grant allowing the inbound client to pin the credential, or nil if none does.
+func (p *OverridePolicy) Grant(req *http.Request, token string, credential string) *CredentialGrant {
+	if p == nil {
+		return nil
+	}
+	for _, grant := range p.Grants {
+		if grant.allows(req, token, credential) {
+			return grant
+		}
+	}
+	return nil
+}
+
+type credentialKey struct{}
+
+// WithCredential returns a copy of the context pinning the request to the credential with the ID.
+func WithCredential(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, credentialKey{}, id)
+}
+
+// CredentialFromContext returns the ID of the credential the request is pinned to, if any.
+func CredentialFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(credentialKey{}).(string)
+	return id
+}
+
+// CredentialOverrideHandler pins the requests with a CredentialHeader allowed by the Policy (see CredentialPool),
+// rejecting the others with a 403 rather than silently balancing them. The headers are always stripped, so the token
+// never reaches the upstream (even without a Policy, where every override is rejected). The credential must be in
+// the Pool, and in the credential subset of the tenant of the request (if any).
+type CredentialOverrideHandler struct {
+	Handler http.Handler
+	Policy  *OverridePolicy
+	Pool    *CredentialPool
+}
+
+func (h *CredentialOverrideHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id, token := req.Header.Get(CredentialHeader), req.Header.Get(CredentialTokenHeader)
+	req.Header.Del(CredentialHeader)
+	req.Header.Del(CredentialTokenHeader)
+	if id == "" {
+		h.Handler.ServeHTTP(w, req)
+		return
+	}
+	grant := h.Policy.Grant(req, token, id)
+	if tenant := TenantFromContext(req.Context()); grant != nil && tenant != nil && len(tenant.Credentials) > 0 && !slices.Contains(tenant.Credentials, id) {
+		grant = nil
+	}
+	if grant == nil {
+		CredentialOverrides.WithLabelValues("", "denied").Inc()
+		WriteProxyError(w, http.StatusForbidden, ReasonOverrideDenied, "The client is not allowed to pin the credential")
+		return
+	}
+	if h.Pool.Get(id) == nil {
+		CredentialOverrides.WithLabelValues(grant.Name, ReasonUnknownCredential).Inc()
+		WriteProxyError(w, http.StatusBadRequest, ReasonUnknownCredential, "The pinned credential is not in the pool of the proxy")
+		return
+	}
+	CredentialOverrides.WithLabelValues(grant.Name, "pinned").Inc()
+	h.Handler.ServeHTTP(w, req.WithContext(WithCredential(req.Context(), id)))
+}
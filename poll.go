@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/url"
+	"time"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// RateLimitPolls counts the scheduled /rate_limit polls by result.
+var RateLimitPolls = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:      "rate_limit_polls_total",
+		Help:      "Scheduled rate limit polls by result (fetched, failed, skipped, exhausted, follower)",
+		Subsystem: "github",
+	},
+	[]string{"result"},
+)
+
+// jittered returns the duration randomly adjusted by up to +/- the jitter fraction (at most 1).
+func jittered(d time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	jitter = min(jitter, 1)
+	return time.Duration(float64(d) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+// exhausted returns the time the core rate-limit of the credential resets if it currently has no remaining quota.
+func exhausted(credential *Credential) (time.Time, bool) {
+	rate := credential.Transport.Limits.Load(ghratelimit.ResourceCore)
+	if rate == nil || rate.Remaining > 0 {
+		return time.Time{}, false
+	}
+	reset := time.Unix(int64(rate.Reset), 0)
+	return reset, reset.After(UpstreamNow())
+}
+
+// pollCredential fetches the rate-limits of the credential, returning the delay until it should be polled again.
+// Polling is skipped if the rate-limits were updated by the headers of proxied traffic since the last poll (fetched)
+// and within the interval, and while the credential is exhausted, as nothing will change until the reset.
+func pollCredential(ctx context.Context, credential *Credential, interval time.Duration, jitter float64, u *url.URL, leader *Leader, fetched *time.Time) time.Duration {
+	if leader != nil && !leader.IsLeader() {
+		RateLimitPolls.WithLabelValues("follower").Inc()
+		return jittered(interval, jitter)
+	}
+	if reset, ok := exhausted(credential); ok {
+		RateLimitPolls.WithLabelValues("exhausted").Inc()
+		// Poll shortly after the reset (rather than exactly on it) to pick up the new window.
+		return reset.Sub(UpstreamNow()) + jittered(interval, jitter)/4
+	}
+	if updated := credential.Updated(); updated.After(*fetched) && time.Since(updated) < interval {
+		RateLimitPolls.WithLabelValues("skipped").Inc()
+		return jittered(interval-time.Since(updated), jitter)
+	}
+	if err := credential.Transport.Limits.Fetch(ctx, credential.Transport, u); err != nil {
+		RateLimitPolls.WithLabelValues("failed").Inc()
+		log.Error().Err(err).Str("credential", credential.ID).Msg("(*ghratelimit.Limits).Fetch failed")
+		return jittered(interval, jitter)
+	}
+	RateLimitPolls.WithLabelValues("fetched").Inc()
+	*fetched = credential.Updated()
+	return jittered(interval, jitter)
+}
+
+// PollCredential fetches the rate-limits of the credential each interval until the context is cancelled.
+// The interval is randomly adjusted by up to +/- the jitter fraction, so the polls of many credentials (and replicas)
+// spread out rather than arriving at the upstream in bursts.
+// If a leader is provided, only the elected leader polls, the other replicas consume the shared results.
+func PollCredential(ctx context.Context, credential *Credential, interval time.Duration, jitter float64, u *url.URL, leader *Leader) {
+	// Stagger the first poll across the jitter, credentials validated at startup are skipped as already updated.
+	var fetched time.Time
+	timer := time.NewTimer(time.Duration(float64(interval) * jitter * rand.Float64()))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(pollCredential(ctx, credential, interval, jitter, u, leader, &fetched))
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+)
+
+var (
+	// ErrCredentialExists is returned when adding a credential whose ID is already in the pool.
+	ErrCredentialExists = errors.New("credential already exists")
+	// ErrCredentialNotFound is returned when removing a credential that is not in the pool.
+	ErrCredentialNotFound = errors.New("credential not found")
+	// ErrLastCredential is returned when removing the only credential in the pool.
+	ErrLastCredential = errors.New("cannot remove the last credential")
+)
+
+// poolSnapshot is an immutable view of the credentials in a CredentialPool.
+type poolSnapshot struct {
+	credentials []*Credential
+	balancing   ghratelimit.BalancingTransport
+}
+
+// CredentialPool balances requests across a set of credentials that can be added and removed at runtime.
+type CredentialPool struct {
+	// Setup (optional) is called for each credential before it joins the pool, ex: to wrap the transport or start
+	// polling the rate-limits. The context is cancelled once the credential is removed.
+	Setup func(ctx context.Context, credential *Credential)
+	// Affinity (optional) makes the requests of a session stick to one credential.
+	Affinity *Affinity
+
+	ctx      context.Context
+	mu       sync.Mutex
+	cancels  map[*Credential]context.CancelFunc
+	snapshot atomic.Pointer[poolSnapshot]
+}
+
+// NewCredentialPool returns an empty CredentialPool, the context bounds the lifetime of every credential.
+func NewCredentialPool(ctx context.Context, setup func(ctx context.Context, credential *Credential)) *CredentialPool {
+	p := &CredentialPool{
+		Setup:   setup,
+		ctx:     ctx,
+		cancels: make(map[*Credential]context.CancelFunc),
+	}
+	p.snapshot.Store(&poolSnapshot{})
+	return p
+}
+
+// Credentials returns the credentials currently in the pool, the returned slice must not be modified.
+func (p *CredentialPool) Credentials() []*Credential {
+	if p == nil {
+		return nil
+	}
+	return p.snapshot.Load().credentials
+}
+
+// Get returns the credential with the ID, or nil if it is not in the pool.
+func (p *CredentialPool) Get(id string) *Credential {
+	for _, credential := range p.Credentials() {
+		if credential.ID == id {
+			return credential
+		}
+	}
+	return nil
+}
+
+// store publishes the (locked) credentials as the current snapshot.
+func (p *CredentialPool) store(credentials []*Credential) {
+	snapshot := &poolSnapshot{credentials: credentials}
+	for _, credential := range credentials {
+		snapshot.balancing = append(snapshot.balancing, credential.Transport)
+	}
+	p.snapshot.Store(snapshot)
+}
+
+// Add sets up the credentials and adds them to the pool, none are added if any ID is already in the pool.
+func (p *CredentialPool) Add(credentials ...*Credential) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current := p.snapshot.Load().credentials
+	for idx, credential := range credentials {
+		if p.Get(credential.ID) != nil || slices.ContainsFunc(credentials[:idx], func(c *Credential) bool { return c.ID == credential.ID }) {
+			return fmt.Errorf("%w: %s", ErrCredentialExists, credential.ID)
+		}
+	}
+	for _, credential := range credentials {
+		ctx, cancel := context.WithCancel(p.ctx)
+		p.cancels[credential] = cancel
+		if p.Setup != nil {
+			p.Setup(ctx, credential)
+		}
+	}
+	p.store(slices.Concat(current, credentials))
+	return nil
+}
+
+// Remove removes the credential with the ID from the pool, in-flight requests using it are unaffected.
+func (p *CredentialPool) Remove(id string) (*Credential, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current := p.snapshot.Load().credentials
+	idx := slices.IndexFunc(current, func(c *Credential) bool { return c.ID == id })
+	if idx < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrCredentialNotFound, id)
+	}
+	if len(current) == 1 {
+		return nil, ErrLastCredential
+	}
+	credential := current[idx]
+	p.store(slices.Delete(slices.Clone(current), idx, idx+1))
+	p.cancels[credential]()
+	delete(p.cancels, credential)
+	return credential, nil
+}
+
+func (p *CredentialPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	snapshot := p.snapshot.Load()
+	var session string
+	if p.Affinity != nil {
+		session, req = p.Affinity.Session(req)
+	}
+	// A request pinned to a credential (see CredentialOverrideHandler) is not balanced at all.
+	if id := CredentialFromContext(req.Context()); id != "" {
+		idx := slices.IndexFunc(snapshot.credentials, func(c *Credential) bool { return c.ID == id })
+		if idx < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrCredentialNotFound, id)
+		}
+		return snapshot.credentials[idx].Transport.RoundTrip(req)
+	}
+	credentials, balancing, err := candidates(snapshot, req)
+	if err != nil {
+		return nil, err
+	}
+	if p.Affinity != nil {
+		if credential := p.Affinity.Pick(session, req, credentials); credential != nil {
+			return credential.Transport.RoundTrip(req)
+		}
+	}
+	return balancing.RoundTrip(req)
+}
+
+// candidates returns the credentials of the snapshot the request may be balanced across.
+func candidates(snapshot *poolSnapshot, req *http.Request) ([]*Credential, ghratelimit.BalancingTransport, error) {
+	// Only balance across the credential subset of the request's tenant (if any).
+	tenant := TenantFromContext(req.Context())
+	if tenant == nil || len(tenant.Credentials) == 0 {
+		return snapshot.credentials, snapshot.balancing, nil
+	}
+	var credentials []*Credential
+	var balancing ghratelimit.BalancingTransport
+	for _, credential := range snapshot.credentials {
+		if slices.Contains(tenant.Credentials, credential.ID) {
+			credentials = append(credentials, credential)
+			balancing = append(balancing, credential.Transport)
+		}
+	}
+	if len(balancing) == 0 {
+		return nil, nil, fmt.Errorf("none of the credentials of tenant %q are in the pool", tenant.Name)
+	}
+	return credentials, balancing, nil
+}
+
+// Best returns the credential with the highest remaining quota for the request (among the credentials of its tenant,
+// except the excluded ones), or nil if there is none.
+func (p *CredentialPool) Best(req *http.Request, exclude ...string) *Credential {
+	credentials, _, err := candidates(p.snapshot.Load(), req)
+	if len(exclude) > 0 {
+		credentials = slices.DeleteFunc(slices.Clone(credentials), func(c *Credential) bool { return slices.Contains(exclude, c.ID) })
+	}
+	resource := ghratelimit.InferResource(req)
+	if err != nil || resource == "" || len(credentials) == 0 {
+		return nil
+	}
+	return best(credentials, resource)
+}
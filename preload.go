@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	CachePreloadProgress = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "cache_preload_progress",
+		Subsystem: "github",
+		Help:      "Fraction of the BoltDB file read into the page cache by --bbolt-preload, 1 once complete",
+	})
+)
+
+// preloadChunk is the size of each sequential read of PreloadFile.
+const preloadChunk = 1 << 20
+
+// PreloadFile reads the file sequentially into the page cache until complete or the context is cancelled. The page
+// cache backs the memory map of BoltDB (its index and values), so the first lookups after a cold start are not each
+// penalized by a random read of the disk.
+func PreloadFile(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("os.Open failed: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("(*os.File).Stat failed: %w", err)
+	}
+	buf := make([]byte, preloadChunk)
+	var read int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := f.Read(buf)
+		read += int64(n)
+		if size := info.Size(); size > 0 {
+			CachePreloadProgress.Set(min(float64(read)/float64(size), 1))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("(*os.File).Read failed: %w", err)
+		}
+	}
+	CachePreloadProgress.Set(1)
+	return nil
+}
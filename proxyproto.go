@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ProxyProtocolConns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "proxy_protocol_connections_total",
+		Subsystem: "github",
+		Help:      "Number of inbound connections by PROXY protocol result (proxied, local, untrusted, rejected)",
+	}, []string{"result"})
+)
+
+// proxyV2Signature begins every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// DefaultProxyHeaderTimeout is the time a connection has to send its PROXY protocol header.
+const DefaultProxyHeaderTimeout = 10 * time.Second
+
+// readProxyV1 parses the (human-readable) v1 header, ex: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n". The
+// source address is nil for the UNKNOWN protocol.
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("(*bufio.Reader).ReadSlice failed: %w", err)
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 source address: %w", err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 source port: %w", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// readProxyV2 parses the binary v2 header, the source address is nil for the LOCAL command (ex: health checks of the
+// load balancer itself) and for protocols other than TCP over IPv4 or IPv6.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("io.ReadFull failed: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("io.ReadFull failed: %w", err)
+	}
+	switch header[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", header[12]&0x0f)
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("truncated PROXY protocol v2 IPv4 addresses")
+		}
+		addr := netip.AddrFrom4([4]byte(payload[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[8:10]))), nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("truncated PROXY protocol v2 IPv6 addresses")
+		}
+		addr := netip.AddrFrom16([16]byte(payload[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[32:34]))), nil
+	}
+	return nil, nil
+}
+
+// ReadProxyHeader reads the PROXY protocol (v1 or v2) header, returning the source address of the original client.
+// The address is nil if the header does not carry one (ex: the LOCAL command).
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(peek, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if peek, err := r.Peek(6); err != nil || string(peek) != "PROXY " {
+		return nil, errors.New("missing PROXY protocol header")
+	}
+	return readProxyV1(r)
+}
+
+// proxyConn is a connection whose PROXY protocol header was read, the buffered reader holds any data after it.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ProxyListener reads the PROXY protocol header of every accepted connection so the RemoteAddr is that of the
+// original client (ex: behind an L4 load balancer), and the logging, ACLs and per-IP limits apply to it. The headers
+// are read concurrently so a slow connection never blocks the others from being accepted.
+type ProxyListener struct {
+	net.Listener
+	// Trusted (optional) are the sources (ex: the load balancers) allowed to send a header, connections from other
+	// sources are served as-is. If empty, every connection must send a header.
+	Trusted []netip.Prefix
+	// Timeout is the time a connection has to send the header, DefaultProxyHeaderTimeout if zero.
+	Timeout time.Duration
+
+	accepted chan net.Conn
+	done     chan struct{}
+	err      error
+}
+
+// NewProxyListener wraps the listener, reading the PROXY protocol headers from the trusted sources.
+func NewProxyListener(l net.Listener, trusted []netip.Prefix, timeout time.Duration) *ProxyListener {
+	pl := &ProxyListener{
+		Listener: l,
+		Trusted:  trusted,
+		Timeout:  cmp.Or(timeout, DefaultProxyHeaderTimeout),
+		accepted: make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go pl.accept()
+	return pl
+}
+
+// trusted reports if the connection may send a PROXY protocol header.
+func (l *ProxyListener) trusted(conn net.Conn) bool {
+	if len(l.Trusted) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	for _, prefix := range l.Trusted {
+		if prefix.Contains(addr.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept accepts the connections of the listener, reading each header in its own goroutine.
+func (l *ProxyListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake reads the header of the connection, closing it if the header is invalid (or not sent in time).
+func (l *ProxyListener) handshake(conn net.Conn) {
+	if !l.trusted(conn) {
+		ProxyProtocolConns.WithLabelValues("untrusted").Inc()
+		l.deliver(conn)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(l.Timeout))
+	r := bufio.NewReader(conn)
+	remote, err := ReadProxyHeader(r)
+	if err != nil {
+		ProxyProtocolConns.WithLabelValues("rejected").Inc()
+		log.Warn().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("ReadProxyHeader failed")
+		conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if remote == nil {
+		ProxyProtocolConns.WithLabelValues("local").Inc()
+		remote = conn.RemoteAddr()
+	} else {
+		ProxyProtocolConns.WithLabelValues("proxied").Inc()
+	}
+	l.deliver(&proxyConn{Conn: conn, r: r, remote: remote})
+}
+
+// deliver hands the connection to Accept, closing it if the listener was closed in the meantime.
+func (l *ProxyListener) deliver(conn net.Conn) {
+	select {
+	case l.accepted <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	bboltstorage "github.com/bored-engineer/github-conditional-http-transport/bbolt"
+	"github.com/bored-engineer/github-conditional-http-transport/memory"
+	pebblestorage "github.com/bored-engineer/github-conditional-http-transport/pebble"
+	redisstorage "github.com/bored-engineer/github-conditional-http-transport/redis"
+	s3storage "github.com/bored-engineer/github-conditional-http-transport/s3"
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+)
+
+// upperBound returns the smallest key greater than every key with the prefix.
+func upperBound(prefix []byte) []byte {
+	upper := bytes.Clone(prefix)
+	for i := len(upper) - 1; i >= 0; i-- {
+		if upper[i] < 0xff {
+			upper[i]++
+			return upper[:i+1]
+		}
+	}
+	return nil // The prefix is all 0xff, there is no upper bound
+}
+
+// globEscaper escapes the Redis glob-style pattern special characters.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// PurgeStorage deletes every cached response whose URL begins with the prefix, returning the number deleted.
+func PurgeStorage(ctx context.Context, storage ghtransport.Storage, prefix string) (int, error) {
+	return purgeStorage(ctx, storage, prefix, nil)
+}
+
+// pathBoundary reports if the remainder of a key after a path prefix is the same path (with any query or partition)
+// or a path under it, ex: "/comments" or "?page=2" but not "0" for the path /issues/1.
+func pathBoundary(rest string) bool {
+	return rest == "" || rest[0] == '/' || rest[0] == '?' || rest[0] == '#'
+}
+
+// PurgePath deletes every cached response of the URL (ignoring its query) and of the URLs under its path, returning
+// the number deleted.
+func PurgePath(ctx context.Context, storage ghtransport.Storage, u *url.URL) (int, error) {
+	prefix := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: strings.TrimSuffix(u.Path, "/"), RawPath: strings.TrimSuffix(u.RawPath, "/")}).String()
+	return purgeStorage(ctx, storage, prefix, pathBoundary)
+}
+
+// purgeStorage deletes the cached responses whose URL begins with the prefix, if match (optional) reports true for
+// the remainder of the key after the prefix.
+func purgeStorage(ctx context.Context, storage ghtransport.Storage, prefix string, match func(rest string) bool) (int, error) {
+	if match == nil {
+		match = func(string) bool { return true }
+	}
+	switch s := storage.(type) {
+	case *KeyStorage:
+		return purgeStorage(ctx, s.Storage, prefix, match)
+	case *ScrubStorage:
+		return purgeStorage(ctx, s.Storage, prefix, match)
+	case *StreamingStorage:
+		return purgeStorage(ctx, s.Storage, prefix, match)
+	case *EncryptedStorage:
+		return purgeStorage(ctx, s.Storage, prefix, match)
+	case *BreakerStorage:
+		return purgeStorage(ctx, s.Storage, prefix, match)
+	case *ReplicatedStorage:
+		return purgeStorage(ctx, s.Local, prefix, match)
+	case *MeshStorage:
+		return purgeStorage(ctx, s.Local, prefix, match)
+	case *TieredStorage:
+		if _, err := purgeStorage(ctx, s.Local, prefix, match); err != nil {
+			return 0, err
+		}
+		return purgeStorage(ctx, s.Shared, prefix, match)
+	case *MemoryStorage:
+		return s.DeletePrefix(prefix, match), nil
+	case *memory.Storage:
+		var purged int
+		s.Map.Range(func(key, value any) bool {
+			if k, ok := key.(string); ok && strings.HasPrefix(k, prefix) && match(k[len(prefix):]) {
+				s.Map.Delete(key)
+				purged++
+			}
+			return true
+		})
+		return purged, nil
+	case *bboltstorage.Storage:
+		var purged int
+		if err := s.DB.Update(func(tx *bbolt.Tx) error {
+			bucket := tx.Bucket(s.Bucket)
+			if bucket == nil {
+				return nil
+			}
+			// Deleting while iterating a bbolt cursor skips keys, so collect them first.
+			var keys [][]byte
+			cursor := bucket.Cursor()
+			for key, _ := cursor.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, _ = cursor.Next() {
+				if match(string(key[len(prefix):])) {
+					keys = append(keys, bytes.Clone(key))
+				}
+			}
+			for _, key := range keys {
+				if err := bucket.Delete(key); err != nil {
+					return fmt.Errorf("(*bbolt.Bucket).Delete failed: %w", err)
+				}
+			}
+			purged = len(keys)
+			return nil
+		}); err != nil {
+			return 0, fmt.Errorf("(*bbolt.DB).Update failed: %w", err)
+		}
+		return purged, nil
+	case *pebblestorage.Storage:
+		iter, err := s.DB.NewIter(&pebble.IterOptions{
+			LowerBound: []byte(prefix),
+			UpperBound: upperBound([]byte(prefix)),
+		})
+		if err != nil {
+			return 0, fmt.Errorf("(*pebble.DB).NewIter failed: %w", err)
+		}
+		batch := s.DB.NewBatch()
+		defer batch.Close()
+		var purged int
+		for iter.First(); iter.Valid(); iter.Next() {
+			if !match(string(iter.Key()[len(prefix):])) {
+				continue
+			}
+			if err := batch.Delete(iter.Key(), nil); err != nil {
+				iter.Close()
+				return 0, fmt.Errorf("(*pebble.Batch).Delete failed: %w", err)
+			}
+			purged++
+		}
+		if err := iter.Close(); err != nil {
+			return 0, fmt.Errorf("(*pebble.Iterator).Close failed: %w", err)
+		}
+		if err := batch.Commit(pebble.Sync); err != nil {
+			return 0, fmt.Errorf("(*pebble.Batch).Commit failed: %w", err)
+		}
+		return purged, nil
+	case *redisstorage.Storage:
+		key := strings.TrimPrefix(prefix, "https://")
+		var purged int
+		iter := s.Client.Scan(ctx, 0, globEscaper.Replace(key)+"*", 1000).Iterator()
+		var keys []string
+		flush := func() error {
+			if len(keys) == 0 {
+				return nil
+			}
+			n, err := s.Client.Del(ctx, keys...).Result()
+			if err != nil {
+				return fmt.Errorf("(*redis.Client).Del failed: %w", err)
+			}
+			purged += int(n)
+			keys = keys[:0]
+			return nil
+		}
+		for iter.Next(ctx) {
+			if !match(strings.TrimPrefix(iter.Val(), key)) {
+				continue
+			}
+			if keys = append(keys, iter.Val()); len(keys) >= 1000 {
+				if err := flush(); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return 0, fmt.Errorf("(*redis.ScanIterator).Err: %w", err)
+		}
+		if err := flush(); err != nil {
+			return 0, err
+		}
+		return purged, nil
+	case *HashedS3Storage:
+		purged, err := purgeStorage(ctx, s.Storage, prefix, match)
+		if err != nil {
+			return 0, err
+		}
+		hashed, err := purgeHashedS3(ctx, s, prefix, match)
+		return purged + hashed, err
+	case *s3storage.Storage:
+		key := strings.TrimPrefix(prefix, "https://")
+		keyPrefix := path.Join(s.Prefix, key)
+		if strings.HasSuffix(key, "/") {
+			keyPrefix += "/" // path.Join strips the trailing slash
+		}
+		var purged int
+		paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.Bucket),
+			Prefix: aws.String(keyPrefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return 0, fmt.Errorf("(*s3.ListObjectsV2Paginator).NextPage failed: %w", err)
+			}
+			if len(page.Contents) == 0 {
+				continue
+			}
+			objects := make([]types.ObjectIdentifier, 0, len(page.Contents))
+			for _, object := range page.Contents {
+				if match(strings.TrimPrefix(aws.ToString(object.Key), keyPrefix)) {
+					objects = append(objects, types.ObjectIdentifier{Key: object.Key})
+				}
+			}
+			if len(objects) == 0 {
+				continue
+			}
+			if _, err := s.Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+				Bucket: aws.String(s.Bucket),
+				Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			}); err != nil {
+				return 0, fmt.Errorf("(*s3.Client).DeleteObjects failed: %w", err)
+			}
+			purged += len(objects)
+		}
+		return purged, nil
+	default:
+		return 0, fmt.Errorf("purging is not supported by %T", storage)
+	}
+}
+
+// purgeHashedS3 deletes the responses stored at a hashed key (and the objects storing their URL) whose URL begins with
+// the prefix, reading the URL of every hashed key.
+func purgeHashedS3(ctx context.Context, s *HashedS3Storage, prefix string, match func(rest string) bool) (int, error) {
+	var purged int
+	var objects []types.ObjectIdentifier
+	flush := func() error {
+		if len(objects) == 0 {
+			return nil
+		}
+		if _, err := s.Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		}); err != nil {
+			return fmt.Errorf("(*s3.Client).DeleteObjects failed: %w", err)
+		}
+		purged += len(objects) / 2
+		objects = objects[:0]
+		return nil
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(path.Join(s.Prefix, s3HashedPrefix) + "/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("(*s3.ListObjectsV2Paginator).NextPage failed: %w", err)
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if !strings.HasSuffix(key, s3URLSuffix) {
+				continue
+			}
+			out, err := s.Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.Bucket), Key: object.Key})
+			if err != nil {
+				return 0, fmt.Errorf("(*s3.Client).GetObject failed: %w", err)
+			}
+			u, err := io.ReadAll(out.Body)
+			out.Body.Close()
+			if err != nil {
+				return 0, fmt.Errorf("io.ReadAll failed: %w", err)
+			}
+			if rest, ok := strings.CutPrefix(string(u), prefix); ok && match(rest) {
+				objects = append(objects, types.ObjectIdentifier{Key: aws.String(strings.TrimSuffix(key, s3URLSuffix))}, types.ObjectIdentifier{Key: object.Key})
+			}
+			// DeleteObjects deletes at most 1000 objects at once.
+			if len(objects) >= 1000 {
+				if err := flush(); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// PurgePrefix resolves the path prefix (optionally including the /api/v3 prefix) relative to the upstream URL, so only
+// cached API responses are purged.
+func PurgePrefix(u *url.URL, path string) string {
+	prefix := u.JoinPath(strings.TrimPrefix(path, "/api/v3")).String()
+	if !strings.HasSuffix(path, "/") {
+		prefix = strings.TrimSuffix(prefix, "/") // JoinPath may add one, but an exact key must still match
+	}
+	return prefix
+}
+
+// CacheHandler implements the /admin/cache API: DELETE purges the cached responses under the (optional) prefix.
+type CacheHandler struct {
+	Storage ghtransport.Storage
+	// URL is the upstream URL, the prefix is resolved relative to it so only cached API responses are purged.
+	URL *url.URL
+}
+
+func (h *CacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodDelete {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	prefix := PurgePrefix(h.URL, req.URL.Query().Get("prefix"))
+	purged, err := PurgeStorage(req.Context(), h.Storage, prefix)
+	if err != nil {
+		log.Error().Err(err).Str("prefix", prefix).Msg("PurgeStorage failed")
+		WriteProxyError(w, http.StatusInternalServerError, ReasonInternal, "Failed to purge the cache")
+		return
+	}
+	log.Warn().Str("prefix", prefix).Int("purged", purged).Msg("cache purged")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"prefix": prefix,
+		"purged": purged,
+	}); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
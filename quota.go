@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/rs/zerolog/log"
+)
+
+// PoolRate is the rate-limit of a resource aggregated across the credentials of the pool.
+type PoolRate struct {
+	Limit     uint64 `json:"limit"`
+	Used      uint64 `json:"used"`
+	Remaining uint64 `json:"remaining"`
+	// Reset is the earliest upcoming reset of a credential (the remaining quota grows then), 0 once every window reset.
+	Reset uint64 `json:"reset"`
+	// Credentials is the number of credentials with a known rate-limit of the resource.
+	Credentials int `json:"credentials"`
+}
+
+// ClientQuota is the quota of the tenant of the inbound client, see Tenant.
+type ClientQuota struct {
+	Client    string `json:"client,omitempty"`
+	Tenant    string `json:"tenant"`
+	Limit     int    `json:"limit"`
+	Remaining int    `json:"remaining"`
+	Reset     int64  `json:"reset"`
+}
+
+// PoolRateLimit is the body of the /proxy/rate_limit API, shaped like that of the /rate_limit API of GitHub.
+type PoolRateLimit struct {
+	Resources map[string]*PoolRate `json:"resources"`
+	// Rate is the core resource, like the (deprecated) rate of the /rate_limit API.
+	Rate *PoolRate `json:"rate"`
+	// Client (optional) is the quota of the tenant of the client, if it has one.
+	Client *ClientQuota `json:"client,omitempty"`
+}
+
+// RateLimitHandler implements the /proxy/rate_limit API: the remaining quota per resource of the pool (or of the
+// credentials of the tenant of the client) from the most recent rate-limit of each credential, without a request
+// upstream, so the clients can pace themselves by the quota of the proxy rather than the X-RateLimit-* headers of
+// whichever credential served their last response. The core quota excludes the requests reserved for the other jobs
+// (see ReservationTransport), those tagged with a ReservationHeader get the remainder of their reservation instead.
+// With Override it serves the /rate_limit API of GitHub itself (which clients like go-github and octokit back off by),
+// the remaining quota of each resource is then also capped by the client quota.
+type RateLimitHandler struct {
+	Pool *CredentialPool
+	// Reservations (optional) are the budget reservations of the pool.
+	Reservations *ReservationTransport
+	Override     bool
+}
+
+// RateLimit returns the quota available to the request.
+func (h *RateLimitHandler) RateLimit(req *http.Request) *PoolRateLimit {
+	now := UpstreamNow()
+	tenant := TenantFromContext(req.Context())
+	body := &PoolRateLimit{Resources: make(map[string]*PoolRate)}
+	for _, credential := range h.Pool.Credentials() {
+		if tenant != nil && len(tenant.Credentials) > 0 && !slices.Contains(tenant.Credentials, credential.ID) {
+			continue
+		}
+		for resource, rate := range credential.Transport.Limits.Iter() {
+			aggregate, ok := body.Resources[resource.String()]
+			if !ok {
+				aggregate = &PoolRate{}
+				body.Resources[resource.String()] = aggregate
+			}
+			aggregate.Credentials++
+			aggregate.Limit += rate.Limit
+			// A window that has already reset counts its full limit.
+			if rate.Reset > 0 && int64(rate.Reset) <= now.Unix() {
+				aggregate.Remaining += rate.Limit
+				continue
+			}
+			aggregate.Used += rate.Used
+			aggregate.Remaining += rate.Remaining
+			if aggregate.Reset == 0 || rate.Reset < aggregate.Reset {
+				aggregate.Reset = rate.Reset
+			}
+		}
+	}
+	if core, ok := body.Resources[ghratelimit.ResourceCore.String()]; ok {
+		if h.Reservations != nil {
+			core.Remaining = h.Reservations.available(req.Header.Get(ReservationHeader), core.Remaining)
+		}
+		body.Rate = core
+	}
+	if tenant != nil && tenant.RPH > 0 {
+		remaining, reset := tenant.quota(time.Now())
+		body.Client = &ClientQuota{
+			Client:    ClientFromContext(req.Context()),
+			Tenant:    tenant.Name,
+			Limit:     tenant.RPH,
+			Remaining: remaining,
+			Reset:     time.Now().Add(reset + time.Second - 1).Unix(),
+		}
+	}
+	return body
+}
+
+func (h *RateLimitHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	body := h.RateLimit(req)
+	if h.Override {
+		if body.Client != nil {
+			virtual := TenantFromContext(req.Context()).VirtualRateLimit
+			for _, rate := range body.Resources {
+				rate.Remaining = min(rate.Remaining, uint64(body.Client.Remaining))
+				// Consistent with the X-RateLimit-* headers of its responses, see SetVirtualRateLimitHeaders.
+				if virtual {
+					rate.Limit = uint64(body.Client.Limit)
+					rate.Remaining = uint64(body.Client.Remaining)
+					rate.Used = uint64(body.Client.Limit - body.Client.Remaining)
+					rate.Reset = uint64(body.Client.Reset)
+				}
+			}
+			body.Client = nil
+		}
+		// The clients expect a reset, once every window reset the next one ends within the hour.
+		for _, rate := range body.Resources {
+			if rate.Reset == 0 {
+				rate.Reset = uint64(UpstreamNow().Add(time.Hour).Unix())
+			}
+		}
+		// Like the responses of GitHub, the headers are those of the core resource.
+		if body.Rate != nil {
+			w.Header().Set("X-RateLimit-Limit", strconv.FormatUint(body.Rate.Limit, 10))
+			w.Header().Set("X-RateLimit-Remaining", strconv.FormatUint(body.Rate.Remaining, 10))
+			w.Header().Set("X-RateLimit-Used", strconv.FormatUint(body.Rate.Used, 10))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatUint(body.Rate.Reset, 10))
+			w.Header().Set("X-RateLimit-Resource", ghratelimit.ResourceCore.String())
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if req.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	Ready = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "ready",
+		Subsystem: "github",
+		Help:      "Whether the proxy has passed its startup readiness checks (1) or not (0)",
+	})
+)
+
+// ReadyURL is the (synthetic) URL used to probe that the storage backend is writable.
+var ReadyURL = &url.URL{
+	Scheme: "https",
+	Host:   InternalHost,
+	Path:   "/admin/ready",
+}
+
+// ReadinessStatus is the result of the readiness checks.
+type ReadinessStatus struct {
+	Ready bool `json:"ready"`
+	// Credentials is the number of credentials that validated, of the Required.
+	Credentials int `json:"credentials"`
+	Required    int `json:"required"`
+	// Storage is if the storage backend is writable.
+	Storage bool     `json:"storage"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// Readiness is a startup gate that refuses to report ready until at least MinCredentials validate and the storage
+// backend is writable. Once ready, it remains ready.
+type Readiness struct {
+	Credentials []*Credential
+	// MinCredentials is the number of Credentials that must validate (via /rate_limit) before reporting ready.
+	MinCredentials int
+	Storage        ghtransport.Storage
+	// URL is the /rate_limit URL used to validate the Credentials.
+	URL *url.URL
+
+	mu        sync.Mutex
+	validated map[*Credential]bool
+	status    atomic.Pointer[ReadinessStatus]
+}
+
+// probeStorage writes (and reads back) a synthetic response to ensure the storage backend is writable.
+func (r *Readiness) probeStorage(ctx context.Context) error {
+	body := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	req := &http.Request{Method: http.MethodGet, URL: ReadyURL, Header: http.Header{}}
+	if err := r.Storage.Put(ctx, &http.Response{
+		Status:     http.StatusText(http.StatusOK),
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": []string{"text/plain"},
+		},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}); err != nil {
+		return fmt.Errorf("(Storage).Put failed: %w", err)
+	}
+	resp, err := r.Storage.Get(ctx, req)
+	if err != nil {
+		return fmt.Errorf("(Storage).Get failed: %w", err)
+	} else if resp == nil {
+		return fmt.Errorf("(Storage).Get returned no response")
+	}
+	defer resp.Body.Close()
+	stored, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+	}
+	if !bytes.Equal(stored, body) {
+		return fmt.Errorf("(Storage).Get returned a stale response")
+	}
+	return nil
+}
+
+// Check runs the readiness checks, only credentials that have not yet validated are checked again.
+func (r *Readiness) Check(ctx context.Context) ReadinessStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if status := r.status.Load(); status != nil && status.Ready {
+		return *status
+	}
+	if r.validated == nil {
+		r.validated = make(map[*Credential]bool, len(r.Credentials))
+	}
+	status := ReadinessStatus{Required: r.MinCredentials}
+	for _, credential := range r.Credentials {
+		if !r.validated[credential] && len(r.validated) < r.MinCredentials {
+			if err := credential.Transport.Limits.Fetch(ctx, credential.Transport, r.URL); err != nil {
+				status.Errors = append(status.Errors, fmt.Sprintf("credential %s: %s", credential.ID, DefaultScrubber.ScrubError(err)))
+				continue
+			}
+			r.validated[credential] = true
+		}
+	}
+	status.Credentials = len(r.validated)
+	if err := r.probeStorage(ctx); err != nil {
+		status.Errors = append(status.Errors, "storage: "+DefaultScrubber.ScrubError(err).Error())
+	} else {
+		status.Storage = true
+	}
+	status.Ready = status.Storage && status.Credentials >= status.Required
+	r.status.Store(&status)
+	if status.Ready {
+		Ready.Set(1)
+	}
+	return status
+}
+
+// Wait runs the readiness checks every interval until ready, returning an error if not ready within the timeout.
+func (r *Readiness) Wait(ctx context.Context, interval time.Duration, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		status := r.Check(ctx)
+		if status.Ready {
+			return nil
+		}
+		log.Warn().Strs("errors", status.Errors).Int("credentials", status.Credentials).Int("required", status.Required).Msg("waiting for readiness")
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not ready after %s: %v", timeout, status.Errors)
+		case <-ticker.C:
+		}
+	}
+}
+
+// ServeHTTP implements the /readyz endpoint, returning a 503 until the proxy is ready.
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var status ReadinessStatus
+	if loaded := r.status.Load(); loaded != nil {
+		status = *loaded
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
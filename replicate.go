@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	CacheReplications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "cache_replications_total",
+		Subsystem: "github",
+		Help:      "Number of cached responses replicated to the peer regions by region and result (replicated, failed, dropped)",
+	}, []string{"region", "result"})
+	CacheReadThroughs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "cache_read_throughs_total",
+		Subsystem: "github",
+		Help:      "Number of local cache misses read through from the primary region by result (hit, miss, failed)",
+	}, []string{"result"})
+)
+
+// DefaultReplicationQueue is the default number of responses pending replication to each peer region.
+const DefaultReplicationQueue = 1000
+
+// S3Replica is the bucket of the cache in another region.
+type S3Replica struct {
+	Region string
+	Bucket string
+}
+
+// ParseS3Replica parses a "<region>=<bucket>" replica, ex: "eu-west-1=github-api-proxy-eu".
+func ParseS3Replica(spec string) (S3Replica, error) {
+	region, bucket, ok := strings.Cut(spec, "=")
+	if !ok || region == "" || bucket == "" {
+		return S3Replica{}, fmt.Errorf("invalid replica %q, expected <region>=<bucket>", spec)
+	}
+	return S3Replica{Region: region, Bucket: bucket}, nil
+}
+
+// replication is a cached response pending replication, its body is replayed for each peer.
+type replication struct {
+	resp *http.Response
+	body []byte
+}
+
+// ReplicaPeer is the storage of the cache in a peer region.
+type ReplicaPeer struct {
+	Region  string
+	Storage ghtransport.Storage
+
+	queue chan replication
+}
+
+// ReplicatedStorage is a ghtransport.Storage replicated across regions: the responses are written to the Local storage
+// (the backend of the region of the proxy) then asynchronously replicated to each of the Peers (by a queue per peer, a
+// slow region does not delay the others, the replications are dropped once it is full). The misses of the Local storage
+// are read through from the Primary (if any) and copied locally. A replica is only a best-effort copy; a response which
+// did not make it is fetched (or revalidated) upstream as usual.
+type ReplicatedStorage struct {
+	Local   ghtransport.Storage
+	Primary ghtransport.Storage
+	Peers   []*ReplicaPeer
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewReplicatedStorage returns a ReplicatedStorage replicating to the peers, queueing up to queueSize responses for
+// each of them.
+func NewReplicatedStorage(local ghtransport.Storage, primary ghtransport.Storage, peers []*ReplicaPeer, queueSize int) *ReplicatedStorage {
+	s := &ReplicatedStorage{Local: local, Primary: primary, Peers: peers}
+	for _, peer := range peers {
+		peer.queue = make(chan replication, queueSize)
+		s.wg.Add(1)
+		go s.replicate(peer)
+	}
+	return s
+}
+
+// replicate writes the queued responses to the storage of the peer until the queue is closed.
+func (s *ReplicatedStorage) replicate(peer *ReplicaPeer) {
+	defer s.wg.Done()
+	for r := range peer.queue {
+		resp := *r.resp
+		resp.Body = io.NopCloser(bytes.NewReader(r.body))
+		if err := peer.Storage.Put(resp.Request.Context(), &resp); err != nil {
+			CacheReplications.WithLabelValues(peer.Region, "failed").Inc()
+			log.Warn().Err(err).Str("region", peer.Region).Str("url", resp.Request.URL.String()).Msg("(ghtransport.Storage).Put failed")
+			continue
+		}
+		CacheReplications.WithLabelValues(peer.Region, "replicated").Inc()
+	}
+}
+
+// Close stops the replication once the pending responses are replicated.
+func (s *ReplicatedStorage) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		for _, peer := range s.Peers {
+			close(peer.queue)
+		}
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *ReplicatedStorage) Get(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := s.Local.Get(ctx, req)
+	if err != nil || resp != nil || s.Primary == nil {
+		return resp, err
+	}
+	resp, err = s.Primary.Get(ctx, req)
+	if err != nil {
+		// Fall back to upstream rather than failing the request, the primary region may be unreachable.
+		CacheReadThroughs.WithLabelValues("failed").Inc()
+		log.Warn().Err(err).Str("url", req.URL.String()).Msg("(*ReplicatedStorage).Primary.Get failed")
+		return nil, nil
+	}
+	if resp == nil {
+		CacheReadThroughs.WithLabelValues("miss").Inc()
+		return nil, nil
+	}
+	CacheReadThroughs.WithLabelValues("hit").Inc()
+	// Copy the response of the primary to the local storage for subsequent requests.
+	resp.Request = req
+	if err := s.Local.Put(ctx, resp); err != nil {
+		log.Warn().Err(err).Msg("(*ReplicatedStorage).Local.Put failed")
+	}
+	return resp, nil
+}
+
+func (s *ReplicatedStorage) Put(ctx context.Context, resp *http.Response) error {
+	if len(s.Peers) == 0 {
+		return s.Local.Put(ctx, resp)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("io.ReadAll failed: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err := s.Local.Put(ctx, resp); err != nil {
+		return fmt.Errorf("(*ReplicatedStorage).Local.Put failed: %w", err)
+	}
+
+	// The replication outlives the request (and the response may be modified once returned).
+	replicated := *resp
+	replicated.Header = resp.Header.Clone()
+	replicated.Request = resp.Request.Clone(context.WithoutCancel(ctx))
+	replicated.Body = nil
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil
+	}
+	for _, peer := range s.Peers {
+		select {
+		case peer.queue <- replication{resp: &replicated, body: body}:
+		default:
+			CacheReplications.WithLabelValues(peer.Region, "dropped").Inc()
+		}
+	}
+	return nil
+}
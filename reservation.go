@@ -0,0 +1,297 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ReservedRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name:      "reserved_requests",
+		Subsystem: "github",
+		Help:      "Number of core requests of the credential pool reserved and not yet used",
+	})
+	ReservationRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "reservation_rejected_total",
+		Subsystem: "github",
+		Help:      "Number of requests rejected by reason (reservation_exhausted, unknown_reservation, budget_reserved)",
+	}, []string{"reason"})
+)
+
+// ReservationHeader is the request header tagging a request with the ID of the Reservation it is counted against.
+const ReservationHeader = "X-Proxy-Reservation"
+
+// DefaultReservationDuration is the duration of a Reservation, the length of a rate-limit window.
+const DefaultReservationDuration = time.Hour
+
+var (
+	// ErrInsufficientQuota is returned when reserving more requests than the pool has left.
+	ErrInsufficientQuota = errors.New("the credential pool does not have enough remaining quota")
+	// ErrReservationNotFound is returned when releasing a reservation that does not exist (or expired).
+	ErrReservationNotFound = errors.New("reservation not found")
+)
+
+// Reservation is a number of core requests of the credential pool set aside for a single (batch) job.
+type Reservation struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Requests uint64    `json:"requests"`
+	Used     uint64    `json:"used"`
+	Created  time.Time `json:"created_at"`
+	Expires  time.Time `json:"expires_at"`
+}
+
+// ReservationTransport sets aside quota of the Pool for the jobs which reserved it (ex: a large migration), so they
+// can complete predictably: the core requests tagged with the ReservationHeader are counted against their reservation
+// (and rejected beyond it), while the other core requests are rejected once the remaining quota of the pool is all
+// reserved. Only the requests sent upstream count, cached responses are free. The BudgetHeader (if any) is adjusted
+// the same way. The reservations are kept in memory (per replica), they do not survive restarts.
+type ReservationTransport struct {
+	Base   http.RoundTripper
+	Pool   *CredentialPool
+	Shadow PolicyShadow
+
+	mu           sync.Mutex
+	reservations map[string]*Reservation
+}
+
+// outstanding returns the reserved requests not yet used, removing the expired reservations. The caller must hold mu.
+func (t *ReservationTransport) outstanding(now time.Time) uint64 {
+	var total uint64
+	for id, reservation := range t.reservations {
+		if !now.Before(reservation.Expires) {
+			delete(t.reservations, id)
+			continue
+		}
+		total += reservation.Requests - reservation.Used
+	}
+	ReservedRequests.Set(float64(total))
+	return total
+}
+
+// Outstanding returns the reserved core requests not yet used.
+func (t *ReservationTransport) Outstanding() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.outstanding(time.Now())
+}
+
+// Reserve reserves the requests for the duration (DefaultReservationDuration if zero), if the pool has that many
+// unreserved requests remaining.
+func (t *ReservationTransport) Reserve(name string, requests uint64, duration time.Duration) (Reservation, error) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if remaining, known := budget(t.Pool, nil, ghratelimit.ResourceCore, UpstreamNow()); known && remaining < t.outstanding(now)+requests {
+		return Reservation{}, ErrInsufficientQuota
+	}
+	reservation := &Reservation{
+		ID:       rand.Text(),
+		Name:     name,
+		Requests: requests,
+		Created:  now,
+		Expires:  now.Add(cmp.Or(duration, DefaultReservationDuration)),
+	}
+	if t.reservations == nil {
+		t.reservations = make(map[string]*Reservation)
+	}
+	t.reservations[reservation.ID] = reservation
+	t.outstanding(now)
+	return *reservation, nil
+}
+
+// Release releases the remaining requests of the reservation.
+func (t *ReservationTransport) Release(id string) (Reservation, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	reservation, ok := t.reservations[id]
+	if !ok || !time.Now().Before(reservation.Expires) {
+		return Reservation{}, ErrReservationNotFound
+	}
+	delete(t.reservations, id)
+	t.outstanding(time.Now())
+	return *reservation, nil
+}
+
+// List returns the reservations which have not expired, oldest first.
+func (t *ReservationTransport) List() []Reservation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.outstanding(time.Now())
+	reservations := make([]Reservation, 0, len(t.reservations))
+	for _, reservation := range t.reservations {
+		reservations = append(reservations, *reservation)
+	}
+	slices.SortFunc(reservations, func(a, b Reservation) int {
+		return cmp.Or(a.Created.Compare(b.Created), cmp.Compare(a.ID, b.ID))
+	})
+	return reservations
+}
+
+// take counts a request against the reservation (or, without one, checks the pool has unreserved quota left),
+// returning the reason it is rejected otherwise.
+func (t *ReservationTransport) take(id string, now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	outstanding := t.outstanding(now)
+	if id == "" {
+		if remaining, known := budget(t.Pool, nil, ghratelimit.ResourceCore, UpstreamNow()); known && outstanding > 0 && remaining <= outstanding {
+			return ReasonBudgetReserved
+		}
+		return ""
+	}
+	reservation, ok := t.reservations[id]
+	switch {
+	case !ok:
+		return ReasonUnknownReservation
+	case reservation.Used >= reservation.Requests:
+		return ReasonReservationExhausted
+	}
+	reservation.Used++
+	t.outstanding(now)
+	return ""
+}
+
+// refund returns a request (which was not sent upstream) to the reservation.
+func (t *ReservationTransport) refund(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if reservation, ok := t.reservations[id]; ok && reservation.Used > 0 {
+		reservation.Used--
+	}
+	t.outstanding(time.Now())
+}
+
+// reset returns the earliest time the core rate-limit of a credential of the pool resets, at most a minute away as the
+// reservations may be used up or released sooner.
+func (t *ReservationTransport) reset(now time.Time) time.Time {
+	earliest := now.Add(time.Minute)
+	for _, credential := range t.Pool.Credentials() {
+		if rate := credential.Transport.Limits.Load(ghratelimit.ResourceCore); rate != nil {
+			if reset := time.Unix(int64(rate.Reset), 0); reset.After(now) && reset.Before(earliest) {
+				earliest = reset
+			}
+		}
+	}
+	return earliest
+}
+
+func (t *ReservationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	id := req.Header.Get(ReservationHeader)
+	if id != "" {
+		req = req.Clone(req.Context())
+		req.Header.Del(ReservationHeader)
+	}
+	if ghratelimit.InferResource(req) != ghratelimit.ResourceCore {
+		return t.Base.RoundTrip(req)
+	}
+	now := time.Now()
+	if reason := t.take(id, now); reason != "" && (reason != ReasonBudgetReserved || t.Shadow.Deny(req, reason)) {
+		ReservationRejected.WithLabelValues(reason).Inc()
+		switch reason {
+		case ReasonUnknownReservation:
+			return ProxyResponse(req, http.StatusForbidden, reason, "The reservation does not exist or has expired"), nil
+		case ReasonReservationExhausted:
+			return ProxyResponse(req, http.StatusTooManyRequests, reason, "The requests of the reservation are exhausted"), nil
+		}
+		resp := ProxyResponse(req, http.StatusTooManyRequests, reason, "The remaining quota is reserved, retry later")
+		upstream := UpstreamNow()
+		resp.Header.Set("Retry-After", strconv.Itoa(int(t.reset(upstream).Sub(upstream).Round(time.Second)/time.Second)))
+		return resp, nil
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if id != "" && (resp.Header.Get(ghtransport.CachedRequestIDHeader) != "" || resp.Header.Get(ProxyErrorHeader) != "") {
+		t.refund(id) // Only requests sent upstream count against the reservation
+	}
+	if pages, err := strconv.ParseUint(resp.Header.Get(BudgetHeader), 10, 64); err == nil {
+		resp.Header.Set(BudgetHeader, strconv.FormatUint(t.available(id, pages), 10))
+	}
+	return resp, nil
+}
+
+// available returns the part of the budget of the pool available to the requests of the reservation (or, without
+// one, the requests not reserved).
+func (t *ReservationTransport) available(id string, remaining uint64) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	outstanding := t.outstanding(time.Now())
+	if reservation, ok := t.reservations[id]; ok {
+		return min(remaining, reservation.Requests-reservation.Used)
+	}
+	if remaining <= outstanding {
+		return 0
+	}
+	return remaining - outstanding
+}
+
+// reservationRequest is the body of a POST to the /admin/reservations API.
+type reservationRequest struct {
+	Name     string `json:"name"`
+	Requests uint64 `json:"requests"`
+	// Duration (optional) is a Go duration, ex: "30m".
+	Duration string `json:"duration"`
+}
+
+// ServeHTTP implements the /admin/reservations API: GET lists the reservations, POST reserves requests (responding
+// with the Reservation, whose ID is the ReservationHeader to send) and DELETE releases the reservation of the id query
+// parameter.
+func (t *ReservationTransport) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var resp any
+	switch req.Method {
+	case http.MethodGet:
+		resp = t.List()
+	case http.MethodPost:
+		var body reservationRequest
+		if err := json.NewDecoder(io.LimitReader(req.Body, 1<<20)).Decode(&body); err != nil || body.Requests == 0 {
+			WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The body must be a JSON object with the name and (positive) requests to reserve")
+			return
+		}
+		var duration time.Duration
+		if body.Duration != "" {
+			var err error
+			if duration, err = time.ParseDuration(body.Duration); err != nil || duration <= 0 {
+				WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The duration must be a positive Go duration, ex: 30m")
+				return
+			}
+		}
+		reservation, err := t.Reserve(body.Name, body.Requests, duration)
+		if err != nil {
+			WriteProxyError(w, http.StatusConflict, ReasonInvalidRequest, err.Error())
+			return
+		}
+		log.Warn().Str("reservation", reservation.ID).Str("name", reservation.Name).Uint64("requests", reservation.Requests).Msg("budget reserved")
+		resp = reservation
+	case http.MethodDelete:
+		reservation, err := t.Release(req.URL.Query().Get("id"))
+		if err != nil {
+			WriteProxyError(w, http.StatusNotFound, ReasonInvalidRequest, err.Error())
+			return
+		}
+		log.Warn().Str("reservation", reservation.ID).Str("name", reservation.Name).Uint64("used", reservation.Used).Msg("reservation released")
+		resp = reservation
+	default:
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
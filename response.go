@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProxyErrorHeader is the response header identifying the reason a response was generated by the proxy itself.
+const ProxyErrorHeader = "X-Proxy-Error"
+
+// DocumentationURL is the base documentation_url of the errors generated by the proxy itself.
+const DocumentationURL = "https://github.com/bored-engineer/github-api-proxy"
+
+// The reasons the proxy itself rejects a request.
+const (
+	ReasonSourceNotAllowed     = "source_not_allowed"
+	ReasonQueueFull            = "queue_full"
+	ReasonFrozen               = "frozen"
+	ReasonTimeout              = "timeout"
+	ReasonUpstreamUnreachable  = "upstream_unreachable"
+	ReasonMethodNotAllowed     = "method_not_allowed"
+	ReasonInvalidRequest       = "invalid_request"
+	ReasonInternal             = "internal"
+	ReasonUnknownTenant        = "unknown_tenant"
+	ReasonTenantQuota          = "tenant_quota_exceeded"
+	ReasonQueryNotFound        = "persisted_query_not_found"
+	ReasonQueryMismatch        = "persisted_query_mismatch"
+	ReasonQueryCost            = "query_too_expensive"
+	ReasonIdempotencyInUse     = "idempotency_key_in_use"
+	ReasonIdempotencyMismatch  = "idempotency_key_mismatch"
+	ReasonClientBlocked        = "client_blocked"
+	ReasonUnknownReservation   = "unknown_reservation"
+	ReasonReservationExhausted = "reservation_exhausted"
+	ReasonBudgetReserved       = "budget_reserved"
+	ReasonOverrideDenied       = "credential_override_denied"
+	ReasonUnknownCredential    = "unknown_credential"
+	ReasonSnapshotExpired      = "snapshot_expired"
+	ReasonUnknownRoute         = "unknown_route"
+	ReasonInvalidParameter     = "invalid_parameter"
+	ReasonMeshSecret           = "invalid_mesh_secret"
+	ReasonScriptRejected       = "script_rejected"
+	ReasonFilterRejected       = "filter_rejected"
+	ReasonAdminAuth            = "invalid_admin_token"
+	ReasonAdminOnly            = "admin_listener_only"
+)
+
+// reasonSections maps each reason to the README section documenting it.
+var reasonSections = map[string]string{
+	ReasonSourceNotAllowed:     "network-restrictions",
+	ReasonQueueFull:            "concurrency-limiting",
+	ReasonFrozen:               "change-freezes",
+	ReasonTimeout:              "timeouts",
+	ReasonUnknownTenant:        "tenancy",
+	ReasonTenantQuota:          "tenancy",
+	ReasonQueryNotFound:        "graphql",
+	ReasonQueryMismatch:        "graphql",
+	ReasonQueryCost:            "graphql",
+	ReasonIdempotencyInUse:     "idempotency-keys",
+	ReasonIdempotencyMismatch:  "idempotency-keys",
+	ReasonClientBlocked:        "anomaly-detection",
+	ReasonUnknownReservation:   "budget-reservations",
+	ReasonReservationExhausted: "budget-reservations",
+	ReasonBudgetReserved:       "budget-reservations",
+	ReasonOverrideDenied:       "credential-overrides",
+	ReasonUnknownCredential:    "credential-overrides",
+	ReasonSnapshotExpired:      "pagination-snapshots",
+	ReasonUnknownRoute:         "request-validation",
+	ReasonInvalidParameter:     "request-validation",
+	ReasonMeshSecret:           "cache-mesh",
+	ReasonScriptRejected:       "scripting-hooks",
+	ReasonFilterRejected:       "wasm-filters",
+	ReasonAdminAuth:            "admin-api",
+	ReasonAdminOnly:            "admin-api",
+}
+
+// ProxyError is the body of an error generated by the proxy itself, it is shaped like a GitHub API error (message,
+// documentation_url and status) so existing client libraries surface it sensibly, plus the proxy-specific reason.
+type ProxyError struct {
+	Message          string `json:"message"`
+	DocumentationURL string `json:"documentation_url"`
+	Status           string `json:"status"`
+	Reason           string `json:"reason"`
+}
+
+// NewProxyError builds the ProxyError for the status code and reason.
+func NewProxyError(statusCode int, reason string, message string) *ProxyError {
+	documentationURL := DocumentationURL
+	if section, ok := reasonSections[reason]; ok {
+		documentationURL += "#" + section
+	}
+	return &ProxyError{
+		Message:          message,
+		DocumentationURL: documentationURL,
+		Status:           strconv.Itoa(statusCode),
+		Reason:           reason,
+	}
+}
+
+// ProxyResponse builds a JSON error response generated by the proxy itself (rather than the upstream).
+func ProxyResponse(req *http.Request, statusCode int, reason string, message string) *http.Response {
+	body, _ := json.Marshal(NewProxyError(statusCode, reason, message))
+	return &http.Response{
+		Status:     strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode: statusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":   []string{"application/json; charset=utf-8"},
+			ProxyErrorHeader: []string{reason},
+		},
+		Body:          io.NopCloser(strings.NewReader(string(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// WriteProxyError writes a JSON error response generated by the proxy itself to the http.ResponseWriter.
+func WriteProxyError(w http.ResponseWriter, statusCode int, reason string, message string) {
+	body, _ := json.Marshal(NewProxyError(statusCode, reason, message))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set(ProxyErrorHeader, reason)
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	WriteRevalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "write_revalidations_total",
+		Subsystem: "github",
+		Help:      "Number of cached responses revalidated after a mutation of their path by result (revalidated, error)",
+	}, []string{"result"})
+)
+
+// revalidateTimeout bounds the revalidation of the cached response after a mutation.
+const revalidateTimeout = 10 * time.Second
+
+// revalidateStatus reports if the status of the mutation response means the resource may have changed, either by the
+// mutation itself or by the conflicting write (409 Conflict, 422 Unprocessable Entity) the client will re-read.
+func revalidateStatus(status int) bool {
+	return (status >= 200 && status < 300) || status == http.StatusConflict || status == http.StatusUnprocessableEntity
+}
+
+// RevalidateTransport revalidates the cached GET response of the path of every mutation (ex: a PATCH of an issue)
+// before the mutation response is returned, so subsequent reads through the proxy are coherent with the writes made
+// through it even if the cached response was still fresh. The revalidation is conditional, it costs no rate-limit if
+// the resource was not modified.
+type RevalidateTransport struct {
+	Base    http.RoundTripper
+	Storage ghtransport.Storage
+}
+
+// revalidate sends the conditional GET request for the path of the mutation, as the cached response would be read.
+func (t *RevalidateTransport) revalidate(mutation *http.Request) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(mutation.Context()), revalidateTimeout)
+	defer cancel()
+	req := mutation.Clone(ctx)
+	req.Method = http.MethodGet
+	req.Body = nil
+	req.GetBody = nil
+	req.ContentLength = 0
+	for _, name := range []string{"Content-Type", "Content-Length", "If-Match", "If-Unmodified-Since", "If-None-Match", "If-Modified-Since"} {
+		req.Header.Del(name)
+	}
+	cached, err := t.Storage.Get(ctx, req)
+	if err != nil {
+		log.Warn().Err(err).Msg("(ghtransport.Storage).Get failed")
+		return
+	}
+	if cached == nil {
+		return // Nothing to keep coherent
+	}
+	cached.Body.Close()
+	// Revalidate even if the cached response is fresh (see FreshnessTransport).
+	req.Header.Set("Cache-Control", "no-cache")
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		WriteRevalidations.WithLabelValues("error").Inc()
+		log.Warn().Err(err).Str("path", req.URL.Path).Msg("revalidation after mutation failed")
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// ex: the resource was deleted, the stale response is left for the client's own request to replace.
+		WriteRevalidations.WithLabelValues("error").Inc()
+		log.Warn().Int("status", resp.StatusCode).Str("path", req.URL.Path).Msg("revalidation after mutation failed")
+		return
+	}
+	WriteRevalidations.WithLabelValues("revalidated").Inc()
+}
+
+func (t *RevalidateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !mutating(req.Method) {
+		return t.Base.RoundTrip(req)
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || !revalidateStatus(resp.StatusCode) || resp.Header.Get(ProxyErrorHeader) != "" {
+		return resp, err
+	}
+	t.revalidate(req)
+	return resp, nil
+}
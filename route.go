@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+)
+
+// routeNames are path segments which are followed by a single variable segment.
+var routeNames = map[string]string{
+	"users":         "{username}",
+	"orgs":          "{org}",
+	"organizations": "{org}",
+	"enterprises":   "{enterprise}",
+	"teams":         "{team_slug}",
+	"installations": "{installation_id}",
+	"apps":          "{app_slug}",
+	"gists":         "{gist_id}",
+	"branches":      "{branch}",
+	"commits":       "{ref}",
+	"tags":          "{tag}",
+	"labels":        "{name}",
+	"members":       "{username}",
+	"collaborators": "{username}",
+	"environments":  "{environment_name}",
+	"secrets":       "{secret_name}",
+	"variables":     "{name}",
+}
+
+// RouteTemplate approximates the GitHub REST API route template for a path, ex:
+// "/repos/octocat/hello-world/issues/42" becomes "/repos/{owner}/{repo}/issues/{id}".
+// This keeps the cardinality of metrics and reports bounded.
+func RouteTemplate(path string) string {
+	path = strings.TrimPrefix(path, "/api/v3")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for idx := 0; idx < len(segments); idx++ {
+		segment := segments[idx]
+		switch {
+		case segment == "":
+			continue
+		case segment == "repos" && idx == 0:
+			if idx+1 < len(segments) {
+				segments[idx+1] = "{owner}"
+			}
+			if idx+2 < len(segments) {
+				segments[idx+2] = "{repo}"
+			}
+			idx += 2
+		case segment == "contents" || segment == "ref" || segment == "refs" || segment == "trees" || strings.HasSuffix(segment, "-archive"):
+			// Everything after these segments is a (variable length) path or ref
+			if idx+1 < len(segments) {
+				segments = append(segments[:idx+1], "{path}")
+			}
+			idx = len(segments)
+		case isNumeric(segment):
+			segments[idx] = "{id}"
+		case isSHA(segment):
+			segments[idx] = "{sha}"
+		default:
+			if name, ok := routeNames[segment]; ok && idx+1 < len(segments) && !isNumeric(segments[idx+1]) {
+				segments[idx+1] = name
+				idx++
+			}
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func isNumeric(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	for _, r := range segment {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isSHA(segment string) bool {
+	if len(segment) != 40 && len(segment) != 64 {
+		return false
+	}
+	for _, r := range segment {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -12,6 +12,8 @@ type RPSTransport struct {
 }
 
 func (t *RPSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	t.Limiter.Take()
+	if err := take(req.Context(), t.Limiter); err != nil {
+		return nil, err
+	}
 	return t.Base.RoundTrip(req)
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go/middleware"
+	s3storage "github.com/bored-engineer/github-conditional-http-transport/s3"
+)
+
+// The modes of --s3-key-hash.
+const (
+	S3KeyHashNever  = "never"
+	S3KeyHashLong   = "long"
+	S3KeyHashAlways = "always"
+)
+
+const (
+	// s3KeyLimit is the maximum length (in bytes) of an S3 key.
+	s3KeyLimit = 1024
+	// s3HashedPrefix is the prefix of the hashed S3 keys.
+	s3HashedPrefix = "_hashed/"
+	// s3URLSuffix is the suffix of the object storing the URL of a hashed S3 key.
+	s3URLSuffix = ".url"
+)
+
+// S3Key returns the s3storage.Key of the mode: the URL (without its scheme) as-is, or its SHA-256 (under the
+// s3HashedPrefix) if the mode hashes every key (spreading them evenly across the bucket, rather than hot prefixes
+// like search/) or the key would exceed the S3 limit once prefixed.
+func S3Key(mode string, prefix string) func(req *http.Request) string {
+	return func(req *http.Request) string {
+		key := strings.TrimPrefix(req.URL.String(), "https://")
+		if mode == S3KeyHashAlways || (mode == S3KeyHashLong && len(path.Join(prefix, key)) > s3KeyLimit) {
+			hashed := sha256.Sum256([]byte(req.URL.String()))
+			return s3HashedPrefix + hex.EncodeToString(hashed[:])
+		}
+		return key
+	}
+}
+
+// HashedS3Storage is an S3 storage (whose s3storage.Key is an S3Key) storing the URL of each response stored at a
+// hashed key in an object next to it (the key with the s3URLSuffix), so the purges and inspection tooling can map
+// the hashed keys back to their URL.
+type HashedS3Storage struct {
+	*s3storage.Storage
+}
+
+func (s *HashedS3Storage) Put(ctx context.Context, resp *http.Response) error {
+	if err := s.Storage.Put(ctx, resp); err != nil {
+		return err
+	}
+	key := s3storage.Key(resp.Request)
+	if !strings.HasPrefix(key, s3HashedPrefix) {
+		return nil
+	}
+	if _, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.Bucket),
+		Key:         aws.String(path.Join(s.Prefix, key+s3URLSuffix)),
+		Body:        strings.NewReader(resp.Request.URL.String()),
+		ContentType: aws.String("text/plain"),
+	}); err != nil {
+		return fmt.Errorf("(*s3.Client).PutObject failed: %w", err)
+	}
+	return nil
+}
+
+// S3ObjectTagging encodes the key=value tags as the (URL query encoded) Tagging of an S3 object.
+func S3ObjectTagging(tags []string) (string, error) {
+	values := make(url.Values, len(tags))
+	for _, tag := range tags {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok || key == "" {
+			return "", fmt.Errorf("invalid tag %q, must be in the form key=value", tag)
+		}
+		if values.Has(key) {
+			return "", fmt.Errorf("duplicate tag %q", key)
+		}
+		values.Set(key, value)
+	}
+	return values.Encode(), nil
+}
+
+// S3PutObjectMiddleware returns an API option applying server-side encryption with the KMS key (if any) and the
+// tagging (if any) to every object PUT by the s3storage backend, which offers no hook to modify the PutObjectInput.
+func S3PutObjectMiddleware(kmsKeyID string, tagging string) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("PutObjectDefaults", func(
+			ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+		) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if input, ok := in.Parameters.(*s3.PutObjectInput); ok {
+				if kmsKeyID != "" {
+					input.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+					input.SSEKMSKeyId = aws.String(kmsKeyID)
+				}
+				if tagging != "" {
+					input.Tagging = aws.String(tagging)
+				}
+			}
+			return next.HandleInitialize(ctx, in)
+		}), middleware.Before)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var (
+	ScriptHooks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "script_hooks_total",
+		Subsystem: "github",
+		Help:      "Number of runs of the hooks of the --script scripts by result (ok, rejected, failed, timeout)",
+	}, []string{"script", "hook", "result"})
+	ScriptHookDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:      "script_hook_duration_seconds",
+		Subsystem: "github",
+		Help:      "Time spent running the hooks of the --script scripts",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"script", "hook"})
+)
+
+// DefaultScriptTimeout is the default deadline of a run of a hook.
+const DefaultScriptTimeout = 10 * time.Millisecond
+
+// The hooks a script defines as global functions.
+const (
+	// hookRequest is called with the request of the client before the cache, it may modify its path, query and headers
+	// or reject it by returning a status (and a message).
+	hookRequest = "on_request"
+	// hookResponse is called with the request and the final response, it may modify its status and headers.
+	hookResponse = "on_response"
+)
+
+// The bounds of the stacks of a script, exceeding them fails the hook.
+const (
+	scriptCallStackSize   = 128
+	scriptRegistryMaxSize = 128 * 1024
+)
+
+// Script is a sandboxed Lua script defining the hooks of a ScriptTransport: only the base, string, table and math
+// libraries are available (without dofile and loadfile, print logs) and every run (including that of the script
+// itself) is bounded by the Timeout and the size of its stacks. The hooks run concurrently in distinct (pooled) Lua
+// states, whose globals are reset after each run to those set by the script itself: a hook assigning a global does not
+// leak it into the next request, but the tables of the script (ex: a global cache table) mutated in place are shared
+// by the requests of the same state and the states are discarded at any time, so they must not be relied on.
+type Script struct {
+	// Name is the name of the script in the metrics and logs, the base name of its file.
+	Name    string
+	Timeout time.Duration
+
+	proto  *lua.FunctionProto
+	hooks  map[string]bool
+	states sync.Pool
+}
+
+// LoadScript compiles the script of the file, which must define at least one hook.
+func LoadScript(path string, timeout time.Duration) (*Script, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open failed: %w", err)
+	}
+	defer f.Close()
+	name := filepath.Base(path)
+	chunk, err := parse.Parse(f, name)
+	if err != nil {
+		return nil, fmt.Errorf("parse.Parse failed: %w", err)
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, fmt.Errorf("lua.Compile failed: %w", err)
+	}
+	s := &Script{Name: name, Timeout: timeout, proto: proto, hooks: make(map[string]bool)}
+	L, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range []string{hookRequest, hookResponse} {
+		s.hooks[hook] = L.GetGlobal(hook).Type() == lua.LTFunction
+	}
+	if !s.hooks[hookRequest] && !s.hooks[hookResponse] {
+		L.Close()
+		return nil, fmt.Errorf("script %q defines neither %s nor %s", name, hookRequest, hookResponse)
+	}
+	s.states.Put(L)
+	return s, nil
+}
+
+// scriptState is a pooled Lua state which ran the script, with the globals the script set.
+type scriptState struct {
+	*lua.LState
+	globals map[lua.LValue]lua.LValue
+}
+
+// reset restores the globals of the state to those set by the script, undoing the assignments of a hook.
+func (L *scriptState) reset() {
+	var keys []lua.LValue
+	L.G.Global.ForEach(func(key lua.LValue, value lua.LValue) {
+		if original, ok := L.globals[key]; !ok || original != value {
+			keys = append(keys, key)
+		}
+	})
+	for _, key := range keys {
+		L.G.Global.RawSet(key, lua.LNil)
+	}
+	for key, value := range L.globals {
+		if L.G.Global.RawGet(key) != value {
+			L.G.Global.RawSet(key, value)
+		}
+	}
+}
+
+// newState returns a sandboxed Lua state which ran the script.
+func (s *Script) newState() (*scriptState, error) {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       scriptCallStackSize,
+		RegistryMaxSize:     scriptRegistryMaxSize,
+		MinimizeStackMemory: true,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		if err := L.CallByParam(lua.P{Fn: L.NewFunction(lib.open), Protect: true}, lua.LString(lib.name)); err != nil {
+			L.Close()
+			return nil, fmt.Errorf("(*lua.LState).CallByParam failed: %w", err)
+		}
+	}
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		args := make([]string, L.GetTop())
+		for idx := range args {
+			args[idx] = L.ToStringMeta(L.Get(idx + 1)).String()
+		}
+		log.Info().Str("script", s.Name).Msg(strings.Join(args, "\t"))
+		return 0
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("script %q failed: %w", s.Name, err)
+	}
+	L.RemoveContext()
+	globals := make(map[lua.LValue]lua.LValue)
+	L.G.Global.ForEach(func(key lua.LValue, value lua.LValue) {
+		globals[key] = value
+	})
+	return &scriptState{LState: L, globals: globals}, nil
+}
+
+// run runs the hook in a Lua state of the script within the Timeout, fn calls it and reports if it rejected the
+// request. A state is discarded once a hook failed in it, its globals are reset otherwise.
+func (s *Script) run(ctx context.Context, hook string, fn func(L *lua.LState) (rejected bool, err error)) {
+	start := time.Now()
+	L, _ := s.states.Get().(*scriptState)
+	if L == nil {
+		var err error
+		if L, err = s.newState(); err != nil {
+			ScriptHooks.WithLabelValues(s.Name, hook, "failed").Inc()
+			log.Warn().Err(err).Str("script", s.Name).Str("hook", hook).Msg("(*Script).newState failed")
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	rejected, err := fn(L.LState)
+	L.RemoveContext()
+	ScriptHookDuration.WithLabelValues(s.Name, hook).Observe(time.Since(start).Seconds())
+	switch {
+	case err != nil:
+		result := "failed"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			result = "timeout"
+		}
+		ScriptHooks.WithLabelValues(s.Name, hook, result).Inc()
+		log.Warn().Err(err).Str("script", s.Name).Str("hook", hook).Msg("script hook failed, the request proceeds unmodified")
+		L.Close()
+		return
+	case rejected:
+		ScriptHooks.WithLabelValues(s.Name, hook, "rejected").Inc()
+	default:
+		ScriptHooks.WithLabelValues(s.Name, hook, "ok").Inc()
+	}
+	L.SetTop(0)
+	L.reset()
+	s.states.Put(L)
+}
+
+// requestTable returns the Lua table of the request.
+func requestTable(L *lua.LState, req *http.Request) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("method", lua.LString(req.Method))
+	t.RawSetString("path", lua.LString(req.URL.Path))
+	t.RawSetString("query", lua.LString(req.URL.RawQuery))
+	t.RawSetString("headers", headerTable(L, req.Header))
+	t.RawSetString("remote_addr", lua.LString(req.RemoteAddr))
+	t.RawSetString("client", lua.LString(ClientFromContext(req.Context())))
+	if tenant := TenantFromContext(req.Context()); tenant != nil {
+		t.RawSetString("tenant", lua.LString(tenant.Name))
+	}
+	return t
+}
+
+// headerTable returns the Lua table of the header, by the canonical name of each header to its first value.
+func headerTable(L *lua.LState, header http.Header) *lua.LTable {
+	t := L.NewTable()
+	for name := range header {
+		t.RawSetString(name, lua.LString(header.Get(name)))
+	}
+	return t
+}
+
+// applyHeaderTable applies the modifications of the Lua table of the header, the unmodified (multi-valued) headers
+// are kept as-is.
+func applyHeaderTable(t *lua.LTable, header http.Header) {
+	for name := range header {
+		if t.RawGetString(name) == lua.LNil {
+			header.Del(name)
+		}
+	}
+	t.ForEach(func(key lua.LValue, value lua.LValue) {
+		if key.Type() != lua.LTString || (value.Type() != lua.LTString && value.Type() != lua.LTNumber) {
+			return
+		}
+		if _, ok := header[key.String()]; !ok || header.Get(key.String()) != value.String() {
+			header.Set(key.String(), value.String())
+		}
+	})
+}
+
+// OnRequest runs the on_request hook, applying its modifications to the request. A returned status (between 400 and
+// 599) rejects the request, with the message.
+func (s *Script) OnRequest(req *http.Request) (status int, message string) {
+	s.run(req.Context(), hookRequest, func(L *lua.LState) (bool, error) {
+		t := requestTable(L, req)
+		if err := L.CallByParam(lua.P{Fn: L.GetGlobal(hookRequest), NRet: 2, Protect: true}, t); err != nil {
+			return false, err
+		}
+		if code, ok := L.Get(-2).(lua.LNumber); ok {
+			if code < 400 || code > 599 {
+				return false, fmt.Errorf("%s returned the status %v, expected 400 to 599", hookRequest, code)
+			}
+			status, message = int(code), lua.LVAsString(L.Get(-1))
+			if message == "" {
+				message = "Rejected by the script " + s.Name
+			}
+			return true, nil
+		}
+		if p := lua.LVAsString(t.RawGetString("path")); p != req.URL.Path {
+			if !strings.HasPrefix(p, "/") {
+				return false, fmt.Errorf("%s set the invalid path %q", hookRequest, p)
+			}
+			req.URL.Path, req.URL.RawPath = p, ""
+		}
+		req.URL.RawQuery = lua.LVAsString(t.RawGetString("query"))
+		if headers, ok := t.RawGetString("headers").(*lua.LTable); ok {
+			applyHeaderTable(headers, req.Header)
+		}
+		return false, nil
+	})
+	return status, message
+}
+
+// OnResponse runs the on_response hook, applying its modifications to the response.
+func (s *Script) OnResponse(req *http.Request, resp *http.Response) {
+	s.run(req.Context(), hookResponse, func(L *lua.LState) (bool, error) {
+		t := L.NewTable()
+		t.RawSetString("status", lua.LNumber(resp.StatusCode))
+		t.RawSetString("headers", headerTable(L, resp.Header))
+		if err := L.CallByParam(lua.P{Fn: L.GetGlobal(hookResponse), Protect: true}, requestTable(L, req), t); err != nil {
+			return false, err
+		}
+		if code, ok := t.RawGetString("status").(lua.LNumber); ok && int(code) != resp.StatusCode {
+			if code < 100 || code > 599 {
+				return false, fmt.Errorf("%s set the invalid status %v", hookResponse, code)
+			}
+			resp.StatusCode = int(code)
+			resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+		}
+		if headers, ok := t.RawGetString("headers").(*lua.LTable); ok {
+			applyHeaderTable(headers, resp.Header)
+		}
+		return false, nil
+	})
+}
+
+// ScriptTransport runs the hooks of the Scripts (in order) on the requests of the clients and their final responses,
+// for light customizations without recompiling the proxy (see the middleware package otherwise). A hook failing (or
+// exceeding its timeout) is logged and its modifications are dropped, the request proceeds. It wraps inside the
+// SigningTransport, the modified responses are signed.
+type ScriptTransport struct {
+	Base    http.RoundTripper
+	Scripts []*Script
+}
+
+func (t *ScriptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The hooks may modify the request, which belongs to the caller.
+	req = req.Clone(req.Context())
+	for _, script := range t.Scripts {
+		if !script.hooks[hookRequest] {
+			continue
+		}
+		if status, message := script.OnRequest(req); status != 0 {
+			return ProxyResponse(req, status, ReasonScriptRejected, message), nil
+		}
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, script := range t.Scripts {
+		if script.hooks[hookResponse] {
+			script.OnResponse(req, resp)
+		}
+	}
+	return resp, nil
+}
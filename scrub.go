@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Redacted replaces any scrubbed secret.
+const Redacted = "[REDACTED]"
+
+var redacted = []byte(Redacted)
+
+var (
+	ScrubbedSecrets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "scrubbed_secrets_total",
+		Subsystem: "github",
+		Help:      "Number of times a secret was scrubbed from a sink, by sink",
+	}, []string{"sink"})
+)
+
+// secretPatterns match well-known secret formats even if they are not explicitly known to the Scrubber.
+var secretPatterns = []*regexp.Regexp{
+	// https://github.blog/engineering/platform-security/behind-githubs-new-authentication-token-formats/
+	regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,255}|github_pat_[A-Za-z0-9_]{22,255})\b`),
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+	regexp.MustCompile(`(?i)\b(authorization:\s*(?:bearer|token|basic)\s+)[^\s"',]+`),
+	regexp.MustCompile(`(?i)\b((?:access_token|client_secret|private_key)=)[^&\s"']+`),
+}
+
+// Scrubber removes secrets from arbitrary data before it reaches a sink (logs, errors, caches or responses).
+// Literal secrets (ex: the configured credentials) are scrubbed in addition to the well-known secret patterns.
+type Scrubber struct {
+	mu sync.RWMutex
+	// secrets are kept as bytes, converting them on every Scrub would allocate.
+	secrets [][]byte
+}
+
+// minSecretLength avoids redacting short (and likely non-secret) values.
+const minSecretLength = 8
+
+// Add registers literal secrets (and their common encodings) to be scrubbed.
+func (s *Scrubber) Add(secrets ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, secret := range secrets {
+		secret = strings.TrimSpace(secret)
+		if len(secret) < minSecretLength {
+			continue
+		}
+		s.secrets = append(s.secrets, []byte(secret))
+		// Private keys are frequently logged with escaped newlines (ex: within JSON)
+		if escaped := strings.ReplaceAll(secret, "\n", `\n`); escaped != secret {
+			s.secrets = append(s.secrets, []byte(escaped))
+		}
+	}
+}
+
+// replacement preserves any prefix (ex: "access_token=") captured by a pattern.
+func replacement(pattern *regexp.Regexp) []byte {
+	if pattern.NumSubexp() > 0 {
+		return []byte("${1}" + Redacted)
+	}
+	return []byte(Redacted)
+}
+
+// Scrub returns the data with all secrets replaced, and if anything was replaced.
+func (s *Scrubber) Scrub(data []byte) ([]byte, bool) {
+	data, scrubbed := s.ScrubSecrets(data)
+	for _, pattern := range secretPatterns {
+		if pattern.Match(data) {
+			data = pattern.ReplaceAll(data, replacement(pattern))
+			scrubbed = true
+		}
+	}
+	return data, scrubbed
+}
+
+// ScrubSecrets returns the data with only the literal secrets (those registered by Add) replaced, and if anything was
+// replaced. Unlike Scrub it never alters the secret-looking content of upstream (ex: a token in the body of an issue).
+func (s *Scrubber) ScrubSecrets(data []byte) ([]byte, bool) {
+	scrubbed := false
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, secret := range s.secrets {
+		if bytes.Contains(data, secret) {
+			data = bytes.ReplaceAll(data, secret, redacted)
+			scrubbed = true
+		}
+	}
+	return data, scrubbed
+}
+
+// mintingPath matches the (API-relative) paths of the endpoints responding with newly minted credentials, which are
+// unknown to the Scrubber.
+var mintingPath = regexp.MustCompile(`^/(?:app/installations/[^/]+/access_tokens|applications/[^/]+/token(?:/scoped)?|app-manifests/[^/]+/conversions)$`)
+
+// responseScrub returns the scrubbing of the response of the request: the responses minting credentials are scrubbed of
+// the well-known secret formats too, the others only of the literal secrets.
+func (s *Scrubber) responseScrub(req *http.Request) func([]byte) ([]byte, bool) {
+	if req != nil && mintingPath.MatchString("/"+strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/api/v3"), "/")) {
+		return s.Scrub
+	}
+	return s.ScrubSecrets
+}
+
+// ScrubString is a convenience wrapper around (*Scrubber).Scrub for strings.
+func (s *Scrubber) ScrubString(data string) string {
+	scrubbed, _ := s.Scrub([]byte(data))
+	return string(scrubbed)
+}
+
+// DefaultScrubber is the global Scrubber used by all sinks within the proxy.
+var DefaultScrubber = &Scrubber{}
+
+// ScrubWriter scrubs secrets from everything written to the underlying io.Writer (ex: logs).
+type ScrubWriter struct {
+	Writer   io.Writer
+	Scrubber *Scrubber
+}
+
+func (w *ScrubWriter) Write(p []byte) (int, error) {
+	scrubbed, ok := w.Scrubber.Scrub(p)
+	if ok {
+		ScrubbedSecrets.WithLabelValues("log").Inc()
+	}
+	if _, err := w.Writer.Write(scrubbed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// scrubbedError wraps an error, scrubbing any secrets from its message.
+type scrubbedError struct {
+	err     error
+	message string
+}
+
+func (e *scrubbedError) Error() string { return e.message }
+func (e *scrubbedError) Unwrap() error { return e.err }
+
+// ScrubError returns an error whose message has had any secrets scrubbed, preserving errors.Is/As.
+func (s *Scrubber) ScrubError(err error) error {
+	if err == nil {
+		return nil
+	}
+	message, ok := s.Scrub([]byte(err.Error()))
+	if !ok {
+		return err
+	}
+	ScrubbedSecrets.WithLabelValues("error").Inc()
+	return &scrubbedError{err: err, message: string(message)}
+}
+
+// scrubbable reports if the response body is textual (and therefore could contain a secret).
+func scrubbable(header http.Header) bool {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// maxPooledBody is the capacity beyond which a body buffer is not returned to the pool, so a single large response
+// is not retained for the lifetime of the process.
+const maxPooledBody = 1 << 20
+
+// bodyPool recycles the buffers of the response bodies scrubbed before they are returned to the clients.
+var bodyPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// putBody returns the buffer to the pool, unless it grew too large.
+func putBody(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBody {
+		buf.Reset()
+		bodyPool.Put(buf)
+	}
+}
+
+// pooledBody is a response body read from a pooled buffer, returned to the pool once closed.
+type pooledBody struct {
+	mu  sync.Mutex
+	buf *bytes.Buffer
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf == nil {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	return b.buf.Read(p)
+}
+
+func (b *pooledBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buf != nil {
+		putBody(b.buf)
+		b.buf = nil
+	}
+	return nil
+}
+
+// scrubBody replaces the response body with a copy scrubbed by the scrub func, reporting if anything was replaced.
+func scrubBody(resp *http.Response, scrub func([]byte) ([]byte, bool)) (bool, error) {
+	buf := bodyPool.Get().(*bytes.Buffer)
+	if resp.ContentLength > 0 {
+		buf.Grow(int(min(resp.ContentLength, maxPooledBody)))
+	}
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		resp.Body.Close()
+		putBody(buf)
+		return false, fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		putBody(buf)
+		return false, fmt.Errorf("(*http.Response).Body.Close failed: %w", err)
+	}
+	body, scrubbed := scrub(buf.Bytes())
+	if !scrubbed {
+		resp.Body = &pooledBody{buf: buf}
+		return false, nil
+	}
+	// The scrubbed body is a copy, the buffer is no longer needed.
+	putBody(buf)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return true, nil
+}
+
+// ScrubTransport scrubs secrets from the errors and (textual) response bodies returned to clients (see responseScrub).
+// The response bodies are buffered to be scrubbed, except the streaming ones which are scrubbed line by line.
+type ScrubTransport struct {
+	Base     http.RoundTripper
+	Scrubber *Scrubber
+}
+
+func (t *ScrubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return resp, t.Scrubber.ScrubError(err)
+	}
+	if req.Method == http.MethodHead || resp.StatusCode == http.StatusSwitchingProtocols || !scrubbable(resp.Header) {
+		return resp, nil
+	}
+	if StreamingFromContext(req.Context()) || eventStream(resp.Header) {
+		// Buffering the entire body would break streaming, so scrub it line by line instead.
+		resp.Body = &scrubReader{reader: bufio.NewReader(resp.Body), closer: resp.Body, scrub: t.Scrubber.responseScrub(req)}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return resp, nil
+	}
+	scrubbed, err := scrubBody(resp, t.Scrubber.responseScrub(req))
+	if err != nil {
+		return nil, t.Scrubber.ScrubError(err)
+	}
+	if scrubbed {
+		ScrubbedSecrets.WithLabelValues("response").Inc()
+	}
+	return resp, nil
+}
+
+// ScrubStorage scrubs secrets from (textual) response bodies before they are persisted in the cache (see responseScrub).
+type ScrubStorage struct {
+	ghtransport.Storage
+	Scrubber *Scrubber
+}
+
+func (s *ScrubStorage) Put(ctx context.Context, resp *http.Response) error {
+	if scrubbable(resp.Header) {
+		scrubbed, err := scrubBody(resp, s.Scrubber.responseScrub(resp.Request))
+		if err != nil {
+			return err
+		}
+		if scrubbed {
+			ScrubbedSecrets.WithLabelValues("cache").Inc()
+			// The ETag no longer matches the body, so it can never be used for a conditional request
+			return nil
+		}
+	}
+	return s.Storage.Put(ctx, resp)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ShadowDenials = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "shadow_denials_total",
+		Subsystem: "github",
+		Help:      "Number of requests which would have been denied by a --shadow-policy policy but were allowed, by reason",
+	}, []string{"reason"})
+)
+
+// ShadowReasons are the reasons of the denials of the (access and quota) policies which can be evaluated in shadow mode.
+var ShadowReasons = []string{
+	ReasonSourceNotAllowed,
+	ReasonUnknownTenant,
+	ReasonTenantQuota,
+	ReasonQueryCost,
+	ReasonClientBlocked,
+	ReasonBudgetReserved,
+}
+
+// PolicyShadow is the set of policies (by the reason of their denials, see ShadowReasons) evaluated in shadow mode:
+// their would-be denials are logged and counted, but the requests are allowed, so a new restriction can be rolled out
+// without breaking the consumers it was not known to affect. A nil PolicyShadow enforces every policy.
+type PolicyShadow map[string]bool
+
+// NewPolicyShadow returns the PolicyShadow of the reasons.
+func NewPolicyShadow(reasons []string) (PolicyShadow, error) {
+	shadow := make(PolicyShadow, len(reasons))
+	for _, reason := range reasons {
+		if !slices.Contains(ShadowReasons, reason) {
+			return nil, fmt.Errorf("unknown policy %q, expected one of %v", reason, ShadowReasons)
+		}
+		shadow[reason] = true
+	}
+	return shadow, nil
+}
+
+// Deny reports if the request denied by a policy for the reason is rejected, the would-be denials of a shadowed
+// policy are logged and counted instead.
+func (s PolicyShadow) Deny(req *http.Request, reason string) bool {
+	if !s[reason] {
+		return true
+	}
+	ShadowDenials.WithLabelValues(reason).Inc()
+	log.Info().
+		Str("reason", reason).
+		Str("client", ClientFromContext(req.Context())).
+		Str("remote_addr", req.RemoteAddr).
+		Str("method", req.Method).
+		Str("path", req.URL.Path).
+		Msg("request allowed by the shadow policy")
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/rs/zerolog/log"
+)
+
+// SidecarMemoryLimit is the default soft memory limit (see runtime/debug.SetMemoryLimit) in sidecar mode.
+const SidecarMemoryLimit = 64 << 20
+
+// SidecarMemoryBudget is the default budget of the in-memory cache in sidecar mode, half of the memory limit.
+const SidecarMemoryBudget = SidecarMemoryLimit / 2
+
+// loopback reports if the listen address only accepts connections from the local host (ex: 127.0.0.1:44879).
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// TieredStorage is a ghtransport.Storage backed by a fast Local tier (ex: in-memory) in front of a Shared tier (ex: Redis).
+type TieredStorage struct {
+	Local  ghtransport.Storage
+	Shared ghtransport.Storage
+}
+
+func (s *TieredStorage) Get(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := s.Local.Get(ctx, req)
+	if err != nil || resp != nil {
+		return resp, err
+	}
+	resp, err = s.Shared.Get(ctx, req)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	// Promote the shared response to the local tier for subsequent requests.
+	resp.Request = req
+	if err := s.Local.Put(ctx, resp); err != nil {
+		log.Warn().Err(err).Msg("(*TieredStorage).Local.Put failed")
+	}
+	return resp, nil
+}
+
+func (s *TieredStorage) Put(ctx context.Context, resp *http.Response) error {
+	if err := s.Local.Put(ctx, resp); err != nil {
+		return fmt.Errorf("(*TieredStorage).Local.Put failed: %w", err)
+	}
+	if err := s.Shared.Put(ctx, resp); err != nil {
+		return fmt.Errorf("(*TieredStorage).Shared.Put failed: %w", err)
+	}
+	return nil
+}
+
+// EnvHandler serves the shell export lines (ex: GITHUB_API_URL) that tools should use to reach the proxy.
+type EnvHandler struct {
+	// URL is the base URL the proxy is reachable at.
+	URL *url.URL
+}
+
+// Env returns the environment variables pointing tools at the proxy.
+func (h *EnvHandler) Env() [][2]string {
+	base := strings.TrimSuffix(h.URL.String(), "/")
+	return [][2]string{
+		{"GITHUB_API_URL", base}, // GitHub Actions, @actions/github
+		{"GITHUB_GRAPHQL_URL", base + "/graphql"},
+		{"GITHUB_BASE_URL", base + "/"}, // Terraform GitHub provider
+	}
+}
+
+func (h *EnvHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, env := range h.Env() {
+		fmt.Fprintf(w, "export %s='%s'\n", env[0], env[1])
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SignatureHeader is the response header carrying the detached signature of the response body.
+const SignatureHeader = "X-Proxy-Signature"
+
+// SignedPayload returns the payload signed for the response (of the status and body) to the request (of the method
+// and request URI, its path and query as sent by the client) at the timestamp (in Unix seconds). The payload is the
+// timestamp, the method, the request URI, the status and the hex-encoded SHA-256 of the body, each on its own line
+// (separated by a "\n", without a trailing one), so a signed body cannot be replayed for another request or status.
+func SignedPayload(timestamp int64, method string, requestURI string, status int, body []byte) []byte {
+	hash := sha256.Sum256(body)
+	return []byte(strconv.FormatInt(timestamp, 10) + "\n" + method + "\n" + requestURI + "\n" + strconv.Itoa(status) + "\n" + hex.EncodeToString(hash[:]))
+}
+
+type requestURIKey struct{}
+
+// WithRequestURI returns a copy of the context carrying the request URI of the client, as signed by the
+// SigningTransport (the URL of the request sent upstream includes the path of the --url).
+func WithRequestURI(ctx context.Context, requestURI string) context.Context {
+	return context.WithValue(ctx, requestURIKey{}, requestURI)
+}
+
+// signedRequestURI returns the request URI of the client (see WithRequestURI), or that of the request if unknown.
+func signedRequestURI(req *http.Request) string {
+	if requestURI, ok := req.Context().Value(requestURIKey{}).(string); ok && requestURI != "" {
+		return requestURI
+	}
+	return req.URL.RequestURI()
+}
+
+// Signer signs response bodies with an Ed25519 key held by the proxy.
+type Signer struct {
+	Key ed25519.PrivateKey
+	// KeyID identifies the key (the first 8 bytes of the SHA-256 of the public key, hex-encoded) to support rotation.
+	KeyID string
+}
+
+// LoadSigner loads the PEM-encoded (PKCS #8) Ed25519 private key from the file.
+func LoadSigner(path string) (*Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile failed: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("x509.ParsePKCS8PrivateKey failed: %w", err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T, only Ed25519 is supported", key)
+	}
+	hash := sha256.Sum256(privateKey.Public().(ed25519.PublicKey))
+	return &Signer{Key: privateKey, KeyID: hex.EncodeToString(hash[:8])}, nil
+}
+
+// Sign returns the SignatureHeader value for the response to the request at the timestamp (see SignedPayload).
+func (s *Signer) Sign(timestamp int64, method string, requestURI string, status int, body []byte) string {
+	signature := ed25519.Sign(s.Key, SignedPayload(timestamp, method, requestURI, status, body))
+	return "t=" + strconv.FormatInt(timestamp, 10) + ",keyid=" + s.KeyID + ",alg=ed25519,sig=" + base64.StdEncoding.EncodeToString(signature)
+}
+
+// ServeHTTP serves the PEM-encoded public key so downstream consumers can verify the signatures.
+func (s *Signer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	der, err := x509.MarshalPKIXPublicKey(s.Key.Public())
+	if err != nil {
+		log.Error().Err(err).Msg("x509.MarshalPKIXPublicKey failed")
+		WriteProxyError(w, http.StatusInternalServerError, ReasonInternal, "Failed to encode the signing key")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("X-Proxy-Signature-Key-Id", s.KeyID)
+	_, _ = w.Write(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// SigningTransport signs the final status and body of every (non-streaming) response to its request, including those
+// served from the cache and the errors generated by the proxy itself, so downstream consumers can verify the response
+// came through the proxy unmodified. The body must be buffered to be hashed before the headers are sent.
+type SigningTransport struct {
+	Base   http.RoundTripper
+	Signer *Signer
+}
+
+func (t *SigningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || StreamingFromContext(req.Context()) || resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		return nil, fmt.Errorf("(*http.Response).Body.Close failed: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	resp.Header.Set(SignatureHeader, t.Signer.Sign(time.Now().Unix(), req.Method, signedRequestURI(req), resp.StatusCode, body))
+	return resp, nil
+}
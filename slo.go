@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	SLOBurnRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "slo_burn_rate",
+		Subsystem: "github",
+		Help:      "Rate the error budget of the objective (availability, latency) is consumed at over the rolling window, 1 exhausts it exactly at the end of the SLO period",
+	}, []string{"objective", "window"})
+	SLOBudgetRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "slo_error_budget_remaining",
+		Subsystem: "github",
+		Help:      "Fraction of the error budget of the objective (availability, latency) remaining over the SLO period, negative once exceeded",
+	}, []string{"objective"})
+)
+
+// sloInterval is the interval the metrics of the objectives are updated at.
+const sloInterval = 15 * time.Second
+
+// sloWindow is a rolling window the burn rates are computed over.
+type sloWindow struct {
+	Name     string
+	Duration time.Duration
+}
+
+// sloWindows are the rolling windows of the burn rates, the pairs of a long and a short window of the multiwindow
+// burn rate alerts (see https://sre.google/workbook/alerting-on-slos/).
+var sloWindows = []sloWindow{
+	{Name: "5m", Duration: 5 * time.Minute},
+	{Name: "30m", Duration: 30 * time.Minute},
+	{Name: "1h", Duration: time.Hour},
+	{Name: "6h", Duration: 6 * time.Hour},
+	{Name: "1d", Duration: 24 * time.Hour},
+	{Name: "3d", Duration: 72 * time.Hour},
+}
+
+// sloBucket counts the requests completed within a minute.
+type sloBucket struct {
+	minute int64
+	total  uint64
+	failed uint64
+	timed  uint64
+	slow   uint64
+}
+
+// sloCounts are the requests counted over a window.
+type sloCounts struct {
+	total, failed, timed, slow uint64
+}
+
+func (c *sloCounts) add(bucket *sloBucket) {
+	c.total += bucket.total
+	c.failed += bucket.failed
+	c.timed += bucket.timed
+	c.slow += bucket.slow
+}
+
+// SLOObjective is the status of an objective over the SLO period.
+type SLOObjective struct {
+	Name string `json:"name"`
+	// Target is the fraction of the requests that should be good.
+	Target float64 `json:"target"`
+	// Threshold is the latency a good request is faster than (latency objective only).
+	Threshold string `json:"threshold,omitempty"`
+	Requests  uint64 `json:"requests"`
+	Bad       uint64 `json:"bad"`
+	// BudgetRemaining is the fraction of the error budget remaining, negative once exceeded.
+	BudgetRemaining float64 `json:"budget_remaining"`
+	// BurnRates are the rates the error budget is consumed at over each rolling window.
+	BurnRates map[string]float64 `json:"burn_rates"`
+}
+
+// SLOSummary is the status of the objectives, served by the /admin/slo API.
+type SLOSummary struct {
+	Period     string         `json:"period"`
+	Since      time.Time      `json:"since"`
+	Objectives []SLOObjective `json:"objectives"`
+}
+
+// SLOTracker tracks the availability and latency objectives of the proxy from its own traffic: a request is available
+// unless it failed or was answered with a server error (500 and above, including those of the proxy itself) and fast
+// if its response headers arrived within the Latency threshold, the streaming requests are only subject to the
+// availability objective. The counts are kept in memory (per replica) for the Period, a bucket per minute.
+type SLOTracker struct {
+	Base http.RoundTripper
+	// Availability is the target fraction of available requests (0 to disable the objective).
+	Availability float64
+	// Latency is the threshold of the latency objective (0 to disable it).
+	Latency time.Duration
+	// LatencyTarget is the target fraction of the requests faster than the Latency.
+	LatencyTarget float64
+	// Period is the period of the objectives the error budgets are computed over.
+	Period time.Duration
+
+	mu      sync.Mutex
+	buckets []sloBucket
+	since   time.Time
+}
+
+// record counts a completed request.
+func (t *SLOTracker) record(now time.Time, failed bool, timed bool, slow bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.buckets == nil {
+		t.buckets = make([]sloBucket, max(int(t.Period/time.Minute), 1))
+		t.since = now
+	}
+	minute := now.Unix() / 60
+	bucket := &t.buckets[minute%int64(len(t.buckets))]
+	if bucket.minute != minute {
+		*bucket = sloBucket{minute: minute}
+	}
+	bucket.total++
+	if failed {
+		bucket.failed++
+	}
+	if timed {
+		bucket.timed++
+		if slow {
+			bucket.slow++
+		}
+	}
+}
+
+// burnRate returns the rate the error budget of the target is consumed at by the bad requests.
+func burnRate(bad uint64, total uint64, target float64) float64 {
+	if total == 0 || target >= 1 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - target)
+}
+
+// Summary returns the status of the objectives.
+func (t *SLOTracker) Summary() SLOSummary {
+	now := time.Now().Unix() / 60
+	var period sloCounts
+	windows := make([]sloCounts, len(sloWindows))
+	t.mu.Lock()
+	since := t.since
+	for idx := range t.buckets {
+		bucket := &t.buckets[idx]
+		age := time.Duration(now-bucket.minute) * time.Minute
+		if bucket.total == 0 || age >= t.Period {
+			continue
+		}
+		period.add(bucket)
+		for idx, window := range sloWindows {
+			if age < window.Duration {
+				windows[idx].add(bucket)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	summary := SLOSummary{Period: t.Period.String(), Since: since, Objectives: []SLOObjective{}}
+	objective := func(name string, target float64, bad func(c sloCounts) (uint64, uint64)) SLOObjective {
+		o := SLOObjective{Name: name, Target: target, BurnRates: make(map[string]float64)}
+		o.Bad, o.Requests = bad(period)
+		o.BudgetRemaining = 1 - burnRate(o.Bad, o.Requests, target)
+		for idx, window := range sloWindows {
+			if window.Duration <= t.Period {
+				windowBad, windowRequests := bad(windows[idx])
+				o.BurnRates[window.Name] = burnRate(windowBad, windowRequests, target)
+			}
+		}
+		return o
+	}
+	if t.Availability > 0 {
+		summary.Objectives = append(summary.Objectives, objective("availability", t.Availability, func(c sloCounts) (uint64, uint64) {
+			return c.failed, c.total
+		}))
+	}
+	if t.Latency > 0 {
+		o := objective("latency", t.LatencyTarget, func(c sloCounts) (uint64, uint64) {
+			return c.slow, c.timed
+		})
+		o.Threshold = t.Latency.String()
+		summary.Objectives = append(summary.Objectives, o)
+	}
+	return summary
+}
+
+// Run updates the metrics of the objectives every interval until the context is cancelled.
+func (t *SLOTracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, objective := range t.Summary().Objectives {
+			SLOBudgetRemaining.WithLabelValues(objective.Name).Set(objective.BudgetRemaining)
+			for window, rate := range objective.BurnRates {
+				SLOBurnRate.WithLabelValues(objective.Name, window).Set(rate)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *SLOTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.Base.RoundTrip(req)
+	if errors.Is(err, context.Canceled) && req.Context().Err() != nil {
+		return resp, err // The client went away, neither good nor bad
+	}
+	failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+	timed := t.Latency > 0 && !failed && !StreamingFromContext(req.Context())
+	t.record(time.Now(), failed, timed, time.Since(start) > t.Latency)
+	return resp, err
+}
+
+// ServeHTTP implements the /admin/slo API: GET returns the SLOSummary.
+func (t *SLOTracker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.Summary()); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	SnapshotPages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "snapshot_pages_total",
+		Subsystem: "github",
+		Help:      "Number of pages of pagination snapshots by result (prefetched, served, live, expired)",
+	}, []string{"result"})
+)
+
+// SnapshotHeader is the request header starting a pagination snapshot of the listing, and the response header with
+// the ID of the snapshot a page was served from.
+const SnapshotHeader = "X-Proxy-Snapshot"
+
+// SnapshotParam is the query parameter the Link headers of a snapshot carry its ID in, never sent upstream.
+const SnapshotParam = "proxy_snapshot"
+
+// DefaultSnapshotPages is the default maximum number of pages of a snapshot.
+const DefaultSnapshotPages = 100
+
+// paginationSnapshot is the prefetched pages of a listing by their snapshotKey.
+type paginationSnapshot struct {
+	credential string
+	expires    time.Time
+	pages      map[string]*bufferedResponse
+}
+
+// snapshotKey returns the key of the page of the URL in a snapshot, ignoring the order of the query parameters.
+func snapshotKey(u *url.URL) string {
+	query := u.Query()
+	query.Del(SnapshotParam)
+	return strings.TrimPrefix(u.Path, "/api/v3") + "?" + query.Encode()
+}
+
+// rewriteLinks calls fn for the URL of every link of the Link header, replacing it by the result.
+func rewriteLinks(header http.Header, fn func(u *url.URL) string) {
+	values := header.Values("Link")
+	if len(values) == 0 {
+		return
+	}
+	var links []string
+	for _, value := range values {
+		for link := range strings.SplitSeq(value, ",") {
+			link = strings.TrimSpace(link)
+			target, params, ok := strings.Cut(strings.TrimPrefix(link, "<"), ">")
+			if u, err := url.Parse(target); ok && err == nil {
+				link = "<" + fn(u) + ">" + params
+			}
+			links = append(links, link)
+		}
+	}
+	header.Set("Link", strings.Join(links, ", "))
+}
+
+// nextLink returns the URL of the rel="next" link of the Link header, if any.
+func nextLink(header http.Header) *url.URL {
+	var next *url.URL
+	for _, value := range header.Values("Link") {
+		for link := range strings.SplitSeq(value, ",") {
+			target, params, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(link), "<"), ">")
+			if !ok || !strings.Contains(strings.ReplaceAll(params, " ", ""), `rel="next"`) {
+				continue
+			}
+			if u, err := url.Parse(target); err == nil {
+				next = u
+			}
+		}
+	}
+	return next
+}
+
+// SnapshotHandler serves consistent pagination snapshots: a GET request with the SnapshotHeader prefetches every page
+// of the listing (following the rel="next" links, up to MaxPages) back to back through the Handler, all pinned to
+// the same credential (see CredentialPool, so the pages share its view) and revalidated against the cache (so the
+// unchanged pages are free). Page requests following the links of a snapshot (which carry the SnapshotParam) are
+// served from it until it expires after the TTL, even if the listing changes upstream in the meantime, instead of
+// duplicating or skipping items. The pages beyond the MaxPages are served live, with the same credential.
+type SnapshotHandler struct {
+	Handler  http.Handler
+	Pool     *CredentialPool
+	TTL      time.Duration
+	MaxPages int
+
+	mu        sync.Mutex
+	snapshots map[string]*paginationSnapshot
+}
+
+// get returns the (unexpired) snapshot with the ID.
+func (h *SnapshotHandler) get(id string) *paginationSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snapshot, ok := h.snapshots[id]
+	if !ok || !time.Now().Before(snapshot.expires) {
+		return nil
+	}
+	return snapshot
+}
+
+// put stores the snapshot with the ID, forgetting the expired snapshots.
+func (h *SnapshotHandler) put(id string, snapshot *paginationSnapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for id, snapshot := range h.snapshots {
+		if !now.Before(snapshot.expires) {
+			delete(h.snapshots, id)
+		}
+	}
+	if h.snapshots == nil {
+		h.snapshots = make(map[string]*paginationSnapshot)
+	}
+	h.snapshots[id] = snapshot
+}
+
+// snapshotLink returns the URL of the link with the ID of the snapshot.
+func snapshotLink(id string) func(u *url.URL) string {
+	return func(u *url.URL) string {
+		query := u.Query()
+		query.Set(SnapshotParam, id)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+}
+
+// writePage writes the buffered page to the http.ResponseWriter, honoring the If-None-Match of the request.
+func writePage(w http.ResponseWriter, req *http.Request, page *bufferedResponse) {
+	for name, values := range page.header {
+		w.Header()[name] = values
+	}
+	if etag := page.header.Get("ETag"); etag != "" && req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(page.body.Len()))
+	w.WriteHeader(page.status)
+	_, _ = w.Write(page.body.Bytes())
+}
+
+func (h *SnapshotHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := req.Header.Get(SnapshotHeader) != ""
+	req.Header.Del(SnapshotHeader)
+	id := req.URL.Query().Get(SnapshotParam)
+	switch {
+	case req.Method != http.MethodGet:
+	case id != "":
+		snapshot := h.get(id)
+		if snapshot == nil {
+			SnapshotPages.WithLabelValues("expired").Inc()
+			WriteProxyError(w, http.StatusGone, ReasonSnapshotExpired, "The pagination snapshot expired, restart the listing")
+			return
+		}
+		if page, ok := snapshot.pages[snapshotKey(req.URL)]; ok {
+			SnapshotPages.WithLabelValues("served").Inc()
+			writePage(w, req, page)
+			return
+		}
+		// Beyond the prefetched pages, continue the listing live with the same credential.
+		SnapshotPages.WithLabelValues("live").Inc()
+		target := *req.URL
+		query := target.Query()
+		query.Del(SnapshotParam)
+		target.RawQuery = query.Encode()
+		page := subrequest(h.Handler, req.WithContext(WithCredential(req.Context(), snapshot.credential)), req.Method, target.RequestURI(), nil, nil)
+		rewriteLinks(page.header, snapshotLink(id))
+		writePage(w, req, page)
+		return
+	case start:
+		h.prefetch(w, req)
+		return
+	}
+	h.Handler.ServeHTTP(w, req)
+}
+
+// prefetch creates the snapshot of the listing of the request, responding with its first page.
+func (h *SnapshotHandler) prefetch(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	credential := CredentialFromContext(ctx)
+	if credential == "" {
+		best := h.Pool.Best(req)
+		if best == nil {
+			h.Handler.ServeHTTP(w, req)
+			return
+		}
+		credential = best.ID
+		ctx = WithCredential(ctx, credential)
+	}
+	parent := req.WithContext(ctx)
+	first := subrequest(h.Handler, parent, req.Method, req.URL.RequestURI(), nil, nil)
+	if first.status != http.StatusOK || nextLink(first.header) == nil {
+		writePage(w, req, first) // Not a (successful) listing of several pages
+		return
+	}
+
+	id := rand.Text()
+	snapshot := &paginationSnapshot{
+		credential: credential,
+		pages:      map[string]*bufferedResponse{snapshotKey(req.URL): first},
+	}
+	maxPages := cmp.Or(h.MaxPages, DefaultSnapshotPages)
+	for page, next := first, nextLink(first.header); next != nil && len(snapshot.pages) < maxPages; next = nextLink(page.header) {
+		key := snapshotKey(next)
+		if _, ok := snapshot.pages[key]; ok {
+			break // The links loop
+		}
+		page = subrequest(h.Handler, parent, http.MethodGet, next.RequestURI(), nil, nil)
+		if page.status != http.StatusOK {
+			break // Served live once requested
+		}
+		snapshot.pages[key] = page
+	}
+	SnapshotPages.WithLabelValues("prefetched").Add(float64(len(snapshot.pages)))
+	for _, page := range snapshot.pages {
+		rewriteLinks(page.header, snapshotLink(id))
+		page.header.Set(SnapshotHeader, id)
+	}
+	snapshot.expires = time.Now().Add(h.TTL)
+	h.put(id, snapshot)
+	writePage(w, req, first)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	bboltstorage "github.com/bored-engineer/github-conditional-http-transport/bbolt"
+	"github.com/bored-engineer/github-conditional-http-transport/memory"
+	pebblestorage "github.com/bored-engineer/github-conditional-http-transport/pebble"
+	redisstorage "github.com/bored-engineer/github-conditional-http-transport/redis"
+	s3storage "github.com/bored-engineer/github-conditional-http-transport/s3"
+	"github.com/redis/go-redis/v9"
+)
+
+// openS3 opens the S3 storage of the bucket in the region, sharing the endpoint, prefix, encryption, tags and key
+// hashing of the configured cache.
+func openS3(ctx context.Context, cfg *Config, region string, bucket string) (ghtransport.Storage, error) {
+	awsConfig, err := LoadAWSConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("LoadAWSConfig failed: %w", err)
+	}
+	if region != "" {
+		awsConfig.Region = region
+	}
+	tagging, err := S3ObjectTagging(cfg.S3ObjectTags)
+	if err != nil {
+		return nil, fmt.Errorf("S3ObjectTagging failed: %w", err)
+	}
+	s3Client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if cfg.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.S3Endpoint)
+			// https://xuanwo.io/links/2025/02/aws_s3_sdk_breaks_its_compatible_services/
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		}
+		if cfg.S3SSEKMSKeyID != "" || tagging != "" {
+			o.APIOptions = append(o.APIOptions, S3PutObjectMiddleware(cfg.S3SSEKMSKeyID, tagging))
+		}
+	})
+	s3Storage, err := s3storage.New(s3Client, bucket, cfg.S3Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("s3storage.New failed: %w", err)
+	}
+	if cfg.S3KeyHash != S3KeyHashNever {
+		return &HashedS3Storage{Storage: s3Storage}, nil
+	}
+	return s3Storage, nil
+}
+
+// OpenStorage opens the configured storage backend (defaulting to in-memory), wrapped to scrub secrets and vary the
+// cache key. The returned function closes the backend.
+func OpenStorage(ctx context.Context, cfg *Config) (ghtransport.Storage, func() error, error) {
+	var storage ghtransport.Storage
+	closeStorage := func() error { return nil }
+	// Bound the operations of a remote backend (see BreakerStorage).
+	guard := func(storage ghtransport.Storage, backend string) ghtransport.Storage {
+		if cfg.StorageTimeout <= 0 {
+			return storage
+		}
+		return NewBreakerStorage(ctx, storage, backend, cfg.StorageWorkers, cfg.StorageTimeout, cfg.StorageFailures, cfg.StorageCooldown)
+	}
+	if cfg.PebbleDBPath != "" {
+		pebbleStorage, err := pebblestorage.Open(cfg.PebbleDBPath, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pebblestorage.Open failed: %w", err)
+		}
+		closeStorage = func() error {
+			if err := pebbleStorage.DB.Close(); err != nil {
+				return fmt.Errorf("(*pebble.DB).Close failed: %w", err)
+			}
+			return nil
+		}
+		storage = pebbleStorage
+	} else if cfg.BoltDBPath != "" {
+		boltStorage, err := bboltstorage.Open(cfg.BoltDBPath, 0600, nil, []byte(cfg.BoltDBBucket))
+		if err != nil {
+			return nil, nil, fmt.Errorf("bboltstorage.Open failed: %w", err)
+		}
+		closeStorage = func() error {
+			if err := boltStorage.DB.Close(); err != nil {
+				return fmt.Errorf("(*bbolt.DB).Close failed: %w", err)
+			}
+			return nil
+		}
+		storage = boltStorage
+	} else if cfg.S3Bucket != "" {
+		// The key of every bucket (see S3Key), the replicas share their keys.
+		s3storage.Key = S3Key(cfg.S3KeyHash, cfg.S3Prefix)
+		s3Storage, err := openS3(ctx, cfg, cfg.S3Region, cfg.S3Bucket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("openS3 failed: %w", err)
+		}
+		storage = guard(s3Storage, "s3")
+		// Replicate the cache across the regions (see ReplicatedStorage).
+		if len(cfg.S3ReplicateTo) > 0 || cfg.S3ReadThrough != "" {
+			var primary ghtransport.Storage
+			if cfg.S3ReadThrough != "" {
+				replica, err := ParseS3Replica(cfg.S3ReadThrough)
+				if err != nil {
+					return nil, nil, fmt.Errorf("ParseS3Replica failed: %w", err)
+				}
+				if primary, err = openS3(ctx, cfg, replica.Region, replica.Bucket); err != nil {
+					return nil, nil, fmt.Errorf("openS3 failed: %w", err)
+				}
+			}
+			var peers []*ReplicaPeer
+			for _, spec := range cfg.S3ReplicateTo {
+				replica, err := ParseS3Replica(spec)
+				if err != nil {
+					return nil, nil, fmt.Errorf("ParseS3Replica failed: %w", err)
+				}
+				peer, err := openS3(ctx, cfg, replica.Region, replica.Bucket)
+				if err != nil {
+					return nil, nil, fmt.Errorf("openS3 failed: %w", err)
+				}
+				peers = append(peers, &ReplicaPeer{Region: replica.Region, Storage: peer})
+			}
+			replicated := NewReplicatedStorage(storage, primary, peers, cmp.Or(cfg.S3ReplicationQueue, DefaultReplicationQueue))
+			closeStorage = func() error {
+				replicated.Close()
+				return nil
+			}
+			storage = replicated
+		}
+	} else if cfg.RedisAddr != "" {
+		redisClient := redis.NewClient(&redis.Options{
+			Addr:     cfg.RedisAddr,
+			Username: cfg.RedisUsername,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+			Dialer:   RedisDialer(),
+		})
+		closeStorage = redisClient.Close
+		storage = guard(redisstorage.New(redisClient), "redis")
+		if cfg.Sidecar {
+			storage = &TieredStorage{
+				Local:  NewMemoryStorage(cmp.Or(cfg.CacheMemoryBudget, SidecarMemoryBudget)),
+				Shared: storage,
+			}
+		}
+	} else if cfg.CacheMemoryBudget > 0 || cfg.Sidecar {
+		storage = NewMemoryStorage(cmp.Or(cfg.CacheMemoryBudget, SidecarMemoryBudget))
+	} else {
+		storage = memory.NewStorage()
+	}
+
+	// Serve cache hits directly from storage if the backend supports it.
+	storage = NewStreamingStorage(storage)
+
+	// Share the cached responses with the other replicas.
+	var mesh *MeshStorage
+	if len(cfg.MeshPeer) > 0 {
+		mesh = &MeshStorage{
+			Local:   storage,
+			URL:     strings.TrimSuffix(cfg.MeshURL, "/"),
+			Secret:  cfg.MeshSecret,
+			MaxKeys: cfg.MeshKeys,
+		}
+		for _, peer := range cfg.MeshPeer {
+			mesh.Peers = append(mesh.Peers, strings.TrimSuffix(peer, "/"))
+		}
+		storage = mesh
+	}
+
+	// Encrypt the cached responses at rest.
+	if len(cfg.CacheEncryptionKey) > 0 {
+		encrypted := &EncryptedStorage{
+			Storage:         storage,
+			RejectPlaintext: cfg.CacheRejectPlaintext,
+		}
+		for _, spec := range cfg.CacheEncryptionKey {
+			key, err := LoadEncryptionKey(ctx, spec)
+			if err != nil {
+				return nil, nil, fmt.Errorf("LoadEncryptionKey failed: %w", err)
+			}
+			encrypted.Keys = append(encrypted.Keys, key)
+		}
+		storage = encrypted
+	}
+
+	// Never persist any secrets in the cache.
+	if cfg.ScrubResponses {
+		storage = &ScrubStorage{
+			Storage:  storage,
+			Scrubber: DefaultScrubber,
+		}
+	}
+
+	// Vary the cache key by the namespace and relevant request headers (Accept, API version, etc).
+	keyed := NewKeyStorage(storage, cfg.CacheVary...)
+	keyed.Namespace = &CacheNamespace{Base: cfg.CacheNamespace, Storage: keyed}
+	keyed.Mesh = mesh
+
+	return keyed, closeStorage, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+type streamKey struct{}
+
+// WithStreaming returns a copy of the context marking the request as streaming.
+func WithStreaming(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamKey{}, true)
+}
+
+// StreamingFromContext reports if the request was marked as streaming.
+func StreamingFromContext(ctx context.Context) bool {
+	streaming, _ := ctx.Value(streamKey{}).(bool)
+	return streaming
+}
+
+// eventStream reports if the header describes a Server-Sent Events stream.
+func eventStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// StreamTransport disables the buffering of streaming responses (SSE, WebSocket upgrades and the configured Patterns)
+// so each write from the upstream is flushed to the client immediately.
+type StreamTransport struct {
+	Base http.RoundTripper
+	// Patterns are path.Match patterns (ex: /repos/*/*/actions/jobs/*/logs) for paths that are always streamed.
+	Patterns []string
+}
+
+// Streaming reports if the request should be streamed.
+func (t *StreamTransport) Streaming(req *http.Request) bool {
+	if req.Header.Get("Upgrade") != "" {
+		return true
+	}
+	for _, accept := range req.Header.Values("Accept") {
+		if strings.Contains(accept, "text/event-stream") {
+			return true
+		}
+	}
+	p := "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/api/v3"), "/")
+	for _, pattern := range t.Patterns {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *StreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.Streaming(req) {
+		return t.Base.RoundTrip(req)
+	}
+	resp, err := t.Base.RoundTrip(req.WithContext(WithStreaming(req.Context())))
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, err
+	}
+	// An unknown length causes the httputil.ReverseProxy to flush after every write.
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	// Also disable the buffering of any intermediate proxies (ex: nginx).
+	resp.Header.Set("X-Accel-Buffering", "no")
+	return resp, nil
+}
+
+// scrubReader scrubs secrets from a (line-oriented) stream one line at a time.
+type scrubReader struct {
+	reader  *bufio.Reader
+	closer  io.Closer
+	scrub   func([]byte) ([]byte, bool)
+	pending []byte
+	err     error
+}
+
+func (r *scrubReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		line, err := r.reader.ReadBytes('\n')
+		r.err = err
+		if len(line) > 0 {
+			scrubbed, ok := r.scrub(line)
+			if ok {
+				ScrubbedSecrets.WithLabelValues("response").Inc()
+			}
+			r.pending = scrubbed
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *scrubReader) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "webhook_deliveries_total",
+		Subsystem: "github",
+		Help:      "Number of webhook deliveries received by result (published, invalid_signature, invalid)",
+	}, []string{"result"})
+)
+
+// maxWebhookBody is the maximum size of a webhook delivery, GitHub caps the payloads at 25 MB.
+const maxWebhookBody = 25 << 20
+
+// webhookName returns the webhook event name of an events API type, ex: "PullRequestEvent" is "pull_request".
+func webhookName(eventType string) string {
+	var name strings.Builder
+	for idx, r := range strings.TrimSuffix(eventType, "Event") {
+		if unicode.IsUpper(r) {
+			if idx > 0 {
+				name.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		name.WriteRune(r)
+	}
+	return name.String()
+}
+
+// WebhookHub fans the webhook deliveries (see WebhookHandler) out to the subscribers of their repository.
+type WebhookHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan Event]struct{}
+}
+
+// Subscribe subscribes to the deliveries of the repository (owner/name), until the cancel func is called.
+func (h *WebhookHub) Subscribe(repo string) (<-chan Event, func()) {
+	repo = strings.ToLower(repo)
+	ch := make(chan Event, maxRecentEvents)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers == nil {
+		h.subscribers = make(map[string]map[chan Event]struct{})
+	}
+	if h.subscribers[repo] == nil {
+		h.subscribers[repo] = make(map[chan Event]struct{})
+	}
+	h.subscribers[repo][ch] = struct{}{}
+	EventSubscribers.Inc()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			EventSubscribers.Dec()
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if delete(h.subscribers[repo], ch); len(h.subscribers[repo]) == 0 {
+				delete(h.subscribers, repo)
+			}
+		})
+	}
+}
+
+// Publish sends the event to every subscriber of the repository.
+func (h *WebhookHub) Publish(repo string, event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers[strings.ToLower(repo)] {
+		select {
+		case ch <- event:
+			EventsDelivered.WithLabelValues("delivered").Inc()
+		default:
+			EventsDelivered.WithLabelValues("dropped").Inc() // The subscriber is not keeping up
+		}
+	}
+}
+
+// WebhookHandler implements the /webhooks API: POST receives the webhook deliveries of GitHub, verifying their
+// X-Hub-Signature-256 with the Secret, and publishes them to the Hub.
+type WebhookHandler struct {
+	Secret string
+	Hub    *WebhookHub
+}
+
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxWebhookBody))
+	if err != nil {
+		WebhookDeliveries.WithLabelValues("invalid").Inc()
+		WriteProxyError(w, http.StatusRequestEntityTooLarge, ReasonInvalidRequest, "The webhook delivery is too large")
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	signature, err := hex.DecodeString(strings.TrimPrefix(req.Header.Get("X-Hub-Signature-256"), "sha256="))
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		WebhookDeliveries.WithLabelValues("invalid_signature").Inc()
+		WriteProxyError(w, http.StatusUnauthorized, ReasonInvalidRequest, "The X-Hub-Signature-256 of the webhook delivery is invalid")
+		return
+	}
+	var payload struct {
+		Repository *struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}
+	var compact bytes.Buffer
+	if err := json.Unmarshal(body, &payload); err != nil || json.Compact(&compact, body) != nil {
+		WebhookDeliveries.WithLabelValues("invalid").Inc()
+		WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The webhook delivery must be a JSON payload")
+		return
+	}
+	WebhookDeliveries.WithLabelValues("published").Inc()
+	if payload.Repository != nil {
+		h.Hub.Publish(payload.Repository.FullName, Event{
+			ID:   req.Header.Get("X-GitHub-Delivery"),
+			Type: req.Header.Get("X-GitHub-Event"),
+			Data: compact.Bytes(),
+		})
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// SubscribeHandler implements the /subscribe API: GET streams the events of the repo (owner/name) as Server-Sent
+// Events, optionally only the comma separated webhook event names (ex: push,issues). The events are the webhook
+// deliveries if the Webhooks hub is set, otherwise they are polled from the events API (see EventHub). Either way the
+// event names are those of the webhooks.
+type SubscribeHandler struct {
+	Events   *EventHub
+	Webhooks *WebhookHub
+}
+
+func (h *SubscribeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		WriteProxyError(w, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, "Method not allowed")
+		return
+	}
+	query := req.URL.Query()
+	repo := query.Get("repo")
+	if owner, name, ok := strings.Cut(repo, "/"); !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "The repo parameter must be owner/name")
+		return
+	}
+	var names []string
+	for name := range strings.SplitSeq(query.Get("events"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	filter := func(event Event) (Event, bool) {
+		if strings.HasSuffix(event.Type, "Event") {
+			event.Type = webhookName(event.Type)
+		}
+		return event, len(names) == 0 || slices.Contains(names, event.Type)
+	}
+	var events <-chan Event
+	var cancel func()
+	if h.Webhooks != nil {
+		events, cancel = h.Webhooks.Subscribe(repo)
+	} else {
+		events, cancel = h.Events.Subscribe(req.Context(), "/repos/"+repo+"/events", req.Header.Get("Last-Event-ID"))
+	}
+	defer cancel()
+	log.Debug().Str("repo", repo).Strs("events", names).Msg("subscribed")
+	ServeEvents(w, req, events, filter)
+}
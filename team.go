@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// TeamHeader is the request header used by inbound clients to attribute their requests for chargeback.
+// It is stripped before the request is sent upstream.
+const TeamHeader = "X-Proxy-Team"
+
+var (
+	TeamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "team_requests_total",
+		Subsystem: "github",
+		Help:      "Number of requests attributed to each team via the X-Proxy-Team header",
+	}, []string{"team", "resource"})
+	TeamCost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "team_cost_total",
+		Subsystem: "github",
+		Help:      "Estimated rate-limit cost (requests or GraphQL points) attributed to each team",
+	}, []string{"team", "resource"})
+)
+
+// TeamUsage is the accumulated usage for a single team and resource.
+type TeamUsage struct {
+	Team     string               `json:"team"`
+	Resource ghratelimit.Resource `json:"resource"`
+	Requests uint64               `json:"requests"`
+	Cost     uint64               `json:"cost"`
+}
+
+// graphqlCost extracts the "rateLimit.cost" from a GraphQL response body if it was queried.
+func graphqlCost(body []byte) (uint64, bool) {
+	var parsed struct {
+		Data struct {
+			RateLimit *struct {
+				Cost uint64 `json:"cost"`
+			} `json:"rateLimit"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil || parsed.Data.RateLimit == nil {
+		return 0, false
+	}
+	return parsed.Data.RateLimit.Cost, true
+}
+
+// TeamTransport accumulates per-team request counts and the estimated rate-limit cost.
+// REST requests served from the cache are free, everything else costs a single request.
+// GraphQL requests cost the "rateLimit.cost" if queried, otherwise the minimum of a single point.
+type TeamTransport struct {
+	Base http.RoundTripper
+
+	mu    sync.Mutex
+	usage map[string]map[ghratelimit.Resource]*TeamUsage
+	since time.Time
+}
+
+func (t *TeamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	team := req.Header.Get(TeamHeader)
+	if team == "" {
+		return t.Base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Del(TeamHeader)
+
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	resource := ghratelimit.InferResource(req)
+	cost := uint64(1)
+	if resp.Header.Get(ghtransport.CachedRequestIDHeader) != "" {
+		cost = 0
+	} else if resource == ghratelimit.ResourceGraphQL && resp.StatusCode == http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("(*http.Response).Body.Read failed: %w", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if points, ok := graphqlCost(body); ok {
+			cost = points
+		}
+	}
+	t.record(team, resource, cost)
+	return resp, nil
+}
+
+func (t *TeamTransport) record(team string, resource ghratelimit.Resource, cost uint64) {
+	label := TeamLabels.Value(team)
+	TeamRequests.WithLabelValues(label, resource.String()).Inc()
+	TeamCost.WithLabelValues(label, resource.String()).Add(float64(cost))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.usage == nil {
+		t.usage = make(map[string]map[ghratelimit.Resource]*TeamUsage)
+		t.since = time.Now()
+	}
+	resources, ok := t.usage[team]
+	if !ok {
+		resources = make(map[ghratelimit.Resource]*TeamUsage)
+		t.usage[team] = resources
+	}
+	usage, ok := resources[resource]
+	if !ok {
+		usage = &TeamUsage{Team: team, Resource: resource}
+		resources[resource] = usage
+	}
+	usage.Requests++
+	usage.Cost += cost
+}
+
+// WriteReport (atomically) writes the accumulated per-team usage as JSON to the file at path.
+func (t *TeamTransport) WriteReport(path string) error {
+	t.mu.Lock()
+	report := struct {
+		Since     time.Time    `json:"since,omitzero"`
+		Generated time.Time    `json:"generated"`
+		Usage     []*TeamUsage `json:"usage"`
+	}{
+		Since:     t.since,
+		Generated: time.Now(),
+		Usage:     []*TeamUsage{},
+	}
+	for _, resources := range t.usage {
+		for _, usage := range resources {
+			copied := *usage
+			report.Usage = append(report.Usage, &copied)
+		}
+	}
+	t.mu.Unlock()
+
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent failed: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("os.CreateTemp failed: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("(*os.File).Write failed: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("(*os.File).Close failed: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("os.Rename failed: %w", err)
+	}
+	return nil
+}
+
+// Poll writes the report to the file at path every interval until the context is cancelled.
+func (t *TeamTransport) Poll(ctx context.Context, interval time.Duration, path string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.WriteReport(path); err != nil {
+				log.Error().Err(err).Str("path", path).Msg("(*TeamTransport).WriteReport failed")
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// CacheStores counts the responses written to storage by result.
+var CacheStores = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:      "cache_stores_total",
+		Help:      "Responses written to the cache storage by result (stored, too_large, aborted, failed)",
+		Subsystem: "github",
+	},
+	[]string{"result"},
+)
+
+var (
+	// errTeeAborted is returned to the storage when the body was not fully read (ex: the client disconnected).
+	errTeeAborted = errors.New("response body was not read to EOF")
+	// errTeeTooLarge is returned to the storage when the body exceeded the maximum size.
+	errTeeTooLarge = errors.New("response body exceeded the maximum cached size")
+)
+
+// TeeStorage streams the body of a response being stored to the client and the wrapped storage simultaneously,
+// rather than the storage buffering the entire body before the client receives the first byte. The body is handed
+// to the storage through a pipe so at most a single read is in-flight between the two. The client's final read waits
+// for the write to storage to complete, so a subsequent request will find the response in the cache.
+type TeeStorage struct {
+	ghtransport.Storage
+	// MaxBody (optional) is the maximum size of a cached body, larger responses are streamed but never stored.
+	MaxBody int64
+}
+
+func (s *TeeStorage) Put(ctx context.Context, resp *http.Response) error {
+	if s.MaxBody > 0 && resp.ContentLength > s.MaxBody {
+		CacheStores.WithLabelValues("too_large").Inc()
+		return nil // Known upfront, don't even start storing it
+	}
+	pr, pw := io.Pipe()
+	stored := *resp
+	stored.Body = pr
+	// Per the storage contract, replace the body, it is now consumed by the client.
+	body := &teeBody{ReadCloser: resp.Body, pw: pw, max: s.MaxBody, stored: make(chan struct{})}
+	resp.Body = body
+	go func() {
+		defer close(body.stored)
+		// The client may finish (and cancel the request context) before the write to storage completes.
+		err := s.Storage.Put(context.WithoutCancel(ctx), &stored)
+		switch {
+		case errors.Is(err, errTeeTooLarge):
+			CacheStores.WithLabelValues("too_large").Inc()
+		case errors.Is(err, errTeeAborted):
+			CacheStores.WithLabelValues("aborted").Inc()
+		case err != nil:
+			CacheStores.WithLabelValues("failed").Inc()
+			log.Error().Err(err).Str("url", stored.Request.URL.String()).Msg("(ghtransport.Storage).Put failed")
+		default:
+			CacheStores.WithLabelValues("stored").Inc()
+		}
+		// Unblock the client if the storage returned without consuming the entire body.
+		pr.CloseWithError(io.ErrClosedPipe)
+	}()
+	return nil
+}
+
+// teeBody copies everything read by the client into the pipe to storage.
+type teeBody struct {
+	io.ReadCloser
+	pw   *io.PipeWriter
+	max  int64
+	n    int64
+	once sync.Once
+	done atomic.Bool
+	// stored is closed once the write to storage has completed.
+	stored chan struct{}
+}
+
+// finish closes the pipe to storage (exactly once), a nil error marks the body as complete.
+func (b *teeBody) finish(err error) {
+	b.once.Do(func() {
+		b.done.Store(true)
+		_ = b.pw.CloseWithError(err)
+	})
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.done.Load() {
+		if b.n += int64(n); b.max > 0 && b.n > b.max {
+			b.finish(errTeeTooLarge)
+		} else if _, werr := b.pw.Write(p[:n]); werr != nil {
+			b.finish(werr) // The storage gave up, keep streaming to the client regardless
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		b.finish(nil)
+		<-b.stored
+	} else if err != nil {
+		b.finish(fmt.Errorf("%w: %w", errTeeAborted, err))
+	}
+	return n, err
+}
+
+func (b *teeBody) Close() error {
+	b.finish(errTeeAborted)
+	return b.ReadCloser.Close()
+}
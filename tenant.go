@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	TenantRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "tenant_requests_total",
+		Subsystem: "github",
+		Help:      "Number of requests by tenant, resource and if they were served from the cache",
+	}, []string{"tenant", "resource", "cached"})
+	TenantRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "tenant_rejected_total",
+		Subsystem: "github",
+		Help:      "Number of requests rejected by tenant and reason (unknown_tenant, tenant_quota_exceeded)",
+	}, []string{"tenant", "reason"})
+)
+
+// TenantTokenHeader is the request header carrying the secret token authenticating the tenant of the request.
+const TenantTokenHeader = "X-Proxy-Tenant-Token"
+
+// Tenant is a group of inbound clients sharing a subset of the credentials, a cache partition and a quota. The
+// inbound clients matching all of its (set) conditions belong to it, a tenant (except the default one) must at least
+// be authenticated by a token or the source network: the client identity is chosen by the client itself.
+type Tenant struct {
+	// Name identifies the tenant in the cache keys and metric labels.
+	Name string `json:"name"`
+	// Tokens are the hex-encoded SHA-256 hashes of the tokens, one of which the TenantTokenHeader must carry.
+	Tokens []string `json:"token_sha256,omitempty"`
+	// CIDRs match the remote address of the inbound client.
+	CIDRs []string `json:"cidrs,omitempty"`
+	// Clients are path.Match patterns matched against the inbound client identity (see ClientHeader).
+	Clients []string `json:"clients,omitempty"`
+	// Credentials are the IDs of the credentials the tenant's requests are balanced across (defaults to all).
+	Credentials []string `json:"credentials,omitempty"`
+	// RPH (optional) is the maximum number of requests per hour sent upstream for the tenant, cache hits are free.
+	RPH int `json:"rph,omitempty"`
+	// VirtualRateLimit replaces the X-RateLimit-* headers of the responses (the quota of the credential) with the RPH
+	// quota, so the existing backoff of the clients enforces it.
+	VirtualRateLimit bool `json:"virtual_rate_limit,omitempty"`
+
+	prefixes []netip.Prefix
+	hashes   [][]byte
+	mu       sync.Mutex
+	used     int
+	reset    time.Time
+}
+
+// match reports if the inbound client belongs to the tenant, a tenant without any authentication never matches.
+func (t *Tenant) match(req *http.Request, token string) bool {
+	if len(t.hashes) == 0 && len(t.prefixes) == 0 {
+		return false
+	}
+	if len(t.hashes) > 0 {
+		hash := sha256.Sum256([]byte(token))
+		if token == "" || !slices.ContainsFunc(t.hashes, func(h []byte) bool { return subtle.ConstantTimeCompare(h, hash[:]) == 1 }) {
+			return false
+		}
+	}
+	if len(t.prefixes) > 0 {
+		addr, ok := remoteAddr(req)
+		if !ok || !slices.ContainsFunc(t.prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+			return false
+		}
+	}
+	if len(t.Clients) > 0 {
+		client := ClientFromContext(req.Context())
+		if !slices.ContainsFunc(t.Clients, func(pattern string) bool {
+			ok, _ := path.Match(pattern, client)
+			return ok
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// reserve counts a request against the quota of the tenant, returning the time the quota resets if it is exhausted.
+func (t *Tenant) reserve(now time.Time) (time.Time, bool) {
+	if t.RPH <= 0 {
+		return time.Time{}, true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !now.Before(t.reset) {
+		t.used, t.reset = 0, now.Add(time.Hour)
+	}
+	if t.used >= t.RPH {
+		return t.reset, false
+	}
+	t.used++
+	return t.reset, true
+}
+
+// refund returns a reserved request to the quota of the tenant (ex: it was served from the cache).
+func (t *Tenant) refund() {
+	if t.RPH <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.used = max(t.used-1, 0)
+}
+
+// quota returns the remaining requests of the quota of the tenant and the duration until it resets.
+func (t *Tenant) quota(now time.Time) (int, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !now.Before(t.reset) {
+		return t.RPH, time.Hour // The window starts with the next request
+	}
+	return max(t.RPH-t.used, 0), t.reset.Sub(now)
+}
+
+// SetRateLimitHeaders sets the IETF RateLimit headers (draft-ietf-httpapi-ratelimit-headers) of the quota of the
+// tenant, so generic HTTP clients can adapt to the proxy-enforced limit without understanding the X-RateLimit-*
+// headers of GitHub (which describe the quota of the credential instead).
+func (t *Tenant) SetRateLimitHeaders(header http.Header, now time.Time) {
+	if t.RPH <= 0 {
+		return
+	}
+	remaining, reset := t.quota(now)
+	header.Set("RateLimit-Limit", strconv.Itoa(t.RPH))
+	header.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(int((reset+time.Second-1)/time.Second)))
+	header.Set("RateLimit-Policy", strconv.Itoa(t.RPH)+";w=3600")
+}
+
+// SetVirtualRateLimitHeaders replaces the X-RateLimit-* headers of GitHub with the quota of the VirtualRateLimit
+// tenant, unless they report the credential is exhausted (the client must then back off until its reset).
+func (t *Tenant) SetVirtualRateLimitHeaders(header http.Header, now time.Time) {
+	if t.RPH <= 0 || !t.VirtualRateLimit || header.Get("X-RateLimit-Remaining") == "0" {
+		return
+	}
+	remaining, reset := t.quota(now)
+	header.Set("X-RateLimit-Limit", strconv.Itoa(t.RPH))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	header.Set("X-RateLimit-Used", strconv.Itoa(t.RPH-remaining))
+	header.Set("X-RateLimit-Reset", strconv.FormatInt(now.Add(reset+time.Second-1).Unix(), 10))
+}
+
+// Tenancy is the configuration of the tenants, loaded from a JSON file.
+type Tenancy struct {
+	Tenants []*Tenant `json:"tenants"`
+	// Default (optional) is the name of the tenant of inbound clients that don't match any tenant, otherwise they are
+	// rejected.
+	Default string `json:"default,omitempty"`
+}
+
+// LoadTenancy loads the tenants from the JSON file.
+func LoadTenancy(file string) (*Tenancy, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile failed: %w", err)
+	}
+	var tenancy Tenancy
+	if err := json.Unmarshal(b, &tenancy); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal failed: %w", err)
+	}
+	names := make(map[string]bool, len(tenancy.Tenants))
+	for _, tenant := range tenancy.Tenants {
+		if tenant.Name == "" || names[tenant.Name] {
+			return nil, fmt.Errorf("tenant names must be unique and non-empty: %q", tenant.Name)
+		}
+		names[tenant.Name] = true
+		if tenant.VirtualRateLimit && tenant.RPH <= 0 {
+			return nil, fmt.Errorf("virtual_rate_limit of tenant %q requires an rph", tenant.Name)
+		}
+		if len(tenant.Tokens) == 0 && len(tenant.CIDRs) == 0 && (len(tenant.Clients) > 0 || tenant.Name != tenancy.Default) {
+			return nil, fmt.Errorf("tenant %q must be authenticated by token_sha256 or cidrs", tenant.Name)
+		}
+		for _, pattern := range tenant.Clients {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid client pattern %q of tenant %q: %w", pattern, tenant.Name, err)
+			}
+		}
+		for _, token := range tenant.Tokens {
+			hash, err := hex.DecodeString(token)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid token_sha256 %q of tenant %q, expected a hex-encoded SHA-256", token, tenant.Name)
+			}
+			tenant.hashes = append(tenant.hashes, hash)
+		}
+		prefixes, err := ParseCIDRs(tenant.CIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("ParseCIDRs of tenant %q failed: %w", tenant.Name, err)
+		}
+		tenant.prefixes = prefixes
+	}
+	if tenancy.Default != "" && !names[tenancy.Default] {
+		return nil, fmt.Errorf("default tenant %q is not defined", tenancy.Default)
+	}
+	return &tenancy, nil
+}
+
+// Tenant returns the tenant of the inbound client (authenticated by the token of its TenantTokenHeader, if any), or
+// nil if it doesn't match any tenant (and there is no default).
+func (t *Tenancy) Tenant(req *http.Request, token string) *Tenant {
+	var fallback *Tenant
+	for _, tenant := range t.Tenants {
+		if tenant.match(req, token) {
+			return tenant
+		}
+		if tenant.Name == t.Default {
+			fallback = tenant
+		}
+	}
+	return fallback
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of the context carrying the tenant of the request.
+func WithTenant(ctx context.Context, tenant *Tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of the request from the context, if any.
+func TenantFromContext(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantKey{}).(*Tenant)
+	return tenant
+}
+
+// TenantHandler resolves the tenant of the inbound client (see ClientHandler) and stores it in the request context,
+// the remote address is only available to the handler. The TenantTokenHeader is always stripped, so the token never
+// reaches the upstream.
+type TenantHandler struct {
+	Handler http.Handler
+	Tenancy *Tenancy
+	Shadow  PolicyShadow
+}
+
+func (h *TenantHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	token := req.Header.Get(TenantTokenHeader)
+	req.Header.Del(TenantTokenHeader)
+	tenant := h.Tenancy.Tenant(req, token)
+	if tenant == nil {
+		if !h.Shadow.Deny(req, ReasonUnknownTenant) {
+			h.Handler.ServeHTTP(w, req) // Without a tenant, like without a tenancy
+			return
+		}
+		TenantRejected.WithLabelValues("", ReasonUnknownTenant).Inc()
+		WriteProxyError(w, http.StatusForbidden, ReasonUnknownTenant, "The client does not belong to any tenant of the proxy")
+		return
+	}
+	h.Handler.ServeHTTP(w, req.WithContext(WithTenant(req.Context(), tenant)))
+}
+
+// TenantTransport enforces the quota of the request's tenant and records the per-tenant metrics. The credential
+// subset (see CredentialPool) and cache partition (see KeyStorage) of the tenant are applied from the context.
+type TenantTransport struct {
+	Base   http.RoundTripper
+	Shadow PolicyShadow
+}
+
+func (t *TenantTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tenant := TenantFromContext(req.Context())
+	if tenant == nil {
+		return t.Base.RoundTrip(req)
+	}
+	now := time.Now()
+	reset, reserved := tenant.reserve(now)
+	if !reserved && t.Shadow.Deny(req, ReasonTenantQuota) {
+		TenantRejected.WithLabelValues(tenant.Name, ReasonTenantQuota).Inc()
+		resp := ProxyResponse(req, http.StatusTooManyRequests, ReasonTenantQuota, "The hourly quota of the tenant is exhausted, retry later")
+		resp.Header.Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Round(time.Second)/time.Second)))
+		tenant.SetRateLimitHeaders(resp.Header, now)
+		tenant.SetVirtualRateLimitHeaders(resp.Header, now)
+		return resp, nil
+	}
+	resp, err := t.Base.RoundTrip(req)
+	cached := err == nil && resp.Header.Get(ghtransport.CachedRequestIDHeader) != ""
+	if reserved && (cached || (err == nil && resp.Header.Get(ProxyErrorHeader) != "")) {
+		tenant.refund() // Only requests sent upstream count against the quota
+	}
+	if err == nil {
+		tenant.SetRateLimitHeaders(resp.Header, time.Now())
+		tenant.SetVirtualRateLimitHeaders(resp.Header, time.Now())
+	}
+	TenantRequests.WithLabelValues(tenant.Name, ghratelimit.InferResource(req).String(), strconv.FormatBool(cached)).Inc()
+	return resp, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	UpstreamTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "upstream_timeouts_total",
+		Subsystem: "github",
+		Help:      "Number of requests that exceeded their deadline, by route prefix",
+	}, []string{"route"})
+)
+
+// RouteTimeout is the overall deadline for all paths beginning with Prefix.
+type RouteTimeout struct {
+	Prefix  string
+	Timeout time.Duration
+}
+
+// ParseRouteTimeout parses a route deadline in the format "<prefix>=<duration>", ex: "/search/=10s".
+func ParseRouteTimeout(spec string) (RouteTimeout, error) {
+	prefix, value, ok := strings.Cut(spec, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return RouteTimeout{}, fmt.Errorf("invalid route timeout %q, expected <prefix>=<duration>", spec)
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return RouteTimeout{}, fmt.Errorf("time.ParseDuration failed: %w", err)
+	}
+	return RouteTimeout{Prefix: prefix, Timeout: timeout}, nil
+}
+
+// TimeoutTransport bounds the overall time (including any queueing) a request may take until its response body is consumed.
+// Requests exceeding their deadline before a response is received are answered with a 504.
+type TimeoutTransport struct {
+	Base http.RoundTripper
+	// Default is the deadline for any path not matching one of the Routes (0 for none).
+	Default time.Duration
+	// Routes override the Default for specific path prefixes, the longest matching prefix wins.
+	Routes []RouteTimeout
+}
+
+// route returns the most specific route prefix and deadline for the path.
+func (t *TimeoutTransport) route(path string) (string, time.Duration) {
+	path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, "/api/v3"), "/")
+	prefix, timeout := "", t.Default
+	for _, route := range t.Routes {
+		if strings.HasPrefix(path, route.Prefix) && len(route.Prefix) > len(prefix) {
+			prefix, timeout = route.Prefix, route.Timeout
+		}
+	}
+	return prefix, timeout
+}
+
+// timedOut reports if the error was caused by a deadline or timeout (ex: the upstream response header timeout).
+func timedOut(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func (t *TimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	prefix, timeout := t.route(req.URL.Path)
+	// Streams are expected to be long-lived, so are never subject to the deadline.
+	if timeout <= 0 || StreamingFromContext(req.Context()) {
+		return t.Base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := t.Base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		// If the client went away, there is nobody to respond to.
+		if req.Context().Err() == nil && timedOut(err) {
+			UpstreamTimeouts.WithLabelValues(prefix).Inc()
+			return ProxyResponse(req, http.StatusGatewayTimeout, ReasonTimeout, fmt.Sprintf("The upstream did not respond within %s", timeout)), nil
+		}
+		return nil, err
+	}
+	if resp.Body == nil {
+		cancel()
+		return resp, nil
+	}
+	// The deadline also bounds reading the response body.
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: cancel}
+	return resp, nil
+}
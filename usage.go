@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/rs/zerolog/log"
+)
+
+// UsageURL is the (synthetic) URL used to persist the usage windows in the storage backend.
+var UsageURL = &url.URL{
+	Scheme: "https",
+	Host:   InternalHost,
+	Path:   "/admin/usage",
+}
+
+// UsageKey identifies a route being called by a specific client.
+type UsageKey struct {
+	Method string `json:"method"`
+	Route  string `json:"route"`
+	Client string `json:"client,omitempty"`
+	// UserAgent is the normalized User-Agent of the client (see UserAgents), if attributed.
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// UsageCount is the accumulated usage for a UsageKey.
+type UsageCount struct {
+	UsageKey
+	// Requests is the total number of requests.
+	Requests uint64 `json:"requests"`
+	// Cached is the number of requests served from the cache (which do not consume rate-limit).
+	Cached uint64 `json:"cached"`
+	// Errors is the number of requests that failed or returned a 5xx status.
+	Errors uint64 `json:"errors"`
+}
+
+// UsageWindow is the usage for a single time window.
+type UsageWindow struct {
+	Start  time.Time     `json:"start"`
+	End    time.Time     `json:"end,omitzero"`
+	Counts []*UsageCount `json:"counts"`
+
+	index map[UsageKey]*UsageCount
+}
+
+// count returns the (possibly new) UsageCount for the key.
+func (w *UsageWindow) count(key UsageKey) *UsageCount {
+	if w.index == nil {
+		w.index = make(map[UsageKey]*UsageCount, len(w.Counts))
+		for _, count := range w.Counts {
+			w.index[count.UsageKey] = count
+		}
+	}
+	count, ok := w.index[key]
+	if !ok {
+		count = &UsageCount{UsageKey: key}
+		w.index[key] = count
+		w.Counts = append(w.Counts, count)
+	}
+	return count
+}
+
+// top returns a copy of the window with the counts sorted by requests, truncated to n (if positive).
+func (w *UsageWindow) top(n int) UsageWindow {
+	counts := make([]*UsageCount, 0, len(w.Counts))
+	for _, count := range w.Counts {
+		copied := *count
+		counts = append(counts, &copied)
+	}
+	slices.SortFunc(counts, func(a, b *UsageCount) int {
+		return cmp.Compare(b.Requests-b.Cached, a.Requests-a.Cached)
+	})
+	if n > 0 && len(counts) > n {
+		counts = counts[:n]
+	}
+	return UsageWindow{Start: w.Start, End: w.End, Counts: counts}
+}
+
+// UsageTransport aggregates request counts by route template and client (and User-Agent) over time windows.
+type UsageTransport struct {
+	Base http.RoundTripper
+	// Storage is (optionally) used to persist the usage windows across restarts.
+	Storage ghtransport.Storage
+	// Retention is the number of completed windows to retain.
+	Retention int
+	// UserAgents (optionally) attributes the usage to the normalized User-Agents of the clients too.
+	UserAgents *UserAgents
+
+	mu      sync.Mutex
+	current *UsageWindow
+	history []*UsageWindow
+}
+
+func (t *UsageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Base.RoundTrip(req)
+
+	key := UsageKey{
+		Method: req.Method,
+		Route:  RouteTemplate(req.URL.Path),
+		Client: ClientFromContext(req.Context()),
+	}
+	cached := err == nil && resp.Header.Get(ghtransport.CachedRequestIDHeader) != ""
+	if t.UserAgents != nil {
+		key.UserAgent = t.UserAgents.Normalize(req.Header.Get("User-Agent"))
+		// Only the requests sent upstream consume the rate-limit.
+		if err == nil && !cached && resp.Header.Get(ProxyErrorHeader) == "" {
+			UserAgentRequests.WithLabelValues(key.UserAgent, ghratelimit.InferResource(req).String()).Inc()
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current == nil {
+		t.current = &UsageWindow{Start: time.Now()}
+	}
+	count := t.current.count(key)
+	count.Requests++
+	if err != nil || resp.StatusCode >= 500 {
+		count.Errors++
+	} else if cached {
+		count.Cached++
+	}
+	return resp, err
+}
+
+// Rotate completes the current window, moving it into the history.
+func (t *UsageTransport) Rotate() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.current != nil {
+		t.current.End = now
+		t.history = append(t.history, t.current)
+		if t.Retention > 0 && len(t.history) > t.Retention {
+			t.history = slices.Delete(t.history, 0, len(t.history)-t.Retention)
+		}
+	}
+	t.current = &UsageWindow{Start: now}
+}
+
+// Windows returns a snapshot of the completed windows (oldest first) followed by the current window.
+// The counts in each window are sorted by (uncached) requests and truncated to top (if positive).
+func (t *UsageTransport) Windows(top int) []UsageWindow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	windows := make([]UsageWindow, 0, len(t.history)+1)
+	for _, window := range t.history {
+		windows = append(windows, window.top(top))
+	}
+	if t.current != nil {
+		windows = append(windows, t.current.top(top))
+	}
+	return windows
+}
+
+// Load restores the usage windows from the storage backend.
+func (t *UsageTransport) Load(ctx context.Context) error {
+	if t.Storage == nil {
+		return nil
+	}
+	resp, err := t.Storage.Get(ctx, &http.Request{Method: http.MethodGet, URL: UsageURL})
+	if err != nil {
+		return fmt.Errorf("(Storage).Get failed: %w", err)
+	}
+	if resp == nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	var windows []*UsageWindow
+	if err := json.NewDecoder(resp.Body).Decode(&windows); err != nil {
+		return fmt.Errorf("(*json.Decoder).Decode failed: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, window := range windows {
+		if window.End.IsZero() {
+			t.current = window
+		} else {
+			t.history = append(t.history, window)
+		}
+	}
+	return nil
+}
+
+// Save persists the usage windows to the storage backend.
+func (t *UsageTransport) Save(ctx context.Context) error {
+	if t.Storage == nil {
+		return nil
+	}
+	body, err := json.Marshal(t.Windows(0))
+	if err != nil {
+		return fmt.Errorf("json.Marshal failed: %w", err)
+	}
+	if err := t.Storage.Put(ctx, &http.Response{
+		Status:     http.StatusText(http.StatusOK),
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": []string{"application/json"},
+		},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       &http.Request{Method: http.MethodGet, URL: UsageURL},
+	}); err != nil {
+		return fmt.Errorf("(Storage).Put failed: %w", err)
+	}
+	return nil
+}
+
+// Poll rotates (and persists) the usage window every interval until the context is cancelled.
+// The caller is responsible for calling (*UsageTransport).Save one final time during shutdown.
+func (t *UsageTransport) Poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.Rotate()
+			if err := t.Save(ctx); err != nil {
+				log.Error().Err(err).Msg("(*UsageTransport).Save failed")
+			}
+		}
+	}
+}
+
+// ServeHTTP implements the /admin/usage report, the (optional) "top" query parameter limits the counts per window.
+func (t *UsageTransport) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var top int
+	if value := req.URL.Query().Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			WriteProxyError(w, http.StatusBadRequest, ReasonInvalidRequest, "Invalid top parameter")
+			return
+		}
+		top = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"windows": t.Windows(top),
+	}); err != nil {
+		log.Error().Err(err).Msg("(*json.Encoder).Encode failed")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	UserAgentRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "user_agent_requests_total",
+		Subsystem: "github",
+		Help:      "Number of requests sent upstream (consuming the rate-limit) by normalized User-Agent and resource",
+	}, []string{"user_agent", "resource"})
+)
+
+// The modes of the UserAgentTransport.
+const (
+	UserAgentAppend  = "append"
+	UserAgentReplace = "replace"
+)
+
+const (
+	// UserAgentNone is the normalized User-Agent of the requests without one.
+	UserAgentNone = "(none)"
+	// UserAgentOther is the normalized User-Agent of the requests beyond the cardinality cap.
+	UserAgentOther = "(other)"
+)
+
+// NormalizeUserAgent returns the name of the first product of the User-Agent, lower-cased and without its version or
+// comments, ex: "go-github/v68.0.0 (+https://example.com)" is "go-github".
+func NormalizeUserAgent(userAgent string) string {
+	product, _, _ := strings.Cut(strings.TrimSpace(userAgent), " ")
+	name, _, _ := strings.Cut(product, "/")
+	name = strings.ToLower(strings.Trim(name, `"'()[];,`))
+	if name == "" {
+		return UserAgentNone
+	}
+	return name
+}
+
+// UserAgents normalizes the User-Agents of the requests, capping their cardinality to the first Max distinct ones
+// (per process, the following are all UserAgentOther) so a client randomizing its User-Agent cannot blow up the
+// metrics and the usage report.
+type UserAgents struct {
+	Max int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// Normalize returns the normalized (and capped) User-Agent.
+func (u *UserAgents) Normalize(userAgent string) string {
+	name := NormalizeUserAgent(userAgent)
+	if name == UserAgentNone {
+		return name
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.seen[name]; ok {
+		return name
+	}
+	if len(u.seen) >= u.Max {
+		return UserAgentOther
+	}
+	if u.seen == nil {
+		u.seen = make(map[string]struct{})
+	}
+	u.seen[name] = struct{}{}
+	return name
+}
+
+// UserAgentTransport identifies the proxy in the User-Agent of the requests sent upstream (GitHub requires one and
+// throttles some tools by it): the UserAgent is appended to that of the client (or used alone without one), or replaces
+// it entirely with Replace. The User-Agent of the client is still logged (see LoggingTransport) and attributed (see
+// UserAgents), those run before it.
+type UserAgentTransport struct {
+	Base      http.RoundTripper
+	UserAgent string
+	Replace   bool
+}
+
+func (t *UserAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	userAgent := req.Header.Get("User-Agent")
+	switch {
+	case t.Replace || userAgent == "":
+		userAgent = t.UserAgent
+	case !strings.Contains(userAgent, t.UserAgent):
+		userAgent += " " + t.UserAgent
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", userAgent)
+	return t.Base.RoundTrip(req)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ValidationRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "validation_rejected_total",
+		Subsystem: "github",
+		Help:      "Number of requests rejected by the validation against the OpenAPI description, by reason",
+	}, []string{"reason"})
+)
+
+// validateValue returns why the value of the parameter does not match its schema, or an empty string if it does.
+func validateValue(parameter *OpenAPIParameter, value string) string {
+	schema := &parameter.Schema
+	types := schema.types()
+	var number *float64
+	switch {
+	case slices.Contains(types, "string"), len(types) == 0:
+	case slices.Contains(types, "integer"):
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Sprintf("%q is not an integer", value)
+		}
+		f := float64(n)
+		number = &f
+	case slices.Contains(types, "number"):
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Sprintf("%q is not a number", value)
+		}
+		number = &f
+	case slices.Contains(types, "boolean"):
+		if value != "true" && value != "false" {
+			return fmt.Sprintf("%q is not a boolean", value)
+		}
+	}
+	if len(schema.Enum) > 0 && !slices.ContainsFunc(schema.Enum, func(v any) bool { return fmt.Sprint(v) == value }) {
+		return fmt.Sprintf("%q is not one of %v", value, schema.Enum)
+	}
+	if number != nil && schema.Minimum != nil && *number < *schema.Minimum {
+		return fmt.Sprintf("%s is less than the minimum of %v", value, *schema.Minimum)
+	}
+	if number != nil && schema.Maximum != nil && *number > *schema.Maximum {
+		return fmt.Sprintf("%s is greater than the maximum of %v", value, *schema.Maximum)
+	}
+	return ""
+}
+
+// validateRequest returns why the path and query parameters of the request do not match the operation, or an empty
+// string if they do. The request bodies are not validated.
+func validateRequest(operation *OpenAPIOperation, req *http.Request) string {
+	segments := openAPISegments(req.URL.Path)
+	query := req.URL.Query()
+	for idx := range operation.Parameters {
+		parameter := &operation.Parameters[idx]
+		switch parameter.In {
+		case "path":
+			position := slices.Index(operation.segments, "{"+parameter.Name+"}")
+			if position < 0 || position >= len(segments) {
+				continue
+			}
+			value := segments[position]
+			if position == len(operation.segments)-1 {
+				value = strings.Join(segments[position:], "/")
+			}
+			if reason := validateValue(parameter, value); reason != "" {
+				return fmt.Sprintf("Invalid path parameter %s: %s", parameter.Name, reason)
+			}
+		case "query":
+			values, ok := query[parameter.Name]
+			if !ok {
+				if parameter.Required {
+					return fmt.Sprintf("Missing required query parameter %s", parameter.Name)
+				}
+				continue
+			}
+			for _, value := range values {
+				if reason := validateValue(parameter, value); reason != "" {
+					return fmt.Sprintf("Invalid query parameter %s: %s", parameter.Name, reason)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// ValidateTransport rejects the requests which do not match the operations of the OpenAPI Spec locally (instead of
+// spending quota on requests GitHub would reject anyway): an unknown path with a 404, a method the path does not
+// support with a 405 and invalid path or query parameters (ex: a per_page that is not an integer or exceeds the
+// maximum, a missing required parameter or a value outside of its enum) with a 422. GraphQL is not validated.
+type ValidateTransport struct {
+	Base http.RoundTripper
+	Spec *OpenAPISpec
+}
+
+func (t *ValidateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ghratelimit.InferResource(req) == ghratelimit.ResourceGraphQL {
+		return t.Base.RoundTrip(req)
+	}
+	method := req.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	operation, methods := t.Spec.Lookup(method, req.URL.Path)
+	if operation == nil && len(methods) == 0 {
+		ValidationRejected.WithLabelValues(ReasonUnknownRoute).Inc()
+		return ProxyResponse(req, http.StatusNotFound, ReasonUnknownRoute, fmt.Sprintf("%s does not match any operation of the API description", req.URL.Path)), nil
+	}
+	if operation == nil {
+		ValidationRejected.WithLabelValues(ReasonMethodNotAllowed).Inc()
+		resp := ProxyResponse(req, http.StatusMethodNotAllowed, ReasonMethodNotAllowed, fmt.Sprintf("%s does not support the %s method", req.URL.Path, req.Method))
+		resp.Header.Set("Allow", strings.Join(methods, ", "))
+		return resp, nil
+	}
+	if reason := validateRequest(operation, req); reason != "" {
+		ValidationRejected.WithLabelValues(ReasonInvalidParameter).Inc()
+		return ProxyResponse(req, http.StatusUnprocessableEntity, ReasonInvalidParameter, reason), nil
+	}
+	return t.Base.RoundTrip(req)
+}
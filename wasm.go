@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+var (
+	WASMFilterCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "wasm_filter_calls_total",
+		Subsystem: "github",
+		Help:      "Number of calls of the hooks of the --wasm-filter filters by result (ok, rejected, failed, timeout)",
+	}, []string{"filter", "hook", "result"})
+	WASMFilterDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:      "wasm_filter_duration_seconds",
+		Subsystem: "github",
+		Help:      "Time spent calling the hooks of the --wasm-filter filters",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"filter", "hook"})
+)
+
+// The defaults of the WASM filters.
+const (
+	DefaultWASMTimeout = 10 * time.Millisecond
+	// DefaultWASMMemory is the default memory limit (in MiB) of an instance of a filter.
+	DefaultWASMMemory = 64
+)
+
+// wasmInitTimeout is the deadline of the initialization of an instance of a filter, that of the runtime of its
+// language (ex: Go) is far slower than the calls of its hooks.
+const wasmInitTimeout = 5 * time.Second
+
+// wasmHostModule is the name of the module of the host functions imported by the filters.
+const wasmHostModule = "github_api_proxy"
+
+// The header maps of the get_header, set_header and remove_header host functions.
+const (
+	wasmRequestHeaders  = 0
+	wasmResponseHeaders = 1
+)
+
+// wasmCall is the state of a call of a hook of a filter, the host functions read (and modify) it. The modifications
+// are only applied to the request (or response) once the hook returned.
+type wasmCall struct {
+	req *http.Request
+	// resp is nil in the on_request hook.
+	resp   *http.Response
+	header http.Header
+	path   string
+	query  string
+	status int
+	// rejected is set by send_response, with the status and message.
+	rejected bool
+	message  string
+}
+
+type wasmCallKey struct{}
+
+// WASMFilter is an (experimental) WebAssembly filter of a FilterTransport, a sandbox shipped independently of the
+// proxy binary. Loosely modelled after proxy-wasm, a filter exports the on_request and/or on_response hooks (without
+// parameters nor results) which inspect and modify the request and response via the functions of the
+// github_api_proxy host module (see wasmHostModule):
+//
+//	get_header(map, name_ptr, name_len, buf_ptr, buf_len) -> len
+//	set_header(map, name_ptr, name_len, value_ptr, value_len) -> ok
+//	remove_header(map, name_ptr, name_len) -> ok
+//	get_property(name_ptr, name_len, buf_ptr, buf_len) -> len
+//	set_property(name_ptr, name_len, value_ptr, value_len) -> ok
+//	send_response(status, message_ptr, message_len) -> ok
+//	log(message_ptr, message_len)
+//
+// The map is 0 for the request headers and 1 for the response headers. The getters return the length of the value
+// (-1 if absent), only copying it into the buffer if it fits; the setters return 0, or -1 if the value is read-only
+// or invalid. The properties are method, path, query, remote_addr, client, tenant and status (path and query are
+// writable in on_request, status in on_response). send_response rejects the request (in on_request) with a status
+// between 400 and 599. The filters only get the WASI functions without a filesystem, network nor environment.
+type WASMFilter struct {
+	// Name is the name of the filter in the metrics and logs, the base name of its file.
+	Name    string
+	Timeout time.Duration
+
+	runtime   wazero.Runtime
+	compiled  wazero.CompiledModule
+	hooks     map[string]bool
+	instances chan api.Module
+}
+
+// LoadWASMFilter compiles the filter of the file, which must export at least one hook, each instance of the filter is
+// limited to memory MiB of memory.
+func LoadWASMFilter(ctx context.Context, path string, timeout time.Duration, memory int) (*WASMFilter, error) {
+	binary, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile failed: %w", err)
+	}
+	f := &WASMFilter{
+		Name:    filepath.Base(path),
+		Timeout: timeout,
+		runtime: wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+			WithCloseOnContextDone(true).
+			WithMemoryLimitPages(uint32(memory*16))), // 64 KiB pages
+		hooks:     make(map[string]bool),
+		instances: make(chan api.Module, runtime.GOMAXPROCS(0)),
+	}
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, f.runtime); err != nil {
+		f.Close(ctx)
+		return nil, fmt.Errorf("wasi_snapshot_preview1.Instantiate failed: %w", err)
+	}
+	if _, err := f.hostModule().Instantiate(ctx); err != nil {
+		f.Close(ctx)
+		return nil, fmt.Errorf("(wazero.HostModuleBuilder).Instantiate failed: %w", err)
+	}
+	if f.compiled, err = f.runtime.CompileModule(ctx, binary); err != nil {
+		f.Close(ctx)
+		return nil, fmt.Errorf("(wazero.Runtime).CompileModule failed: %w", err)
+	}
+	for _, hook := range []string{hookRequest, hookResponse} {
+		_, f.hooks[hook] = f.compiled.ExportedFunctions()[hook]
+	}
+	if !f.hooks[hookRequest] && !f.hooks[hookResponse] {
+		f.Close(ctx)
+		return nil, fmt.Errorf("filter %q exports neither %s nor %s", f.Name, hookRequest, hookResponse)
+	}
+	// Instantiate once to surface the errors of its initialization.
+	mod, err := f.instantiate(ctx)
+	if err != nil {
+		f.Close(ctx)
+		return nil, err
+	}
+	f.instances <- mod
+	return f, nil
+}
+
+// Close closes the runtime of the filter, including its instances.
+func (f *WASMFilter) Close(ctx context.Context) error {
+	return f.runtime.Close(ctx)
+}
+
+// instantiate returns a new instance of the filter, initialized (as a WASI reactor) within the wasmInitTimeout.
+func (f *WASMFilter) instantiate(ctx context.Context) (api.Module, error) {
+	ctx, cancel := context.WithTimeout(ctx, wasmInitTimeout)
+	defer cancel()
+	mod, err := f.runtime.InstantiateModule(ctx, f.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, fmt.Errorf("filter %q failed to initialize: %w", f.Name, err)
+	}
+	return mod, nil
+}
+
+// call calls the hook in an instance of the filter within the Timeout. An instance is discarded once a hook failed in
+// it, or if the idle instances are already as many as GOMAXPROCS.
+func (f *WASMFilter) call(ctx context.Context, hook string, call *wasmCall) error {
+	var mod api.Module
+	select {
+	case mod = <-f.instances:
+	default:
+		var err error
+		if mod, err = f.instantiate(context.WithoutCancel(ctx)); err != nil {
+			WASMFilterCalls.WithLabelValues(f.Name, hook, "failed").Inc()
+			return err
+		}
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, wasmCallKey{}, call), f.Timeout)
+	defer cancel()
+	_, err := mod.ExportedFunction(hook).Call(ctx)
+	WASMFilterDuration.WithLabelValues(f.Name, hook).Observe(time.Since(start).Seconds())
+	if err != nil {
+		result := "failed"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			result = "timeout"
+		}
+		WASMFilterCalls.WithLabelValues(f.Name, hook, result).Inc()
+		_ = mod.Close(context.WithoutCancel(ctx))
+		return err
+	}
+	if call.rejected {
+		WASMFilterCalls.WithLabelValues(f.Name, hook, "rejected").Inc()
+	} else {
+		WASMFilterCalls.WithLabelValues(f.Name, hook, "ok").Inc()
+	}
+	select {
+	case f.instances <- mod:
+	default:
+		_ = mod.Close(context.WithoutCancel(ctx))
+	}
+	return nil
+}
+
+// OnRequest calls the on_request hook, applying its modifications to the request. A status (and message) set by
+// send_response rejects the request.
+func (f *WASMFilter) OnRequest(req *http.Request) (status int, message string) {
+	call := &wasmCall{req: req, header: req.Header.Clone(), path: req.URL.Path, query: req.URL.RawQuery}
+	if err := f.call(req.Context(), hookRequest, call); err != nil {
+		log.Warn().Err(err).Str("filter", f.Name).Str("hook", hookRequest).Msg("WASM filter failed, the request proceeds unmodified")
+		return 0, ""
+	}
+	if call.rejected {
+		return call.status, call.message
+	}
+	req.Header = call.header
+	if call.path != req.URL.Path {
+		req.URL.Path, req.URL.RawPath = call.path, ""
+	}
+	req.URL.RawQuery = call.query
+	return 0, ""
+}
+
+// OnResponse calls the on_response hook, applying its modifications to the response.
+func (f *WASMFilter) OnResponse(req *http.Request, resp *http.Response) {
+	call := &wasmCall{req: req, resp: resp, header: resp.Header.Clone(), path: req.URL.Path, query: req.URL.RawQuery, status: resp.StatusCode}
+	err := f.call(req.Context(), hookResponse, call)
+	if err != nil {
+		log.Warn().Err(err).Str("filter", f.Name).Str("hook", hookResponse).Msg("WASM filter failed, the response proceeds unmodified")
+		return
+	}
+	resp.Header = call.header
+	if call.status != resp.StatusCode {
+		resp.StatusCode = call.status
+		resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	}
+}
+
+// wasmString reads the string of the memory of the module, the ok is false if it is out of range.
+func wasmString(mod api.Module, ptr, size uint32) (string, bool) {
+	b, ok := mod.Memory().Read(ptr, size)
+	return string(b), ok
+}
+
+// wasmCopy copies the value into the buffer of the module if it fits, returning its length.
+func wasmCopy(mod api.Module, value string, ptr, size uint32) int32 {
+	if len(value) <= int(size) && !mod.Memory().Write(ptr, []byte(value)) {
+		return -1
+	}
+	return int32(len(value))
+}
+
+// headers returns the header map of the call, it is only writable by the hook owning it.
+func (c *wasmCall) headers(kind uint32) (header http.Header, writable bool) {
+	switch {
+	case kind == wasmRequestHeaders && c.resp == nil:
+		return c.header, true
+	case kind == wasmRequestHeaders:
+		return c.req.Header, false
+	case kind == wasmResponseHeaders && c.resp != nil:
+		return c.header, true
+	}
+	return nil, false
+}
+
+// property returns the value of the property of the call.
+func (c *wasmCall) property(name string) (string, bool) {
+	switch name {
+	case "method":
+		return c.req.Method, true
+	case "path":
+		return c.path, true
+	case "query":
+		return c.query, true
+	case "remote_addr":
+		return c.req.RemoteAddr, true
+	case "client":
+		return ClientFromContext(c.req.Context()), true
+	case "tenant":
+		if tenant := TenantFromContext(c.req.Context()); tenant != nil {
+			return tenant.Name, true
+		}
+	case "status":
+		if c.resp != nil {
+			return strconv.Itoa(c.status), true
+		}
+	}
+	return "", false
+}
+
+// setProperty sets the writable property of the call.
+func (c *wasmCall) setProperty(name string, value string) bool {
+	switch {
+	case name == "path" && c.resp == nil && strings.HasPrefix(value, "/"):
+		c.path = value
+	case name == "query" && c.resp == nil:
+		c.query = value
+	case name == "status" && c.resp != nil:
+		status, err := strconv.Atoi(value)
+		if err != nil || status < 100 || status > 599 {
+			return false
+		}
+		c.status = status
+	default:
+		return false
+	}
+	return true
+}
+
+// hostModule returns the builder of the host functions imported by the filters, see WASMFilter.
+func (f *WASMFilter) hostModule() wazero.HostModuleBuilder {
+	callOf := func(ctx context.Context) *wasmCall {
+		call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+		return call
+	}
+	return f.runtime.NewHostModuleBuilder(wasmHostModule).
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, mod api.Module, kind, namePtr, nameLen, bufPtr, bufLen uint32) int32 {
+		call := callOf(ctx)
+		name, ok := wasmString(mod, namePtr, nameLen)
+		if call == nil || !ok {
+			return -1
+		}
+		header, _ := call.headers(kind)
+		values, ok := header[http.CanonicalHeaderKey(name)]
+		if !ok || len(values) == 0 {
+			return -1
+		}
+		return wasmCopy(mod, values[0], bufPtr, bufLen)
+	}).Export("get_header").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, mod api.Module, kind, namePtr, nameLen, valuePtr, valueLen uint32) int32 {
+		call := callOf(ctx)
+		name, ok := wasmString(mod, namePtr, nameLen)
+		value, valueOK := wasmString(mod, valuePtr, valueLen)
+		if call == nil || !ok || !valueOK {
+			return -1
+		}
+		header, writable := call.headers(kind)
+		if !writable {
+			return -1
+		}
+		header.Set(name, value)
+		return 0
+	}).Export("set_header").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, mod api.Module, kind, namePtr, nameLen uint32) int32 {
+		call := callOf(ctx)
+		name, ok := wasmString(mod, namePtr, nameLen)
+		if call == nil || !ok {
+			return -1
+		}
+		header, writable := call.headers(kind)
+		if !writable {
+			return -1
+		}
+		header.Del(name)
+		return 0
+	}).Export("remove_header").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, mod api.Module, namePtr, nameLen, bufPtr, bufLen uint32) int32 {
+		call := callOf(ctx)
+		name, ok := wasmString(mod, namePtr, nameLen)
+		if call == nil || !ok {
+			return -1
+		}
+		value, ok := call.property(name)
+		if !ok {
+			return -1
+		}
+		return wasmCopy(mod, value, bufPtr, bufLen)
+	}).Export("get_property").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, mod api.Module, namePtr, nameLen, valuePtr, valueLen uint32) int32 {
+		call := callOf(ctx)
+		name, ok := wasmString(mod, namePtr, nameLen)
+		value, valueOK := wasmString(mod, valuePtr, valueLen)
+		if call == nil || !ok || !valueOK || !call.setProperty(name, value) {
+			return -1
+		}
+		return 0
+	}).Export("set_property").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, mod api.Module, status, messagePtr, messageLen uint32) int32 {
+		call := callOf(ctx)
+		message, ok := wasmString(mod, messagePtr, messageLen)
+		if call == nil || !ok || call.resp != nil || status < 400 || status > 599 {
+			return -1
+		}
+		call.rejected, call.status, call.message = true, int(status), message
+		if call.message == "" {
+			call.message = "Rejected by the filter " + f.Name
+		}
+		return 0
+	}).Export("send_response").
+		NewFunctionBuilder().WithFunc(func(ctx context.Context, mod api.Module, messagePtr, messageLen uint32) {
+		if message, ok := wasmString(mod, messagePtr, messageLen); ok {
+			log.Info().Str("filter", f.Name).Msg(message)
+		}
+	}).Export("log")
+}
+
+// FilterTransport calls the hooks of the (experimental) WASM Filters in order on the requests of the clients and
+// their final responses, see WASMFilter. A hook failing (or exceeding its timeout) is logged and its modifications
+// are dropped, the request proceeds. It wraps inside the SigningTransport, the modified responses are signed.
+type FilterTransport struct {
+	Base    http.RoundTripper
+	Filters []*WASMFilter
+}
+
+func (t *FilterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The hooks may modify the request, which belongs to the caller.
+	req = req.Clone(req.Context())
+	for _, filter := range t.Filters {
+		if !filter.hooks[hookRequest] {
+			continue
+		}
+		if status, message := filter.OnRequest(req); status != 0 {
+			return ProxyResponse(req, status, ReasonFilterRejected, message), nil
+		}
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, filter := range t.Filters {
+		if filter.hooks[hookResponse] {
+			filter.OnResponse(req, resp)
+		}
+	}
+	return resp, nil
+}
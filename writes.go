@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	ghratelimit "github.com/bored-engineer/github-rate-limit-http-transport"
+	"go.uber.org/ratelimit"
+)
+
+// mutating determines if the request method is a write (mutation) as far as GitHub's secondary rate-limits are concerned.
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// maxClassifiedBody is the maximum size of a GraphQL request body buffered to classify it, a larger one is a write.
+const maxClassifiedBody = 1 << 20
+
+// mutatingRequest determines if the request is a write like mutating, except the GraphQL requests (always POSTed)
+// which are only writes if their document has a mutation or a subscription (see readOnly), a persisted query sent by
+// its hash alone (or a body larger than maxClassifiedBody) counts as a write. The body of a GraphQL request is
+// buffered to classify it, the returned request (a clone if so) must be sent instead.
+func mutatingRequest(req *http.Request) (*http.Request, bool, error) {
+	if !mutating(req.Method) {
+		return req, false, nil
+	}
+	if req.Method != http.MethodPost || ghratelimit.InferResource(req) != ghratelimit.ResourceGraphQL || req.Body == nil || req.Body == http.NoBody {
+		return req, true, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxClassifiedBody+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, false, fmt.Errorf("(*http.Request).Body.Read failed: %w", err)
+	}
+	clone := req.Clone(req.Context())
+	// Too large to classify, send the body as a whole (the part read followed by the rest).
+	if len(body) > maxClassifiedBody {
+		clone.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return clone, true, nil
+	}
+	req.Body.Close()
+	req = clone
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	var gql graphqlRequest
+	if err := json.Unmarshal(body, &gql); err != nil || gql.Query == "" {
+		return req, true, nil
+	}
+	return req, !readOnly(gql.Query), nil
+}
+
+// WriteTransport smooths out bursts of mutating requests using a separate (lower) rate-limit and concurrency ceiling.
+// Read requests are passed through to the Base transport untouched.
+// https://docs.github.com/en/rest/using-the-rest-api/best-practices-for-using-the-rest-api#avoid-concurrent-requests
+type WriteTransport struct {
+	Base http.RoundTripper
+	// Limiter (optionally) limits the rate of mutating requests.
+	Limiter ratelimit.Limiter
+
+	slots chan struct{}
+}
+
+// NewWriteTransport creates a WriteTransport allowing rate mutating requests per minute with at most concurrency in-flight.
+// If rate or concurrency are zero (or negative), they are not limited.
+func NewWriteTransport(base http.RoundTripper, rate int, concurrency int) *WriteTransport {
+	t := &WriteTransport{
+		Base: base,
+	}
+	if rate > 0 {
+		// Disable the slack so the writes are evenly spaced (leaky-bucket) instead of bursting.
+		t.Limiter = ratelimit.New(rate, ratelimit.Per(time.Minute), ratelimit.WithoutSlack)
+	}
+	if concurrency > 0 {
+		t.slots = make(chan struct{}, concurrency)
+	}
+	return t
+}
+
+func (t *WriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !mutating(req.Method) {
+		return t.Base.RoundTrip(req)
+	}
+	// The GraphQL queries are reads, even though they are POSTed.
+	req, write, err := mutatingRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if !write {
+		return t.Base.RoundTrip(req)
+	}
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		defer func() { <-t.slots }()
+	}
+	if t.Limiter != nil {
+		if err := take(req.Context(), t.Limiter); err != nil {
+			return nil, err
+		}
+	}
+	return t.Base.RoundTrip(req)
+}
+
+// take waits for the limiter like Take, giving up once the context is done (the permit is still consumed once the
+// limiter grants it, ratelimit.Limiter cannot be cancelled).
+func take(ctx context.Context, limiter ratelimit.Limiter) error {
+	taken := make(chan struct{})
+	go func() {
+		limiter.Take()
+		close(taken)
+	}()
+	select {
+	case <-taken:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	ghtransport "github.com/bored-engineer/github-conditional-http-transport"
+	bboltstorage "github.com/bored-engineer/github-conditional-http-transport/bbolt"
+	pebblestorage "github.com/bored-engineer/github-conditional-http-transport/pebble"
+	"github.com/cockroachdb/pebble/v2"
+	"go.etcd.io/bbolt"
+	bolterrors "go.etcd.io/bbolt/errors"
+)
+
+// ReaderAtStorage is an optional extension of ghtransport.Storage implemented by backends that can expose a stored
+// (serialized) response in place, without copying the value into memory.
+type ReaderAtStorage interface {
+	// GetReaderAt returns the stored response for the (*http.Request).URL and its size, the value remains valid until
+	// the io.Closer is called. If no response is stored, it must return (nil, 0, nil, nil).
+	GetReaderAt(ctx context.Context, req *http.Request) (io.ReaderAt, int64, io.Closer, error)
+}
+
+// StreamingStorage serves cache hits by streaming directly from the ReaderAt, rather than the Get of the backend
+// copying the entire value into memory first.
+type StreamingStorage struct {
+	ghtransport.Storage
+	ReaderAt ReaderAtStorage
+}
+
+// NewStreamingStorage wraps the backend in a StreamingStorage if it supports (or can be adapted to) ReaderAtStorage,
+// otherwise the backend is returned as-is.
+func NewStreamingStorage(storage ghtransport.Storage) ghtransport.Storage {
+	var readerAt ReaderAtStorage
+	switch s := storage.(type) {
+	case ReaderAtStorage:
+		readerAt = s
+	case *bboltstorage.Storage:
+		readerAt = &boltReaderAt{Storage: s}
+	case *pebblestorage.Storage:
+		readerAt = &pebbleReaderAt{Storage: s}
+	default:
+		return storage
+	}
+	return &StreamingStorage{Storage: storage, ReaderAt: readerAt}
+}
+
+func (s *StreamingStorage) Get(ctx context.Context, req *http.Request) (*http.Response, error) {
+	r, size, closer, err := s.ReaderAt.GetReaderAt(ctx, req)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(io.NewSectionReader(r, 0, size)), nil)
+	if err != nil {
+		_ = closer.Close()
+		return nil, fmt.Errorf("http.ReadResponse failed: %w", err)
+	}
+	resp.Body = &closerBody{ReadCloser: resp.Body, closer: closer}
+	return resp, nil
+}
+
+// closerBody releases the stored value (exactly once) when the body is closed.
+type closerBody struct {
+	io.ReadCloser
+	closer io.Closer
+	once   sync.Once
+}
+
+func (b *closerBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		err = errors.Join(err, b.closer.Close())
+	})
+	return err
+}
+
+// boltReaderAt reads the value in place from the memory-mapped bbolt file, the read transaction is held open until
+// the body is closed. A long-lived read transaction delays the file from being re-mapped as it grows, so slow clients
+// of large responses can stall writes that need to grow the file.
+type boltReaderAt struct {
+	*bboltstorage.Storage
+}
+
+func (s *boltReaderAt) GetReaderAt(ctx context.Context, req *http.Request) (io.ReaderAt, int64, io.Closer, error) {
+	tx, err := s.DB.Begin(false)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("(*bbolt.DB).Begin failed: %w", err)
+	}
+	bucket := tx.Bucket(s.Bucket)
+	if bucket == nil {
+		_ = tx.Rollback()
+		return nil, 0, nil, fmt.Errorf("(*bbolt.Tx).Bucket failed: %w", bolterrors.ErrBucketNotFound)
+	}
+	value := bucket.Get([]byte(req.URL.String()))
+	if value == nil {
+		_ = tx.Rollback()
+		return nil, 0, nil, nil
+	}
+	return bytes.NewReader(value), int64(len(value)), rollbackCloser{tx: tx}, nil
+}
+
+// rollbackCloser ends a read-only bbolt transaction.
+type rollbackCloser struct {
+	tx *bbolt.Tx
+}
+
+func (c rollbackCloser) Close() error {
+	if err := c.tx.Rollback(); err != nil {
+		return fmt.Errorf("(*bbolt.Tx).Rollback failed: %w", err)
+	}
+	return nil
+}
+
+// pebbleReaderAt reads the value in place from the pebble block cache, which is pinned until the body is closed.
+type pebbleReaderAt struct {
+	*pebblestorage.Storage
+}
+
+func (s *pebbleReaderAt) GetReaderAt(ctx context.Context, req *http.Request) (io.ReaderAt, int64, io.Closer, error) {
+	value, closer, err := s.DB.Get([]byte(req.URL.String()))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, 0, nil, nil
+	}
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("(*pebble.DB).Get failed: %w", err)
+	}
+	return bytes.NewReader(value), int64(len(value)), closer, nil
+}